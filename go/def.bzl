@@ -62,6 +62,10 @@ load(
     "//go/private/tools:path.bzl",
     _go_path = "go_path",
 )
+load(
+    "//go/private/rules:compile_commands.bzl",
+    _go_compile_commands = "go_compile_commands",
+)
 load(
     "//go/private/rules:library.bzl",
     _go_tool_library = "go_tool_library",
@@ -159,6 +163,9 @@ go_source = _go_source
 # See go/core.rst#go_path for full documentation.
 go_path = _go_path
 
+# See go/core.rst#go_compile_commands for full documentation.
+go_compile_commands = _go_compile_commands
+
 def go_vet_test(*args, **kwargs):
     fail("The go_vet_test rule has been removed. Please migrate to nogo instead, which supports vet tests.")
 
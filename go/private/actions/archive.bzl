@@ -47,6 +47,8 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
 
     split = split_srcs(source.srcs)
     testfilter = getattr(source.library, "testfilter", None)
+    is_testmain = getattr(source.library, "is_testmain", False)
+    testdata_run_dir = getattr(source.library, "testdata_run_dir", None)
     pre_ext = ""
     if go.mode.link == LINKMODE_C_ARCHIVE:
         pre_ext = "_"  # avoid collision with go_binary output file with .a extension
@@ -58,8 +60,16 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
         pre_ext += _recompile_suffix
     out_lib = go.declare_file(go, name = source.library.name, ext = pre_ext + ".a")
 
-    # store __.PKGDEF and nogo facts in .x
+    # store __.PKGDEF in .x
     out_export = go.declare_file(go, name = source.library.name, ext = pre_ext + ".x")
+
+    # nogo runs in its own action, which writes the facts it found for
+    # dependents and an empty file that fails to build if it finds errors.
+    out_facts = None
+    out_nogo_validation = None
+    if go.nogo:
+        out_facts = go.declare_file(go, name = source.library.name, ext = pre_ext + ".facts")
+        out_nogo_validation = go.declare_file(go, name = source.library.name, ext = pre_ext + ".nogo")
     out_cgo_export_h = None  # set if cgo used in c-shared or c-archive mode
 
     direct = [get_archive(dep) for dep in source.deps]
@@ -70,6 +80,13 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
         if a.source.mode != go.mode:
             fail("Archive mode does not match {} is {} expected {}".format(a.data.label, mode_string(a.source.mode), mode_string(go.mode)))
 
+    # Labels of the targets that contributed each source. The builder uses
+    # these to explain conflicts between sources from embedded libraries.
+    src_labels = {
+        src: source.src_labels.get(source.orig_src_map.get(src, src), source.library.label)
+        for src in source.srcs
+    }
+
     importmap = "main" if source.library.is_main else source.library.importmap
     importpath, _ = effective_importpath_pkgpath(source.library)
 
@@ -90,19 +107,30 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
         )
         if go.mode.link in (LINKMODE_C_SHARED, LINKMODE_C_ARCHIVE):
             out_cgo_export_h = go.declare_file(go, path = "_cgo_install.h")
+
+        # Compile commands for C/C++ sources, collected by go_compile_commands.
+        out_compile_commands = go.declare_file(go, name = source.library.name, ext = pre_ext + ".compile_commands.json")
+
+        # Go files generated by cgo, reported by gopackagesdriver.
+        out_cgo_go_srcs = go.declare_directory(go, name = source.library.name, ext = pre_ext + ".cgo_go_srcs")
         cgo_deps = cgo.deps
         runfiles = runfiles.merge(cgo.runfiles)
         emit_compilepkg(
             go,
-            sources = split.go + split.c + split.asm + split.cxx + split.objc + split.headers,
+            sources = split.go + split.c + split.asm + split.cxx + split.objc + split.headers + split.syso,
             cover = source.cover,
             embedsrcs = source.embedsrcs,
+            src_labels = src_labels,
             importpath = importpath,
             importmap = importmap,
             archives = direct,
             out_lib = out_lib,
             out_export = out_export,
+            out_facts = out_facts,
+            out_nogo_validation = out_nogo_validation,
             out_cgo_export_h = out_cgo_export_h,
+            out_compile_commands = out_compile_commands,
+            out_cgo_go_srcs = out_cgo_go_srcs,
             gc_goopts = source.gc_goopts,
             cgo = True,
             cgo_inputs = cgo.inputs,
@@ -112,23 +140,33 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
             objcopts = cgo.objcopts,
             objcxxopts = cgo.objcxxopts,
             clinkopts = cgo.clinkopts,
+            pch = source.pch,
+            is_testmain = is_testmain,
             testfilter = testfilter,
+            testdata_run_dir = testdata_run_dir,
         )
     else:
         cgo_deps = depset()
+        out_compile_commands = None
+        out_cgo_go_srcs = None
         emit_compilepkg(
             go,
-            sources = split.go + split.c + split.asm + split.cxx + split.objc + split.headers,
+            sources = split.go + split.c + split.asm + split.cxx + split.objc + split.headers + split.syso,
             cover = source.cover,
             embedsrcs = source.embedsrcs,
+            src_labels = src_labels,
             importpath = importpath,
             importmap = importmap,
             archives = direct,
             out_lib = out_lib,
             out_export = out_export,
+            out_facts = out_facts,
+            out_nogo_validation = out_nogo_validation,
             gc_goopts = source.gc_goopts,
             cgo = False,
+            is_testmain = is_testmain,
             testfilter = testfilter,
+            testdata_run_dir = testdata_run_dir,
         )
 
     data = GoArchiveData(
@@ -150,6 +188,7 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
         srcs = as_tuple(source.srcs),
         orig_srcs = as_tuple(source.orig_srcs),
         _orig_src_map = tuple([source.orig_src_map.get(src, src) for src in source.srcs]),
+        _src_labels = tuple([src_labels[src] for src in source.srcs]),
         _cover = as_tuple(source.cover),
         _embedsrcs = as_tuple(source.embedsrcs),
         _x_defs = tuple(source.x_defs.items()),
@@ -160,6 +199,7 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
         _copts = as_tuple(source.copts),
         _cxxopts = as_tuple(source.cxxopts),
         _clinkopts = as_tuple(source.clinkopts),
+        _pch = source.pch,
         _cgo_exports = as_tuple(source.cgo_exports),
 
         # Information on dependencies
@@ -171,6 +211,10 @@ def emit_archive(go, source = None, _recompile_suffix = ""):
         export_file = out_export,
         data_files = as_tuple(data_files),
         _cgo_deps = as_tuple(cgo_deps),
+        _compile_commands = out_compile_commands,
+        _cgo_go_srcs = out_cgo_go_srcs,
+        _facts_file = out_facts,
+        _nogo_validation = out_nogo_validation,
     )
     x_defs = dict(source.x_defs)
     for a in direct:
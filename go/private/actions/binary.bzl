@@ -32,7 +32,11 @@ def emit_binary(
         gc_linkopts = [],
         version_file = None,
         info_file = None,
-        executable = None):
+        executable = None,
+        debug_file = None,
+        def_file = None,
+        import_library = None,
+        _generated_x_defs = {}):
     """See go/toolchains.rst#binary for full documentation."""
 
     if name == "" and executable == None:
@@ -57,6 +61,10 @@ def emit_binary(
         gc_linkopts = gc_linkopts,
         version_file = version_file,
         info_file = info_file,
+        debug_file = debug_file,
+        def_file = def_file,
+        import_library = import_library,
+        _generated_x_defs = _generated_x_defs,
     )
     cgo_dynamic_deps = [
         d
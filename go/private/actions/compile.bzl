@@ -59,6 +59,12 @@ def emit_compile(
     if go.nogo:
         builder_args.add("-nogo", go.nogo)
         inputs.append(go.nogo)
+        if go.nogo_config:
+            builder_args.add("-nogo_config", go.nogo_config)
+            inputs.append(go.nogo_config)
+        if go.nogo_baseline:
+            builder_args.add("-nogo_baseline", go.nogo_baseline)
+            inputs.append(go.nogo_baseline)
 
     tool_args = go.tool_args(go)
     if asmhdr:
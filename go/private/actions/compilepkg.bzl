@@ -30,11 +30,15 @@ def _archive(v):
         v.data.export_file.path if v.data.export_file else v.data.file.path,
     )
 
+def _facts(v):
+    return "{}={}".format(v.data.importpath, v.data._facts_file.path)
+
 def emit_compilepkg(
         go,
         sources = None,
         cover = None,
         embedsrcs = [],
+        src_labels = {},
         importpath = "",
         importmap = "",
         archives = [],
@@ -46,11 +50,18 @@ def emit_compilepkg(
         objcopts = [],
         objcxxopts = [],
         clinkopts = [],
+        pch = None,
         out_lib = None,
         out_export = None,
+        out_facts = None,
+        out_nogo_validation = None,
         out_cgo_export_h = None,
+        out_compile_commands = None,
+        out_cgo_go_srcs = None,
         gc_goopts = [],
-        testfilter = None):  # TODO: remove when test action compiles packages
+        is_testmain = False,
+        testfilter = None,  # TODO: remove when test action compiles packages
+        testdata_run_dir = None):
     """Compiles a complete Go package."""
     if sources == None:
         fail("sources is a required parameter")
@@ -66,6 +77,20 @@ def emit_compilepkg(
     args = go.builder_args(go, "compilepkg")
     args.add_all(sources, before_each = "-src")
     args.add_all(embedsrcs, before_each = "-embedsrc", expand_directories = False)
+
+    # Generated embedsrcs may be under a different output root than the package
+    # (for example, if they were built in another configuration). Embed patterns
+    # are matched against the package directory under each of those roots.
+    embedroots = {}
+    for f in embedsrcs:
+        if f.root.path and f.root.path != out_lib.root.path:
+            parts = [f.root.path, go.label.workspace_root, go.label.package]
+            embedroots["/".join([p for p in parts if p])] = None
+    args.add_all(embedroots.keys(), before_each = "-embedroot")
+    args.add_all(
+        ["{}={}".format(src.path, label) for src, label in src_labels.items() if src.extension == "go"],
+        before_each = "-src_label",
+    )
     if cover and go.coverdata:
         inputs.append(go.coverdata.data.export_file)
         args.add("-arc", _archive(go.coverdata))
@@ -74,23 +99,25 @@ def emit_compilepkg(
         else:
             args.add("-cover_mode", "set")
         args.add_all(cover, before_each = "-cover")
+        args.add_all(go.mode.cover_exclude, before_each = "-cover_exclude")
+        args.add("-cover_format", go.mode.cover_format)
+    elif is_testmain and go.coverage_instrumented and go.mode.cover_format == "binary":
+        # The generated test main isn't instrumented, but in the binary format,
+        # it's compiled so the runtime writes coverage data when the test exits.
+        args.add("-cover_mode", "testmain")
+        args.add("-cover_format", go.mode.cover_format)
     args.add_all(archives, before_each = "-arc", map_each = _archive)
     if importpath:
         args.add("-importpath", importpath)
     if importmap:
         args.add("-p", importmap)
     args.add("-package_list", go.package_list)
-
-    args.add("-o", out_lib)
-    args.add("-x", out_export)
-    if go.nogo:
-        args.add("-nogo", go.nogo)
-        inputs.append(go.nogo)
-    if out_cgo_export_h:
-        args.add("-cgoexport", out_cgo_export_h)
-        outputs.append(out_cgo_export_h)
     if testfilter:
         args.add("-testfilter", testfilter)
+    if testdata_run_dir:
+        args.add("-testdata_run_dir", testdata_run_dir)
+    if go.mode.trimpath_prefix:
+        args.add("-trimpath_prefix", go.mode.trimpath_prefix)
 
     gc_flags = list(gc_goopts)
     asm_flags = []
@@ -123,15 +150,62 @@ def emit_compilepkg(
             args.add("-objcxxflags", _quote_opts(objcxxopts))
         if clinkopts:
             args.add("-ldflags", _quote_opts(clinkopts))
+        if pch:
+            inputs.append(pch)
+            args.add("-pch", pch)
+        if go.mode.pkg_config:
+            args.add("-pkg_config", go.mode.pkg_config)
+
+    compile_args = go.tool_args(go)
+    compile_args.add("-o", out_lib)
+    compile_args.add("-x", out_export)
+    if out_cgo_export_h:
+        compile_args.add("-cgoexport", out_cgo_export_h)
+        outputs.append(out_cgo_export_h)
+    if out_compile_commands:
+        compile_args.add("-compile_commands", out_compile_commands)
+        outputs.append(out_compile_commands)
+    if out_cgo_go_srcs:
+        compile_args.add("-cgo_go_srcs", out_cgo_go_srcs.path)
+        outputs.append(out_cgo_go_srcs)
 
     go.actions.run(
         inputs = inputs,
         outputs = outputs,
         mnemonic = "GoCompilePkg",
         executable = go.toolchain._builder,
-        arguments = [args],
+        arguments = [args, compile_args],
         env = go.env,
     )
 
+    # nogo analyzes the package in a separate action with the same sources
+    # and flags. The compile action doesn't depend on nogo or its
+    # configuration, so changing them only reruns nogo actions.
+    if go.nogo and out_facts:
+        nogo_inputs = inputs + [go.nogo]
+        nogo_args = go.tool_args(go)
+        nogo_args.add("-nogo", go.nogo)
+        if go.nogo_config:
+            nogo_args.add("-nogo_config", go.nogo_config)
+            nogo_inputs.append(go.nogo_config)
+        if go.nogo_baseline:
+            nogo_args.add("-nogo_baseline", go.nogo_baseline)
+            nogo_inputs.append(go.nogo_baseline)
+        if go.mode.nogo_generate_baseline:
+            nogo_args.add("-nogo_generate_baseline")
+        fact_archives = [archive for archive in archives if archive.data._facts_file]
+        nogo_args.add_all(fact_archives, before_each = "-nogo_fact", map_each = _facts)
+        nogo_inputs.extend([archive.data._facts_file for archive in fact_archives])
+        nogo_args.add("-out_facts", out_facts)
+        nogo_args.add("-out_nogo_validation", out_nogo_validation)
+        go.actions.run(
+            inputs = nogo_inputs,
+            outputs = [out_facts, out_nogo_validation],
+            mnemonic = "RunNogo",
+            executable = go.toolchain._builder,
+            arguments = [args, nogo_args],
+            env = go.env,
+        )
+
 def _quote_opts(opts):
     return " ".join([shell.quote(opt) if " " in opt else opt for opt in opts])
@@ -54,7 +54,11 @@ def emit_link(
         executable = None,
         gc_linkopts = [],
         version_file = None,
-        info_file = None):
+        info_file = None,
+        debug_file = None,
+        def_file = None,
+        import_library = None,
+        _generated_x_defs = {}):
     """See go/toolchains.rst#link for full documentation."""
 
     if archive == None:
@@ -74,6 +78,7 @@ def emit_link(
     if go.coverage_enabled:
         extldflags.append("--coverage")
     gc_linkopts, extldflags = _extract_extldflags(gc_linkopts, extldflags)
+    gc_linkopts, linkopts_x_defs = _extract_x_defs(gc_linkopts)
     builder_args = go.builder_args(go, "link")
     tool_args = go.tool_args(go)
 
@@ -114,6 +119,13 @@ def emit_link(
             rpath.install_name(executable),
         ])
 
+    # On Windows, the MinGW linker can write a module-definition file and an
+    # import library for a DLL, which C and C++ programs link against.
+    if def_file:
+        extldflags.append("-Wl,--output-def," + def_file.path)
+    if import_library:
+        extldflags.append("-Wl,--out-implib," + import_library.path)
+
     arcs = _transitive_archives_without_test_archives(archive, test_archives)
     arcs.extend(test_archives)
     if (go.coverage_enabled and go.coverdata and
@@ -135,20 +147,45 @@ def emit_link(
     ]))
     extldflags.extend(cgo_rpaths)
 
-    # Process x_defs, and record whether stamping is used.
+    # Process x_defs, and record whether stamping is used. -X flags from
+    # gc_linkopts are handled the same way, so they may refer to stamp keys,
+    # too. They come last, so they override x_defs, as the linker would.
+    # The builder warns about user-written definitions that have no effect,
+    # but not about the ones rules_go generates.
     stamp_x_defs = False
-    for k, v in archive.x_defs.items():
-        if go.stamp and v.find("{") != -1 and v.find("}") != -1:
-            stamp_x_defs = True
-        builder_args.add("-X", "%s=%s" % (k, v))
+    generated_x_defs = ["%s=%s" % (k, v) for k, v in _generated_x_defs.items()]
+    x_defs = ["%s=%s" % (k, v) for k, v in archive.x_defs.items()] + linkopts_x_defs
+    for flag, defs in (("-unchecked_X", generated_x_defs), ("-X", x_defs)):
+        for x_def in defs:
+            if go.stamp and x_def.find("{") != -1 and x_def.find("}") != -1:
+                stamp_x_defs = True
+            builder_args.add(flag, x_def)
 
     # Stamping support
     stamp_inputs = []
     if stamp_x_defs:
         stamp_inputs = [info_file, version_file]
-        builder_args.add_all(stamp_inputs, before_each = "-stamp")
+    elif go.stamp and info_file:
+        stamp_inputs = [info_file]
+    builder_args.add_all(stamp_inputs, before_each = "-stamp")
+
+    # The main module version reported by runtime/debug.ReadBuildInfo comes
+    # from --embed_label, which Bazel writes to the stable status file.
+    if go.stamp and info_file:
+        builder_args.add("-buildinfo_version", "{BUILD_EMBED_LABEL}")
 
     builder_args.add("-o", executable)
+    outputs = [executable]
+    if debug_file:
+        if not go.cgo_tools or not go.cgo_tools.objcopy_path:
+            fail("debug_file requires a C/C++ toolchain with objcopy")
+        builder_args.add("-debug_out", debug_file)
+        builder_args.add("-objcopy", go.cgo_tools.objcopy_path)
+        outputs.append(debug_file)
+    if def_file:
+        outputs.append(def_file)
+    if import_library:
+        outputs.append(import_library)
     builder_args.add("-main", archive.data.file)
     builder_args.add("-p", archive.data.importmap)
     tool_args.add_all(gc_linkopts)
@@ -156,7 +193,9 @@ def emit_link(
 
     # Do not remove, somehow this is needed when building for darwin/arm only.
     tool_args.add("-buildid=redacted")
-    if go.mode.strip:
+    if go.mode.strip and not debug_file:
+        # With a debug file, the executable is stripped anyway, and the debug
+        # file should keep its DWARF information.
         tool_args.add("-w")
     tool_args.add_joined("-extldflags", extldflags, join_with = " ")
 
@@ -170,6 +209,10 @@ def emit_link(
     inputs_direct = stamp_inputs + [go.sdk.package_list]
     if go.coverage_enabled and go.coverdata:
         inputs_direct.append(go.coverdata.data.file)
+
+    # Linking waits for nogo to check each package. nogo's validation files
+    # are empty, so rerunning nogo doesn't relink.
+    inputs_direct.extend([arc._nogo_validation for arc in arcs if arc._nogo_validation])
     inputs_transitive = [
         archive.libs,
         archive.cgo_deps,
@@ -181,7 +224,7 @@ def emit_link(
 
     go.actions.run(
         inputs = inputs,
-        outputs = [executable],
+        outputs = outputs,
         mnemonic = "GoLink",
         executable = go.toolchain._builder,
         arguments = [builder_args, "--", tool_args],
@@ -214,6 +257,35 @@ def _extract_extldflags(gc_linkopts, extldflags):
             filtered_gc_linkopts.append(opt)
     return filtered_gc_linkopts, extldflags
 
+def _extract_x_defs(gc_linkopts):
+    """Extracts -X flags from gc_linkopts.
+
+    Args:
+      gc_linkopts: a list of flags passed in through the gc_linkopts attributes.
+        -X may appear either as a separate argument ("-X", "pkg.name=value")
+        or with its value ("-X=pkg.name=value").
+
+    Return:
+      A tuple containing the filtered gc_linkopts with -X flags removed, and
+      a list of "pkg.name=value" strings, in the order they appeared.
+    """
+    filtered_gc_linkopts = []
+    x_defs = []
+    is_x_def = False
+    for opt in gc_linkopts:
+        if is_x_def:
+            is_x_def = False
+            x_defs.append(opt)
+        elif opt in ("-X", "--X"):
+            is_x_def = True
+        elif opt.startswith("-X=") or opt.startswith("--X="):
+            x_defs.append(opt[opt.index("=") + 1:])
+        else:
+            filtered_gc_linkopts.append(opt)
+    if is_x_def:
+        fail("gc_linkopts: -X must be followed by a pkg.name=value argument")
+    return filtered_gc_linkopts, x_defs
+
 def _check_conflicts(arcs):
     importmap_to_label = {}
     for arc in arcs:
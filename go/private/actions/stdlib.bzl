@@ -49,6 +49,7 @@ def _should_use_sdk_stdlib(go):
             not go.mode.race and  # TODO(jayconrod): use precompiled race
             not go.mode.msan and
             not go.mode.pure and
+            not go.mode.stdlib_gcflags and
             go.mode.link == LINKMODE_NORMAL)
 
 def _build_stdlib_list_json(go):
@@ -81,6 +82,7 @@ def _build_stdlib(go):
     if go.mode.race:
         args.add("-race")
     args.add_all(link_mode_args(go.mode))
+    args.add_all(go.mode.stdlib_gcflags, before_each = "-gcflags")
     go.actions.write(root_file, "")
     env = go.env
     if go.mode.pure:
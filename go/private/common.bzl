@@ -22,6 +22,11 @@ asm_exts = [
     ".h",  # may be included by .s
 ]
 
+# prebuilt object files, packed into the archive as they are.
+syso_exts = [
+    ".syso",
+]
+
 # be consistent to cc_library.
 hdr_exts = [
     ".h",
@@ -88,6 +93,7 @@ def split_srcs(srcs):
         c = [],
         cxx = [],
         objc = [],
+        syso = [],
     )
     ext_pairs = (
         (sources.go, go_exts),
@@ -96,6 +102,7 @@ def split_srcs(srcs):
         (sources.c, c_exts),
         (sources.cxx, cxx_exts),
         (sources.objc, objc_exts),
+        (sources.syso, syso_exts),
     )
     extmap = {}
     for outs, exts in ext_pairs:
@@ -113,7 +120,7 @@ def split_srcs(srcs):
 
 def join_srcs(source):
     """Combines source from a split_srcs struct into a single list."""
-    return source.go + source.headers + source.asm + source.c + source.cxx + source.objc
+    return source.go + source.headers + source.asm + source.c + source.cxx + source.objc + source.syso
 
 def env_execute(ctx, arguments, environment = {}, **kwargs):
     """Executes a command in for a repository rule.
@@ -199,7 +206,7 @@ def has_versioned_shared_lib_extension(path):
     # something like 1.2.3, or so.1.2, or dylib.1.2, or foo.1.2
     return False
 
-MINIMUM_BAZEL_VERSION = "4.2.0"
+MINIMUM_BAZEL_VERSION = "5.0.0"
 
 def as_list(v):
     """Returns a list, tuple, or depset as a list."""
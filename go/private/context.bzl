@@ -38,6 +38,7 @@ load(
     "GoSource",
     "GoStdLib",
     "INFERRED_PATH",
+    "NogoInfo",
     "get_source",
 )
 load(
@@ -174,6 +175,8 @@ def _merge_embed(source, embed):
     source["srcs"] = s.srcs + source["srcs"]
     source["orig_srcs"] = s.orig_srcs + source["orig_srcs"]
     source["orig_src_map"].update(s.orig_src_map)
+    for src in s.orig_srcs:
+        source["src_labels"].setdefault(src, s.src_labels.get(src, s.library.label))
     source["embedsrcs"] = source["embedsrcs"] + s.embedsrcs
     source["cover"] = source["cover"] + s.cover
     source["deps"] = source["deps"] + s.deps
@@ -188,6 +191,7 @@ def _merge_embed(source, embed):
     source["copts"] = source["copts"] or s.copts
     source["cxxopts"] = source["cxxopts"] or s.cxxopts
     source["clinkopts"] = source["clinkopts"] or s.clinkopts
+    source["pch"] = source["pch"] or s.pch
     source["cgo_deps"] = source["cgo_deps"] + s.cgo_deps
     source["cgo_exports"] = source["cgo_exports"] + s.cgo_exports
 
@@ -226,6 +230,7 @@ def _library_to_source(go, attr, library, coverage_instrumented):
         "srcs": srcs,
         "orig_srcs": srcs,
         "orig_src_map": {},
+        "src_labels": {},
         "cover": [],
         "embedsrcs": embedsrcs,
         "x_defs": {},
@@ -238,6 +243,7 @@ def _library_to_source(go, attr, library, coverage_instrumented):
         "copts": _expand_opts(go, "copts", getattr(attr, "copts", [])),
         "cxxopts": _expand_opts(go, "cxxopts", getattr(attr, "cxxopts", [])),
         "clinkopts": _expand_opts(go, "clinkopts", getattr(attr, "clinkopts", [])),
+        "pch": _pch_file(getattr(attr, "pch", None)),
         "cgo_deps": [],
         "cgo_exports": [],
     }
@@ -256,7 +262,7 @@ def _library_to_source(go, attr, library, coverage_instrumented):
         x_defs[k] = v
     source["x_defs"] = x_defs
     if not source["cgo"]:
-        for k in ("cdeps", "cppopts", "copts", "cxxopts", "clinkopts"):
+        for k in ("cdeps", "cppopts", "copts", "cxxopts", "clinkopts", "pch"):
             if getattr(attr, k, None):
                 fail(k + " set without cgo = True")
         for f in source["srcs"]:
@@ -359,6 +365,8 @@ def go_context(ctx, attr = None):
     stdlib = None
     coverdata = None
     nogo = None
+    nogo_config = None
+    nogo_baseline = None
     if hasattr(attr, "_go_context_data"):
         if CgoContextInfo in attr._go_context_data:
             cgo_context_info = attr._go_context_data[CgoContextInfo]
@@ -366,6 +374,8 @@ def go_context(ctx, attr = None):
         stdlib = attr._go_context_data[GoStdLib]
         coverdata = attr._go_context_data[GoContextInfo].coverdata
         nogo = attr._go_context_data[GoContextInfo].nogo
+        nogo_config = attr._go_context_data[GoContextInfo].nogo_config
+        nogo_baseline = attr._go_context_data[GoContextInfo].nogo_baseline
     if getattr(attr, "_cgo_context_data", None) and CgoContextInfo in attr._cgo_context_data:
         cgo_context_info = attr._cgo_context_data[CgoContextInfo]
     if getattr(attr, "cgo_context_data", None) and CgoContextInfo in attr.cgo_context_data:
@@ -469,6 +479,8 @@ def go_context(ctx, attr = None):
         pathtype = pathtype,
         cgo_tools = cgo_tools,
         nogo = nogo,
+        nogo_config = nogo_config,
+        nogo_baseline = nogo_baseline,
         coverdata = coverdata,
         coverage_enabled = ctx.configuration.coverage_enabled,
         coverage_instrumented = ctx.coverage_instrumented(),
@@ -507,10 +519,17 @@ def _go_context_data_impl(ctx):
         print("WARNING: --features=msan is no longer supported. Use --@io_bazel_rules_go//go/config:msan instead.")
     coverdata = ctx.attr.coverdata[GoArchive]
     nogo = ctx.files.nogo[0] if ctx.files.nogo else None
+    nogo_config = None
+    nogo_baseline = None
+    if nogo and NogoInfo in ctx.attr.nogo:
+        nogo_config = ctx.attr.nogo[NogoInfo].config
+        nogo_baseline = ctx.attr.nogo[NogoInfo].baseline
     providers = [
         GoContextInfo(
             coverdata = ctx.attr.coverdata[GoArchive],
             nogo = nogo,
+            nogo_config = nogo_config,
+            nogo_baseline = nogo_baseline,
         ),
         ctx.attr.stdlib[GoStdLib],
         ctx.attr.go_config[GoConfigInfo],
@@ -735,6 +754,7 @@ def _cgo_context_data_impl(ctx):
             ld_static_lib_path = ld_static_lib_path,
             ld_dynamic_lib_path = ld_dynamic_lib_path,
             ld_dynamic_lib_options = ld_dynamic_lib_options,
+            objcopy_path = cc_toolchain.objcopy_executable,
         ),
     )]
 
@@ -773,12 +793,19 @@ def _go_config_impl(ctx):
     return [GoConfigInfo(
         static = ctx.attr.static[BuildSettingInfo].value,
         race = ctx.attr.race[BuildSettingInfo].value,
+        race_fallback = ctx.attr.race_fallback[BuildSettingInfo].value,
         msan = ctx.attr.msan[BuildSettingInfo].value,
         pure = ctx.attr.pure[BuildSettingInfo].value,
         strip = ctx.attr.strip[BuildSettingInfo].value,
         debug = ctx.attr.debug[BuildSettingInfo].value,
         linkmode = ctx.attr.linkmode[BuildSettingInfo].value,
         tags = ctx.attr.gotags[BuildSettingInfo].value,
+        stdlib_gcflags = ctx.attr.stdlib_gcflags[BuildSettingInfo].value,
+        trimpath_prefix = ctx.attr.trimpath_prefix[BuildSettingInfo].value,
+        pkg_config = ctx.attr.pkg_config[BuildSettingInfo].value,
+        cover_exclude = ctx.attr.cover_exclude[BuildSettingInfo].value,
+        cover_format = ctx.attr.cover_format[BuildSettingInfo].value,
+        nogo_generate_baseline = ctx.attr.nogo_generate_baseline[BuildSettingInfo].value,
         stamp = ctx.attr.stamp,
     )]
 
@@ -793,6 +820,10 @@ go_config = rule(
             mandatory = True,
             providers = [BuildSettingInfo],
         ),
+        "race_fallback": attr.label(
+            mandatory = True,
+            providers = [BuildSettingInfo],
+        ),
         "msan": attr.label(
             mandatory = True,
             providers = [BuildSettingInfo],
@@ -817,6 +848,30 @@ go_config = rule(
             mandatory = True,
             providers = [BuildSettingInfo],
         ),
+        "stdlib_gcflags": attr.label(
+            mandatory = True,
+            providers = [BuildSettingInfo],
+        ),
+        "trimpath_prefix": attr.label(
+            mandatory = True,
+            providers = [BuildSettingInfo],
+        ),
+        "pkg_config": attr.label(
+            mandatory = True,
+            providers = [BuildSettingInfo],
+        ),
+        "cover_exclude": attr.label(
+            mandatory = True,
+            providers = [BuildSettingInfo],
+        ),
+        "cover_format": attr.label(
+            mandatory = True,
+            providers = [BuildSettingInfo],
+        ),
+        "nogo_generate_baseline": attr.label(
+            mandatory = True,
+            providers = [BuildSettingInfo],
+        ),
         "stamp": attr.bool(mandatory = True),
     },
     provides = [GoConfigInfo],
@@ -825,5 +880,11 @@ go_config = rule(
     the build settings directly.""",
 )
 
+def _pch_file(pch):
+    """Returns the header file of a pch attribute, or None if it's not set."""
+    if not pch:
+        return None
+    return pch[DefaultInfo].files.to_list()[0]
+
 def _expand_opts(go, attribute_name, opts):
     return [go._ctx.expand_make_variables(attribute_name, opt, {}) for opt in opts]
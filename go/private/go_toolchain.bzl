@@ -15,6 +15,7 @@
 Toolchain rules used by go.
 """
 
+load("@bazel_skylib//lib:selects.bzl", "selects")
 load("//go/private:platforms.bzl", "PLATFORMS")
 load("//go/private:providers.bzl", "GoSDK")
 load("//go/private/actions:archive.bzl", "emit_archive")
@@ -35,6 +36,7 @@ def _go_toolchain_impl(ctx):
         cross_compile = cross_compile,
         default_goos = ctx.attr.goos,
         default_goarch = ctx.attr.goarch,
+        pie_by_default = ctx.attr.pie_by_default,
         actions = struct(
             archive = emit_archive,
             asm = emit_asm,
@@ -87,13 +89,23 @@ go_toolchain = rule(
         "cgo_link_flags": attr.string_list(
             doc = "Flags passed to the external linker (if it is used)",
         ),
+        "pie_by_default": attr.bool(
+            doc = "Whether binaries are linked as position-independent executables unless a link mode is set explicitly",
+        ),
     },
     doc = "Defines a Go toolchain based on an SDK",
     provides = [platform_common.ToolchainInfo],
 )
 
-def declare_toolchains(host, sdk, builder):
-    """Declares go_toolchain and toolchain targets for each platform."""
+def declare_toolchains(host, sdk, builder, sdk_version = ""):
+    """Declares go_toolchain and toolchain targets for each platform.
+
+    The toolchains are only selected when
+    @io_bazel_rules_go//go/config:sdk_version is empty or matches sdk_version,
+    either fully (like "1.16.3") or by major and minor version (like "1.16").
+    """
+
+    _declare_sdk_version_setting(sdk_version)
 
     # keep in sync with generate_toolchain_names
     host_goos, _, host_goarch = host.partition("_")
@@ -139,5 +151,33 @@ def declare_toolchains(host, sdk, builder):
                 "@io_bazel_rules_go//go/toolchain:" + host_goarch,
             ],
             target_compatible_with = constraints,
+            target_settings = [":sdk_version_setting"],
             toolchain = ":" + impl_name,
         )
+
+def _declare_sdk_version_setting(sdk_version):
+    """Declares the sdk_version_setting config_setting_group.
+
+    It matches when @io_bazel_rules_go//go/config:sdk_version is empty or
+    names sdk_version. An SDK without a known version is only selected when
+    the flag is empty.
+    """
+    versions = [""]
+    if sdk_version:
+        major_minor = ".".join(sdk_version.split(".")[:2])
+        versions.append(major_minor)
+        if sdk_version != major_minor:
+            versions.append(sdk_version)
+
+    settings = []
+    for i, version in enumerate(versions):
+        name = "sdk_version_setting_{}".format(i)
+        native.config_setting(
+            name = name,
+            flag_values = {"@io_bazel_rules_go//go/config:sdk_version": version},
+        )
+        settings.append(":" + name)
+    selects.config_setting_group(
+        name = "sdk_version_setting",
+        match_any = settings,
+    )
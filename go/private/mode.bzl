@@ -14,6 +14,8 @@
 
 # Modes are documented in go/modes.rst#compilation-modes
 
+LINKMODE_AUTO = "auto"
+
 LINKMODE_NORMAL = "normal"
 
 LINKMODE_SHARED = "shared"
@@ -28,6 +30,10 @@ LINKMODE_C_ARCHIVE = "c-archive"
 
 LINKMODES = [LINKMODE_NORMAL, LINKMODE_PLUGIN, LINKMODE_C_SHARED, LINKMODE_C_ARCHIVE, LINKMODE_PIE]
 
+# Patterns for names of generated files that are not instrumented for coverage
+# unless //go/config:cover_exclude is set.
+COVER_EXCLUDE_DEFAULT = ["*.pb.go", "*_gen.go"]
+
 def mode_string(mode):
     result = [mode.goos, mode.goarch]
     if mode.static:
@@ -76,8 +82,29 @@ def get_mode(ctx, go_toolchain, cgo_context_info, go_config_info):
     stamp = go_config_info.stamp if go_config_info else False
     debug = go_config_info.debug if go_config_info else False
     linkmode = go_config_info.linkmode if go_config_info else LINKMODE_NORMAL
+    stdlib_gcflags = list(go_config_info.stdlib_gcflags) if go_config_info else []
+    trimpath_prefix = go_config_info.trimpath_prefix if go_config_info else ""
+    pkg_config = go_config_info.pkg_config if go_config_info else ""
+    cover_exclude = list(go_config_info.cover_exclude) if go_config_info else COVER_EXCLUDE_DEFAULT
+    cover_format = go_config_info.cover_format if go_config_info else "text"
+    nogo_generate_baseline = go_config_info.nogo_generate_baseline if go_config_info else False
     goos = go_toolchain.default_goos
     goarch = go_toolchain.default_goarch
+    if linkmode == LINKMODE_AUTO:
+        # The link mode was not set explicitly on the command line or by the
+        # target. Build position-independent executables if the toolchain asks
+        # for them by default (usually on platforms that require hardened
+        # binaries).
+        if go_toolchain.pie_by_default and goos + "/" + goarch in _LINK_PIE_PLATFORMS:
+            linkmode = LINKMODE_PIE
+        else:
+            linkmode = LINKMODE_NORMAL
+    if race and goos + "/" + goarch not in _RACE_PLATFORMS:
+        race_fallback = go_config_info.race_fallback if go_config_info else False
+        if not race_fallback:
+            fail("race instrumentation is not supported on {}/{}. Set --@io_bazel_rules_go//go/config:race_fallback to build without it on unsupported platforms.".format(goos, goarch))
+        print("WARNING: race instrumentation is not supported on {}/{}; building {} without it.".format(goos, goarch, ctx.label))
+        race = False
 
     # TODO(jayconrod): check for more invalid and contradictory settings.
     if pure and race:
@@ -107,6 +134,12 @@ def get_mode(ctx, go_toolchain, cgo_context_info, go_config_info):
         goos = goos,
         goarch = goarch,
         tags = tags,
+        stdlib_gcflags = stdlib_gcflags,
+        trimpath_prefix = trimpath_prefix,
+        pkg_config = pkg_config,
+        cover_exclude = cover_exclude,
+        cover_format = cover_format,
+        nogo_generate_baseline = nogo_generate_baseline,
     )
 
 def installsuffix(mode):
@@ -125,6 +158,19 @@ def mode_tags_equivalent(l, r):
             l.race == r.race and
             l.msan == r.msan)
 
+# Ported from RaceDetectorSupported in
+# https://github.com/golang/go/blob/master/src/cmd/internal/sys/supported.go
+_RACE_PLATFORMS = {
+    "darwin/amd64": None,
+    "darwin/arm64": None,
+    "freebsd/amd64": None,
+    "linux/amd64": None,
+    "linux/arm64": None,
+    "linux/ppc64le": None,
+    "netbsd/amd64": None,
+    "windows/amd64": None,
+}
+
 # Ported from https://github.com/golang/go/blob/master/src/cmd/go/internal/work/init.go#L76
 _LINK_C_ARCHIVE_PLATFORMS = {
     "darwin/arm": None,
@@ -63,6 +63,10 @@ GoConfigInfo = provider()
 
 GoContextInfo = provider()
 
+# The nogo configuration file, read each time nogo runs.
+# This is a private provider returned by the nogo rule.
+NogoInfo = provider()
+
 CgoContextInfo = provider()
 
 EXPLICIT_PATH = "explicit"
@@ -21,6 +21,8 @@ load(
     "asm_exts",
     "cgo_exts",
     "go_exts",
+    "hdr_exts",
+    "syso_exts",
 )
 load(
     "//go/private:providers.bzl",
@@ -35,6 +37,8 @@ load(
     "//go/private:mode.bzl",
     "LINKMODE_C_ARCHIVE",
     "LINKMODE_C_SHARED",
+    "LINKMODE_NORMAL",
+    "LINKMODE_PIE",
     "LINKMODE_PLUGIN",
     "LINKMODE_SHARED",
 )
@@ -45,12 +49,23 @@ load(
 
 _EMPTY_DEPSET = depset([])
 
+# Platforms that produce ELF files. Only ELF binaries are split into a
+# stripped binary and a debug file, using objcopy from the C/C++ toolchain.
+_ELF_GOOS = ["android", "dragonfly", "freebsd", "illumos", "linux", "netbsd", "openbsd", "solaris"]
+
+def _supports_split_debug_info(go):
+    return (go.mode.goos in _ELF_GOOS and
+            go.mode.link in (LINKMODE_NORMAL, LINKMODE_PIE, LINKMODE_C_SHARED) and
+            go.cgo_tools != None and
+            go.cgo_tools.objcopy_path != "")
+
 def new_cc_import(
         go,
         hdrs = _EMPTY_DEPSET,
         defines = _EMPTY_DEPSET,
         local_defines = _EMPTY_DEPSET,
         dynamic_library = None,
+        interface_library = None,
         static_library = None,
         alwayslink = False,
         linkopts = []):
@@ -73,6 +88,7 @@ def new_cc_import(
                             cc_toolchain = go.cgo_tools.cc_toolchain,
                             feature_configuration = go.cgo_tools.feature_configuration,
                             dynamic_library = dynamic_library,
+                            interface_library = interface_library,
                             static_library = static_library,
                             alwayslink = alwayslink,
                         ),
@@ -83,6 +99,23 @@ def new_cc_import(
         ),
     )
 
+def _declare_c_shared_windows_files(ctx, go, name):
+    """Declares the module-definition file and import library written with a
+    c-shared DLL on Windows. C and C++ programs need one of them to link
+    against the DLL."""
+    if ctx.attr.out:
+        base = ctx.attr.out
+        if base.endswith(".dll"):
+            base = base[:-len(".dll")]
+        return (
+            ctx.actions.declare_file(base + ".def"),
+            ctx.actions.declare_file(ctx.attr.out + ".a"),
+        )
+    return (
+        go.declare_file(go, path = "lib" + name, ext = ".def"),
+        go.declare_file(go, path = "lib" + name, ext = ".dll.a"),
+    )
+
 def _go_binary_impl(ctx):
     """go_binary_impl emits actions for compiling and linking a go executable."""
     go = go_context(ctx)
@@ -99,6 +132,24 @@ def _go_binary_impl(ctx):
         # directly, Bazel warns them not to use the same name as the rule, which is
         # the common case with go_binary.
         executable = ctx.actions.declare_file(ctx.attr.out)
+    debug_file = None
+    if ctx.attr.split_debug_info:
+        if not _supports_split_debug_info(go):
+            print("WARNING: split_debug_info is not supported on {}/{} with linkmode {}{}; building {} with debug information in the binary.".format(
+                go.mode.goos,
+                go.mode.goarch,
+                go.mode.link,
+                " without a C/C++ toolchain that has objcopy" if go.mode.goos in _ELF_GOOS else "",
+                ctx.label,
+            ))
+        elif ctx.attr.out:
+            debug_file = ctx.actions.declare_file(ctx.attr.out + ".debug")
+        else:
+            debug_file = go.declare_file(go, path = name, ext = ".debug")
+    def_file = None
+    import_library = None
+    if go.cgo_tools and go.mode.link == LINKMODE_C_SHARED and go.mode.goos == "windows":
+        def_file, import_library = _declare_c_shared_windows_files(ctx, go, name)
     archive, executable, runfiles = go.binary(
         go,
         name = name,
@@ -107,7 +158,12 @@ def _go_binary_impl(ctx):
         version_file = ctx.version_file,
         info_file = ctx.info_file,
         executable = executable,
+        debug_file = debug_file,
+        def_file = def_file,
+        import_library = import_library,
     )
+    debug_files = [debug_file] if debug_file else []
+    windows_files = [def_file, import_library] if def_file else []
 
     providers = [
         library,
@@ -116,9 +172,10 @@ def _go_binary_impl(ctx):
         OutputGroupInfo(
             cgo_exports = archive.cgo_exports,
             compilation_outputs = [archive.data.file],
+            debug_info = debug_files,
         ),
         DefaultInfo(
-            files = depset([executable]),
+            files = depset([executable] + debug_files + windows_files),
             runfiles = runfiles,
             executable = executable,
         ),
@@ -142,6 +199,7 @@ def _go_binary_impl(ctx):
             cc_import_kwargs["hdrs"] = depset([header])
         if go.mode.link == LINKMODE_C_SHARED:
             cc_import_kwargs["dynamic_library"] = executable
+            cc_import_kwargs["interface_library"] = import_library
         elif go.mode.link == LINKMODE_C_ARCHIVE:
             cc_import_kwargs["static_library"] = executable
             cc_import_kwargs["alwayslink"] = True
@@ -156,7 +214,7 @@ def _go_binary_impl(ctx):
 _go_binary_kwargs = {
     "implementation": _go_binary_impl,
     "attrs": {
-        "srcs": attr.label_list(allow_files = go_exts + asm_exts + cgo_exts),
+        "srcs": attr.label_list(allow_files = go_exts + asm_exts + cgo_exts + syso_exts),
         "data": attr.label_list(allow_files = True),
         "deps": attr.label_list(
             providers = [GoLibrary],
@@ -171,12 +229,14 @@ _go_binary_kwargs = {
         "x_defs": attr.string_dict(),
         "basename": attr.string(),
         "out": attr.string(),
+        "split_debug_info": attr.bool(),
         "cgo": attr.bool(),
         "cdeps": attr.label_list(),
         "cppopts": attr.string_list(),
         "copts": attr.string_list(),
         "cxxopts": attr.string_list(),
         "clinkopts": attr.string_list(),
+        "pch": attr.label(allow_single_file = hdr_exts),
         "_go_context_data": attr.label(default = "//:go_context_data"),
     },
     "executable": True,
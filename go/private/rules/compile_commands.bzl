@@ -0,0 +1,73 @@
+# Copyright 2022 The Bazel Authors. All rights reserved.
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#    http://www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+load(
+    "//go/private:context.bzl",
+    "go_context",
+)
+load(
+    "//go/private:providers.bzl",
+    "GoArchive",
+    "get_archive",
+)
+
+def _go_compile_commands_impl(ctx):
+    go = go_context(ctx)
+
+    # Each cgo archive has a file listing the commands used to compile its
+    # C/C++ sources. Collect them from the deps and their dependencies.
+    fragments = {}
+    for dep in ctx.attr.deps:
+        for data in get_archive(dep).transitive.to_list():
+            if getattr(data, "_compile_commands", None):
+                fragments[data._compile_commands] = None
+    fragments = fragments.keys()
+
+    out = go.declare_file(go, ext = ".json")
+    args = go.builder_args(go, "compilecommands")
+    args.add("-o", out)
+    args.add_all(fragments)
+    go.actions.run(
+        inputs = fragments + go.sdk_files,
+        outputs = [out],
+        mnemonic = "GoCompileCommands",
+        executable = go.toolchain._builder,
+        arguments = [args],
+        env = go.env,
+    )
+    return [DefaultInfo(files = depset([out]))]
+
+go_compile_commands = rule(
+    implementation = _go_compile_commands_impl,
+    attrs = {
+        "deps": attr.label_list(
+            providers = [GoArchive],
+            doc = """Go targets to collect compile commands from. Compile
+            commands are included for C, C++, Objective-C, and Objective-C++
+            sources in these targets and their transitive dependencies.""",
+        ),
+        "_go_context_data": attr.label(
+            default = "//:go_context_data",
+        ),
+    },
+    doc = """Writes a compile_commands.json file for the cgo sources in deps.
+
+    The file lists the compiler and flags used for each C/C++ source file, so
+    editors using clangd can analyze the sources the way Bazel builds them.
+    Actions may run in a sandbox, so the directory in each command is
+    written as "__EXEC_ROOT__". Replace this with the output of
+    "bazel info execution_root" before use.
+    """,
+    toolchains = ["@io_bazel_rules_go//go:toolchain"],
+)
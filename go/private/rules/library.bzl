@@ -17,6 +17,8 @@ load(
     "asm_exts",
     "cgo_exts",
     "go_exts",
+    "hdr_exts",
+    "syso_exts",
 )
 load(
     "//go/private:context.bzl",
@@ -47,6 +49,9 @@ def _go_library_impl(ctx):
         OutputGroupInfo(
             cgo_exports = archive.cgo_exports,
             compilation_outputs = [archive.data.file],
+            # Builds the library's nogo action, which binaries would otherwise
+            # wait for when linking.
+            _validation = [archive.data._nogo_validation] if archive.data._nogo_validation else [],
         ),
     ]
 
@@ -54,7 +59,7 @@ go_library = rule(
     _go_library_impl,
     attrs = {
         "data": attr.label_list(allow_files = True),
-        "srcs": attr.label_list(allow_files = go_exts + asm_exts + cgo_exts),
+        "srcs": attr.label_list(allow_files = go_exts + asm_exts + cgo_exts + syso_exts),
         "deps": attr.label_list(providers = [GoLibrary]),
         "importpath": attr.string(),
         "importmap": attr.string(),
@@ -69,6 +74,7 @@ go_library = rule(
         "copts": attr.string_list(),
         "cxxopts": attr.string_list(),
         "clinkopts": attr.string_list(),
+        "pch": attr.label(allow_single_file = hdr_exts),
         "_go_context_data": attr.label(default = "//:go_context_data"),
     },
     toolchains = ["@io_bazel_rules_go//go:toolchain"],
@@ -21,6 +21,7 @@ load(
     "EXPORT_PATH",
     "GoArchive",
     "GoLibrary",
+    "NogoInfo",
     "get_archive",
 )
 load(
@@ -40,15 +41,12 @@ def _nogo_impl(ctx):
     nogo_args = ctx.actions.args()
     nogo_args.add("gennogomain")
     nogo_args.add("-output", nogo_main)
-    nogo_inputs = []
     analyzer_archives = [get_archive(dep) for dep in ctx.attr.deps]
     analyzer_importpaths = [archive.data.importpath for archive in analyzer_archives]
     nogo_args.add_all(analyzer_importpaths, before_each = "-analyzer_importpath")
-    if ctx.file.config:
-        nogo_args.add("-config", ctx.file.config)
-        nogo_inputs.append(ctx.file.config)
+    if ctx.attr.concurrency:
+        nogo_args.add("-concurrency", str(ctx.attr.concurrency))
     ctx.actions.run(
-        inputs = nogo_inputs,
         outputs = [nogo_main],
         mnemonic = "GoGenNogo",
         executable = go.toolchain._builder,
@@ -77,11 +75,19 @@ def _nogo_impl(ctx):
         name = ctx.label.name,
         source = nogo_source,
     )
-    return [DefaultInfo(
-        files = depset([executable]),
-        runfiles = nogo_archive.runfiles,
-        executable = executable,
-    )]
+    return [
+        DefaultInfo(
+            files = depset([executable]),
+            runfiles = nogo_archive.runfiles,
+            executable = executable,
+        ),
+        # The configuration and baseline aren't compiled into nogo, so
+        # changing them only reruns nogo actions.
+        NogoInfo(
+            config = ctx.file.config,
+            baseline = ctx.file.baseline,
+        ),
+    ]
 
 _nogo = rule(
     implementation = _nogo_impl,
@@ -92,6 +98,12 @@ _nogo = rule(
         "config": attr.label(
             allow_single_file = True,
         ),
+        "baseline": attr.label(
+            allow_single_file = True,
+        ),
+        "concurrency": attr.int(
+            default = 0,
+        ),
         "_nogo_srcs": attr.label(
             default = "@io_bazel_rules_go//go/tools/builders:nogo_srcs",
         ),
@@ -22,8 +22,10 @@ load(
     "asm_exts",
     "cgo_exts",
     "go_exts",
+    "hdr_exts",
     "pkg_dir",
     "split_srcs",
+    "syso_exts",
 )
 load(
     "//go/private/rules:binary.bzl",
@@ -61,9 +63,28 @@ def _go_test_impl(ctx):
 
     go = go_context(ctx)
 
+    if ctx.attr.rundir:
+        if ctx.attr.rundir.startswith("/"):
+            run_dir = ctx.attr.rundir
+        else:
+            run_dir = pkg_dir(ctx.label.workspace_root, ctx.attr.rundir)
+    else:
+        run_dir = pkg_dir(ctx.label.workspace_root, ctx.label.package)
+
+    # If requested, the builder generates a TestDataPath function in the
+    # internal and external test packages, which finds data files relative to
+    # the run directory in runfiles.
+    testdata_run_dir = None
+    if ctx.attr.testdata_path:
+        if run_dir.startswith("/"):
+            testdata_run_dir = run_dir
+        else:
+            testdata_run_dir = ctx.workspace_name + "/" + run_dir
+
     # Compile the library to test with internal white box tests
-    internal_library = go.new_library(go, testfilter = "exclude")
+    internal_library = go.new_library(go, testfilter = "exclude", testdata_run_dir = testdata_run_dir)
     internal_source = go.library_to_source(go, ctx.attr, internal_library, ctx.coverage_instrumented())
+    internal_source, generated_x_defs = _split_unqualified_x_defs(ctx, internal_source)
     internal_archive = go.archive(go, internal_source)
     go_srcs = split_srcs(internal_source.srcs).go
 
@@ -73,6 +94,7 @@ def _go_test_impl(ctx):
         name = internal_library.name + "_test",
         importpath = internal_library.importpath + "_test",
         testfilter = "only",
+        testdata_run_dir = testdata_run_dir,
     )
     external_source = go.library_to_source(go, struct(
         srcs = [struct(files = go_srcs)],
@@ -80,24 +102,23 @@ def _go_test_impl(ctx):
         deps = internal_archive.direct + [internal_archive],
         x_defs = ctx.attr.x_defs,
     ), external_library, ctx.coverage_instrumented())
+    external_source, external_generated_x_defs = _split_unqualified_x_defs(ctx, external_source)
+    generated_x_defs.update(external_generated_x_defs)
     external_source, internal_archive = _recompile_external_deps(go, external_source, internal_archive, [t.label for t in ctx.attr.embed])
     external_archive = go.archive(go, external_source)
     external_srcs = split_srcs(external_source.srcs).go
 
     # now generate the main function
-    if ctx.attr.rundir:
-        if ctx.attr.rundir.startswith("/"):
-            run_dir = ctx.attr.rundir
-        else:
-            run_dir = pkg_dir(ctx.label.workspace_root, ctx.attr.rundir)
-    else:
-        run_dir = pkg_dir(ctx.label.workspace_root, ctx.label.package)
-
     main_go = go.declare_file(go, path = "testmain.go")
     arguments = go.builder_args(go, "gentestmain")
     arguments.add("-output", main_go)
     if ctx.configuration.coverage_enabled:
         arguments.add("-coverage")
+        arguments.add("-cover_format", go.mode.cover_format)
+    if ctx.attr.coverage_threshold:
+        arguments.add("-coverage_threshold", ctx.attr.coverage_threshold)
+    for importpath, percent in sorted(ctx.attr.coverage_package_thresholds.items()):
+        arguments.add("-coverage_package_threshold", "{}={}".format(importpath, percent))
     arguments.add(
         # the l is the alias for the package under test, the l_test must be the
         # same with the test suffix
@@ -110,6 +131,7 @@ def _go_test_impl(ctx):
     )
     arguments.add("-pkgname", internal_source.library.importpath)
     arguments.add_all(go_srcs, before_each = "-src", format_each = "l=%s")
+    changed_files_runfiles = _emit_changed_files_filter(ctx, go, arguments, internal_archive, external_archive)
     ctx.actions.run(
         inputs = go_srcs,
         outputs = [main_go],
@@ -124,7 +146,7 @@ def _go_test_impl(ctx):
         test_gc_linkopts.extend(["-s", "-w"])
 
     # Link in the run_dir global for bzltestutil
-    test_gc_linkopts.extend(["-X", "github.com/bazelbuild/rules_go/go/tools/bzltestutil.RunDir=" + run_dir])
+    generated_x_defs["github.com/bazelbuild/rules_go/go/tools/bzltestutil.RunDir"] = run_dir
 
     # Now compile the test binary itself
     test_library = GoLibrary(
@@ -135,10 +157,11 @@ def _go_test_impl(ctx):
         importpath_aliases = (),
         pathtype = INFERRED_PATH,
         is_main = True,
+        is_testmain = True,
         resolve = None,
     )
     test_deps = external_archive.direct + [external_archive] + ctx.attr._testmain_additional_deps
-    if ctx.configuration.coverage_enabled:
+    if ctx.configuration.coverage_enabled and go.mode.cover_format == "text":
         test_deps.append(go.coverdata)
     test_source = go.library_to_source(go, struct(
         srcs = [struct(files = [main_go])],
@@ -152,8 +175,11 @@ def _go_test_impl(ctx):
         gc_linkopts = test_gc_linkopts,
         version_file = ctx.version_file,
         info_file = ctx.info_file,
+        _generated_x_defs = generated_x_defs,
     )
 
+    runfiles = runfiles.merge(changed_files_runfiles)
+
     # Bazel only looks for coverage data if the test target has an
     # InstrumentedFilesProvider. If the provider is found and at least one
     # source file is present, Bazel will set the COVERAGE_OUTPUT_FILE
@@ -177,11 +203,35 @@ def _go_test_impl(ctx):
         ),
     ]
 
+def _split_unqualified_x_defs(ctx, source):
+    """Separates x_defs without a package name from the other x_defs.
+
+    library_to_source qualifies these with the importmap of the library. They
+    apply to both the internal and the external test package, and the variable
+    is usually defined in only one of them, so the linker shouldn't warn about
+    the other.
+
+    Returns:
+      A tuple containing the source without those x_defs and a dict of them.
+    """
+    qualified = {}
+    x_defs = dict(source.x_defs)
+    for k in ctx.attr.x_defs:
+        if "." not in k:
+            k = "{}.{}".format(source.library.importmap, k)
+            if k in x_defs:
+                qualified[k] = x_defs.pop(k)
+    if not qualified:
+        return source, qualified
+    attrs = structs.to_dict(source)
+    attrs["x_defs"] = x_defs
+    return GoSource(**attrs), qualified
+
 _go_test_kwargs = {
     "implementation": _go_test_impl,
     "attrs": {
         "data": attr.label_list(allow_files = True),
-        "srcs": attr.label_list(allow_files = go_exts + asm_exts + cgo_exts),
+        "srcs": attr.label_list(allow_files = go_exts + asm_exts + cgo_exts + syso_exts),
         "deps": attr.label_list(providers = [GoLibrary]),
         "embed": attr.label_list(providers = [GoLibrary]),
         "embedsrcs": attr.label_list(allow_files = True),
@@ -189,6 +239,7 @@ _go_test_kwargs = {
         "gc_goopts": attr.string_list(),
         "gc_linkopts": attr.string_list(),
         "rundir": attr.string(),
+        "testdata_path": attr.bool(),
         "x_defs": attr.string_dict(),
         "linkmode": attr.string(default = LINKMODE_NORMAL),
         "cgo": attr.bool(),
@@ -197,6 +248,13 @@ _go_test_kwargs = {
         "copts": attr.string_list(),
         "cxxopts": attr.string_list(),
         "clinkopts": attr.string_list(),
+        "pch": attr.label(allow_single_file = hdr_exts),
+        "coverage_threshold": attr.string(),
+        "coverage_package_thresholds": attr.string_dict(),
+        "_changed_files": attr.label(
+            default = "//go/config:changed_files",
+            allow_files = True,
+        ),
         "_go_context_data": attr.label(default = "//:go_context_data"),
         "_testmain_additional_deps": attr.label_list(
             providers = [GoLibrary],
@@ -217,6 +275,45 @@ _go_test_kwargs = {
 go_test = rule(**_go_test_kwargs)
 go_transition_test = go_transition_rule(**_go_test_kwargs)
 
+def _emit_changed_files_filter(ctx, go, arguments, internal_archive, external_archive):
+    """Lets the test skip itself when no changed file affects it.
+
+    If --@io_bazel_rules_go//go/config:changed_files names a manifest, this
+    writes the list of source files the test is built from, and tells the
+    generated test main to compare it with the manifest when the test runs.
+    The test is never skipped if it may depend on files that aren't listed,
+    like generated files or C libraries.
+
+    Returns:
+        runfiles with the manifest and the list of inputs, or empty runfiles
+        if tests aren't filtered.
+    """
+    if not ctx.files._changed_files:
+        return ctx.runfiles()
+    if len(ctx.files._changed_files) != 1:
+        fail("{}: expected exactly one file".format(ctx.attr._changed_files.label))
+    changed_files = ctx.files._changed_files[0]
+
+    arcs = depset(
+        direct = [internal_archive.data],
+        transitive = [external_archive.transitive],
+    ).to_list()
+    inputs = []
+    for arc in arcs:
+        if arc._cdeps:
+            return ctx.runfiles()
+        inputs.extend(arc.orig_srcs)
+        inputs.extend(arc._embedsrcs)
+        inputs.extend(arc.data_files)
+    if any([not f.is_source for f in inputs]):
+        return ctx.runfiles()
+
+    test_inputs = go.declare_file(go, path = "test_inputs.txt")
+    ctx.actions.write(test_inputs, "".join([f.path + "\n" for f in inputs]))
+    arguments.add("-changed_files", changed_files.short_path)
+    arguments.add("-test_inputs", test_inputs.short_path)
+    return ctx.runfiles(files = [changed_files, test_inputs])
+
 def _recompile_external_deps(go, external_source, internal_archive, library_labels):
     """Recompiles some archives in order to split internal and external tests.
 
@@ -397,6 +494,7 @@ def _recompile_external_deps(go, external_source, internal_archive, library_labe
             srcs = as_list(arc_data.srcs),
             orig_srcs = as_list(arc_data.orig_srcs),
             orig_src_map = dict(zip(arc_data.srcs, arc_data._orig_src_map)),
+            src_labels = dict(zip(arc_data._orig_src_map, arc_data._src_labels)),
             cover = arc_data._cover,
             embedsrcs = as_list(arc_data._embedsrcs),
             x_defs = dict(arc_data._x_defs),
@@ -409,6 +507,7 @@ def _recompile_external_deps(go, external_source, internal_archive, library_labe
             copts = as_list(arc_data._copts),
             cxxopts = as_list(arc_data._cxxopts),
             clinkopts = as_list(arc_data._clinkopts),
+            pch = arc_data._pch,
             cgo_exports = as_list(arc_data._cgo_exports),
         )
 
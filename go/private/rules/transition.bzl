@@ -18,6 +18,7 @@ load(
 )
 load(
     "//go/private:mode.bzl",
+    "COVER_EXCLUDE_DEFAULT",
     "LINKMODES",
     "LINKMODE_NORMAL",
 )
@@ -60,6 +61,16 @@ def filter_transition_label(label):
     else:
         return label
 
+# Compiler flags that change generated code. When one of these is set in the
+# gc_goopts of a go_binary or go_test, the standard library is compiled with
+# the same flag, so that, for example, a binary built for debugging with
+# "-N -l" can be stepped through in standard library code, too.
+_STDLIB_GCFLAGS = ("-N", "-l", "-B")
+
+def _stdlib_gcflags(gc_goopts):
+    """Returns the flags in gc_goopts that should also apply to the standard library."""
+    return [opt for opt in gc_goopts if opt in _STDLIB_GCFLAGS]
+
 def go_transition_wrapper(kind, transition_kind, name, **kwargs):
     """Wrapper for rules that may use transitions.
 
@@ -69,8 +80,11 @@ def go_transition_wrapper(kind, transition_kind, name, **kwargs):
     regular rule. This prevents targets from being rebuilt for an alternative
     configuration identical to the default configuration.
     """
-    transition_keys = ("goos", "goarch", "pure", "static", "msan", "race", "gotags", "linkmode")
+    transition_keys = ("goos", "goarch", "pure", "static", "msan", "race", "gotags", "linkmode", "sdk_version")
     need_transition = any([key in kwargs for key in transition_keys])
+    gc_goopts = kwargs.get("gc_goopts")
+    if type(gc_goopts) == "list" and _stdlib_gcflags(gc_goopts):
+        need_transition = True
     if need_transition:
         transition_kind(name = name, **kwargs)
     else:
@@ -109,6 +123,7 @@ def go_transition_rule(**kwargs):
             default = "auto",
             values = ["auto"] + LINKMODES,
         ),
+        "sdk_version": attr.string(default = ""),
         "_whitelist_function_transition": attr.label(
             default = "@bazel_tools//tools/whitelists/function_transition_whitelist",
         ),
@@ -179,6 +194,16 @@ def _go_transition_impl(settings, attr):
         linkmode_label = filter_transition_label("@io_bazel_rules_go//go/config:linkmode")
         settings[linkmode_label] = linkmode
 
+    sdk_version = getattr(attr, "sdk_version", "")
+    if sdk_version:
+        sdk_version_label = filter_transition_label("@io_bazel_rules_go//go/config:sdk_version")
+        settings[sdk_version_label] = sdk_version
+
+    gcflags = _stdlib_gcflags(getattr(attr, "gc_goopts", []))
+    if gcflags:
+        gcflags_label = filter_transition_label("@io_bazel_rules_go//go/config:stdlib_gcflags")
+        settings[gcflags_label] = gcflags
+
     return settings
 
 def _request_nogo_transition(settings, attr):
@@ -215,6 +240,8 @@ go_transition = transition(
         "@io_bazel_rules_go//go/config:pure",
         "@io_bazel_rules_go//go/config:tags",
         "@io_bazel_rules_go//go/config:linkmode",
+        "@io_bazel_rules_go//go/config:stdlib_gcflags",
+        "@io_bazel_rules_go//go/config:sdk_version",
     ]],
     outputs = [filter_transition_label(label) for label in [
         "//command_line_option:platforms",
@@ -224,6 +251,8 @@ go_transition = transition(
         "@io_bazel_rules_go//go/config:pure",
         "@io_bazel_rules_go//go/config:tags",
         "@io_bazel_rules_go//go/config:linkmode",
+        "@io_bazel_rules_go//go/config:stdlib_gcflags",
+        "@io_bazel_rules_go//go/config:sdk_version",
     ]],
 )
 
@@ -236,6 +265,11 @@ _reset_transition_dict = {
     "@io_bazel_rules_go//go/config:debug": False,
     "@io_bazel_rules_go//go/config:linkmode": LINKMODE_NORMAL,
     "@io_bazel_rules_go//go/config:tags": [],
+    "@io_bazel_rules_go//go/config:stdlib_gcflags": [],
+    "@io_bazel_rules_go//go/config:trimpath_prefix": "",
+    "@io_bazel_rules_go//go/config:pkg_config": "",
+    "@io_bazel_rules_go//go/config:cover_exclude": COVER_EXCLUDE_DEFAULT,
+    "@io_bazel_rules_go//go/config:cover_format": "text",
     "@io_bazel_rules_go//go/private:bootstrap_nogo": True,
 }
 
@@ -27,10 +27,16 @@ load(
 
 MIN_SUPPORTED_VERSION = (1, 14, 0)
 
+# Delays between attempts to download a file from the same url. The delay
+# doubles after each failed attempt, up to the maximum.
+_RETRY_DELAY_SECONDS = 1
+_MAX_RETRY_DELAY_SECONDS = 16
+
 def _go_host_sdk_impl(ctx):
     goroot = _detect_host_sdk(ctx)
     platform = _detect_sdk_platform(ctx, goroot)
-    _sdk_build_file(ctx, platform)
+    version = _detect_sdk_version(ctx, goroot)
+    _sdk_build_file(ctx, platform, version)
     _local_sdk(ctx, goroot)
 
 _go_host_sdk = repository_rule(
@@ -52,7 +58,6 @@ def _go_download_sdk_impl(ctx):
             fail("goos set but goarch not set")
         goos, goarch = ctx.attr.goos, ctx.attr.goarch
     platform = goos + "_" + goarch
-    _sdk_build_file(ctx, platform)
 
     version = ctx.attr.version
     sdks = ctx.attr.sdks
@@ -67,12 +72,13 @@ def _go_download_sdk_impl(ctx):
             ctx.report_progress("Finding latest Go version")
         else:
             ctx.report_progress("Finding Go SHA-256 sums")
-        ctx.download(
-            url = [
+        _download(
+            ctx,
+            [
                 "https://golang.org/dl/?mode=json&include=all",
                 "https://golang.google.cn/dl/?mode=json&include=all",
             ],
-            output = "versions.json",
+            "versions.json",
         )
 
         data = ctx.read("versions.json")
@@ -98,6 +104,7 @@ def _go_download_sdk_impl(ctx):
         fail("unsupported platform {}".format(platform))
     filename, sha256 = sdks[platform]
     _remote_sdk(ctx, [url.format(filename) for url in ctx.attr.urls], ctx.attr.strip_prefix, sha256)
+    _sdk_build_file(ctx, platform, _detect_sdk_version(ctx, "."))
 
     if not ctx.attr.sdks and not ctx.attr.version:
         # Returning this makes Bazel print a message that 'version' must be
@@ -110,6 +117,7 @@ def _go_download_sdk_impl(ctx):
             "urls": ctx.attr.urls,
             "version": version,
             "strip_prefix": ctx.attr.strip_prefix,
+            "retries": ctx.attr.retries,
         }
     return None
 
@@ -122,6 +130,7 @@ _go_download_sdk = repository_rule(
         "urls": attr.string_list(default = ["https://dl.google.com/go/{}"]),
         "version": attr.string(),
         "strip_prefix": attr.string(default = "go"),
+        "retries": attr.int(default = 2),
     },
 )
 
@@ -132,7 +141,8 @@ def go_download_sdk(name, **kwargs):
 def _go_local_sdk_impl(ctx):
     goroot = ctx.attr.path
     platform = _detect_sdk_platform(ctx, goroot)
-    _sdk_build_file(ctx, platform)
+    version = _detect_sdk_version(ctx, goroot)
+    _sdk_build_file(ctx, platform, version)
     _local_sdk(ctx, goroot)
 
 _go_local_sdk = repository_rule(
@@ -161,7 +171,8 @@ def _go_wrap_sdk_impl(ctx):
         root_file = Label(ctx.attr.root_files[platform])
     goroot = str(ctx.path(root_file).dirname)
     platform = _detect_sdk_platform(ctx, goroot)
-    _sdk_build_file(ctx, platform)
+    version = _detect_sdk_version(ctx, goroot)
+    _sdk_build_file(ctx, platform, version)
     _local_sdk(ctx, goroot)
 
 _go_wrap_sdk = repository_rule(
@@ -202,27 +213,68 @@ def _remote_sdk(ctx, urls, strip_prefix, sha256):
         # instead, we use this workaround.
         if strip_prefix != "go":
             fail("strip_prefix not supported")
-        ctx.download(
-            url = urls,
-            sha256 = sha256,
-            output = "go_sdk.tar.gz",
-        )
+        _download(ctx, urls, "go_sdk.tar.gz", sha256)
         res = ctx.execute(["tar", "-xf", "go_sdk.tar.gz", "--strip-components=1"])
         if res.return_code:
             fail("error extracting Go SDK:\n" + res.stdout + res.stderr)
         ctx.delete("go_sdk.tar.gz")
     else:
-        ctx.download_and_extract(
-            url = urls,
-            stripPrefix = strip_prefix,
-            sha256 = sha256,
-        )
+        # Keep the archive's file name, so ctx.extract can tell its type.
+        archive = urls[0].rpartition("/")[2]
+        _download(ctx, urls, archive, sha256)
+        ctx.extract(archive, stripPrefix = strip_prefix)
+        ctx.delete(archive)
+
+def _download(ctx, urls, output, sha256 = ""):
+    """Downloads a file from the first url in urls that works.
+
+    Each url is tried up to ctx.attr.retries + 1 times, with a growing delay
+    between attempts. If a url serves a file that doesn't match sha256, the
+    next url is tried right away. If no url works, _download fails with the
+    reason each url failed.
+    """
+    errors = []
+    for url in urls:
+        err = _download_from_url(ctx, url, output, sha256)
+        if not err:
+            return
+        errors.append("{}: {}".format(url, err))
+    fail("could not download {}:\n  {}".format(output, "\n  ".join(errors)))
+
+def _download_from_url(ctx, url, output, sha256):
+    attempts = ctx.attr.retries + 1
+    delay = _RETRY_DELAY_SECONDS
+    for attempt in range(attempts):
+        if attempt > 0:
+            _sleep(ctx, delay)
+            delay = min(delay * 2, _MAX_RETRY_DELAY_SECONDS)
+        result = ctx.download(url = [url], output = output, sha256 = sha256, allow_fail = True)
+        if result.success:
+            return None
+        if not sha256:
+            continue
+
+        # Bazel doesn't report why the download failed. Download again without
+        # the checksum to tell a corrupt file from a transient failure.
+        result = ctx.download(url = [url], output = output, allow_fail = True)
+        if result.success:
+            if result.sha256 == sha256:
+                return None
+            ctx.delete(output)
+            return "checksum mismatch: got SHA-256 {}, want {}".format(result.sha256, sha256)
+    return "download failed after {} attempt(s)".format(attempts)
+
+def _sleep(ctx, seconds):
+    if ctx.os.name.startswith("windows"):
+        ctx.execute(["powershell", "-NoProfile", "-Command", "Start-Sleep -Seconds {}".format(seconds)])
+    else:
+        ctx.execute(["sleep", str(seconds)])
 
 def _local_sdk(ctx, path):
     for entry in ["src", "pkg", "bin", "lib"]:
         ctx.symlink(path + "/" + entry, entry)
 
-def _sdk_build_file(ctx, platform):
+def _sdk_build_file(ctx, platform, version):
     ctx.file("ROOT")
     goos, _, goarch = platform.partition("_")
     ctx.template(
@@ -233,6 +285,7 @@ def _sdk_build_file(ctx, platform):
             "{goos}": goos,
             "{goarch}": goarch,
             "{exe}": ".exe" if goos == "windows" else "",
+            "{version}": version,
         },
     )
 
@@ -312,6 +365,20 @@ def _detect_sdk_platform(ctx, goroot):
         fail("Could not detect SDK platform: found multiple platforms %s in %s" % (platforms, path))
     return platforms[0]
 
+def _detect_sdk_version(ctx, goroot):
+    """Returns the version of the SDK in goroot, like "1.16.3".
+
+    The version is read from the first line of the VERSION file. An empty
+    string is returned for SDKs without one, like those built from source.
+    """
+    path = ctx.path(goroot + "/VERSION")
+    if not path.exists:
+        return ""
+    version = ctx.read(path).split("\n")[0].strip()
+    if not version.startswith("go"):
+        return ""
+    return version[len("go"):]
+
 def _parse_versions_json(data):
     """Parses version metadata returned by golang.org.
 
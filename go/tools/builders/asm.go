@@ -60,7 +60,7 @@ func asm(args []string) error {
 	}
 
 	// Build source with the assembler.
-	return asmFile(goenv, source, asmFlags, outPath)
+	return asmFile(goenv, source, asmFlags, ".", outPath)
 }
 
 // buildSymabisFile generates a file from assembly files that is consumed
@@ -115,19 +115,11 @@ func buildSymabisFile(goenv *env, sFiles, hFiles []fileInfo, asmhdr string) (str
 	}
 	asmargs := goenv.goTool("asm")
 	asmargs = append(asmargs, "-trimpath", wd)
-	asmargs = append(asmargs, "-I", wd)
-	asmargs = append(asmargs, "-I", filepath.Join(os.Getenv("GOROOT"), "pkg", "include"))
-	asmargs = append(asmargs, "-I", asmhdrDir)
-	seenHdrDirs := map[string]bool{wd: true, asmhdrDir: true}
-	for _, hFile := range hFiles {
-		hdrDir := filepath.Dir(abs(hFile.filename))
-		if !seenHdrDirs[hdrDir] {
-			asmargs = append(asmargs, "-I", hdrDir)
-			seenHdrDirs[hdrDir] = true
-		}
+	for _, inc := range asmIncludeDirs(asmhdrDir, hFiles) {
+		asmargs = append(asmargs, "-I", inc)
 	}
-	// TODO(#1894): define GOOS_goos, GOARCH_goarch, both here and in the
-	// GoAsm action.
+	asmargs = append(asmargs, "-I", wd)
+	asmargs = append(asmargs, asmDefines()...)
 	asmargs = append(asmargs, "-gensymabis", "-o", symabisName, "--")
 	for _, sFile := range sFiles {
 		asmargs = append(asmargs, sFile.filename)
@@ -137,12 +129,50 @@ func buildSymabisFile(goenv *env, sFiles, hFiles []fileInfo, asmhdr string) (str
 	return symabisName, err
 }
 
-func asmFile(goenv *env, srcPath string, asmFlags []string, outPath string) error {
+// asmIncludeDirs returns the directories searched for headers included by
+// assembly files, after the directory of each assembly file. The directory
+// containing go_asm.h, written by the compiler, comes first, so the header
+// can't be shadowed by another file with the same name. It's followed by
+// GOROOT/pkg/include, for textflag.h and funcdata.h, then the directories of
+// the package's headers in the order they're listed. The same directories are
+// used when generating symbol ABIs and when assembling, so both see the same
+// headers.
+func asmIncludeDirs(asmhdrDir string, hFiles []fileInfo) []string {
+	dirs := []string{
+		abs(asmhdrDir),
+		filepath.Join(os.Getenv("GOROOT"), "pkg", "include"),
+	}
+	seen := map[string]bool{dirs[0]: true, dirs[1]: true}
+	for _, hFile := range hFiles {
+		dir := filepath.Dir(abs(hFile.filename))
+		if !seen[dir] {
+			dirs = append(dirs, dir)
+			seen[dir] = true
+		}
+	}
+	return dirs
+}
+
+// asmFile assembles srcPath into outPath. trimpath is passed to the assembler
+// with -trimpath; it may be a path to remove or a rewrite like "from=>to".
+func asmFile(goenv *env, srcPath string, asmFlags []string, trimpath, outPath string) error {
 	args := goenv.goTool("asm")
 	args = append(args, asmFlags...)
-	args = append(args, "-trimpath", ".")
+	args = append(args, asmDefines()...)
+	args = append(args, "-trimpath", trimpath)
 	args = append(args, "-o", outPath)
 	args = append(args, "--", srcPath)
 	absArgs(args, []string{"-I", "-o", "-trimpath"})
 	return goenv.runCommand(args)
 }
+
+// asmDefines returns flags that define the GOOS_goos and GOARCH_goarch macros
+// for the target platform, like the go command does. Assembly files that are
+// built for more than one architecture may use these with #ifdef to select
+// instructions.
+func asmDefines() []string {
+	return []string{
+		"-D", "GOOS_" + build.Default.GOOS,
+		"-D", "GOARCH_" + build.Default.GOARCH,
+	}
+}
@@ -43,10 +43,18 @@ func main() {
 		action = asm
 	case "compile":
 		action = compile
+	case "compilecommands":
+		action = compileCommands
 	case "compilepkg":
 		action = compilePkg
 	case "cover":
 		action = cover
+	case "coverfunc":
+		action = coverFunc
+	case "coverlcov":
+		action = coverLcov
+	case "covermerge":
+		action = coverMerge
 	case "filterbuildid":
 		action = filterBuildID
 	case "gentestmain":
@@ -0,0 +1,60 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"go/build"
+	"strings"
+)
+
+// buildInfoDevelVersion is the version reported for modules without a known
+// version, as the go command does.
+const buildInfoDevelVersion = "(devel)"
+
+// buildInfoStart and buildInfoEnd surround the build info text in
+// runtime.modinfo. runtime/debug.ReadBuildInfo strips them.
+const (
+	buildInfoStart = "\x30\x77\xaf\x0c\x92\x74\x08\x02\x41\xe1\xc1\x07\xe6\xd6\x18\xe6"
+	buildInfoEnd   = "\xf9\x32\x43\x31\x86\x18\x20\x72\x00\x82\x42\x10\x41\x16\xd8\xf2"
+)
+
+// buildModInfo returns the value of runtime.modinfo for a binary with the
+// main package mainPath. There are no go.mod files in a Bazel build, so the
+// main module has the main package's path and the given version. Deps is
+// left empty: Bazel targets don't record which module a package comes from or
+// its version, and reporting packages as modules would mislead tools that
+// read build info to find dependencies, like vulnerability scanners.
+func buildModInfo(mainPath, version string) string {
+	if version == "" {
+		version = buildInfoDevelVersion
+	}
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "path\t%s\n", mainPath)
+	fmt.Fprintf(b, "mod\t%s\t%s\n", mainPath, version)
+	return buildInfoStart + b.String() + buildInfoEnd
+}
+
+// linkerSupportsModInfo reports whether the linker accepts a modinfo line in
+// its importcfg file, which was added in Go 1.18. The value can't be set with
+// -X instead, since it contains a NUL byte.
+func linkerSupportsModInfo() bool {
+	for _, t := range build.Default.ReleaseTags {
+		if t == "go1.18" {
+			return true
+		}
+	}
+	return false
+}
@@ -22,14 +22,21 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 )
 
 // cgo2 processes a set of mixed source files with cgo.
-func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs []string, packagePath, packageName string, cc string, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags []string, cgoExportHPath string) (srcDir string, allGoSrcs, cObjs []string, err error) {
+func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs []string, pchHdr string, packagePath, packageName string, cc string, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags []string, cgoExportHPath, compileCommandsPath string) (srcDir string, allGoSrcs, cObjs []string, err error) {
+	if err := checkObjcSrcs(objcSrcs, objcxxSrcs); err != nil {
+		return "", nil, nil, err
+	}
+
 	// Report an error if the C/C++ toolchain wasn't configured.
 	if cc == "" {
 		err := cgoError(cgoSrcs[:])
@@ -48,7 +55,7 @@ func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSr
 	// might miss dependencies like -lstdc++ if they aren't referenced in
 	// some other way.
 	if len(cgoSrcs) == 0 {
-		cObjs, err = compileCSources(goenv, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs, cc, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags)
+		cObjs, err = compileCSources(goenv, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs, pchHdr, cc, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, compileCommandsPath)
 		return ".", nil, cObjs, err
 	}
 
@@ -92,6 +99,7 @@ func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSr
 		}
 	}
 	combinedLdFlags = append(combinedLdFlags, defaultLdFlags()...)
+	combinedLdFlags = append(combinedLdFlags, appleSysrootFlags(ldFlags)...)
 	os.Setenv("CGO_LDFLAGS", strings.Join(combinedLdFlags, " "))
 
 	// If cgo sources are in different directories, gather them into a temporary
@@ -164,21 +172,41 @@ func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSr
 
 	// Compile C, C++, Objective-C/C++, and assembly code.
 	defaultCFlags := defaultCFlags(workDir)
+	defaultCFlags = append(defaultCFlags, appleSysrootFlags(cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags)...)
 	combinedCFlags := combineFlags(cppFlags, hdrIncludes, cFlags, defaultCFlags)
-	for _, lang := range []struct{ srcs, flags []string }{
-		{genCSrcs, combinedCFlags},
-		{cSrcs, combinedCFlags},
-		{cxxSrcs, combineFlags(cppFlags, hdrIncludes, cxxFlags, defaultCFlags)},
-		{objcSrcs, combineFlags(cppFlags, hdrIncludes, objcFlags, defaultCFlags)},
-		{objcxxSrcs, combineFlags(cppFlags, hdrIncludes, objcxxFlags, defaultCFlags)},
-		{sSrcs, nil},
+	combinedCxxFlags := combineFlags(cppFlags, hdrIncludes, cxxFlags, defaultCFlags)
+	var pchFlags []string
+	if len(cxxSrcs) > 0 {
+		if pchFlags, err = precompileHeader(goenv, pchHdr, cc, combinedCxxFlags, workDir); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	var compileCmds []compileCommand
+	for _, lang := range []struct {
+		srcs, flags, pchFlags []string
+		generated             bool
+	}{
+		{genCSrcs, combinedCFlags, nil, true},
+		{cSrcs, combinedCFlags, nil, false},
+		{cxxSrcs, combinedCxxFlags, pchFlags, false},
+		{objcSrcs, combineFlags(cppFlags, hdrIncludes, objcFlags, defaultCFlags), nil, false},
+		{objcxxSrcs, combineFlags(cppFlags, hdrIncludes, objcxxFlags, defaultCFlags), nil, false},
+		{sSrcs, nil, nil, false},
 	} {
 		for _, src := range lang.srcs {
 			obj := filepath.Join(workDir, fmt.Sprintf("_x%d.o", len(cObjs)))
 			cObjs = append(cObjs, obj)
-			if err := cCompile(goenv, src, cc, lang.flags, obj); err != nil {
+			if err := cCompile(goenv, src, cc, combineFlags(lang.flags, lang.pchFlags), obj); err != nil {
 				return "", nil, nil, err
 			}
+			if !lang.generated {
+				compileCmds = append(compileCmds, newCompileCommand(src, cc, lang.flags, workDir))
+			}
+		}
+	}
+	if compileCommandsPath != "" {
+		if err := writeCompileCommands(compileCommandsPath, compileCmds); err != nil {
+			return "", nil, nil, err
 		}
 	}
 
@@ -222,7 +250,7 @@ func cgo2(goenv *env, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSr
 // It does not run cgo. This is used for packages with "cgo = True" but
 // without any .go files that import "C". The Go command forbids this,
 // but we have historically allowed it.
-func compileCSources(goenv *env, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs []string, cc string, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags []string) (cObjs []string, err error) {
+func compileCSources(goenv *env, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs []string, pchHdr, cc string, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags []string, compileCommandsPath string) (cObjs []string, err error) {
 	workDir, cleanup, err := goenv.workDir()
 	if err != nil {
 		return nil, err
@@ -240,19 +268,34 @@ func compileCSources(goenv *env, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hS
 	}
 
 	defaultCFlags := defaultCFlags(workDir)
-	for _, lang := range []struct{ srcs, flags []string }{
-		{cSrcs, combineFlags(cppFlags, hdrIncludes, cFlags, defaultCFlags)},
-		{cxxSrcs, combineFlags(cppFlags, hdrIncludes, cxxFlags, defaultCFlags)},
-		{objcSrcs, combineFlags(cppFlags, hdrIncludes, objcFlags, defaultCFlags)},
-		{objcxxSrcs, combineFlags(cppFlags, hdrIncludes, objcxxFlags, defaultCFlags)},
-		{sSrcs, nil},
+	defaultCFlags = append(defaultCFlags, appleSysrootFlags(cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags)...)
+	combinedCxxFlags := combineFlags(cppFlags, hdrIncludes, cxxFlags, defaultCFlags)
+	var pchFlags []string
+	if len(cxxSrcs) > 0 {
+		if pchFlags, err = precompileHeader(goenv, pchHdr, cc, combinedCxxFlags, workDir); err != nil {
+			return nil, err
+		}
+	}
+	var compileCmds []compileCommand
+	for _, lang := range []struct{ srcs, flags, pchFlags []string }{
+		{cSrcs, combineFlags(cppFlags, hdrIncludes, cFlags, defaultCFlags), nil},
+		{cxxSrcs, combinedCxxFlags, pchFlags},
+		{objcSrcs, combineFlags(cppFlags, hdrIncludes, objcFlags, defaultCFlags), nil},
+		{objcxxSrcs, combineFlags(cppFlags, hdrIncludes, objcxxFlags, defaultCFlags), nil},
+		{sSrcs, nil, nil},
 	} {
 		for _, src := range lang.srcs {
 			obj := filepath.Join(workDir, fmt.Sprintf("_x%d.o", len(cObjs)))
 			cObjs = append(cObjs, obj)
-			if err := cCompile(goenv, src, cc, lang.flags, obj); err != nil {
+			if err := cCompile(goenv, src, cc, combineFlags(lang.flags, lang.pchFlags), obj); err != nil {
 				return nil, err
 			}
+			compileCmds = append(compileCmds, newCompileCommand(src, cc, lang.flags, workDir))
+		}
+	}
+	if compileCommandsPath != "" {
+		if err := writeCompileCommands(compileCommandsPath, compileCmds); err != nil {
+			return nil, err
 		}
 	}
 	return cObjs, nil
@@ -270,6 +313,54 @@ func combineFlags(lists ...[]string) []string {
 	return flags
 }
 
+// precompileHeader compiles the C++ header hdr with flags into a precompiled
+// header in workDir. It returns the flags C++ sources should be compiled with
+// to use it. The header is also included in C++ sources that don't include
+// it, so it should have an include guard.
+//
+// The precompiled header is an optimization, so if the compiler can't
+// precompile the header, for example, because it doesn't support precompiled
+// headers, precompileHeader returns no flags, and sources are compiled as
+// usual. precompileHeader also returns no flags if hdr is empty.
+func precompileHeader(goenv *env, hdr, cc string, flags []string, workDir string) ([]string, error) {
+	if hdr == "" {
+		return nil, nil
+	}
+	// GCC and Clang look for a precompiled header with a .gch suffix next to
+	// a header included with -include. The header is copied there too, so
+	// the compiler can fall back to it if it can't use the precompiled header.
+	pchDir := filepath.Join(workDir, "_pch")
+	if err := os.MkdirAll(pchDir, 0777); err != nil {
+		return nil, err
+	}
+	include := filepath.Join(pchDir, filepath.Base(hdr))
+	if err := copyFile(hdr, include); err != nil {
+		return nil, err
+	}
+	pch := include + ".gch"
+	args := append([]string{cc}, flags...)
+	args = append(args, "-x", "c++-header", "-c", hdr, "-o", pch)
+	cmd := exec.Command(args[0], args[1:]...)
+	if goenv.verbose {
+		fmt.Fprintln(os.Stderr, formatCommand(cmd))
+	}
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = os.Stat(pch); err == nil && fi.Size() == 0 {
+			err = errors.New("compiler wrote an empty file")
+		}
+	}
+	if err != nil {
+		if goenv.verbose {
+			fmt.Fprintf(os.Stderr, "not using precompiled header for %s: %v\n%s", hdr, err, relativizePaths(out))
+		}
+		os.Remove(pch)
+		return nil, nil
+	}
+	return []string{"-include", include}, nil
+}
+
 func cCompile(goenv *env, src, cc string, flags []string, out string) error {
 	args := []string{cc}
 	args = append(args, flags...)
@@ -307,6 +398,34 @@ func defaultLdFlags() []string {
 	}
 }
 
+// hostGOOS is the operating system the builder is running on. It's a
+// variable so tests can pretend to run on another host.
+var hostGOOS = runtime.GOOS
+
+// appleSysrootFlags returns flags that point the C toolchain at the Apple SDK
+// named by SDKROOT when cross-compiling for darwin or ios from another host.
+// On a macOS host, the toolchain finds the SDK itself (through xcrun), so no
+// flags are returned. No flags are returned either when SDKROOT is not set or
+// when any of the given flag lists already sets a sysroot.
+func appleSysrootFlags(flagLists ...[]string) []string {
+	goos := os.Getenv("GOOS")
+	if goos != "darwin" && goos != "ios" || hostGOOS == "darwin" {
+		return nil
+	}
+	sdkRoot := os.Getenv("SDKROOT")
+	if sdkRoot == "" {
+		return nil
+	}
+	for _, flags := range flagLists {
+		for _, f := range flags {
+			if strings.HasPrefix(f, "-isysroot") || strings.HasPrefix(f, "--sysroot") {
+				return nil
+			}
+		}
+	}
+	return []string{"-isysroot", abs(sdkRoot)}
+}
+
 // gatherSrcs copies or links files listed in srcs into dir. This is needed
 // to effectively use -trimpath with generated sources. It's also needed by cgo.
 //
@@ -335,6 +454,30 @@ func gatherSrcs(dir string, srcs []string) ([]string, error) {
 	return copiedBases, nil
 }
 
+// checkObjcSrcs returns an error if there are Objective-C or Objective-C++
+// sources and the target platform isn't darwin or ios. They're compiled
+// against Apple's SDKs, which aren't available for other platforms.
+func checkObjcSrcs(srcLists ...[]string) error {
+	goos := os.Getenv("GOOS")
+	if goos == "darwin" || goos == "ios" {
+		return nil
+	}
+	var srcs []string
+	for _, list := range srcLists {
+		srcs = append(srcs, list...)
+	}
+	if len(srcs) == 0 {
+		return nil
+	}
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "Objective-C and Objective-C++ files can only be compiled for darwin or ios, not %s:\n", goos)
+	for _, f := range srcs {
+		fmt.Fprintf(b, "\t%s\n", f)
+	}
+	fmt.Fprint(b, "Add a _darwin suffix to their names or select them only for darwin platforms.")
+	return errors.New(b.String())
+}
+
 type cgoError []string
 
 func (e cgoError) Error() string {
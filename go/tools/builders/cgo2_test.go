@@ -0,0 +1,268 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestAppleSysrootFlags(t *testing.T) {
+	sdkRoot := abs("MacOSX.sdk")
+	for _, test := range []struct {
+		desc, goos, host, sdkRoot string
+		flags                     []string
+		want                      []string
+	}{
+		{
+			desc:    "darwin_cross",
+			goos:    "darwin",
+			host:    "linux",
+			sdkRoot: sdkRoot,
+			want:    []string{"-isysroot", sdkRoot},
+		}, {
+			desc:    "ios_cross",
+			goos:    "ios",
+			host:    "windows",
+			sdkRoot: sdkRoot,
+			want:    []string{"-isysroot", sdkRoot},
+		}, {
+			desc:    "darwin_native",
+			goos:    "darwin",
+			host:    "darwin",
+			sdkRoot: sdkRoot,
+		}, {
+			desc:    "linux_target",
+			goos:    "linux",
+			host:    "linux",
+			sdkRoot: sdkRoot,
+		}, {
+			desc: "no_sdkroot",
+			goos: "darwin",
+			host: "linux",
+		}, {
+			desc:    "explicit_isysroot",
+			goos:    "darwin",
+			host:    "linux",
+			sdkRoot: sdkRoot,
+			flags:   []string{"-O2", "-isysroot", "/other/sdk"},
+		}, {
+			desc:    "explicit_sysroot",
+			goos:    "darwin",
+			host:    "linux",
+			sdkRoot: sdkRoot,
+			flags:   []string{"--sysroot=/other/sdk"},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			setenv(t, "GOOS", test.goos)
+			setenv(t, "SDKROOT", test.sdkRoot)
+			origHost := hostGOOS
+			hostGOOS = test.host
+			defer func() { hostGOOS = origHost }()
+
+			got := appleSysrootFlags([]string{"-Wall"}, test.flags)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewCompileCommand(t *testing.T) {
+	root := abs(".")
+	workDir := "/tmp/rules_go_work-123"
+	flags := []string{
+		"-DFOO=1",
+		"-iquote", "pkg",
+		"-iquote", workDir,
+		"-I" + root + "/external/lib/include",
+		"-fdebug-prefix-map=" + root + "=.",
+		"-fdebug-prefix-map=" + workDir + "=.",
+	}
+	got := newCompileCommand(root+"/pkg/foo.c", "/usr/bin/cc", flags, workDir)
+	want := compileCommand{
+		Directory: "__EXEC_ROOT__",
+		File:      "__EXEC_ROOT__/pkg/foo.c",
+		Arguments: []string{
+			"/usr/bin/cc",
+			"-DFOO=1",
+			"-iquote", "pkg",
+			"-I__EXEC_ROOT__/external/lib/include",
+			"-fdebug-prefix-map=__EXEC_ROOT__=.",
+			"-c", "__EXEC_ROOT__/pkg/foo.c",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestCheckObjcSrcs(t *testing.T) {
+	for _, test := range []struct {
+		desc, goos   string
+		objc, objcxx []string
+		wantErr      bool
+	}{
+		{
+			desc: "darwin",
+			goos: "darwin",
+			objc: []string{"a.m"},
+		}, {
+			desc:   "ios",
+			goos:   "ios",
+			objcxx: []string{"a.mm"},
+		}, {
+			desc:    "linux_objc",
+			goos:    "linux",
+			objc:    []string{"a.m"},
+			wantErr: true,
+		}, {
+			desc:    "windows_objcxx",
+			goos:    "windows",
+			objcxx:  []string{"a.mm"},
+			wantErr: true,
+		}, {
+			desc: "linux_no_objc",
+			goos: "linux",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			setenv(t, "GOOS", test.goos)
+			err := checkObjcSrcs(test.objc, test.objcxx)
+			if !test.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("unexpected success")
+			}
+			for _, want := range append([]string{"not " + test.goos}, append(test.objc, test.objcxx...)...) {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error does not contain %q:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPrecompileHeader(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake compiler is a shell script")
+	}
+	for _, test := range []struct {
+		desc, cc string
+		wantPCH  bool
+	}{
+		{
+			// Writes the output file of each command.
+			desc: "supported",
+			cc: `#!/bin/sh
+echo "$@" >>"$LOG"
+while [ $# -gt 1 ]; do
+  if [ "$1" = -o ]; then echo out >"$2"; fi
+  shift
+done
+`,
+			wantPCH: true,
+		}, {
+			// Fails to compile headers.
+			desc: "unsupported",
+			cc: `#!/bin/sh
+echo "$@" >>"$LOG"
+case "$*" in *c++-header*) echo "unsupported language" >&2; exit 1;; esac
+while [ $# -gt 1 ]; do
+  if [ "$1" = -o ]; then echo out >"$2"; fi
+  shift
+done
+`,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cgo2_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			workDir := filepath.Join(dir, "work")
+			if err := os.Mkdir(workDir, 0777); err != nil {
+				t.Fatal(err)
+			}
+			cc := filepath.Join(dir, "cc")
+			log := filepath.Join(dir, "log")
+			hdr := filepath.Join(dir, "pch.h")
+			src := filepath.Join(dir, "a.cc")
+			for name, content := range map[string]string{
+				cc:  test.cc,
+				hdr: "#ifndef PCH_H\n#define PCH_H\n#include <vector>\n#endif\n",
+				src: "#include \"pch.h\"\n",
+			} {
+				if err := ioutil.WriteFile(name, []byte(content), 0777); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setenv(t, "LOG", log)
+
+			goenv := &env{workDirPath: workDir}
+			cxxFlags := []string{"-std=c++17"}
+			if _, err := compileCSources(goenv, nil, []string{src}, nil, nil, nil, []string{hdr}, hdr, cc, nil, nil, cxxFlags, nil, nil, ""); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(log)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmds := strings.Split(strings.TrimSpace(string(data)), "\n")
+			if len(cmds) != 2 {
+				t.Fatalf("got %d compiler commands; want 2:\n%s", len(cmds), data)
+			}
+
+			pch := filepath.Join(workDir, "_pch", "pch.h.gch")
+			if want := "-std=c++17"; !strings.Contains(cmds[0], want) {
+				t.Errorf("header was not precompiled with C++ flags %q:\n%s", want, cmds[0])
+			}
+			if want := "-x c++-header -c " + hdr + " -o " + pch; !strings.HasSuffix(cmds[0], want) {
+				t.Errorf("got header command:\n%s\nwant command ending with:\n%s", cmds[0], want)
+			}
+			include := "-include " + filepath.Join(workDir, "_pch", "pch.h")
+			if got := strings.Contains(cmds[1], include); got != test.wantPCH {
+				t.Errorf("source command contains %q: got %v; want %v\n%s", include, got, test.wantPCH, cmds[1])
+			}
+			if _, err := os.Stat(pch); os.IsNotExist(err) == test.wantPCH {
+				t.Errorf("precompiled header exists: got %v; want %v", !os.IsNotExist(err), test.wantPCH)
+			}
+		})
+	}
+}
+
+// setenv sets an environment variable for the duration of a test.
+func setenv(t *testing.T, key, value string) {
+	orig, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, orig)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
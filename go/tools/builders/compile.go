@@ -42,6 +42,8 @@ func compile(args []string) error {
 	flags.Var(&unfiltered, "src", "A source file to be filtered and compiled")
 	flags.Var(&archives, "arc", "Import path, package path, and file name of a direct dependency, separated by '='")
 	nogo := flags.String("nogo", "", "The nogo binary")
+	nogoConfig := flags.String("nogo_config", "", "The nogo configuration file, read by the nogo binary")
+	nogoBaseline := flags.String("nogo_baseline", "", "The nogo baseline file, listing findings that don't fail the build")
 	outExport := flags.String("x", "", "The output archive file to write export data and nogo facts")
 	output := flags.String("o", "", "The output archive file to write compiled code")
 	asmhdr := flags.String("asmhdr", "", "Path to assembly header file to write")
@@ -169,6 +171,12 @@ func compile(args []string) error {
 		var nogoargs []string
 		nogoargs = append(nogoargs, "-p", *packagePath)
 		nogoargs = append(nogoargs, "-importcfg", importcfgName)
+		if *nogoConfig != "" {
+			nogoargs = append(nogoargs, "-config", *nogoConfig)
+		}
+		if *nogoBaseline != "" {
+			nogoargs = append(nogoargs, "-baseline", *nogoBaseline)
+		}
 		for _, arc := range archives {
 			nogoargs = append(nogoargs, "-fact", fmt.Sprintf("%s=%s", arc.importPath, arc.file))
 		}
@@ -0,0 +1,115 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// compileCommand is an entry in a compile_commands.json file, the JSON
+// compilation database format read by clangd and other C/C++ tools. See
+// https://clang.llvm.org/docs/JSONCompilationDatabase.html.
+type compileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments"`
+}
+
+// execRootPlaceholder is written in place of the execution root in compile
+// commands. Actions may run in a sandbox that is deleted after the build,
+// and the files they write should not depend on where they ran. Tools should
+// replace this with the output of "bazel info execution_root".
+const execRootPlaceholder = "__EXEC_ROOT__"
+
+// newCompileCommand returns the compile command for a C, C++, Objective-C,
+// Objective-C++, or assembly source compiled by cCompile with the given
+// compiler and flags. Flags that refer to workDir are omitted, since workDir
+// is deleted when the action finishes.
+func newCompileCommand(src, cc string, flags []string, workDir string) compileCommand {
+	root := abs(".")
+	args := []string{mapExecRoot(cc, root)}
+	for i := 0; i < len(flags); i++ {
+		f := flags[i]
+		if strings.Contains(f, workDir) {
+			continue
+		}
+		if (f == "-iquote" || f == "-I" || f == "-isystem") && i+1 < len(flags) && strings.Contains(flags[i+1], workDir) {
+			i++
+			continue
+		}
+		args = append(args, mapExecRoot(f, root))
+	}
+	src = mapExecRoot(abs(src), root)
+	args = append(args, "-c", src)
+	return compileCommand{
+		Directory: execRootPlaceholder,
+		File:      src,
+		Arguments: args,
+	}
+}
+
+func mapExecRoot(s, root string) string {
+	return strings.ReplaceAll(s, root, execRootPlaceholder)
+}
+
+// writeCompileCommands writes cmds to path as a JSON array. Each package
+// gets its own file; compileCommands concatenates them into a complete
+// compile_commands.json file.
+func writeCompileCommands(path string, cmds []compileCommand) error {
+	if cmds == nil {
+		cmds = []compileCommand{}
+	}
+	data, err := json.MarshalIndent(cmds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0666)
+}
+
+// compileCommands concatenates compile command files written by compilepkg
+// into a single compile_commands.json file. It is invoked by the
+// go_compile_commands rule.
+func compileCommands(args []string) error {
+	flags := flag.NewFlagSet("compilecommands", flag.ExitOnError)
+	goenv := envFlags(flags)
+	out := flags.String("o", "", "compile_commands.json file to write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if err := goenv.checkFlags(); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("-o was not set")
+	}
+
+	var all []compileCommand
+	for _, path := range flags.Args() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var cmds []compileCommand
+		if err := json.Unmarshal(data, &cmds); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		all = append(all, cmds...)
+	}
+	return writeCompileCommands(*out, all)
+}
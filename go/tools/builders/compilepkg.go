@@ -18,16 +18,21 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -40,15 +45,19 @@ func compilePkg(args []string) error {
 
 	fs := flag.NewFlagSet("GoCompilePkg", flag.ExitOnError)
 	goenv := envFlags(fs)
-	var unfilteredSrcs, coverSrcs, embedSrcs multiFlag
+	var unfilteredSrcs, coverSrcs, coverExclude, embedSrcs, embedRoots, srcLabelFlags, nogoFactFlags multiFlag
 	var deps archiveMultiFlag
-	var importPath, packagePath, nogoPath, packageListPath, coverMode string
-	var outPath, outFactsPath, cgoExportHPath string
-	var testFilter string
+	var importPath, packagePath, nogoPath, nogoConfigPath, packageListPath, coverMode, coverFormat string
+	var outPath, outFactsPath, outNogoFactsPath, outNogoValidationPath, cgoExportHPath, compileCommandsPath, cgoGoSrcsPath string
+	var testFilter, trimpathPrefix, pkgConfig, pchHdr, nogoBaselinePath, testDataRunDir string
+	var nogoGenerateBaseline bool
 	var gcFlags, asmFlags, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags quoteMultiFlag
 	fs.Var(&unfilteredSrcs, "src", ".go, .c, .cc, .m, .mm, .s, or .S file to be filtered and compiled")
 	fs.Var(&coverSrcs, "cover", ".go file that should be instrumented for coverage (must also be a -src)")
+	fs.Var(&coverExclude, "cover_exclude", "Glob pattern matching base names of -cover files that should not be instrumented (may be repeated)")
 	fs.Var(&embedSrcs, "embedsrc", "file that may be compiled into the package with a //go:embed directive")
+	fs.Var(&srcLabelFlags, "src_label", "A .go file and the label of the target that provided it, separated by '='")
+	fs.Var(&embedRoots, "embedroot", "directory containing -embedsrc files, which //go:embed patterns are matched against as if it were the package directory")
 	fs.Var(&deps, "arc", "Import path, package path, and file name of a direct dependency, separated by '='")
 	fs.StringVar(&importPath, "importpath", "", "The import path of the package being compiled. Not passed to the compiler, but may be displayed in debug data.")
 	fs.StringVar(&packagePath, "p", "", "The package path (importmap) of the package being compiled")
@@ -60,13 +69,26 @@ func compilePkg(args []string) error {
 	fs.Var(&objcFlags, "objcflags", "Objective-C compiler flags")
 	fs.Var(&objcxxFlags, "objcxxflags", "Objective-C++ compiler flags")
 	fs.Var(&ldFlags, "ldflags", "C linker flags")
-	fs.StringVar(&nogoPath, "nogo", "", "The nogo binary. If unset, nogo will not be run.")
+	fs.StringVar(&pchHdr, "pch", "", "C++ header to precompile and include in C++ sources, if the C++ compiler supports it")
+	fs.StringVar(&nogoPath, "nogo", "", "The nogo binary. If set, the package is analyzed with nogo instead of compiled.")
+	fs.StringVar(&nogoConfigPath, "nogo_config", "", "The nogo configuration file, read by the nogo binary")
+	fs.StringVar(&nogoBaselinePath, "nogo_baseline", "", "The nogo baseline file, listing findings that don't fail the build")
+	fs.BoolVar(&nogoGenerateBaseline, "nogo_generate_baseline", false, "If true, nogo findings are written to the -out_nogo_validation file in the baseline format instead of failing the build")
+	fs.Var(&nogoFactFlags, "nogo_fact", "Import path and nogo facts file of a direct dependency, separated by '='")
 	fs.StringVar(&packageListPath, "package_list", "", "The file containing the list of standard library packages")
 	fs.StringVar(&coverMode, "cover_mode", "", "The coverage mode to use. Empty if coverage instrumentation should not be added.")
+	fs.StringVar(&coverFormat, "cover_format", coverFormatText, "The format coverage data is written in: text or binary. With binary, -cover_mode may be testmain, which registers hooks that write coverage data when a test exits without instrumenting any files.")
 	fs.StringVar(&outPath, "o", "", "The output archive file to write compiled code")
-	fs.StringVar(&outFactsPath, "x", "", "The output archive file to write export data and nogo facts")
+	fs.StringVar(&outFactsPath, "x", "", "The output archive file to write export data")
+	fs.StringVar(&outNogoFactsPath, "out_facts", "", "The output archive file to write nogo facts (with -nogo)")
+	fs.StringVar(&outNogoValidationPath, "out_nogo_validation", "", "The empty file to write when nogo finds no errors, or the file to write findings to with -nogo_generate_baseline (with -nogo)")
 	fs.StringVar(&cgoExportHPath, "cgoexport", "", "The _cgo_exports.h file to write")
+	fs.StringVar(&compileCommandsPath, "compile_commands", "", "The JSON file to write compile commands for C/C++ sources to")
+	fs.StringVar(&cgoGoSrcsPath, "cgo_go_srcs", "", "The directory to copy Go files generated by cgo into")
 	fs.StringVar(&testFilter, "testfilter", "off", "Controls test package filtering")
+	fs.StringVar(&trimpathPrefix, "trimpath_prefix", "", "If set, source file paths recorded in the archive are relative to the execution root, with this prefix")
+	fs.StringVar(&pkgConfig, "pkg_config", "pkg-config", "The pkg-config command to run for #cgo pkg-config: directives")
+	fs.StringVar(&testDataRunDir, "testdata_run_dir", "", "If set, a TestDataPath function is generated in the package, which finds data files in runfiles relative to this directory")
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
@@ -76,18 +98,55 @@ func compilePkg(args []string) error {
 	if importPath == "" {
 		importPath = packagePath
 	}
+	switch {
+	case coverFormat != coverFormatText && coverFormat != coverFormatBinary:
+		return fmt.Errorf("invalid -cover_format %q: must be %s or %s", coverFormat, coverFormatText, coverFormatBinary)
+	case coverMode == "testmain" && coverFormat != coverFormatBinary:
+		return fmt.Errorf("-cover_mode testmain requires -cover_format %s", coverFormatBinary)
+	}
+	if nogoPath != "" && (outNogoFactsPath == "" || outNogoValidationPath == "") {
+		return errors.New("-out_facts and -out_nogo_validation must be set with -nogo")
+	}
+	nogoFacts := make(map[string]string)
+	for _, f := range nogoFactFlags {
+		i := strings.Index(f, "=")
+		if i < 0 {
+			return fmt.Errorf("-nogo_fact %q: expected importpath=file", f)
+		}
+		nogoFacts[f[:i]] = abs(f[i+1:])
+	}
 	cgoEnabled := os.Getenv("CGO_ENABLED") == "1"
 	cc := os.Getenv("CC")
 	outPath = abs(outPath)
+	outNogoFactsPath = abs(outNogoFactsPath)
+	outNogoValidationPath = abs(outNogoValidationPath)
+	if pchHdr != "" {
+		pchHdr = abs(pchHdr)
+	}
 	for i := range unfilteredSrcs {
 		unfilteredSrcs[i] = abs(unfilteredSrcs[i])
 	}
 	for i := range embedSrcs {
 		embedSrcs[i] = abs(embedSrcs[i])
 	}
+	for i := range embedRoots {
+		embedRoots[i] = abs(embedRoots[i])
+	}
 	for i := range coverSrcs {
 		coverSrcs[i] = abs(coverSrcs[i])
 	}
+	coverSrcs, err = filterCoverSrcs(coverSrcs, coverExclude)
+	if err != nil {
+		return err
+	}
+	srcLabels := make(map[string]string)
+	for _, f := range srcLabelFlags {
+		i := strings.Index(f, "=")
+		if i < 0 {
+			return fmt.Errorf("-src_label %q: expected file=label", f)
+		}
+		srcLabels[abs(f[:i])] = f[i+1:]
+	}
 
 	// Filter sources.
 	srcs, err := filterAndSplitFiles(unfilteredSrcs)
@@ -127,8 +186,11 @@ func compilePkg(args []string) error {
 		srcs,
 		deps,
 		coverMode,
+		coverFormat,
 		coverSrcs,
 		embedSrcs,
+		embedRoots,
+		srcLabels,
 		cgoEnabled,
 		cc,
 		gcFlags,
@@ -139,11 +201,23 @@ func compilePkg(args []string) error {
 		objcFlags,
 		objcxxFlags,
 		ldFlags,
+		pchHdr,
 		nogoPath,
+		nogoConfigPath,
+		nogoBaselinePath,
+		nogoGenerateBaseline,
+		nogoFacts,
 		packageListPath,
 		outPath,
 		outFactsPath,
-		cgoExportHPath)
+		outNogoFactsPath,
+		outNogoValidationPath,
+		cgoExportHPath,
+		compileCommandsPath,
+		cgoGoSrcsPath,
+		trimpathPrefix,
+		pkgConfig,
+		testDataRunDir)
 }
 
 func compileArchive(
@@ -153,8 +227,11 @@ func compileArchive(
 	srcs archiveSrcs,
 	deps []archive,
 	coverMode string,
+	coverFormat string,
 	coverSrcs []string,
 	embedSrcs []string,
+	embedRoots []string,
+	srcLabels map[string]string,
 	cgoEnabled bool,
 	cc string,
 	gcFlags []string,
@@ -165,11 +242,23 @@ func compileArchive(
 	objcFlags []string,
 	objcxxFlags []string,
 	ldFlags []string,
+	pchHdr string,
 	nogoPath string,
+	nogoConfigPath string,
+	nogoBaselinePath string,
+	nogoGenerateBaseline bool,
+	nogoFacts map[string]string,
 	packageListPath string,
 	outPath string,
 	outXPath string,
-	cgoExportHPath string) error {
+	outNogoFactsPath string,
+	outNogoValidationPath string,
+	cgoExportHPath string,
+	compileCommandsPath string,
+	cgoGoSrcsPath string,
+	trimpathPrefix string,
+	pkgConfig string,
+	testDataRunDir string) error {
 
 	workDir, cleanup, err := goenv.workDir()
 	if err != nil {
@@ -177,7 +266,21 @@ func compileArchive(
 	}
 	defer cleanup()
 
+	// Compile sources in a canonical order, so the archive is the same when
+	// the same sources are listed in a different order.
+	srcs.sort()
+
+	// The output directory is where generated files of the package are, so
+	// they can be embedded. When the package is analyzed with nogo, it isn't
+	// compiled, and there's no archive.
+	outDir := filepath.Dir(outPath)
+	if nogoPath != "" {
+		outDir = filepath.Dir(outNogoFactsPath)
+	}
+
+	testDataPath := testDataRunDir != ""
 	if len(srcs.goSrcs) == 0 {
+		testDataPath = false
 		emptyPath := filepath.Join(workDir, "_empty.go")
 		if err := ioutil.WriteFile(emptyPath, []byte("package empty\n"), 0666); err != nil {
 			return err
@@ -225,7 +328,10 @@ func compileArchive(
 	}
 	haveCgo := len(cgoSrcs)+len(cSrcs)+len(cxxSrcs)+len(objcSrcs)+len(objcxxSrcs) > 0
 
-	// Instrument source files for coverage.
+	// Instrument source files for coverage. In the binary format, the files
+	// are instrumented together after the loop, and the compiler is given a
+	// config file describing the package's counters.
+	var coverageCfgPath string
 	if coverMode != "" {
 		shouldCover := make(map[string]bool)
 		for _, s := range coverSrcs {
@@ -236,24 +342,30 @@ func compileArchive(
 		if cgoEnabled {
 			combined = append(combined, cgoSrcs...)
 		}
+		var pkgCoverSrcs, pkgCoverOuts []string
 		for i, origSrc := range combined {
-			if !shouldCover[origSrc] {
+			if !shouldCover[origSrc] && coverMode != "testmain" {
 				continue
 			}
 
-			srcName := origSrc
-			if importPath != "" {
-				srcName = path.Join(importPath, filepath.Base(origSrc))
-			}
-
-			stem := filepath.Base(origSrc)
-			if ext := filepath.Ext(stem); ext != "" {
-				stem = stem[:len(stem)-len(ext)]
-			}
-			coverVar := fmt.Sprintf("Cover_%s_%d_%s", sanitizePathForIdentifier(importPath), i, sanitizePathForIdentifier(stem))
 			coverSrc := filepath.Join(workDir, fmt.Sprintf("cover_%d.go", i))
-			if err := instrumentForCoverage(goenv, origSrc, srcName, coverVar, coverMode, coverSrc); err != nil {
-				return err
+			if coverFormat == coverFormatBinary {
+				pkgCoverSrcs = append(pkgCoverSrcs, origSrc)
+				pkgCoverOuts = append(pkgCoverOuts, coverSrc)
+			} else {
+				srcName := origSrc
+				if importPath != "" {
+					srcName = path.Join(importPath, filepath.Base(origSrc))
+				}
+
+				stem := filepath.Base(origSrc)
+				if ext := filepath.Ext(stem); ext != "" {
+					stem = stem[:len(stem)-len(ext)]
+				}
+				coverVar := fmt.Sprintf("Cover_%s_%d_%s", sanitizePathForIdentifier(importPath), i, sanitizePathForIdentifier(stem))
+				if err := instrumentForCoverage(goenv, origSrc, srcName, coverVar, coverMode, coverSrc); err != nil {
+					return err
+				}
 			}
 
 			if i < len(goSrcs) {
@@ -262,6 +374,15 @@ func compileArchive(
 				cgoSrcs[i-len(goSrcs)] = coverSrc
 			}
 		}
+		if len(pkgCoverSrcs) > 0 {
+			coverVar := "goCover_" + sanitizePathForIdentifier(importPath)
+			varsPath, cfgPath, err := instrumentPackageForCoverage(goenv, pkgCoverSrcs, pkgCoverOuts, importPath, packageName, coverVar, coverMode, workDir)
+			if err != nil {
+				return err
+			}
+			goSrcs = append(goSrcs, varsPath)
+			coverageCfgPath = cfgPath
+		}
 	}
 
 	// If we have cgo, generate separate C and go files, and compile the
@@ -271,29 +392,94 @@ func compileArchive(
 		// TODO(#2006): Compile .s and .S files with cgo2, not the Go assembler.
 		// If cgo is not enabled or we don't have other cgo sources, don't
 		// compile .S files.
+		directives, err := readPkgConfigDirectives(build.Default, srcs.goSrcs)
+		if err != nil {
+			return err
+		}
+		pkgConfigCppFlags, pkgConfigLdFlags, err := runPkgConfig(pkgConfig, directives)
+		if err != nil {
+			return err
+		}
+		cppFlags = append(cppFlags, pkgConfigCppFlags...)
+		ldFlags = append(ldFlags, pkgConfigLdFlags...)
+
 		var srcDir string
-		srcDir, goSrcs, objFiles, err = cgo2(goenv, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, nil, hSrcs, packagePath, packageName, cc, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags, cgoExportHPath)
+		nGoSrcs := len(goSrcs)
+		srcDir, goSrcs, objFiles, err = cgo2(goenv, goSrcs, cgoSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, nil, hSrcs, pchHdr, packagePath, packageName, cc, cppFlags, cFlags, cxxFlags, objcFlags, objcxxFlags, ldFlags, cgoExportHPath, compileCommandsPath)
 		if err != nil {
 			return err
 		}
 
-		gcFlags = append(gcFlags, fmt.Sprintf("-trimpath=%s=>%s", abs(srcDir), packagePath))
+		if trimpathPrefix != "" && len(srcs.goSrcs) > 0 {
+			// cgo2 copies sources into srcDir. Show them as if they were still
+			// in their original directory.
+			relDir, err := filepath.Rel(abs("."), packageSrcDir(srcs.goSrcs))
+			if err != nil {
+				return err
+			}
+			gcFlags = append(gcFlags, fmt.Sprintf("-trimpath=%s=>%s", abs(srcDir), path.Join(trimpathPrefix, filepath.ToSlash(relDir))))
+		} else {
+			gcFlags = append(gcFlags, fmt.Sprintf("-trimpath=%s=>%s", abs(srcDir), packagePath))
+		}
+
+		// cgo2 returns the regular Go files followed by the generated ones.
+		if cgoGoSrcsPath != "" {
+			var genGoSrcs []string
+			if len(goSrcs) > nGoSrcs {
+				genGoSrcs = goSrcs[nGoSrcs:]
+			}
+			if err := copyCgoGoSrcs(cgoGoSrcsPath, genGoSrcs); err != nil {
+				return err
+			}
+		}
 	} else {
 		if cgoExportHPath != "" {
 			if err := ioutil.WriteFile(cgoExportHPath, nil, 0666); err != nil {
 				return err
 			}
 		}
+		if compileCommandsPath != "" {
+			if err := writeCompileCommands(compileCommandsPath, nil); err != nil {
+				return err
+			}
+		}
+		if cgoGoSrcsPath != "" {
+			if err := copyCgoGoSrcs(cgoGoSrcsPath, nil); err != nil {
+				return err
+			}
+		}
 		// We want the source files to show up (e.g. in stack traces) with the package
 		// path. We use -trimpath to replace the root path with the correct prefix
-		// of the package path.
+		// of the package path. If a trimpath prefix is set, we replace the root
+		// path with that instead, so paths are relative to the execution root.
 		root := abs(".")
-		relSrcPath, err := filepath.Rel(root, srcs.goSrcs[0].filename)
+		if trimpathPrefix != "" {
+			gcFlags = append(gcFlags, fmt.Sprintf("-trimpath=%s=>%s", root, trimpathPrefix))
+		} else {
+			relSrcDir, err := filepath.Rel(root, packageSrcDir(srcs.goSrcs))
+			if err != nil {
+				return err
+			}
+			rootPkgPath := filepath.Clean(strings.TrimSuffix(packagePath, relSrcDir))
+			gcFlags = append(gcFlags, fmt.Sprintf("-trimpath=%s=>%s", root, rootPkgPath))
+		}
+	}
+
+	// Test packages may get a generated TestDataPath function for finding
+	// data files in runfiles, unless they declare the same names.
+	if testDataPath {
+		declared, err := declaresTestDataPathNames(srcs.goSrcs)
+		if err != nil {
+			return err
+		}
+		testDataPath = !declared
+	}
+	if testDataPath {
+		testDataPathFile, err := writeTestDataPathFile(workDir, packageName, testDataRunDir)
 		if err != nil {
 			return err
 		}
-		rootPkgPath := filepath.Clean(strings.TrimSuffix(packagePath, filepath.Dir(relSrcPath)))
-		gcFlags = append(gcFlags, fmt.Sprintf("-trimpath=%s=>%s", root, rootPkgPath))
+		goSrcs = append(goSrcs, testDataPathFile)
 	}
 
 	// Check that the filtered sources don't import anything outside of
@@ -302,16 +488,27 @@ func compileArchive(
 	if err != nil {
 		return err
 	}
+	if testDataPath {
+		for _, imp := range testDataPathImports {
+			imports[imp] = nil
+		}
+	}
 	if cgoEnabled && len(cgoSrcs) != 0 {
 		// cgo generated code imports some extra packages.
 		imports["runtime/cgo"] = nil
 		imports["syscall"] = nil
 		imports["unsafe"] = nil
 	}
-	if coverMode != "" {
-		if coverMode == "atomic" {
-			imports["sync/atomic"] = nil
-		}
+	if coverMode == "atomic" {
+		imports["sync/atomic"] = nil
+	}
+	if coverMode != "" && coverFormat == coverFormatBinary && packagePath == "main" {
+		// The compiler adds a call to the runtime's coverage hooks to main.
+		imports["runtime/coverage"] = nil
+	}
+	if coverMode != "" && coverFormat == coverFormatText {
+		// Files instrumented in the text format register themselves with
+		// coverdata. In the binary format, the runtime keeps track of them.
 		const coverdataPath = "github.com/bazelbuild/rules_go/go/tools/coverdata"
 		var coverdata *archive
 		for i := range deps {
@@ -327,7 +524,7 @@ func compileArchive(
 	}
 
 	// Build an importcfg file for the compiler.
-	importcfgPath, err := buildImportcfgFileForCompile(imports, goenv.installSuffix, filepath.Dir(outPath))
+	importcfgPath, err := buildImportcfgFileForCompile(imports, goenv.installSuffix, outDir)
 	if err != nil {
 		return err
 	}
@@ -340,9 +537,11 @@ func compileArchive(
 	// relative to the source file. Usually, there are two roots: the source
 	// directory, and the output directory (so that generated files are
 	// embeddable). There may be additional roots if sources are in multiple
-	// directories (like if there are are generated source files).
+	// directories (like if there are are generated source files). Roots given
+	// with -embedroot come first, so files in them are matched relative to
+	// them, even if they're also in another root.
 	var srcDirs []string
-	srcDirs = append(srcDirs, filepath.Dir(outPath))
+	srcDirs = append(srcDirs, outDir)
 	for _, src := range srcs.goSrcs {
 		srcDirs = append(srcDirs, filepath.Dir(src.filename))
 	}
@@ -356,6 +555,7 @@ func compileArchive(
 		}
 		embedRootDirs = append(embedRootDirs, dir)
 	}
+	embedRootDirs = append(append([]string{}, embedRoots...), embedRootDirs...)
 	embedcfgPath, err := buildEmbedcfgFile(srcs.goSrcs, embedSrcs, embedRootDirs, workDir)
 	if err != nil {
 		return err
@@ -364,21 +564,26 @@ func compileArchive(
 		defer os.Remove(embedcfgPath)
 	}
 
-	// Run nogo concurrently.
-	var nogoChan chan error
-	outFactsPath := filepath.Join(workDir, nogoFact)
+	// Analyze the package with nogo instead of compiling it. This runs in a
+	// separate action, so compiled packages don't depend on the nogo binary
+	// or its configuration, and changing them doesn't recompile anything.
 	if nogoPath != "" {
-		ctx, cancel := context.WithCancel(context.Background())
-		nogoChan = make(chan error)
-		go func() {
-			nogoChan <- runNogo(ctx, workDir, nogoPath, goSrcs, deps, packagePath, importcfgPath, outFactsPath)
-		}()
-		defer func() {
-			if nogoChan != nil {
-				cancel()
-				<-nogoChan
-			}
-		}()
+		factsPath := filepath.Join(workDir, nogoFact)
+		writeBaselinePath := ""
+		if nogoGenerateBaseline {
+			writeBaselinePath = outNogoValidationPath
+		}
+		if err := runNogo(workDir, nogoPath, nogoConfigPath, nogoBaselinePath, writeBaselinePath, goSrcs, nogoFacts, packagePath, importcfgPath, factsPath); err != nil {
+			return err
+		}
+		if err := appendFiles(goenv, outNogoFactsPath, []string{factsPath}); err != nil {
+			return err
+		}
+		if nogoGenerateBaseline {
+			// nogo wrote the package's findings to the validation file.
+			return nil
+		}
+		return ioutil.WriteFile(outNogoValidationPath, nil, 0666)
 	}
 
 	// If there are assembly files, and this is go1.12+, generate symbol ABIs.
@@ -394,62 +599,71 @@ func compileArchive(
 		return err
 	}
 
-	// Compile the filtered .go files.
+	// Compile the filtered .go files. Functions implemented in assembly, C,
+	// or .syso files are declared in Go without bodies, so -complete from
+	// gc_goopts is dropped for packages with those sources. Otherwise, the
+	// compiler would report the missing function bodies.
+	if len(srcs.sSrcs) > 0 || len(srcs.sysoSrcs) > 0 || haveCgo {
+		gcFlags = removeCompleteFlag(gcFlags)
+	}
+
+	// The compiler registers packages instrumented in the binary coverage
+	// format with the runtime.
+	if coverageCfgPath != "" {
+		gcFlags = append(gcFlags, "-coveragecfg="+coverageCfgPath)
+	}
+
+	// Most of the compiler's work on a package happens on one thread, but its
+	// backend can compile functions concurrently. Very large packages still
+	// compile slowly, so with -v, suggest splitting them.
+	gcFlags = concurrencyFlags(gcFlags, runtime.GOMAXPROCS(0))
+	if goenv.verbose && len(goSrcs) > largePackageFileCount {
+		fmt.Fprintf(os.Stderr, "package %s has %d Go files and may compile slowly; consider splitting it into smaller packages, which can be compiled in parallel\n", packagePath, len(goSrcs))
+	}
 	if err := compileGo(goenv, goSrcs, packagePath, importcfgPath, embedcfgPath, asmHdrPath, symabisPath, gcFlags, outPath); err != nil {
+		if explanation := explainConflictingDecls(srcs.goSrcs, srcLabels); explanation != "" {
+			return fmt.Errorf("%v\n%s", err, explanation)
+		}
 		return err
 	}
 
 	// Compile the .s files.
 	if len(srcs.sSrcs) > 0 {
-		includeSet := map[string]struct{}{
-			filepath.Join(os.Getenv("GOROOT"), "pkg", "include"): struct{}{},
-			workDir: struct{}{},
-		}
-		for _, hdr := range srcs.hSrcs {
-			includeSet[filepath.Dir(hdr.filename)] = struct{}{}
-		}
-		includes := make([]string, len(includeSet))
-		for inc := range includeSet {
-			includes = append(includes, inc)
-		}
-		sort.Strings(includes)
-		for _, inc := range includes {
+		// The compiler wrote go_asm.h above, so it's complete by now.
+		for _, inc := range asmIncludeDirs(filepath.Dir(asmHdrPath), srcs.hSrcs) {
 			asmFlags = append(asmFlags, "-I", inc)
 		}
+		asmTrimpath := "."
+		if trimpathPrefix != "" {
+			asmTrimpath = abs(".") + "=>" + trimpathPrefix
+		}
 		for i, sSrc := range srcs.sSrcs {
 			obj := filepath.Join(workDir, fmt.Sprintf("s%d.o", i))
-			if err := asmFile(goenv, sSrc.filename, asmFlags, obj); err != nil {
+			if err := asmFile(goenv, sSrc.filename, asmFlags, asmTrimpath, obj); err != nil {
 				return err
 			}
 			objFiles = append(objFiles, obj)
 		}
 	}
 
+	// Prebuilt .syso files are packed into the archive as they are, like the
+	// go command does. The linker loads them with the other object files.
+	for _, syso := range srcs.sysoSrcs {
+		objFiles = append(objFiles, syso.filename)
+	}
+
 	// Pack .o files into the archive. These may come from cgo generated code,
-	// cgo dependencies (cdeps), or assembly.
+	// cgo dependencies (cdeps), assembly, or .syso files.
 	if len(objFiles) > 0 {
 		if err := appendFiles(goenv, outPath, objFiles); err != nil {
 			return err
 		}
 	}
 
-	// Check results from nogo.
-	nogoStatus := nogoNotRun
-	if nogoChan != nil {
-		err := <-nogoChan
-		nogoChan = nil // no cancellation needed
-		if err != nil {
-			nogoStatus = nogoFailed
-			// TODO: should we still create the .x file without nogo facts in this case?
-			return err
-		}
-		nogoStatus = nogoSucceeded
-	}
-
-	// Extract the export data file and pack it in an .x archive together with the
-	// nogo facts file (if there is one). This allows compile actions to depend
-	// on .x files only, so we don't need to recompile a package when one of its
-	// imports changes in a way that doesn't affect export data.
+	// Extract the export data file and pack it in an .x archive. This allows
+	// compile actions to depend on .x files only, so we don't need to recompile
+	// a package when one of its imports changes in a way that doesn't affect
+	// export data.
 	// TODO(golang/go#33820): After Go 1.16 is the minimum supported version,
 	// use -linkobj to tell the compiler to create separate .a and .x files for
 	// compiled code and export data. Before that version, the linker needed
@@ -459,12 +673,24 @@ func compileArchive(
 		return err
 	}
 	pkgDefPath := filepath.Join(workDir, pkgDef)
-	if nogoStatus == nogoSucceeded {
-		return appendFiles(goenv, outXPath, []string{pkgDefPath, outFactsPath})
-	}
 	return appendFiles(goenv, outXPath, []string{pkgDefPath})
 }
 
+// copyCgoGoSrcs copies Go files generated by cgo into dir, so tools like
+// gopackagesdriver can report them as compiled files. dir is created if it
+// doesn't exist.
+func copyCgoGoSrcs(dir string, genGoSrcs []string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	for _, src := range genGoSrcs {
+		if err := copyFile(src, filepath.Join(dir, filepath.Base(src))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func compileGo(goenv *env, srcs []string, packagePath, importcfgPath, embedcfgPath, asmHdrPath, symabisPath string, gcFlags []string, outPath string) error {
 	args := goenv.goTool("compile")
 	args = append(args, "-p", packagePath, "-importcfg", importcfgPath, "-pack")
@@ -485,12 +711,149 @@ func compileGo(goenv *env, srcs []string, packagePath, importcfgPath, embedcfgPa
 	return goenv.runCommand(args)
 }
 
-func runNogo(ctx context.Context, workDir string, nogoPath string, srcs []string, deps []archive, packagePath, importcfgPath, outFactsPath string) error {
+// removeCompleteFlag returns gcFlags without -complete.
+func removeCompleteFlag(gcFlags []string) []string {
+	var flags []string
+	for _, f := range gcFlags {
+		if f != "-complete" && f != "-complete=true" {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// maxCompilerConcurrency is the largest number of functions the compiler
+// backend compiles concurrently. Like "go build", this is capped, since Bazel
+// usually runs several compile actions at the same time.
+const maxCompilerConcurrency = 4
+
+// largePackageFileCount is the number of Go files above which a package is
+// reported as large enough to be worth splitting, in verbose mode.
+const largePackageFileCount = 1000
+
+// concurrencyFlags returns gcFlags with -c=n added, where n is the number of
+// functions the compiler backend should compile concurrently: maxProcs, up to
+// maxCompilerConcurrency. gcFlags is returned unchanged if it already sets -c
+// or if concurrent compilation is disabled with GO19CONCURRENTCOMPILATION=0,
+// as "go build" does.
+func concurrencyFlags(gcFlags []string, maxProcs int) []string {
+	for _, f := range gcFlags {
+		if f == "-c" || strings.HasPrefix(f, "-c=") {
+			return gcFlags
+		}
+	}
+	if os.Getenv("GO19CONCURRENTCOMPILATION") == "0" {
+		return gcFlags
+	}
+	c := maxProcs
+	if c > maxCompilerConcurrency {
+		c = maxCompilerConcurrency
+	}
+	if c <= 1 {
+		return gcFlags
+	}
+	flags := append([]string(nil), gcFlags...)
+	return append(flags, "-c="+strconv.Itoa(c))
+}
+
+// explainConflictingDecls looks for package-level names declared in more
+// than one of srcs, where the declaring files were provided by different
+// targets (typically a library and the libraries it embeds). The compiler
+// reports these as redeclarations without saying where the files came from,
+// so this returns a description of each conflict naming the targets. It
+// returns "" if there are no such conflicts. This is only called after
+// compilation fails, since it parses every file.
+func explainConflictingDecls(srcs []fileInfo, srcLabels map[string]string) string {
+	type decl struct {
+		filename, label string
+	}
+	var names []string
+	declsByName := make(map[string][]decl)
+	fset := token.NewFileSet()
+	for _, src := range srcs {
+		label, ok := srcLabels[src.filename]
+		if !ok {
+			continue
+		}
+		f, err := parser.ParseFile(fset, src.filename, nil, 0)
+		if err != nil {
+			// The compiler has already reported syntax errors.
+			continue
+		}
+		addDecl := func(name *ast.Ident) {
+			if name.Name == "_" {
+				return
+			}
+			if _, ok := declsByName[name.Name]; !ok {
+				names = append(names, name.Name)
+			}
+			declsByName[name.Name] = append(declsByName[name.Name], decl{src.filename, label})
+		}
+		for _, d := range f.Decls {
+			switch d := d.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil && d.Name.Name != "init" {
+					addDecl(d.Name)
+				}
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch spec := spec.(type) {
+					case *ast.TypeSpec:
+						addDecl(spec.Name)
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							addDecl(name)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	explanation := &bytes.Buffer{}
+	for _, name := range names {
+		decls := declsByName[name]
+		conflict := false
+		for _, d := range decls[1:] {
+			if d.label != decls[0].label {
+				conflict = true
+				break
+			}
+		}
+		if !conflict {
+			continue
+		}
+		if explanation.Len() == 0 {
+			explanation.WriteString("package-level names are declared in sources from more than one target:\n")
+		}
+		fmt.Fprintf(explanation, "\t%s is declared in:\n", name)
+		for _, d := range decls {
+			fmt.Fprintf(explanation, "\t\t%s (from %s)\n", d.filename, d.label)
+		}
+	}
+	return string(relativizePaths(explanation.Bytes()))
+}
+
+func runNogo(workDir string, nogoPath, nogoConfigPath, nogoBaselinePath, writeBaselinePath string, srcs []string, facts map[string]string, packagePath, importcfgPath, outFactsPath string) error {
 	args := []string{nogoPath}
 	args = append(args, "-p", packagePath)
 	args = append(args, "-importcfg", importcfgPath)
-	for _, dep := range deps {
-		args = append(args, "-fact", fmt.Sprintf("%s=%s", dep.importPath, dep.file))
+	if nogoConfigPath != "" {
+		args = append(args, "-config", nogoConfigPath)
+	}
+	if nogoBaselinePath != "" {
+		args = append(args, "-baseline", nogoBaselinePath)
+	}
+	if writeBaselinePath != "" {
+		args = append(args, "-write_baseline", writeBaselinePath)
+	}
+	factImportPaths := make([]string, 0, len(facts))
+	for importPath := range facts {
+		factImportPaths = append(factImportPaths, importPath)
+	}
+	sort.Strings(factImportPaths)
+	for _, importPath := range factImportPaths {
+		args = append(args, "-fact", fmt.Sprintf("%s=%s", importPath, facts[importPath]))
 	}
 	args = append(args, "-x", outFactsPath)
 	args = append(args, srcs...)
@@ -500,7 +863,7 @@ func runNogo(ctx context.Context, workDir string, nogoPath string, srcs []string
 		return fmt.Errorf("error writing nogo params file: %v", err)
 	}
 
-	cmd := exec.CommandContext(ctx, args[0], "-param="+paramsFile)
+	cmd := exec.Command(args[0], "-param="+paramsFile)
 	out := &bytes.Buffer{}
 	cmd.Stdout, cmd.Stderr = out, out
 	if err := cmd.Run(); err != nil {
@@ -517,6 +880,10 @@ func runNogo(ctx context.Context, workDir string, nogoPath string, srcs []string
 			return fmt.Errorf("error running nogo: %v", err)
 		}
 	}
+	if out.Len() != 0 {
+		// nogo succeeded but printed warnings. Pass them on to the build log.
+		os.Stderr.Write(relativizePaths(out.Bytes()))
+	}
 	return nil
 }
 
@@ -0,0 +1,120 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestConcurrencyFlags(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		gcFlags  []string
+		maxProcs int
+		disable  bool
+		want     []string
+	}{
+		{
+			desc:     "few_cpus",
+			gcFlags:  []string{"-shared"},
+			maxProcs: 2,
+			want:     []string{"-shared", "-c=2"},
+		}, {
+			desc:     "many_cpus",
+			maxProcs: 64,
+			want:     []string{"-c=4"},
+		}, {
+			desc:     "one_cpu",
+			gcFlags:  []string{"-shared"},
+			maxProcs: 1,
+			want:     []string{"-shared"},
+		}, {
+			desc:     "explicit",
+			gcFlags:  []string{"-c=1", "-shared"},
+			maxProcs: 8,
+			want:     []string{"-c=1", "-shared"},
+		}, {
+			desc:     "explicit_separate",
+			gcFlags:  []string{"-c", "8"},
+			maxProcs: 2,
+			want:     []string{"-c", "8"},
+		}, {
+			desc:     "disabled",
+			gcFlags:  []string{"-shared"},
+			maxProcs: 8,
+			disable:  true,
+			want:     []string{"-shared"},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if old, ok := os.LookupEnv("GO19CONCURRENTCOMPILATION"); ok {
+				defer os.Setenv("GO19CONCURRENTCOMPILATION", old)
+			} else {
+				defer os.Unsetenv("GO19CONCURRENTCOMPILATION")
+			}
+			if test.disable {
+				os.Setenv("GO19CONCURRENTCOMPILATION", "0")
+			} else {
+				os.Unsetenv("GO19CONCURRENTCOMPILATION")
+			}
+
+			gcFlags := append([]string(nil), test.gcFlags...)
+			got := concurrencyFlags(gcFlags, test.maxProcs)
+			if len(got) == 0 {
+				got = nil
+			}
+			want := test.want
+			if len(want) == 0 {
+				want = nil
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q; want %q", got, want)
+			}
+			if !reflect.DeepEqual(gcFlags, test.gcFlags) {
+				t.Errorf("gcFlags was modified: got %q; want %q", gcFlags, test.gcFlags)
+			}
+		})
+	}
+}
+
+func TestRemoveCompleteFlag(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		gcFlags []string
+		want    []string
+	}{
+		{
+			desc:    "none",
+			gcFlags: []string{"-shared"},
+			want:    []string{"-shared"},
+		}, {
+			desc:    "complete",
+			gcFlags: []string{"-complete", "-shared"},
+			want:    []string{"-shared"},
+		}, {
+			desc:    "complete_true",
+			gcFlags: []string{"-shared", "-complete=true"},
+			want:    []string{"-shared"},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if got := removeCompleteFlag(test.gcFlags); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -16,15 +16,39 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"go/build"
 	"go/format"
 	"go/parser"
 	"go/token"
 	"io/ioutil"
+	"path/filepath"
 	"strconv"
+	"strings"
 )
 
+// Coverage formats accepted by -cover_format. In the text format, files are
+// registered with the coverdata package, and the test writes a profile like
+// "go test -coverprofile". In the binary format, which needs Go 1.20 or
+// later, the runtime writes covmeta and covcounters files to $GOCOVERDIR,
+// which "go tool covdata" reads.
+const (
+	coverFormatText   = "text"
+	coverFormatBinary = "binary"
+)
+
+// coverPkgConfig is the configuration read by "go tool cover -pkgcfg". It
+// has the fields of CoverPkgConfig in cmd/internal/cov/covcmd that are set
+// by the Go command.
+type coverPkgConfig struct {
+	OutConfig   string
+	PkgPath     string
+	PkgName     string
+	Granularity string
+}
+
 // cover transforms a source file with "go tool cover". It is invoked by the
 // Go rules as an action.
 func cover(args []string) error {
@@ -74,6 +98,83 @@ func instrumentForCoverage(goenv *env, srcPath, srcName, coverVar, mode, outPath
 	return registerCoverage(outPath, coverVar, srcName)
 }
 
+// instrumentPackageForCoverage runs "go tool cover" on source files of a
+// package to produce versions of the files instrumented for the binary
+// coverage format, written to outPaths. Files aren't registered with the
+// coverdata package. Instead, the compiler registers the package with the
+// runtime when it's given the returned -coveragecfg file. The returned
+// vars file declares the package's counters and must be compiled with it.
+//
+// In "testmain" mode, files aren't instrumented. The config only tells the
+// compiler to write coverage data for the other packages when a test exits.
+func instrumentPackageForCoverage(goenv *env, srcPaths, outPaths []string, pkgPath, pkgName, coverVar, mode, dir string) (varsPath, cfgPath string, err error) {
+	if !coverFormatBinarySupported() {
+		return "", "", fmt.Errorf("the %s coverage format requires Go 1.20 or later", coverFormatBinary)
+	}
+	varsPath = filepath.Join(dir, "cover_vars.go")
+	cfgPath = filepath.Join(dir, "coveragecfg")
+	pkgcfg, err := json.Marshal(coverPkgConfig{
+		OutConfig:   cfgPath,
+		PkgPath:     pkgPath,
+		PkgName:     pkgName,
+		Granularity: "perblock",
+	})
+	if err != nil {
+		return "", "", err
+	}
+	pkgcfgPath := filepath.Join(dir, "cover_pkgcfg.json")
+	if err := ioutil.WriteFile(pkgcfgPath, pkgcfg, 0666); err != nil {
+		return "", "", err
+	}
+	outList := strings.Join(append([]string{varsPath}, outPaths...), "\n") + "\n"
+	outListPath := filepath.Join(dir, "cover_outfiles.txt")
+	if err := ioutil.WriteFile(outListPath, []byte(outList), 0666); err != nil {
+		return "", "", err
+	}
+
+	goargs := goenv.goTool("cover", "-pkgcfg", pkgcfgPath, "-mode", mode, "-var", coverVar, "-outfilelist", outListPath)
+	goargs = append(goargs, srcPaths...)
+	if err := goenv.runCommand(goargs); err != nil {
+		return "", "", err
+	}
+	return varsPath, cfgPath, nil
+}
+
+// coverFormatBinarySupported reports whether the cover tool and compiler
+// support the binary coverage format, which was added in Go 1.20.
+func coverFormatBinarySupported() bool {
+	for _, t := range build.Default.ReleaseTags {
+		if t == "go1.20" {
+			return true
+		}
+	}
+	return false
+}
+
+// filterCoverSrcs returns the files in srcs whose base names don't match any
+// of the glob patterns in exclude. These are usually generated files, like
+// .pb.go files, which only add uncovered lines to coverage reports.
+func filterCoverSrcs(srcs, exclude []string) ([]string, error) {
+	var filtered []string
+	for _, src := range srcs {
+		excluded := false
+		for _, pattern := range exclude {
+			matched, err := filepath.Match(pattern, filepath.Base(src))
+			if err != nil {
+				return nil, fmt.Errorf("invalid coverage exclusion pattern %q: %v", pattern, err)
+			}
+			if matched {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			filtered = append(filtered, src)
+		}
+	}
+	return filtered, nil
+}
+
 // registerCoverage modifies coverSrc, the output file from go tool cover. It
 // adds a call to coverdata.RegisterCoverage, which ensures the coverage
 // data from each file is reported. The name by which the file is registered
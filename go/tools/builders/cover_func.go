@@ -0,0 +1,190 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// coverFunc rolls up the blocks in one or more coverage profiles into the
+// percentage of statements covered in each function, and writes a report in
+// the format of "go tool cover -func". Profiles are merged as by coverMerge
+// first. Functions are found by parsing source files, given with -src as
+// the file name in the profile and the path of the file, separated by '='.
+func coverFunc(args []string) error {
+	flags := flag.NewFlagSet("coverfunc", flag.ExitOnError)
+	var srcs multiFlag
+	out := flags.String("o", "", "per-function coverage report")
+	flags.Var(&srcs, "src", "File name in the coverage profile and path of the source file, separated by '='")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("-o was not set")
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no coverage profiles to read")
+	}
+	srcPaths := make(map[string]string)
+	for _, src := range srcs {
+		i := strings.LastIndexByte(src, '=')
+		if i < 0 {
+			return fmt.Errorf("-src %q: expected name=path", src)
+		}
+		srcPaths[src[:i]] = src[i+1:]
+	}
+
+	merged := &coverProfile{counts: make(map[coverBlock]int)}
+	for _, path := range flags.Args() {
+		p, err := readCoverProfile(path)
+		if err != nil {
+			return err
+		}
+		if err := merged.merge(p); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	funcs, err := rollUpFuncCoverage(merged, srcPaths)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*out, formatFuncCoverage(funcs), 0666)
+}
+
+// funcCoverage is the number of statements in a function, and the number of
+// those that were covered.
+type funcCoverage struct {
+	file             string
+	line             int
+	name             string
+	covered, numStmt int
+}
+
+// percent returns the percentage of statements covered. A function without
+// statements, like an empty function, has nothing left to cover, so it's
+// reported as fully covered. "go tool cover -func" reports these as 0%.
+func (f funcCoverage) percent() float64 {
+	if f.numStmt == 0 {
+		return 100
+	}
+	return 100 * float64(f.covered) / float64(f.numStmt)
+}
+
+// rollUpFuncCoverage returns the coverage of each function declared in the
+// files of p, sorted by file and line. Each file in p must be named in
+// srcPaths. A block is attributed to the function declaration containing it.
+// Blocks outside function declarations, like those in function literals in
+// package-level variables, are not counted, as in "go tool cover -func".
+func rollUpFuncCoverage(p *coverProfile, srcPaths map[string]string) ([]funcCoverage, error) {
+	blocksByFile := make(map[string][]coverBlock)
+	for b := range p.counts {
+		blocksByFile[b.file] = append(blocksByFile[b.file], b)
+	}
+	files := make([]string, 0, len(blocksByFile))
+	for file := range blocksByFile {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var funcs []funcCoverage
+	for _, file := range files {
+		path, ok := srcPaths[file]
+		if !ok {
+			return nil, fmt.Errorf("no source file given for %s in coverage profile", file)
+		}
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, decl := range f.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Body == nil {
+				continue
+			}
+			start, end := fset.Position(fn.Pos()), fset.Position(fn.End())
+			fc := funcCoverage{file: file, line: start.Line, name: funcName(fn)}
+			for _, b := range blocksByFile[file] {
+				if !positionBefore(start.Line, start.Column, b.startLine, b.startCol) ||
+					!positionBefore(b.endLine, b.endCol, end.Line, end.Column) {
+					continue
+				}
+				fc.numStmt += b.numStmt
+				if p.counts[b] > 0 {
+					fc.covered += b.numStmt
+				}
+			}
+			funcs = append(funcs, fc)
+		}
+	}
+	return funcs, nil
+}
+
+// positionBefore reports whether line1.col1 is at or before line2.col2.
+func positionBefore(line1, col1, line2, col2 int) bool {
+	return line1 < line2 || line1 == line2 && col1 <= col2
+}
+
+// funcName returns the name of a function, with its receiver type for
+// methods, like "(*T).M" or "T.M".
+func funcName(fn *ast.FuncDecl) string {
+	if fn.Recv == nil || len(fn.Recv.List) == 0 {
+		return fn.Name.Name
+	}
+	typ := fn.Recv.List[0].Type
+	pointer := false
+	if star, ok := typ.(*ast.StarExpr); ok {
+		pointer = true
+		typ = star.X
+	}
+	// Drop type parameters from generic receivers.
+	if index, ok := typ.(*ast.IndexExpr); ok {
+		typ = index.X
+	}
+	name := "?"
+	if id, ok := typ.(*ast.Ident); ok {
+		name = id.Name
+	}
+	if pointer {
+		return fmt.Sprintf("(*%s).%s", name, fn.Name.Name)
+	}
+	return fmt.Sprintf("%s.%s", name, fn.Name.Name)
+}
+
+// formatFuncCoverage formats a report like "go tool cover -func", with a line
+// for each function and a line with the percentage of statements covered in
+// all of them.
+func formatFuncCoverage(funcs []funcCoverage) []byte {
+	buf := &bytes.Buffer{}
+	w := tabwriter.NewWriter(buf, 0, 8, 1, '\t', 0)
+	total := funcCoverage{}
+	for _, f := range funcs {
+		fmt.Fprintf(w, "%s:%d:\t%s\t%.1f%%\n", f.file, f.line, f.name, f.percent())
+		total.covered += f.covered
+		total.numStmt += f.numStmt
+	}
+	fmt.Fprintf(w, "total:\t(statements)\t%.1f%%\n", total.percent())
+	w.Flush()
+	return buf.Bytes()
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const coverFuncSrc = `package a
+
+func A(x int) int {
+	if x > 0 {
+		return 1
+	}
+	return 0
+}
+
+type T struct{}
+
+func (t *T) M() {
+	println("m")
+}
+
+func (T) V() {}
+`
+
+func TestCoverFunc(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		profiles []string
+		noSrc    bool
+		want     string
+		wantErr  string
+	}{
+		{
+			desc: "single",
+			profiles: []string{
+				`mode: set
+example.com/a/a.go:3.19,4.11 1 1
+example.com/a/a.go:4.11,6.3 1 0
+example.com/a/a.go:6.3,7.10 1 1
+example.com/a/a.go:12.17,14.2 1 0
+`,
+			},
+			want: `example.com/a/a.go:3:	A		66.7%
+example.com/a/a.go:12:	(*T).M		0.0%
+example.com/a/a.go:16:	T.V		100.0%
+total:			(statements)	50.0%
+`,
+		}, {
+			desc: "merged",
+			profiles: []string{
+				`mode: count
+example.com/a/a.go:3.19,4.11 1 1
+example.com/a/a.go:4.11,6.3 1 0
+example.com/a/a.go:6.3,7.10 1 1
+example.com/a/a.go:12.17,14.2 1 0
+`,
+				`mode: count
+example.com/a/a.go:3.19,4.11 1 2
+example.com/a/a.go:4.11,6.3 1 2
+example.com/a/a.go:12.17,14.2 1 3
+`,
+			},
+			want: `example.com/a/a.go:3:	A		100.0%
+example.com/a/a.go:12:	(*T).M		100.0%
+example.com/a/a.go:16:	T.V		100.0%
+total:			(statements)	100.0%
+`,
+		}, {
+			desc: "missing_src",
+			profiles: []string{
+				`mode: set
+example.com/a/a.go:3.19,4.11 1 1
+`,
+			},
+			noSrc:   true,
+			wantErr: "no source file given for example.com/a/a.go",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cover_func_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			srcPath := filepath.Join(dir, "a.go")
+			if err := ioutil.WriteFile(srcPath, []byte(coverFuncSrc), 0666); err != nil {
+				t.Fatal(err)
+			}
+			args := []string{"-o", filepath.Join(dir, "func.txt")}
+			if !test.noSrc {
+				args = append(args, "-src", "example.com/a/a.go="+srcPath)
+			}
+			for i, profile := range test.profiles {
+				path := filepath.Join(dir, fmt.Sprintf("profile%d.out", i))
+				if err := ioutil.WriteFile(path, []byte(profile), 0666); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, path)
+			}
+			err = coverFunc(args)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v; want error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(dir, "func.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
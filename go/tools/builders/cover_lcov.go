@@ -0,0 +1,201 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// coverLcov converts one or more coverage profiles into the lcov tracefile
+// format read by coverage viewers like genhtml, Codecov, and Coveralls.
+// Profiles are merged as by coverMerge first. Source files are given with
+// -src as the file name in the profile and the path of the file, relative to
+// the repository root, separated by '='. That path is reported for the file
+// instead of its name in the profile, and the file is parsed to report the
+// coverage of its functions. Files without -src are reported by their names
+// in the profile, with line coverage only.
+func coverLcov(args []string) error {
+	flags := flag.NewFlagSet("coverlcov", flag.ExitOnError)
+	var srcs multiFlag
+	out := flags.String("o", "", "lcov tracefile")
+	flags.Var(&srcs, "src", "File name in the coverage profile and repository-relative path of the source file, separated by '='")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("-o was not set")
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no coverage profiles to read")
+	}
+	srcPaths := make(map[string]string)
+	for _, src := range srcs {
+		i := strings.LastIndexByte(src, '=')
+		if i < 0 {
+			return fmt.Errorf("-src %q: expected name=path", src)
+		}
+		srcPaths[src[:i]] = src[i+1:]
+	}
+
+	merged := &coverProfile{counts: make(map[coverBlock]int)}
+	for _, path := range flags.Args() {
+		p, err := readCoverProfile(path)
+		if err != nil {
+			return err
+		}
+		if err := merged.merge(p); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	files, err := lcovFiles(merged, srcPaths)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*out, formatLcov(files), 0666)
+}
+
+// lcovFile is the coverage of a source file, as recorded in an lcov
+// tracefile.
+type lcovFile struct {
+	// path is the file's repository-relative path, or its name in the
+	// profile if its path wasn't given.
+	path string
+
+	// funcs are the functions declared in the file, in order.
+	funcs []lcovFunc
+
+	// lines maps line numbers to the number of times they were executed.
+	// Lines without statements are not included.
+	lines map[int]int
+}
+
+// lcovFunc is the coverage of a function declaration. count is the number of
+// times the function was executed, which is the count of its first block.
+type lcovFunc struct {
+	name        string
+	line, count int
+}
+
+// lcovFiles returns the coverage of each file in p, sorted by path. A line's
+// count is the highest count of the blocks that include it, so a line is hit
+// if any statement on it was executed.
+func lcovFiles(p *coverProfile, srcPaths map[string]string) ([]lcovFile, error) {
+	blocksByFile := make(map[string][]coverBlock)
+	for b := range p.counts {
+		blocksByFile[b.file] = append(blocksByFile[b.file], b)
+	}
+
+	var files []lcovFile
+	for name, blocks := range blocksByFile {
+		sort.Slice(blocks, func(i, j int) bool {
+			if blocks[i].startLine != blocks[j].startLine {
+				return blocks[i].startLine < blocks[j].startLine
+			}
+			return blocks[i].startCol < blocks[j].startCol
+		})
+		f := lcovFile{path: name, lines: make(map[int]int)}
+		for _, b := range blocks {
+			count := p.counts[b]
+			for line := b.startLine; line <= b.endLine; line++ {
+				if c, ok := f.lines[line]; !ok || count > c {
+					f.lines[line] = count
+				}
+			}
+		}
+		if path, ok := srcPaths[name]; ok {
+			f.path = path
+			funcs, err := lcovFuncs(path, blocks, p.counts)
+			if err != nil {
+				return nil, err
+			}
+			f.funcs = funcs
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+	return files, nil
+}
+
+// lcovFuncs parses the source file at path and returns the coverage of the
+// functions it declares. blocks are the file's blocks, sorted by position.
+func lcovFuncs(path string, blocks []coverBlock, counts map[coverBlock]int) ([]lcovFunc, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	var funcs []lcovFunc
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Body == nil {
+			continue
+		}
+		start, end := fset.Position(fn.Pos()), fset.Position(fn.End())
+		lf := lcovFunc{name: funcName(fn), line: start.Line}
+		for _, b := range blocks {
+			if positionBefore(start.Line, start.Column, b.startLine, b.startCol) &&
+				positionBefore(b.endLine, b.endCol, end.Line, end.Column) {
+				lf.count = counts[b]
+				break
+			}
+		}
+		funcs = append(funcs, lf)
+	}
+	return funcs, nil
+}
+
+// formatLcov formats files as an lcov tracefile. Each file has a record with
+// its functions (FN, FNDA, FNF, and FNH) and lines (DA, LF, and LH).
+func formatLcov(files []lcovFile) []byte {
+	buf := &bytes.Buffer{}
+	for _, f := range files {
+		fmt.Fprintf(buf, "SF:%s\n", f.path)
+		fnHit := 0
+		for _, fn := range f.funcs {
+			fmt.Fprintf(buf, "FN:%d,%s\n", fn.line, fn.name)
+		}
+		for _, fn := range f.funcs {
+			fmt.Fprintf(buf, "FNDA:%d,%s\n", fn.count, fn.name)
+			if fn.count > 0 {
+				fnHit++
+			}
+		}
+		if len(f.funcs) > 0 {
+			fmt.Fprintf(buf, "FNF:%d\nFNH:%d\n", len(f.funcs), fnHit)
+		}
+		lines := make([]int, 0, len(f.lines))
+		for line := range f.lines {
+			lines = append(lines, line)
+		}
+		sort.Ints(lines)
+		lineHit := 0
+		for _, line := range lines {
+			fmt.Fprintf(buf, "DA:%d,%d\n", line, f.lines[line])
+			if f.lines[line] > 0 {
+				lineHit++
+			}
+		}
+		fmt.Fprintf(buf, "LF:%d\nLH:%d\nend_of_record\n", len(lines), lineHit)
+	}
+	return buf.Bytes()
+}
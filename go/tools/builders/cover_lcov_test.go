@@ -0,0 +1,181 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const coverLcovSrc = `package a
+
+func A(x int) int {
+	if x > 0 {
+		return 1
+	}
+	return 0
+}
+
+type T struct{}
+
+func (t *T) M() {
+	println("m")
+}
+
+func (T) V() {}
+`
+
+func TestCoverLcov(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		profiles []string
+		srcs     []string
+		want     string
+		wantErr  string
+	}{
+		{
+			desc: "packages",
+			profiles: []string{
+				`mode: count
+example.com/a/a.go:3.19,4.11 1 2
+example.com/a/a.go:4.11,6.3 1 0
+example.com/a/a.go:6.3,7.10 1 2
+example.com/a/a.go:12.17,14.2 1 0
+example.com/b/b.go:3.14,5.2 2 1
+`,
+				`mode: count
+example.com/a/a.go:3.19,4.11 1 1
+example.com/a/a.go:4.11,6.3 1 1
+example.com/b/b.go:3.14,5.2 2 1
+`,
+			},
+			srcs: []string{"example.com/a/a.go=a/a.go"},
+			want: `SF:a/a.go
+FN:3,A
+FN:12,(*T).M
+FN:16,T.V
+FNDA:3,A
+FNDA:0,(*T).M
+FNDA:0,T.V
+FNF:3
+FNH:1
+DA:3,3
+DA:4,3
+DA:5,1
+DA:6,2
+DA:7,2
+DA:12,0
+DA:13,0
+DA:14,0
+LF:8
+LH:5
+end_of_record
+SF:example.com/b/b.go
+DA:3,2
+DA:4,2
+DA:5,2
+LF:3
+LH:3
+end_of_record
+`,
+		}, {
+			desc: "set",
+			profiles: []string{
+				`mode: set
+example.com/a/a.go:3.19,4.11 1 1
+example.com/a/a.go:4.11,6.3 1 0
+example.com/a/a.go:6.3,7.10 1 1
+`,
+			},
+			want: `SF:example.com/a/a.go
+DA:3,1
+DA:4,1
+DA:5,0
+DA:6,1
+DA:7,1
+LF:5
+LH:4
+end_of_record
+`,
+		}, {
+			desc: "missing_src",
+			profiles: []string{
+				`mode: set
+example.com/a/a.go:3.19,4.11 1 1
+`,
+			},
+			srcs:    []string{"example.com/a/a.go=missing/a.go"},
+			wantErr: "missing/a.go",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cover_lcov_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := os.Mkdir(filepath.Join(dir, "a"), 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, "a", "a.go"), []byte(coverLcovSrc), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			// Source paths are relative to the repository root, which is the
+			// working directory in a Bazel action.
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+
+			args := []string{"-o", "coverage.dat"}
+			for _, src := range test.srcs {
+				args = append(args, "-src", src)
+			}
+			for i, profile := range test.profiles {
+				path := fmt.Sprintf("profile%d.out", i)
+				if err := ioutil.WriteFile(path, []byte(profile), 0666); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, path)
+			}
+			err = coverLcov(args)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v; want error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile("coverage.dat")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// coverMerge merges several coverage profiles in the format written by
+// "go test -coverprofile" into a single profile. This is used to combine the
+// profiles written by the shards of a sharded test. Counts for identical
+// blocks are combined; blocks that appear in only some of the profiles
+// (for example, because shards covered different files) are copied as is.
+func coverMerge(args []string) error {
+	flags := flag.NewFlagSet("covermerge", flag.ExitOnError)
+	out := flags.String("o", "", "merged coverage profile")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return fmt.Errorf("-o was not set")
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("no coverage profiles to merge")
+	}
+
+	merged := &coverProfile{counts: make(map[coverBlock]int)}
+	for _, path := range flags.Args() {
+		p, err := readCoverProfile(path)
+		if err != nil {
+			return err
+		}
+		if err := merged.merge(p); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return ioutil.WriteFile(*out, merged.format(), 0666)
+}
+
+// coverBlock identifies a block of statements in a coverage profile.
+type coverBlock struct {
+	file                string
+	startLine, startCol int
+	endLine, endCol     int
+	numStmt             int
+}
+
+// coverProfile is the content of a coverage profile. mode is empty if the
+// profile had no "mode:" line, which happens when nothing was covered.
+type coverProfile struct {
+	mode   string
+	counts map[coverBlock]int
+}
+
+// readCoverProfile parses a coverage profile. Each line after the "mode:" line
+// has the form "file:startLine.startCol,endLine.endCol numStmt count".
+func readCoverProfile(path string) (*coverProfile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p := &coverProfile{counts: make(map[coverBlock]int)}
+	s := bufio.NewScanner(f)
+	lineNum := 0
+	for s.Scan() {
+		lineNum++
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if lineNum == 1 && strings.HasPrefix(line, "mode: ") {
+			p.mode = strings.TrimPrefix(line, "mode: ")
+			continue
+		}
+		b, count, err := parseCoverLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		p.add(b, count)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return p, nil
+}
+
+func parseCoverLine(line string) (coverBlock, int, error) {
+	var b coverBlock
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return b, 0, fmt.Errorf("malformed coverage line %q", line)
+	}
+	// The file name may contain colons (for example, a drive letter), so split
+	// on the last one.
+	colon := strings.LastIndexByte(fields[0], ':')
+	if colon < 0 {
+		return b, 0, fmt.Errorf("malformed coverage line %q", line)
+	}
+	b.file = fields[0][:colon]
+	if _, err := fmt.Sscanf(fields[0][colon+1:], "%d.%d,%d.%d", &b.startLine, &b.startCol, &b.endLine, &b.endCol); err != nil {
+		return b, 0, fmt.Errorf("malformed coverage block in %q: %v", line, err)
+	}
+	numStmt, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return b, 0, fmt.Errorf("malformed statement count in %q: %v", line, err)
+	}
+	b.numStmt = numStmt
+	count, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return b, 0, fmt.Errorf("malformed count in %q: %v", line, err)
+	}
+	return b, count, nil
+}
+
+// add records count for a block. In "set" mode, a block is either covered or
+// not, so counts are not summed.
+func (p *coverProfile) add(b coverBlock, count int) {
+	if p.mode == "set" {
+		if count > 0 {
+			p.counts[b] = 1
+		} else if _, ok := p.counts[b]; !ok {
+			p.counts[b] = 0
+		}
+		return
+	}
+	p.counts[b] += count
+}
+
+// merge adds the counts from other into p.
+func (p *coverProfile) merge(other *coverProfile) error {
+	switch {
+	case other.mode == "":
+	case p.mode == "":
+		p.mode = other.mode
+	case p.mode != other.mode:
+		return fmt.Errorf("coverage mode %q does not match mode %q of other profiles", other.mode, p.mode)
+	}
+	for b, count := range other.counts {
+		p.add(b, count)
+	}
+	return nil
+}
+
+// format returns the profile in the format written by "go test -coverprofile".
+// Blocks are sorted by file and position, so the output is deterministic.
+func (p *coverProfile) format() []byte {
+	blocks := make([]coverBlock, 0, len(p.counts))
+	for b := range p.counts {
+		blocks = append(blocks, b)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		bi, bj := blocks[i], blocks[j]
+		if bi.file != bj.file {
+			return bi.file < bj.file
+		}
+		if bi.startLine != bj.startLine {
+			return bi.startLine < bj.startLine
+		}
+		if bi.startCol != bj.startCol {
+			return bi.startCol < bj.startCol
+		}
+		if bi.endLine != bj.endLine {
+			return bi.endLine < bj.endLine
+		}
+		if bi.endCol != bj.endCol {
+			return bi.endCol < bj.endCol
+		}
+		return bi.numStmt < bj.numStmt
+	})
+
+	buf := &bytes.Buffer{}
+	mode := p.mode
+	if mode == "" {
+		mode = "set"
+	}
+	fmt.Fprintf(buf, "mode: %s\n", mode)
+	for _, b := range blocks {
+		fmt.Fprintf(buf, "%s:%d.%d,%d.%d %d %d\n", b.file, b.startLine, b.startCol, b.endLine, b.endCol, b.numStmt, p.counts[b])
+	}
+	return buf.Bytes()
+}
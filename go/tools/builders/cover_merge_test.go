@@ -0,0 +1,145 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCoverMerge(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		shards  []string
+		want    string
+		wantErr string
+	}{
+		{
+			desc: "count",
+			shards: []string{
+				`mode: count
+example.com/a/a.go:3.14,5.2 1 2
+example.com/a/a.go:7.14,9.2 2 0
+example.com/b/b.go:3.14,5.2 1 1
+`,
+				`mode: count
+example.com/a/a.go:7.14,9.2 2 3
+example.com/a/a.go:3.14,5.2 1 1
+example.com/c/c.go:1.10,2.2 1 4
+`,
+			},
+			want: `mode: count
+example.com/a/a.go:3.14,5.2 1 3
+example.com/a/a.go:7.14,9.2 2 3
+example.com/b/b.go:3.14,5.2 1 1
+example.com/c/c.go:1.10,2.2 1 4
+`,
+		}, {
+			desc: "set",
+			shards: []string{
+				`mode: set
+example.com/a/a.go:3.14,5.2 1 1
+example.com/a/a.go:7.14,9.2 2 0
+example.com/a/a.go:11.14,13.2 1 0
+`,
+				`mode: set
+example.com/a/a.go:3.14,5.2 1 1
+example.com/a/a.go:7.14,9.2 2 1
+example.com/a/a.go:11.14,13.2 1 0
+`,
+			},
+			want: `mode: set
+example.com/a/a.go:3.14,5.2 1 1
+example.com/a/a.go:7.14,9.2 2 1
+example.com/a/a.go:11.14,13.2 1 0
+`,
+		}, {
+			desc: "disjoint",
+			shards: []string{
+				`mode: atomic
+example.com/b/b.go:3.14,5.2 1 5
+`,
+				`mode: atomic
+example.com/a/a.go:3.14,5.2 1 2
+`,
+			},
+			want: `mode: atomic
+example.com/a/a.go:3.14,5.2 1 2
+example.com/b/b.go:3.14,5.2 1 5
+`,
+		}, {
+			desc: "empty_shard",
+			shards: []string{
+				"",
+				`mode: count
+example.com/a/a.go:3.14,5.2 1 2
+`,
+			},
+			want: `mode: count
+example.com/a/a.go:3.14,5.2 1 2
+`,
+		}, {
+			desc: "mode_mismatch",
+			shards: []string{
+				"mode: set\n",
+				"mode: count\n",
+			},
+			wantErr: `coverage mode "count" does not match mode "set"`,
+		}, {
+			desc: "malformed",
+			shards: []string{
+				"mode: set\nexample.com/a/a.go 1 1\n",
+			},
+			wantErr: "malformed coverage line",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "cover_merge_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			args := []string{"-o", filepath.Join(dir, "merged.out")}
+			for i, shard := range test.shards {
+				path := filepath.Join(dir, fmt.Sprintf("shard%d.out", i))
+				if err := ioutil.WriteFile(path, []byte(shard), 0666); err != nil {
+					t.Fatal(err)
+				}
+				args = append(args, path)
+			}
+			err = coverMerge(args)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v; want error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadFile(filepath.Join(dir, "merged.out"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
@@ -295,14 +295,21 @@ func resolveEmbed(embed fileEmbed, root *embedNode) (matchedPaths, matchedFiles
 		}
 	}()
 
+	// Patterns prefixed with "all:" match hidden files in directories, too.
+	pattern := embed.pattern
+	all := strings.HasPrefix(pattern, "all:")
+	if all {
+		pattern = pattern[len("all:"):]
+	}
+
 	// Check that the pattern has valid syntax.
-	if _, err := path.Match(embed.pattern, ""); err != nil || !validEmbedPattern(embed.pattern) {
+	if _, err := path.Match(pattern, ""); err != nil || !validEmbedPattern(pattern) {
 		return nil, nil, fmt.Errorf("invalid pattern syntax")
 	}
 
 	// Search for matching files.
 	err = root.walk(func(matchRel string, matchNode *embedNode) error {
-		if ok, _ := path.Match(embed.pattern, matchRel); !ok {
+		if ok, _ := path.Match(pattern, matchRel); !ok {
 			// Non-matching file or directory.
 			return nil
 		}
@@ -314,10 +321,11 @@ func resolveEmbed(embed fileEmbed, root *embedNode) (matchedPaths, matchedFiles
 		}
 
 		// Matching directory. Recursively add all files in subdirectories.
-		// Don't add hidden files or directories (starting with "." or "_").
-		// See golang/go#42328.
+		// Don't add hidden files or directories (starting with "." or "_"),
+		// unless the pattern starts with "all:". See golang/go#42328 and
+		// golang/go#43854.
 		matchTreeErr := matchNode.walk(func(childRel string, childNode *embedNode) error {
-			if childRel != "" {
+			if childRel != "" && !all {
 				if base := path.Base(childRel); strings.HasPrefix(base, ".") || strings.HasPrefix(base, "_") {
 					return errSkip
 				}
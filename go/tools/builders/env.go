@@ -173,106 +173,6 @@ func runAndLogCommand(cmd *exec.Cmd, verbose bool) error {
 	return nil
 }
 
-// expandParamsFiles looks for arguments in args of the form
-// "-param=filename". When it finds these arguments it reads the file "filename"
-// and replaces the argument with its content.
-func expandParamsFiles(args []string) ([]string, error) {
-	var paramsIndices []int
-	for i, arg := range args {
-		if strings.HasPrefix(arg, "-param=") {
-			paramsIndices = append(paramsIndices, i)
-		}
-	}
-	if len(paramsIndices) == 0 {
-		return args, nil
-	}
-	var expandedArgs []string
-	last := 0
-	for _, pi := range paramsIndices {
-		expandedArgs = append(expandedArgs, args[last:pi]...)
-		last = pi + 1
-
-		fileName := args[pi][len("-param="):]
-		fileArgs, err := readParamsFile(fileName)
-		if err != nil {
-			return nil, err
-		}
-		expandedArgs = append(expandedArgs, fileArgs...)
-	}
-	expandedArgs = append(expandedArgs, args[last:]...)
-	return expandedArgs, nil
-}
-
-// readParamsFiles parses a Bazel params file in "shell" format. The file
-// should contain one argument per line. Arguments may be quoted with single
-// quotes. All characters within quoted strings are interpreted literally
-// including newlines and excepting single quotes. Characters outside quoted
-// strings may be escaped with a backslash.
-func readParamsFile(name string) ([]string, error) {
-	data, err := ioutil.ReadFile(name)
-	if err != nil {
-		return nil, err
-	}
-
-	var args []string
-	var arg []byte
-	quote := false
-	escape := false
-	for p := 0; p < len(data); p++ {
-		b := data[p]
-		switch {
-		case escape:
-			arg = append(arg, b)
-			escape = false
-
-		case b == '\'':
-			quote = !quote
-
-		case !quote && b == '\\':
-			escape = true
-
-		case !quote && b == '\n':
-			args = append(args, string(arg))
-			arg = arg[:0]
-
-		default:
-			arg = append(arg, b)
-		}
-	}
-	if quote {
-		return nil, fmt.Errorf("unterminated quote")
-	}
-	if escape {
-		return nil, fmt.Errorf("unterminated escape")
-	}
-	if len(arg) > 0 {
-		args = append(args, string(arg))
-	}
-	return args, nil
-}
-
-// writeParamsFile formats a list of arguments in Bazel's "shell" format and writes
-// it to a file.
-func writeParamsFile(path string, args []string) error {
-	buf := new(bytes.Buffer)
-	for _, arg := range args {
-		if !strings.ContainsAny(arg, "'\n\\") {
-			fmt.Fprintln(buf, arg)
-			continue
-		}
-		buf.WriteByte('\'')
-		for _, r := range arg {
-			if r == '\'' {
-				buf.WriteString(`'\''`)
-			} else {
-				buf.WriteRune(r)
-			}
-		}
-		buf.WriteString("'\n")
-	}
-	return ioutil.WriteFile(path, buf.Bytes(), 0666)
-}
-
 // splitArgs splits a list of command line arguments into two parts: arguments
 // that should be interpreted by the builder (before "--"), and arguments
 // that should be passed through to the underlying tool (after "--").
@@ -0,0 +1,224 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeParamsFiles writes params files into a new temporary directory.
+// files maps file names to their contents. Each content string may contain
+// "%DIR%", which is replaced with the directory. The directory is returned.
+func writeParamsFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "env_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, content := range files {
+		content = strings.ReplaceAll(content, "%DIR%", dir)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestExpandParamsFilesNested(t *testing.T) {
+	dir := writeParamsFiles(t, map[string]string{
+		"outer.params": "-a\n-param=%DIR%/inner.params\n-d\n",
+		"inner.params": "-b\n-c\n",
+	})
+	got, err := expandParamsFiles([]string{"-first", "-param=" + filepath.Join(dir, "outer.params"), "-last"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-first", "-a", "-b", "-c", "-d", "-last"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExpandParamsFilesCycle(t *testing.T) {
+	for _, tc := range []struct {
+		desc  string
+		files map[string]string
+		want  string
+	}{
+		{
+			desc:  "self",
+			files: map[string]string{"a.params": "-x\n-param=%DIR%/a.params\n"},
+			want:  "a.params -> %DIR%/a.params",
+		}, {
+			desc: "mutual",
+			files: map[string]string{
+				"a.params": "-param=%DIR%/b.params\n",
+				"b.params": "-param=%DIR%/a.params\n",
+			},
+			want: "a.params -> %DIR%/b.params -> %DIR%/a.params",
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir := writeParamsFiles(t, tc.files)
+			_, err := expandParamsFiles([]string{"-param=" + filepath.Join(dir, "a.params")})
+			if err == nil {
+				t.Fatal("unexpected success")
+			}
+			want := "params file cycle: " + filepath.Join(dir, strings.ReplaceAll(tc.want, "%DIR%", dir))
+			if err.Error() != want {
+				t.Errorf("got error %q, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestExpandParamsFilesDepth(t *testing.T) {
+	files := map[string]string{}
+	for i := 0; i <= maxParamsFileDepth; i++ {
+		files[fmt.Sprintf("%d.params", i)] = fmt.Sprintf("-param=%%DIR%%/%d.params\n", i+1)
+	}
+	files[fmt.Sprintf("%d.params", maxParamsFileDepth+1)] = "-x\n"
+	dir := writeParamsFiles(t, files)
+	_, err := expandParamsFiles([]string{"-param=" + filepath.Join(dir, "0.params")})
+	if err == nil || !strings.Contains(err.Error(), "nested more than") {
+		t.Errorf("got error %v, want depth error", err)
+	}
+}
+
+func TestReadParamsFileQuoting(t *testing.T) {
+	for _, tc := range []struct {
+		desc, content string
+		want          []string
+	}{
+		{
+			desc:    "double quotes",
+			content: "-option\n\"M foo/bar.proto=baz\"\n--option \"M foo/bar.proto=baz\"\n",
+			want:    []string{"-option", "M foo/bar.proto=baz", "--option M foo/bar.proto=baz"},
+		}, {
+			desc:    "single quotes",
+			content: "'a b'\n'multi\nline'\n'it'\\''s'\n",
+			want:    []string{"a b", "multi\nline", "it's"},
+		}, {
+			desc:    "escaped quotes",
+			content: "\"say \\\"hi\\\"\"\n\\\"bare\\\"\n'\"'\n\"'\"\n",
+			want:    []string{`say "hi"`, `"bare"`, `"`, `'`},
+		}, {
+			desc:    "escaped backslash",
+			content: "a\\\\b\n\"c\\\\d\"\n'e\\f'\n",
+			want:    []string{`a\b`, `c\d`, `e\f`},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir := writeParamsFiles(t, map[string]string{"a.params": tc.content})
+			got, err := readParamsFile(filepath.Join(dir, "a.params"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadParamsFileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		desc, content, want string
+	}{
+		{desc: "trailing backslash", content: "-a\n-b\\", want: "unterminated escape"},
+		{desc: "unterminated single quote", content: "'-a\n", want: "unterminated quote"},
+		{desc: "unterminated double quote", content: "\"-a\n", want: "unterminated quote"},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir := writeParamsFiles(t, map[string]string{"a.params": tc.content})
+			_, err := readParamsFile(filepath.Join(dir, "a.params"))
+			if err == nil || err.Error() != tc.want {
+				t.Errorf("got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestWriteParamsFileRoundTrip(t *testing.T) {
+	args := []string{"plain", "with space", "M foo/bar.proto=baz", `"double"`, "it's", "multi\nline", `back\slash`, ""}
+	dir := writeParamsFiles(t, nil)
+	path := filepath.Join(dir, "a.params")
+	if err := writeParamsFile(path, args); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readParamsFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, args) {
+		t.Errorf("got %q, want %q", got, args)
+	}
+}
+
+func TestWriteParamsFileFormat(t *testing.T) {
+	// These are the lines Bazel writes for the same arguments with
+	// args.set_param_file_format("shell").
+	args := []string{"-o", "a/b.a", "-p=x", "with space", "it's", "", "tab\there", "multi\nline"}
+	want := "-o\na/b.a\n'-p=x'\n'with space'\n'it'\\''s'\n''\n'tab\there'\n'multi\nline'\n"
+	dir := writeParamsFiles(t, nil)
+	path := filepath.Join(dir, "a.params")
+	if err := writeParamsFile(path, args); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExpandParamsFilesRoundTrip(t *testing.T) {
+	// Every builder reads its arguments with expandParamsFiles, so arguments
+	// written with writeParamsFile must come back unchanged.
+	args := []string{
+		"",
+		" leading and trailing spaces ",
+		"multi\nline\n",
+		"\n",
+		`'single'`,
+		`"double"`,
+		`'\''`,
+		`back\slash\`,
+		"tab\tand\r\ncrlf",
+		"unicode ✓",
+		"-importpath=example.com/a b",
+	}
+	dir := writeParamsFiles(t, nil)
+	path := filepath.Join(dir, "a.params")
+	if err := writeParamsFile(path, args); err != nil {
+		t.Fatal(err)
+	}
+	got, err := expandParamsFiles([]string{"before", "-param=" + path, "after"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append([]string{"before"}, args...), "after")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
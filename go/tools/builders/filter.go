@@ -21,6 +21,7 @@ import (
 	"go/token"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -48,6 +49,7 @@ const (
 	objcxxExt
 	sExt
 	hExt
+	sysoExt
 )
 
 type fileImport struct {
@@ -62,7 +64,7 @@ type fileEmbed struct {
 }
 
 type archiveSrcs struct {
-	goSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs []fileInfo
+	goSrcs, cSrcs, cxxSrcs, objcSrcs, objcxxSrcs, sSrcs, hSrcs, sysoSrcs []fileInfo
 }
 
 // filterAndSplitFiles filters files using build constraints and collates
@@ -93,12 +95,47 @@ func filterAndSplitFiles(fileNames []string) (archiveSrcs, error) {
 			srcs = &res.sSrcs
 		case hExt:
 			srcs = &res.hSrcs
+		case sysoExt:
+			srcs = &res.sysoSrcs
 		}
 		*srcs = append(*srcs, src)
 	}
 	return res, nil
 }
 
+// sort orders each kind of source by base name, then by path, like the go
+// command orders the files in a package directory. The order in which files
+// are passed to the compiler and assembler affects their output, including
+// the order package-level variables are initialized in, so sorting makes the
+// compiled archive independent of the order sources were listed in.
+func (s *archiveSrcs) sort() {
+	for _, files := range [][]fileInfo{s.goSrcs, s.cSrcs, s.cxxSrcs, s.objcSrcs, s.objcxxSrcs, s.sSrcs, s.hSrcs, s.sysoSrcs} {
+		sort.SliceStable(files, func(i, j int) bool {
+			bi, bj := filepath.Base(files[i].filename), filepath.Base(files[j].filename)
+			if bi != bj {
+				return bi < bj
+			}
+			return files[i].filename < files[j].filename
+		})
+	}
+}
+
+// packageSrcDir returns the directory of the Go sources that the package
+// directory is inferred from, for paths recorded in compiled code. When
+// sources are in more than one directory, like static and generated files,
+// this is the directory with the shortest path, which is the static source
+// directory since generated files are in a subdirectory of the execution
+// root. This doesn't depend on the order of srcs.
+func packageSrcDir(srcs []fileInfo) string {
+	dir := filepath.Dir(srcs[0].filename)
+	for _, src := range srcs[1:] {
+		if d := filepath.Dir(src.filename); len(d) < len(dir) || len(d) == len(dir) && d < dir {
+			dir = d
+		}
+	}
+	return dir
+}
+
 // readFileInfo applies build constraints to an input file and returns whether
 // it should be compiled.
 func readFileInfo(bctx build.Context, input string) (fileInfo, error) {
@@ -121,6 +158,8 @@ func readFileInfo(bctx build.Context, input string) (fileInfo, error) {
 			fi.ext = sExt
 		case ".h", ".hh", ".hpp", ".hxx":
 			fi.ext = hExt
+		case ".syso":
+			fi.ext = sysoExt
 		default:
 			return fileInfo{}, fmt.Errorf("unrecognized file extension: %s", ext)
 		}
@@ -130,6 +130,78 @@ func runTest(t *testing.T, bctx build.Context, inputs []string, expect []string)
 	}
 }
 
+func TestSysoFiles(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "goruletest")
+	if err != nil {
+		t.Fatalf("Error creating temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	var inputs []string
+	for _, name := range []string{"any.syso", "rsrc_windows_amd64.syso", "rsrc_windows_arm64.syso", "obj_linux.syso"} {
+		p := filepath.Join(tempdir, name)
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatalf("WriteFile(%s): %v", p, err)
+		}
+		inputs = append(inputs, p)
+	}
+
+	defer func(bctx build.Context) { build.Default = bctx }(build.Default)
+	for _, test := range []struct {
+		goos, goarch string
+		want         []string
+	}{
+		{"windows", "amd64", []string{"any.syso", "rsrc_windows_amd64.syso"}},
+		{"windows", "arm64", []string{"any.syso", "rsrc_windows_arm64.syso"}},
+		{"linux", "amd64", []string{"any.syso", "obj_linux.syso"}},
+	} {
+		build.Default.GOOS = test.goos
+		build.Default.GOARCH = test.goarch
+		got, err := filterAndSplitFiles(inputs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotNames []string
+		for _, src := range got.sysoSrcs {
+			gotNames = append(gotNames, filepath.Base(src.filename))
+		}
+		if !reflect.DeepEqual(gotNames, test.want) {
+			t.Errorf("%s/%s: got .syso files %v; want %v", test.goos, test.goarch, gotNames, test.want)
+		}
+	}
+}
+
+func TestSortSrcs(t *testing.T) {
+	srcs := archiveSrcs{
+		goSrcs: []fileInfo{
+			{filename: "pkg/c.go"},
+			{filename: "bazel-out/bin/pkg/b_gen.go"},
+			{filename: "pkg/a.go"},
+			{filename: "pkg/sub/a.go"},
+		},
+		sSrcs: []fileInfo{{filename: "pkg/y.s"}, {filename: "pkg/x.s"}},
+	}
+	srcs.sort()
+	var gotGo, gotS []string
+	for _, src := range srcs.goSrcs {
+		gotGo = append(gotGo, src.filename)
+	}
+	for _, src := range srcs.sSrcs {
+		gotS = append(gotS, src.filename)
+	}
+	if want := []string{"pkg/a.go", "pkg/sub/a.go", "bazel-out/bin/pkg/b_gen.go", "pkg/c.go"}; !reflect.DeepEqual(gotGo, want) {
+		t.Errorf("got .go files %v; want %v", gotGo, want)
+	}
+	if want := []string{"pkg/x.s", "pkg/y.s"}; !reflect.DeepEqual(gotS, want) {
+		t.Errorf("got .s files %v; want %v", gotS, want)
+	}
+
+	// The package directory doesn't depend on which file is first.
+	if got, want := packageSrcDir(srcs.goSrcs), "pkg"; got != want {
+		t.Errorf("got package directory %q; want %q", got, want)
+	}
+}
+
 // abs is a dummy env.go abs to avoid depending on env.go and flags.go.
 func abs(p string) string {
 	return p
@@ -18,14 +18,11 @@ limitations under the License.
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"math"
 	"os"
-	"regexp"
 	"strconv"
 	"text/template"
 )
@@ -35,48 +32,23 @@ package main
 
 
 import (
-{{- if .NeedRegexp }}
-	"regexp"
-{{- end}}
 {{- range $import := .Imports}}
 	{{$import.Name}} "{{$import.Path}}"
 {{- end}}
 	"golang.org/x/tools/go/analysis"
 )
 
+// analyzers are all the analyzers compiled into nogo. The configuration
+// file read when nogo runs may turn some of them off.
 var analyzers = []*analysis.Analyzer{
 {{- range $import := .Imports}}
 	{{$import.Name}}.Analyzer,
 {{- end}}
 }
 
-// configs maps analysis names to configurations.
-var configs = map[string]config{
-{{- range $name, $config := .Configs}}
-	{{printf "%q" $name}}: config{
-		{{- if $config.OnlyFiles}}
-		onlyFiles: []*regexp.Regexp{
-			{{- range $path, $comment := $config.OnlyFiles}}
-			{{- if $comment}}
-			// {{$comment}}
-			{{end -}}
-			{{printf "regexp.MustCompile(%q)" $path}},
-			{{- end}}
-		},
-		{{- end -}}
-		{{- if $config.ExcludeFiles}}
-		excludeFiles: []*regexp.Regexp{
-			{{- range $path, $comment := $config.ExcludeFiles}}
-			{{- if $comment}}
-			// {{$comment}}
-			{{end -}}
-			{{printf "regexp.MustCompile(%q)" $path}},
-			{{- end}}
-		},
-		{{- end}}
-	},
-{{- end}}
-}
+// defaultConcurrency is the maximum number of analyzers run at the same time
+// on a package, or 0 to use GOMAXPROCS.
+const defaultConcurrency = {{.Concurrency}}
 `
 
 func genNogoMain(args []string) error {
@@ -84,13 +56,16 @@ func genNogoMain(args []string) error {
 	flags := flag.NewFlagSet("generate_nogo_main", flag.ExitOnError)
 	out := flags.String("output", "", "output file to write (defaults to stdout)")
 	flags.Var(&analyzerImportPaths, "analyzer_importpath", "import path of an analyzer library")
-	configFile := flags.String("config", "", "nogo config file")
+	concurrency := flags.Int("concurrency", 0, "maximum number of analyzers to run at the same time, or 0 to use GOMAXPROCS")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
 	if *out == "" {
 		return errors.New("must provide output file")
 	}
+	if *concurrency < 0 {
+		return fmt.Errorf("invalid concurrency %d: must not be negative", *concurrency)
+	}
 
 	outFile := os.Stdout
 	var cErr error
@@ -104,11 +79,6 @@ func genNogoMain(args []string) error {
 		}
 	}()
 
-	config, err := buildConfig(*configFile)
-	if err != nil {
-		return err
-	}
-
 	type Import struct {
 		Path, Name string
 	}
@@ -125,18 +95,11 @@ func genNogoMain(args []string) error {
 		suffix++
 	}
 	data := struct {
-		Imports    []Import
-		Configs    Configs
-		NeedRegexp bool
+		Imports     []Import
+		Concurrency int
 	}{
-		Imports: imports,
-		Configs: config,
-	}
-	for _, c := range config {
-		if len(c.OnlyFiles) > 0 || len(c.ExcludeFiles) > 0 {
-			data.NeedRegexp = true
-			break
-		}
+		Imports:     imports,
+		Concurrency: *concurrency,
 	}
 
 	tpl := template.Must(template.New("source").Parse(nogoMainTpl))
@@ -145,43 +108,3 @@ func genNogoMain(args []string) error {
 	}
 	return cErr
 }
-
-func buildConfig(path string) (Configs, error) {
-	if path == "" {
-		return Configs{}, nil
-	}
-	b, err := ioutil.ReadFile(path)
-	if err != nil {
-		return Configs{}, fmt.Errorf("failed to read config file: %v", err)
-	}
-	configs := make(Configs)
-	if err = json.Unmarshal(b, &configs); err != nil {
-		return Configs{}, fmt.Errorf("failed to unmarshal config file: %v", err)
-	}
-	for name, config := range configs {
-		for pattern := range config.OnlyFiles {
-			if _, err := regexp.Compile(pattern); err != nil {
-				return Configs{}, fmt.Errorf("invalid pattern for analysis %q: %v", name, err)
-			}
-		}
-		for pattern := range config.ExcludeFiles {
-			if _, err := regexp.Compile(pattern); err != nil {
-				return Configs{}, fmt.Errorf("invalid pattern for analysis %q: %v", name, err)
-			}
-		}
-		configs[name] = Config{
-			// Description is currently unused.
-			OnlyFiles:    config.OnlyFiles,
-			ExcludeFiles: config.ExcludeFiles,
-		}
-	}
-	return configs, nil
-}
-
-type Configs map[string]Config
-
-type Config struct {
-	Description  string
-	OnlyFiles    map[string]string `json:"only_files"`
-	ExcludeFiles map[string]string `json:"exclude_files"`
-}
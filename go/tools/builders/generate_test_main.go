@@ -40,6 +40,7 @@ import (
 	"go/token"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 )
@@ -71,6 +72,35 @@ type Cases struct {
 	TestMain    string
 	Coverage    bool
 	Pkgname     string
+
+	// BinaryCoverage is set when coverage data is written in the binary
+	// format. The runtime writes it to GOCOVERDIR when the test exits, instead
+	// of the test writing a profile with the data registered with coverdata.
+	BinaryCoverage bool
+
+	// CoverageThreshold is the minimum percentage of statements covered in
+	// all instrumented packages together. CoveragePackageThresholds are
+	// minimum percentages for individual packages.
+	CoverageThreshold         float64
+	CoveragePackageThresholds []CoverageThreshold
+
+	// ChangedFiles and TestInputs are the runfiles paths of a manifest of
+	// changed files and of the list of files the test was built from. When
+	// set, the test is skipped if none of the changed files affect it.
+	ChangedFiles, TestInputs string
+}
+
+// CoverageThreshold is the minimum percentage of statements covered in a
+// package for the test to pass.
+type CoverageThreshold struct {
+	Package string
+	Percent float64
+}
+
+// CheckCoverage returns whether the test main function should check coverage
+// against thresholds after tests pass.
+func (c *Cases) CheckCoverage() bool {
+	return c.Coverage && (c.CoverageThreshold > 0 || len(c.CoveragePackageThresholds) > 0)
 }
 
 // Version returns whether v is a supported Go version (like "go1.18").
@@ -95,9 +125,15 @@ import "github.com/bazelbuild/rules_go/go/tools/bzltestutil"
 
 import (
 	"flag"
+{{if .CheckCoverage}}
+	"fmt"
+{{end}}
 	"log"
 	"os"
 	"os/exec"
+{{if .BinaryCoverage}}
+	"path/filepath"
+{{end}}
 {{if .TestMain}}
 	"reflect"
 {{end}}
@@ -105,7 +141,7 @@ import (
 	"testing"
 	"testing/internal/testdeps"
 
-{{if .Coverage}}
+{{if and .Coverage (not .BinaryCoverage)}}
 	"github.com/bazelbuild/rules_go/go/tools/coverdata"
 {{end}}
 
@@ -165,6 +201,37 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	{{if .ChangedFiles}}
+	if reason, skip := bzltestutil.Unaffected({{printf "%q" .ChangedFiles}}, {{printf "%q" .TestInputs}}); skip {
+		log.Printf("Skipping %v: %s", os.Getenv("TEST_TARGET"), reason)
+		names := make([]string, len(allTests))
+		for i, t := range allTests {
+			names[i] = t.Name
+		}
+		if err := bzltestutil.ReportSkipped("{{.Pkgname}}", names, reason); err != nil {
+			log.Print(err)
+			os.Exit(bzltestutil.TestWrapperAbnormalExit)
+		}
+		os.Exit(0)
+	}
+	{{end}}
+
+	{{if .BinaryCoverage}}
+	// Bazel keeps files written to TEST_UNDECLARED_OUTPUTS_DIR in the test's
+	// outputs. This is set before the test is wrapped, so coverage data from
+	// the wrapper and the test process are written to the same directory.
+	if _, ok := os.LookupEnv("GOCOVERDIR"); !ok {
+		if outputsDir, ok := os.LookupEnv("TEST_UNDECLARED_OUTPUTS_DIR"); ok {
+			coverDir := filepath.Join(outputsDir, "gocoverdir")
+			if err := os.MkdirAll(coverDir, 0777); err != nil {
+				log.Print(err)
+				os.Exit(bzltestutil.TestWrapperAbnormalExit)
+			}
+			os.Setenv("GOCOVERDIR", coverDir)
+		}
+	}
+	{{end}}
+
 	if bzltestutil.ShouldWrap() {
 		err := bzltestutil.Wrap("{{.Pkgname}}")
 		if xerr, ok := err.(*exec.ExitError); ok {
@@ -188,7 +255,7 @@ func main() {
 		flag.Lookup("test.run").Value.Set(filter)
 	}
 
-	{{if .Coverage}}
+	{{if and .Coverage (not .BinaryCoverage)}}
 	if len(coverdata.Cover.Counters) > 0 {
 		testing.RegisterCover(coverdata.Cover)
 	}
@@ -200,12 +267,27 @@ func main() {
 	{{end}}
 
 	{{if not .TestMain}}
-	os.Exit(m.Run())
+	exitCode := m.Run()
 	{{else}}
 	{{.TestMain}}(m)
 	{{/* See golang.org/issue/34129 and golang.org/cl/219639 */}}
-	os.Exit(int(reflect.ValueOf(m).Elem().FieldByName("exitCode").Int()))
+	exitCode := int(reflect.ValueOf(m).Elem().FieldByName("exitCode").Int())
+	{{end}}
+
+	{{if .CheckCoverage}}
+	if exitCode == 0 && testing.CoverMode() != "" {
+		packageThresholds := map[string]float64{
+		{{range .CoveragePackageThresholds}}
+			{{printf "%q" .Package}}: {{.Percent}},
+		{{end}}
+		}
+		if err := bzltestutil.CheckCoverage(coverdata.Cover, {{.CoverageThreshold}}, packageThresholds); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitCode = 1
+		}
+	}
 	{{end}}
+	os.Exit(exitCode)
 }
 `
 
@@ -221,9 +303,15 @@ func genTestMain(args []string) error {
 	goenv := envFlags(flags)
 	out := flags.String("output", "", "output file to write. Defaults to stdout.")
 	coverage := flags.Bool("coverage", false, "whether coverage is supported")
+	coverFormat := flags.String("cover_format", coverFormatText, "the format coverage data is written in with -coverage: text or binary")
 	pkgname := flags.String("pkgname", "", "package name of test")
+	coverageThreshold := flags.String("coverage_threshold", "", "minimum percentage of statements covered in all instrumented packages")
+	var coveragePackageThresholds multiFlag
+	changedFiles := flags.String("changed_files", "", "runfiles path of a manifest of changed files; the test is skipped if none of them affect it")
+	testInputs := flags.String("test_inputs", "", "runfiles path of the list of files the test was built from (with -changed_files)")
 	flags.Var(&imports, "import", "Packages to import")
 	flags.Var(&sources, "src", "Sources to process for tests")
+	flags.Var(&coveragePackageThresholds, "coverage_package_threshold", "Import path of an instrumented package and the minimum percentage of statements covered in it, separated by '='")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -269,9 +357,39 @@ func genTestMain(args []string) error {
 		defer outFile.Close()
 	}
 
+	if (*changedFiles == "") != (*testInputs == "") {
+		return fmt.Errorf("-changed_files and -test_inputs must be set together")
+	}
+
+	if *coverFormat != coverFormatText && *coverFormat != coverFormatBinary {
+		return fmt.Errorf("invalid -cover_format %q: must be %s or %s", *coverFormat, coverFormatText, coverFormatBinary)
+	}
+
 	cases := Cases{
-		Coverage: *coverage,
-		Pkgname:  *pkgname,
+		Coverage:       *coverage,
+		BinaryCoverage: *coverage && *coverFormat == coverFormatBinary,
+		Pkgname:        *pkgname,
+		ChangedFiles:   *changedFiles,
+		TestInputs:     *testInputs,
+	}
+	if *coverageThreshold != "" {
+		if cases.CoverageThreshold, err = parseCoveragePercent(*coverageThreshold); err != nil {
+			return fmt.Errorf("-coverage_threshold: %v", err)
+		}
+	}
+	for _, t := range coveragePackageThresholds {
+		i := strings.LastIndexByte(t, '=')
+		if i < 0 {
+			return fmt.Errorf("-coverage_package_threshold %q: expected importpath=percent", t)
+		}
+		percent, err := parseCoveragePercent(t[i+1:])
+		if err != nil {
+			return fmt.Errorf("-coverage_package_threshold %q: %v", t, err)
+		}
+		cases.CoveragePackageThresholds = append(cases.CoveragePackageThresholds, CoverageThreshold{Package: t[:i], Percent: percent})
+	}
+	if cases.BinaryCoverage && (cases.CoverageThreshold > 0 || len(cases.CoveragePackageThresholds) > 0) {
+		return fmt.Errorf("coverage thresholds can't be checked with the %s coverage format", coverFormatBinary)
 	}
 
 	testFileSet := token.NewFileSet()
@@ -390,3 +508,13 @@ func genTestMain(args []string) error {
 	}
 	return nil
 }
+
+// parseCoveragePercent parses a coverage threshold, which must be a
+// percentage between 0 and 100.
+func parseCoveragePercent(s string) (float64, error) {
+	percent, err := strconv.ParseFloat(s, 64)
+	if err != nil || percent < 0 || percent > 100 {
+		return 0, fmt.Errorf("invalid coverage threshold %q: must be a percentage between 0 and 100", s)
+	}
+	return percent, nil
+}
@@ -147,7 +147,7 @@ func buildImportcfgFileForCompile(imports map[string]*archive, installSuffix, di
 	return filename, nil
 }
 
-func buildImportcfgFileForLink(archives []archive, stdPackageListPath, installSuffix, dir string) (string, error) {
+func buildImportcfgFileForLink(archives []archive, stdPackageListPath, installSuffix, modInfo, dir string) (string, error) {
 	buf := &bytes.Buffer{}
 	goroot, ok := os.LookupEnv("GOROOT")
 	if !ok {
@@ -170,14 +170,25 @@ func buildImportcfgFileForLink(archives []archive, stdPackageListPath, installSu
 	if err := scanner.Err(); err != nil {
 		return "", err
 	}
+	// Write packages in order of package path, so the importcfg, and the
+	// binary linked with it, don't depend on the order archives were given.
+	// Bazel doesn't guarantee that order is the same across dependency
+	// graphs that are otherwise equivalent.
+	sortedArchives := append([]archive(nil), archives...)
+	sort.SliceStable(sortedArchives, func(i, j int) bool {
+		return sortedArchives[i].packagePath < sortedArchives[j].packagePath
+	})
 	depsSeen := map[string]string{}
-	for _, arc := range archives {
+	for _, arc := range sortedArchives {
 		if _, ok := depsSeen[arc.packagePath]; ok {
 			return "", fmt.Errorf("internal error: package %s provided multiple times. This should have been detected during analysis.", arc.packagePath)
 		}
 		depsSeen[arc.packagePath] = arc.label
 		fmt.Fprintf(buf, "packagefile %s=%s\n", arc.packagePath, arc.file)
 	}
+	if modInfo != "" {
+		fmt.Fprintf(buf, "modinfo %q\n", modInfo)
+	}
 	f, err := ioutil.TempFile(dir, "importcfg")
 	if err != nil {
 		return "", err
@@ -27,6 +27,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 )
 
@@ -53,18 +54,23 @@ func link(args []string) error {
 	builderArgs, toolArgs := splitArgs(args)
 	stamps := multiFlag{}
 	xdefs := multiFlag{}
+	uncheckedXdefs := multiFlag{}
 	archives := archiveMultiFlag{}
 	flags := flag.NewFlagSet("link", flag.ExitOnError)
 	goenv := envFlags(flags)
 	main := flags.String("main", "", "Path to the main archive.")
 	packagePath := flags.String("p", "", "Package path of the main archive.")
 	outFile := flags.String("o", "", "Path to output file.")
+	debugOut := flags.String("debug_out", "", "If set, path to a file with the symbols and debug information stripped from the output file. Requires -objcopy.")
+	objcopy := flags.String("objcopy", "", "The objcopy command used to split debug information into the -debug_out file.")
 	flags.Var(&archives, "arc", "Label, package path, and file name of a dependency, separated by '='")
 	packageList := flags.String("package_list", "", "The file containing the list of standard library packages")
 	buildmode := flags.String("buildmode", "", "Build mode used.")
 	flags.Var(&xdefs, "X", "A string variable to replace in the linked binary (repeated).")
+	flags.Var(&uncheckedXdefs, "unchecked_X", "Like -X, but no warning is printed if the variable doesn't exist. Used for flags generated by rules_go (repeated).")
 	flags.Var(&stamps, "stamp", "The name of a file with stamping values.")
 	conflictErrMsg := flags.String("conflict_err", "", "Error message about conflicts to report if there's a link error.")
+	buildInfoVersion := flags.String("buildinfo_version", "", "Version of the main module reported by runtime/debug.ReadBuildInfo. May refer to stamp keys.")
 	if err := flags.Parse(builderArgs); err != nil {
 		return err
 	}
@@ -75,6 +81,9 @@ func link(args []string) error {
 	if *conflictErrMsg != "" {
 		return errors.New(*conflictErrMsg)
 	}
+	if *debugOut != "" && *objcopy == "" {
+		return errors.New("-debug_out requires -objcopy")
+	}
 
 	// On Windows, take the absolute path of the output file and main file.
 	// This is needed on Windows because the relative path is frequently too long.
@@ -83,6 +92,9 @@ func link(args []string) error {
 	// outputs because they get baked in as the "install path".
 	if runtime.GOOS != "darwin" {
 		*outFile = abs(*outFile)
+		if *debugOut != "" {
+			*debugOut = abs(*debugOut)
+		}
 	}
 	*main = abs(*main)
 
@@ -109,8 +121,35 @@ func link(args []string) error {
 		}
 	}
 
+	// expandStamps replaces {KEY} references to stamp keys in value. ok is
+	// false if a key wasn't found.
+	expandStamps := func(value string) (expanded string, ok bool) {
+		ok = true
+		expanded = regexp.MustCompile(`\{.+?\}`).ReplaceAllStringFunc(value, func(key string) string {
+			if value, found := stampMap[key[1:len(key)-1]]; found {
+				return value
+			}
+			ok = false
+			return key
+		})
+		return expanded, ok
+	}
+
+	// Synthesize build info for runtime/debug.ReadBuildInfo. Without stamping,
+	// or if the version refers to a missing key, the version is "(devel)", so
+	// the binary is reproducible. Linkers before Go 1.18 can only get build
+	// info from compiled code, so it's left out.
+	var modInfo string
+	if linkerSupportsModInfo() {
+		version, ok := expandStamps(*buildInfoVersion)
+		if !ok {
+			version = ""
+		}
+		modInfo = buildModInfo(*packagePath, version)
+	}
+
 	// Build an importcfg file.
-	importcfgName, err := buildImportcfgFileForLink(archives, *packageList, goenv.installSuffix, filepath.Dir(*outFile))
+	importcfgName, err := buildImportcfgFileForLink(archives, *packageList, goenv.installSuffix, modInfo, filepath.Dir(*outFile))
 	if err != nil {
 		return err
 	}
@@ -120,42 +159,36 @@ func link(args []string) error {
 	goargs := goenv.goTool("link")
 	goargs = append(goargs, "-importcfg", importcfgName)
 
-	parseXdef := func(xdef string) (pkg, name, value string, err error) {
-		eq := strings.IndexByte(xdef, '=')
-		if eq < 0 {
-			return "", "", "", fmt.Errorf("-X flag does not contain '=': %s", xdef)
-		}
-		dot := strings.LastIndexByte(xdef[:eq], '.')
-		if dot < 0 {
-			return "", "", "", fmt.Errorf("-X flag does not contain '.': %s", xdef)
-		}
-		pkg, name, value = xdef[:dot], xdef[dot+1:eq], xdef[eq+1:]
-		if pkg == *packagePath {
-			pkg = "main"
-		}
-		return pkg, name, value, nil
+	// -X flags may name a package by its import path, which is what users
+	// usually know, or by its package path, which is what the linker knows.
+	// The linker silently ignores flags for variables that don't exist, so
+	// warn about flags the user wrote that won't have any effect.
+	xdefTargets, err := newXdefResolver(goenv, *packagePath, *main, archives, *packageList)
+	if err != nil {
+		return err
 	}
-	for _, xdef := range xdefs {
-		pkg, name, value, err := parseXdef(xdef)
-		if err != nil {
-			return err
-		}
-		var missingKey bool
-		value = regexp.MustCompile(`\{.+?\}`).ReplaceAllStringFunc(value, func(key string) string {
-			if value, ok := stampMap[key[1:len(key)-1]]; ok {
-				return value
+	for _, xdefList := range []struct {
+		xdefs multiFlag
+		check bool
+	}{{uncheckedXdefs, false}, {xdefs, true}} {
+		for _, xdef := range xdefList.xdefs {
+			pkg, name, value, err := xdefTargets.resolve(xdef, xdefList.check)
+			if err != nil {
+				return err
+			}
+			if value, ok := expandStamps(value); ok {
+				goargs = append(goargs, "-X", fmt.Sprintf("%s.%s=%s", pkg, name, value))
 			}
-			missingKey = true
-			return key
-		})
-		if !missingKey {
-			goargs = append(goargs, "-X", fmt.Sprintf("%s.%s=%s", pkg, name, value))
 		}
 	}
+	for _, warning := range xdefTargets.warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
 
 	if *buildmode != "" {
 		goargs = append(goargs, "-buildmode", *buildmode)
 	}
+
 	goargs = append(goargs, "-o", *outFile)
 
 	// add in the unprocess pass through options
@@ -171,5 +204,176 @@ func link(args []string) error {
 		}
 	}
 
+	if *debugOut != "" {
+		// Move the symbols and debug information into the debug file, and
+		// record its name and checksum in the output file, so debuggers can
+		// find it. The output file is only linked once, so its addresses
+		// match those in the debug file.
+		if err := goenv.runCommand([]string{*objcopy, "--only-keep-debug", *outFile, *debugOut}); err != nil {
+			return err
+		}
+		if err := goenv.runCommand([]string{*objcopy, "--strip-all", "--add-gnu-debuglink=" + *debugOut, *outFile}); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// xdefResolver translates the package names in -X flags into package paths
+// known to the linker and checks that the variables they set exist.
+type xdefResolver struct {
+	goenv                *env
+	mainPath, mainFile   string
+	archivesByPath       map[string]*archive
+	ambiguousImportPaths map[string][]string
+	stdPackages          map[string]bool
+
+	// symbols caches the names of data symbols defined in each archive file.
+	symbols map[string]map[string]bool
+
+	// warnings lists -X flags that won't have any effect.
+	warnings []string
+}
+
+func newXdefResolver(goenv *env, mainPath, mainFile string, archives []archive, stdPackageListPath string) (*xdefResolver, error) {
+	r := &xdefResolver{
+		goenv:                goenv,
+		mainPath:             mainPath,
+		mainFile:             mainFile,
+		archivesByPath:       make(map[string]*archive),
+		ambiguousImportPaths: make(map[string][]string),
+		stdPackages:          make(map[string]bool),
+		symbols:              make(map[string]map[string]bool),
+	}
+	for i := range archives {
+		r.archivesByPath[archives[i].packagePath] = &archives[i]
+	}
+	// Package paths take precedence over import paths. Several archives may
+	// have the same import path, for example, vendored copies of a package.
+	// Those import paths can't be used in -X flags.
+	importPathArchives := make(map[string][]*archive)
+	for i := range archives {
+		arc := &archives[i]
+		for _, imp := range append([]string{arc.importPath}, arc.importPathAliases...) {
+			importPathArchives[imp] = append(importPathArchives[imp], arc)
+		}
+	}
+	for imp, arcs := range importPathArchives {
+		if _, ok := r.archivesByPath[imp]; ok {
+			continue
+		}
+		if len(arcs) == 1 {
+			r.archivesByPath[imp] = arcs[0]
+			continue
+		}
+		for _, arc := range arcs {
+			r.ambiguousImportPaths[imp] = append(r.ambiguousImportPaths[imp], arc.packagePath)
+		}
+		sort.Strings(r.ambiguousImportPaths[imp])
+	}
+
+	if stdPackageListPath != "" {
+		data, err := ioutil.ReadFile(stdPackageListPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				r.stdPackages[line] = true
+			}
+		}
+	}
+	return r, nil
+}
+
+// resolve parses an -X flag of the form importpath.name=value. pkg is the
+// path the linker knows the package by: "main" for the main package, or the
+// package path of a dependency. If check is true, resolve records a warning
+// if the package isn't linked into the binary or doesn't define the variable,
+// and it returns an error if the import path refers to more than one linked
+// package. Variables in standard library packages aren't checked.
+func (r *xdefResolver) resolve(xdef string, check bool) (pkg, name, value string, err error) {
+	eq := strings.IndexByte(xdef, '=')
+	if eq < 0 {
+		return "", "", "", fmt.Errorf("-X flag does not contain '=': %s", xdef)
+	}
+	dot := strings.LastIndexByte(xdef[:eq], '.')
+	if dot < 0 {
+		return "", "", "", fmt.Errorf("-X flag does not contain '.': %s", xdef)
+	}
+	pkg, name, value = xdef[:dot], xdef[dot+1:eq], xdef[eq+1:]
+
+	var file string
+	var symbolPrefixes []string
+	if pkg == r.mainPath || pkg == "main" {
+		pkg, file = "main", r.mainFile
+		symbolPrefixes = []string{"main", r.mainPath}
+	} else if arc, ok := r.archivesByPath[pkg]; ok {
+		pkg, file = arc.packagePath, arc.file
+		symbolPrefixes = []string{arc.packagePath}
+	} else if paths, ok := r.ambiguousImportPaths[pkg]; ok && check {
+		return "", "", "", fmt.Errorf("-X %s: import path %s refers to more than one package linked into this binary; use one of these package paths instead: %s", xdef[:eq], pkg, strings.Join(paths, ", "))
+	} else {
+		if check && !r.stdPackages[pkg] {
+			r.warnings = append(r.warnings, fmt.Sprintf("-X %s: package %s is not linked into this binary", xdef[:eq], pkg))
+		}
+		return pkg, name, value, nil
+	}
+	if !check {
+		return pkg, name, value, nil
+	}
+
+	symbols, err := r.dataSymbols(file)
+	if err != nil {
+		return "", "", "", err
+	}
+	if symbols == nil {
+		return pkg, name, value, nil
+	}
+	// Older compilers refer to symbols in the package being compiled with
+	// the "" prefix and leave it to the linker to fill in the package path.
+	for _, prefix := range append(symbolPrefixes, `""`) {
+		if symbols[prefix+"."+name] {
+			return pkg, name, value, nil
+		}
+	}
+	r.warnings = append(r.warnings, fmt.Sprintf("-X %s: package %s does not define variable %s", xdef[:eq], xdef[:dot], name))
+	return pkg, name, value, nil
+}
+
+// dataSymbols returns the names of data symbols defined in an archive, as
+// reported by "go tool nm". Package-level variables are data symbols.
+// dataSymbols returns nil if the SDK doesn't include a prebuilt nm, in which
+// case variables aren't checked. Since a missing variable is only a warning,
+// that doesn't change the result of the link.
+func (r *xdefResolver) dataSymbols(file string) (map[string]bool, error) {
+	if symbols, ok := r.symbols[file]; ok {
+		return symbols, nil
+	}
+	nmArgs := r.goenv.goTool("nm", file)
+	if _, err := os.Stat(nmArgs[0]); os.IsNotExist(err) {
+		r.symbols[file] = nil
+		return nil, nil
+	}
+	out := &bytes.Buffer{}
+	if err := r.goenv.runCommandToFile(out, nmArgs); err != nil {
+		return nil, err
+	}
+	symbols := make(map[string]bool)
+	for _, line := range strings.Split(out.String(), "\n") {
+		// Lines are "address type name". Symbols in archives with several
+		// objects may be prefixed with the name of the object, so look at the
+		// last fields.
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		switch fields[len(fields)-2] {
+		case "D", "d", "B", "b":
+			symbols[fields[len(fields)-1]] = true
+		}
+	}
+	r.symbols[file] = symbols
+	return symbols, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A finding is a diagnostic reported by an analyzer, as it's recorded in a
+// baseline file.
+type finding struct {
+	// file is the path of the file the diagnostic is in, relative to the
+	// execution root and with forward slashes, or "-" if the diagnostic has
+	// no position.
+	file string
+
+	// line is the 1-based line of the diagnostic, or 0 if it has no position.
+	line int
+
+	analyzer, message string
+}
+
+// String formats f as a line of a baseline file. This is how nogo prints
+// diagnostics, without the column, so lines copied from a build log may be
+// added to a baseline, too.
+func (f finding) String() string {
+	message := strings.ReplaceAll(f.message, "\n", `\n`)
+	return fmt.Sprintf("%s:%d: %s (%s)", f.file, f.line, message, f.analyzer)
+}
+
+// baselineLineRe matches a line of a baseline file. A column after the line
+// number is allowed and ignored.
+var baselineLineRe = regexp.MustCompile(`^(.*?):(\d+)(?::\d+)?: (.*) \(([^()\s]+)\)$`)
+
+// baselineKey identifies findings that may match each other, whatever their
+// lines are.
+type baselineKey struct {
+	file, analyzer, message string
+}
+
+// A baseline is a set of findings that don't fail the build. It maps each
+// file, analyzer, and message to the sorted lines of findings with them.
+type baseline map[baselineKey][]int
+
+// readBaseline reads the baseline file at path. Each line of the file is a
+// finding formatted by finding.String. Blank lines and lines starting with
+// "#" are ignored.
+func readBaseline(path string) (baseline, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline file: %v", err)
+	}
+	b := make(baseline)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		m := baselineLineRe.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("%s:%d: invalid baseline entry %q: syntax is \"file:line: message (analyzer)\"", path, i+1, line)
+		}
+		n, err := strconv.Atoi(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid line number %q", path, i+1, m[2])
+		}
+		key := baselineKey{file: m[1], analyzer: m[4], message: m[3]}
+		b[key] = append(b[key], n)
+	}
+	for _, lines := range b {
+		sort.Ints(lines)
+	}
+	return b, nil
+}
+
+// match reports, for each of findings, whether it's recorded in b.
+//
+// A finding is recorded if b has a finding in the same file, from the same
+// analyzer, with the same message. The line doesn't need to match, so
+// findings that moved because lines were added or removed above them are
+// still matched. Each finding in b matches at most one of findings, and the
+// closest pairs of lines are matched first, so when a file has more findings
+// with a message than b records, the ones furthest from the recorded lines
+// don't match.
+func (b baseline) match(findings []finding) []bool {
+	type pair struct {
+		finding, entry, distance int
+	}
+	byKey := make(map[baselineKey][]pair)
+	for i, f := range findings {
+		key := baselineKey{file: f.file, analyzer: f.analyzer, message: strings.ReplaceAll(f.message, "\n", `\n`)}
+		for j, line := range b[key] {
+			byKey[key] = append(byKey[key], pair{finding: i, entry: j, distance: lineDistance(line, f.line)})
+		}
+	}
+
+	matched := make([]bool, len(findings))
+	for key, pairs := range byKey {
+		sort.SliceStable(pairs, func(i, j int) bool {
+			return pairs[i].distance < pairs[j].distance
+		})
+		used := make([]bool, len(b[key]))
+		for _, p := range pairs {
+			if matched[p.finding] || used[p.entry] {
+				continue
+			}
+			matched[p.finding] = true
+			used[p.entry] = true
+		}
+	}
+	return matched
+}
+
+func lineDistance(a, b int) int {
+	if a < b {
+		return b - a
+	}
+	return a - b
+}
+
+// writeBaseline writes findings to a baseline file at path, one per line,
+// sorted by file and line. The file is written even if there are no findings.
+func writeBaseline(path string, findings []finding) error {
+	sorted := append([]finding(nil), findings...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].file != sorted[j].file {
+			return sorted[i].file < sorted[j].file
+		}
+		if sorted[i].line != sorted[j].line {
+			return sorted[i].line < sorted[j].line
+		}
+		return sorted[i].String() < sorted[j].String()
+	})
+	buf := &bytes.Buffer{}
+	for _, f := range sorted {
+		buf.WriteString(f.String())
+		buf.WriteByte('\n')
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		return fmt.Errorf("error writing baseline: %v", err)
+	}
+	return nil
+}
+
+// baselinePath returns the path of filename as it's recorded in a baseline:
+// relative to the working directory, which is the execution root, with
+// forward slashes.
+func baselinePath(filename string) string {
+	if filepath.IsAbs(filename) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, filename); err == nil && !strings.HasPrefix(rel, "..") {
+				filename = rel
+			}
+		}
+	}
+	return filepath.ToSlash(filename)
+}
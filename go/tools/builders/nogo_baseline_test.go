@@ -0,0 +1,192 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBaselineMatch(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		baseline string
+		findings []finding
+		want     []bool
+	}{
+		{
+			desc:     "same_line",
+			baseline: "a.go:3: bad call (funcs)\n",
+			findings: []finding{{file: "a.go", line: 3, analyzer: "funcs", message: "bad call"}},
+			want:     []bool{true},
+		}, {
+			desc:     "shifted_line",
+			baseline: "a.go:3: bad call (funcs)\n",
+			findings: []finding{{file: "a.go", line: 10, analyzer: "funcs", message: "bad call"}},
+			want:     []bool{true},
+		}, {
+			desc:     "column_ignored",
+			baseline: "a.go:3:7: bad call (funcs)\n",
+			findings: []finding{{file: "a.go", line: 3, analyzer: "funcs", message: "bad call"}},
+			want:     []bool{true},
+		}, {
+			desc:     "comments_and_blank_lines",
+			baseline: "# Existing findings.\n\na.go:3: bad call (funcs)\n\n",
+			findings: []finding{{file: "a.go", line: 3, analyzer: "funcs", message: "bad call"}},
+			want:     []bool{true},
+		}, {
+			desc:     "new_finding",
+			baseline: "a.go:3: bad call (funcs)\n",
+			findings: []finding{
+				{file: "a.go", line: 3, analyzer: "funcs", message: "bad call"},
+				{file: "a.go", line: 8, analyzer: "funcs", message: "bad call"},
+			},
+			want: []bool{true, false},
+		}, {
+			desc:     "closest_line_matched",
+			baseline: "a.go:8: bad call (funcs)\n",
+			findings: []finding{
+				{file: "a.go", line: 3, analyzer: "funcs", message: "bad call"},
+				{file: "a.go", line: 9, analyzer: "funcs", message: "bad call"},
+			},
+			want: []bool{false, true},
+		}, {
+			desc:     "different_file",
+			baseline: "a.go:3: bad call (funcs)\n",
+			findings: []finding{{file: "b.go", line: 3, analyzer: "funcs", message: "bad call"}},
+			want:     []bool{false},
+		}, {
+			desc:     "different_analyzer",
+			baseline: "a.go:3: bad call (funcs)\n",
+			findings: []finding{{file: "a.go", line: 3, analyzer: "calls", message: "bad call"}},
+			want:     []bool{false},
+		}, {
+			desc:     "multiline_message",
+			baseline: `a.go:3: bad\ncall (funcs)` + "\n",
+			findings: []finding{{file: "a.go", line: 3, analyzer: "funcs", message: "bad\ncall"}},
+			want:     []bool{true},
+		}, {
+			desc:     "message_with_parens",
+			baseline: "a.go:3: call to f() (funcs)\n",
+			findings: []finding{{file: "a.go", line: 3, analyzer: "funcs", message: "call to f()"}},
+			want:     []bool{true},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			b := readTestBaseline(t, test.baseline)
+			if got := b.match(test.findings); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v; want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadBaselineInvalid(t *testing.T) {
+	path, cleanup := writeTestFile(t, "a.go:3: bad call (funcs)\nnot a finding\n")
+	defer cleanup()
+	_, err := readBaseline(path)
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	if want := path + ":2: invalid baseline entry"; !strings.Contains(err.Error(), want) {
+		t.Errorf("got error %q; want it to contain %q", err, want)
+	}
+}
+
+func TestWriteBaseline(t *testing.T) {
+	findings := []finding{
+		{file: "b.go", line: 1, analyzer: "funcs", message: "bad call"},
+		{file: "a.go", line: 12, analyzer: "funcs", message: "bad\ncall"},
+		{file: "a.go", line: 2, analyzer: "funcs", message: "call to f()"},
+	}
+	dir, err := ioutil.TempDir("", "nogo_baseline_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "baseline.txt")
+	if err := writeBaseline(path, findings); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `a.go:2: call to f() (funcs)
+a.go:12: bad\ncall (funcs)
+b.go:1: bad call (funcs)
+`
+	if got := string(data); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	b, err := readBaseline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.match(findings), []bool{true, true, true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("written baseline doesn't match its findings: got %v; want %v", got, want)
+	}
+}
+
+func TestWriteBaselineEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nogo_baseline_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "baseline.txt")
+	if err := writeBaseline(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("got %d bytes; want an empty file", info.Size())
+	}
+}
+
+func readTestBaseline(t *testing.T, content string) baseline {
+	t.Helper()
+	path, cleanup := writeTestFile(t, content)
+	defer cleanup()
+	b, err := readBaseline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// writeTestFile writes content to a baseline file in a new temporary
+// directory. The returned function removes the directory.
+func writeTestFile(t *testing.T, content string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "nogo_baseline_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "baseline.txt")
+	if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
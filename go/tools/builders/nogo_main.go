@@ -22,6 +22,7 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -34,6 +35,7 @@ import (
 	"os"
 	"reflect"
 	"regexp"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -73,18 +75,43 @@ func run(args []string) error {
 	importcfg := flags.String("importcfg", "", "The import configuration file")
 	packagePath := flags.String("p", "", "The package path (importmap) of the package being compiled")
 	xPath := flags.String("x", "", "The archive file where serialized facts should be written")
+	configPath := flags.String("config", "", "The JSON file configuring analyzers")
+	concurrency := flags.Int("concurrency", defaultConcurrency, "The maximum number of analyzers to run at the same time, or 0 to use GOMAXPROCS")
+	baselinePath := flags.String("baseline", "", "A file listing findings that don't fail the build")
+	writeBaselinePath := flags.String("write_baseline", "", "If set, findings are written to this file in the baseline format instead of failing the build")
 	flags.Parse(args)
 	srcs := flags.Args()
+	if *concurrency <= 0 {
+		*concurrency = runtime.GOMAXPROCS(0)
+	}
+	if configs, err = readConfig(*configPath); err != nil {
+		return err
+	}
+	var base baseline
+	if *baselinePath != "" {
+		if base, err = readBaseline(*baselinePath); err != nil {
+			return err
+		}
+	}
+	generate := *writeBaselinePath != ""
 
 	packageFile, importMap, err := readImportCfg(*importcfg)
 	if err != nil {
 		return fmt.Errorf("error parsing importcfg: %v", err)
 	}
 
-	diagnostics, facts, err := checkPackage(analyzers, *packagePath, packageFile, importMap, factMap, srcs)
+	diagnostics, warnings, findings, facts, err := checkPackage(analyzers, *packagePath, packageFile, importMap, factMap, srcs, *concurrency, base, generate)
 	if err != nil {
 		return fmt.Errorf("error running analyzers: %v", err)
 	}
+	if generate {
+		if err := writeBaseline(abs(*writeBaselinePath), findings); err != nil {
+			return err
+		}
+	}
+	if warnings != "" {
+		fmt.Fprintf(os.Stderr, "warnings found by nogo during build-time code analysis:\n%s\n", warnings)
+	}
 	if diagnostics != "" {
 		return fmt.Errorf("errors found by nogo during build-time code analysis:\n%s\n", diagnostics)
 	}
@@ -142,10 +169,18 @@ func readImportCfg(file string) (packageFile map[string]string, importMap map[st
 
 // checkPackage runs all the given analyzers on the specified package and
 // returns the source code diagnostics that the must be printed in the build log.
-// It returns an empty string if no source code diagnostics need to be printed.
+// Diagnostics from analyzers configured with severity "warning" are returned
+// separately, since they should not fail the build. Each string is empty if
+// there are no diagnostics of that kind. Analyzers configured with severity
+// "off" are not run. Analyzers that don't depend on each other run in
+// parallel, at most concurrency at a time.
+//
+// Diagnostics that would fail the build are also returned as findings.
+// Findings matched by base don't fail the build, and when generate is true,
+// none do, so they can be written to a new baseline.
 //
 // This implementation was adapted from that of golang.org/x/tools/go/checker/internal/checker.
-func checkPackage(analyzers []*analysis.Analyzer, packagePath string, packageFile, importMap map[string]string, factMap map[string]string, filenames []string) (string, []byte, error) {
+func checkPackage(analyzers []*analysis.Analyzer, packagePath string, packageFile, importMap map[string]string, factMap map[string]string, filenames []string, concurrency int, base baseline, generate bool) (string, string, []finding, []byte, error) {
 	// Register fact types and establish dependencies between analyzers.
 	actions := make(map[*analysis.Analyzer]*action)
 	var visit func(a *analysis.Analyzer) *action
@@ -171,27 +206,38 @@ func checkPackage(analyzers []*analysis.Analyzer, packagePath string, packageFil
 	}
 
 	roots := make([]*action, 0, len(analyzers))
+	usesFacts := false
 	for _, a := range analyzers {
-		roots = append(roots, visit(a))
+		if configs[a.Name].severity == "off" {
+			continue
+		}
+		act := visit(a)
+		roots = append(roots, act)
+		usesFacts = usesFacts || act.usesFacts
 	}
 
-	// Load the package, including AST, types, and facts.
+	// Load the package, including AST and types. Type information for imported
+	// packages is read from their export data when the type checker first
+	// imports them. Facts are only read if some analyzer declares fact types,
+	// so memory isn't spent on facts nobody will look at.
 	imp := newImporter(importMap, packageFile, factMap)
-	pkg, err := load(packagePath, imp, filenames)
+	pkg, err := load(packagePath, imp, filenames, usesFacts)
 	if err != nil {
-		return "", nil, fmt.Errorf("error loading package: %v", err)
+		return "", "", nil, nil, fmt.Errorf("error loading package: %v", err)
 	}
+	sem := make(chan struct{}, concurrency)
 	for _, act := range actions {
 		act.pkg = pkg
+		act.sem = sem
 	}
 
 	// Execute the analyzers.
 	execAll(roots)
 
 	// Process diagnostics and encode facts for importers of this package.
-	diagnostics := checkAnalysisResults(roots, pkg)
+	diagnostics, warnings, findings := checkAnalysisResults(roots, pkg, base, generate)
 	facts := pkg.facts.Encode()
-	return diagnostics, facts, nil
+	return diagnostics, warnings, findings, facts, nil
 }
 
 // An action represents one unit of analysis work: the application of
@@ -203,6 +249,7 @@ type action struct {
 	a           *analysis.Analyzer
 	pass        *analysis.Pass
 	pkg         *goPackage
+	sem         chan struct{} // limits the number of analyzers running at once
 	deps        []*action
 	inputs      map[*analysis.Analyzer]interface{}
 	result      interface{}
@@ -279,6 +326,11 @@ func (act *action) execOnce() {
 	}
 	act.pass = pass
 
+	// Wait for a free slot before running. Prerequisites have already
+	// finished, so an action never holds a slot while waiting for another.
+	act.sem <- struct{}{}
+	defer func() { <-act.sem }()
+
 	var err error
 	if act.pkg.illTyped && !pass.Analyzer.RunDespiteErrors {
 		err = fmt.Errorf("analysis skipped due to type-checking error: %v", act.pkg.typeCheckError)
@@ -296,8 +348,9 @@ func (act *action) execOnce() {
 }
 
 // load parses and type checks the source code in each file in filenames.
-// load also deserializes facts stored for imported packages.
-func load(packagePath string, imp *importer, filenames []string) (*goPackage, error) {
+// If readFacts is true, load also deserializes facts stored for imported
+// packages.
+func load(packagePath string, imp *importer, filenames []string, readFacts bool) (*goPackage, error) {
 	if len(filenames) == 0 {
 		return nil, errors.New("no filenames")
 	}
@@ -326,7 +379,11 @@ func load(packagePath string, imp *importer, filenames []string) (*goPackage, er
 	}
 	pkg.types, pkg.typesInfo = types, info
 
-	pkg.facts, err = facts.Decode(pkg.types, imp.readFacts)
+	read := imp.readFacts
+	if !readFacts {
+		read = func(string) ([]byte, error) { return nil, nil }
+	}
+	pkg.facts, err = facts.Decode(pkg.types, read)
 	if err != nil {
 		return nil, fmt.Errorf("internal error decoding facts: %v", err)
 	}
@@ -363,14 +420,17 @@ func (g *goPackage) String() string {
 }
 
 // checkAnalysisResults checks the analysis diagnostics in the given actions
-// and returns a string containing all the diagnostics that should be printed
-// to the build log.
-func checkAnalysisResults(actions []*action, pkg *goPackage) string {
+// and returns strings containing all the diagnostics that should be printed
+// to the build log: the first fails the build, and the second holds
+// diagnostics from analyzers configured as warnings. It also returns the
+// diagnostics that aren't warnings as findings, including those suppressed
+// by base, or by generate, as described in checkPackage.
+func checkAnalysisResults(actions []*action, pkg *goPackage, base baseline, generate bool) (string, string, []finding) {
 	type entry struct {
 		analysis.Diagnostic
 		*analysis.Analyzer
 	}
-	var diagnostics []entry
+	var diagnostics, warnings []entry
 	var errs []error
 	for _, act := range actions {
 		if act.err != nil {
@@ -382,11 +442,15 @@ func checkAnalysisResults(actions []*action, pkg *goPackage) string {
 			continue
 		}
 		config, ok := configs[act.a.Name]
+		out := &diagnostics
+		if config.severity == "warning" {
+			out = &warnings
+		}
 		if !ok {
 			// If the analyzer is not explicitly configured, it emits diagnostics for
 			// all files.
 			for _, diag := range act.diagnostics {
-				diagnostics = append(diagnostics, entry{Diagnostic: diag, Analyzer: act.a})
+				*out = append(*out, entry{Diagnostic: diag, Analyzer: act.a})
 			}
 			continue
 		}
@@ -410,44 +474,72 @@ func checkAnalysisResults(actions []*action, pkg *goPackage) string {
 					}
 				}
 			}
-			if include {
-				for _, pattern := range config.excludeFiles {
-					if pattern.MatchString(filename) {
-						include = false
-						break
-					}
+			if include && (len(config.excludeFiles) > 0 || len(config.excludeMessages) > 0) {
+				// A diagnostic is excluded when it matches every kind of exclusion
+				// that is configured, so a message pattern can be restricted to a
+				// set of files.
+				if (len(config.excludeFiles) == 0 || matchesAny(config.excludeFiles, filename)) &&
+					(len(config.excludeMessages) == 0 || matchesAny(config.excludeMessages, d.Message)) {
+					include = false
 				}
 			}
 			if include {
-				diagnostics = append(diagnostics, entry{Diagnostic: d, Analyzer: act.a})
+				*out = append(*out, entry{Diagnostic: d, Analyzer: act.a})
 			}
 		}
 	}
-	if len(diagnostics) == 0 && len(errs) == 0 {
-		return ""
-	}
 
-	sort.Slice(diagnostics, func(i, j int) bool {
-		return diagnostics[i].Pos < diagnostics[j].Pos
-	})
-	errMsg := &bytes.Buffer{}
-	sep := ""
-	for _, err := range errs {
-		errMsg.WriteString(sep)
-		sep = "\n"
-		errMsg.WriteString(err.Error())
+	findings := make([]finding, len(diagnostics))
+	for i, d := range diagnostics {
+		f := finding{file: "-", analyzer: d.Name, message: d.Message}
+		if p := pkg.fset.Position(d.Pos); p.IsValid() {
+			f.file, f.line = baselinePath(p.Filename), p.Line
+		}
+		findings[i] = f
+	}
+	if generate {
+		diagnostics = nil
+	} else if base != nil {
+		matched := base.match(findings)
+		var unmatched []entry
+		for i, d := range diagnostics {
+			if !matched[i] {
+				unmatched = append(unmatched, d)
+			}
+		}
+		diagnostics = unmatched
 	}
-	for _, d := range diagnostics {
-		errMsg.WriteString(sep)
-		sep = "\n"
-		fmt.Fprintf(errMsg, "%s: %s (%s)", pkg.fset.Position(d.Pos), d.Message, d.Name)
+
+	format := func(errs []error, diagnostics []entry) string {
+		if len(diagnostics) == 0 && len(errs) == 0 {
+			return ""
+		}
+		sort.Slice(diagnostics, func(i, j int) bool {
+			return diagnostics[i].Pos < diagnostics[j].Pos
+		})
+		msg := &bytes.Buffer{}
+		sep := ""
+		for _, err := range errs {
+			msg.WriteString(sep)
+			sep = "\n"
+			msg.WriteString(err.Error())
+		}
+		for _, d := range diagnostics {
+			msg.WriteString(sep)
+			sep = "\n"
+			fmt.Fprintf(msg, "%s: %s (%s)", pkg.fset.Position(d.Pos), d.Message, d.Name)
+		}
+		return msg.String()
 	}
-	return errMsg.String()
+	return format(errs, diagnostics), format(nil, warnings), findings
 }
 
+// configs maps analyzer names to their configurations. Analyzers that aren't
+// configured emit diagnostics for all files.
+var configs map[string]config
+
 // config determines which source files an analyzer will emit diagnostics for.
-// config values are generated in another file that is compiled with
-// nogo_main.go by the nogo rule.
+// config values are read from the file set with -config.
 type config struct {
 	// onlyFiles is a list of regular expressions that match files an analyzer
 	// will emit diagnostics for. When empty, the analyzer will emit diagnostics
@@ -457,6 +549,92 @@ type config struct {
 	// excludeFiles is a list of regular expressions that match files that an
 	// analyzer will not emit diagnostics for.
 	excludeFiles []*regexp.Regexp
+
+	// excludeMessages is a list of regular expressions that match diagnostic
+	// messages that an analyzer will not emit. When excludeFiles is also set,
+	// a diagnostic is only excluded if both its file and its message match.
+	excludeMessages []*regexp.Regexp
+
+	// severity is "warning" if the analyzer's diagnostics should be printed
+	// without failing the build, or "off" if the analyzer should not be run.
+	// When empty, diagnostics are errors.
+	severity string
+}
+
+// readConfig reads the JSON configuration file at path, documented in
+// go/nogo.rst. nogo reads it each time it runs instead of compiling it in, so
+// changing the configuration, for example to turn an analyzer on or off,
+// doesn't rebuild nogo.
+func readConfig(path string) (map[string]config, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+	var jsonConfigs map[string]struct {
+		Description     string            `json:"description"`
+		OnlyFiles       map[string]string `json:"only_files"`
+		ExcludeFiles    map[string]string `json:"exclude_files"`
+		ExcludeMessages map[string]string `json:"exclude_messages"`
+		Severity        string            `json:"severity"`
+	}
+	if err := json.Unmarshal(data, &jsonConfigs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config file: %v", err)
+	}
+	configs := make(map[string]config, len(jsonConfigs))
+	for name, jc := range jsonConfigs {
+		var c config
+		if c.onlyFiles, err = compilePatterns(jc.OnlyFiles); err != nil {
+			return nil, fmt.Errorf("invalid pattern for analysis %q: %v", name, err)
+		}
+		if c.excludeFiles, err = compilePatterns(jc.ExcludeFiles); err != nil {
+			return nil, fmt.Errorf("invalid pattern for analysis %q: %v", name, err)
+		}
+		if c.excludeMessages, err = compilePatterns(jc.ExcludeMessages); err != nil {
+			return nil, fmt.Errorf("invalid message pattern for analysis %q: %v", name, err)
+		}
+		switch jc.Severity {
+		case "", "error":
+			// Errors are the default.
+		case "warning", "off":
+			c.severity = jc.Severity
+		default:
+			return nil, fmt.Errorf("invalid severity for analysis %q: %q (must be \"error\", \"warning\", or \"off\")", name, jc.Severity)
+		}
+		configs[name] = c
+	}
+	return configs, nil
+}
+
+// compilePatterns compiles the regular expressions that are the keys of
+// patterns. The values are descriptions, which are ignored.
+func compilePatterns(patterns map[string]string) ([]*regexp.Regexp, error) {
+	keys := make([]string, 0, len(patterns))
+	for pattern := range patterns {
+		keys = append(keys, pattern)
+	}
+	sort.Strings(keys)
+	var res []*regexp.Regexp
+	for _, pattern := range keys {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// matchesAny reports whether s matches any of patterns.
+func matchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
 }
 
 // importer is an implementation of go/types.Importer that imports type
@@ -0,0 +1,178 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// params.go reads and writes params files. It is compiled into every builder.
+//
+// Params files use Bazel's "shell" format, which is what Starlark actions get
+// with args.set_param_file_format("shell"). Each argument is written on its
+// own line. Arguments that contain anything other than letters, digits, and
+// the characters "@%-_+:,./" are wrapped in single quotes, and each single
+// quote inside is written as '\''. The empty argument is written as ''.
+// writeParamsFile produces exactly this format, so files written by builders
+// (for example, for nogo) are identical to files Bazel would write for the
+// same arguments.
+//
+// readParamsFile accepts that format and a few extensions that are handy when
+// writing params files by hand: double-quoted strings, in which a backslash
+// escapes the next character, and backslash escapes outside quotes.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// maxParamsFileDepth is the maximum depth of params files that reference
+// other params files.
+const maxParamsFileDepth = 16
+
+// expandParamsFiles looks for arguments in args of the form
+// "-param=filename". When it finds these arguments it reads the file "filename"
+// and replaces the argument with its content. Params files may themselves
+// contain "-param=filename" arguments, which are expanded recursively.
+func expandParamsFiles(args []string) ([]string, error) {
+	return expandParamsFilesRec(args, nil)
+}
+
+// expandParamsFilesRec implements expandParamsFiles. stack is the list of
+// params files currently being expanded, used to detect cycles.
+func expandParamsFilesRec(args []string, stack []string) ([]string, error) {
+	var paramsIndices []int
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-param=") {
+			paramsIndices = append(paramsIndices, i)
+		}
+	}
+	if len(paramsIndices) == 0 {
+		return args, nil
+	}
+	var expandedArgs []string
+	last := 0
+	for _, pi := range paramsIndices {
+		expandedArgs = append(expandedArgs, args[last:pi]...)
+		last = pi + 1
+
+		fileName := args[pi][len("-param="):]
+		for i, name := range stack {
+			if filepath.Clean(name) == filepath.Clean(fileName) {
+				cycle := append(append([]string{}, stack[i:]...), fileName)
+				return nil, fmt.Errorf("params file cycle: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		if len(stack) >= maxParamsFileDepth {
+			return nil, fmt.Errorf("params file %s: params files nested more than %d deep", fileName, maxParamsFileDepth)
+		}
+		fileArgs, err := readParamsFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		fileArgs, err = expandParamsFilesRec(fileArgs, append(stack, fileName))
+		if err != nil {
+			return nil, err
+		}
+		expandedArgs = append(expandedArgs, fileArgs...)
+	}
+	expandedArgs = append(expandedArgs, args[last:]...)
+	return expandedArgs, nil
+}
+
+// readParamsFiles parses a Bazel params file in "shell" format. The file
+// should contain one argument per line. Arguments may be quoted with single
+// quotes. All characters within single-quoted strings are interpreted
+// literally including newlines and excepting single quotes. Arguments may
+// also be quoted with double quotes. Within double-quoted strings, newlines
+// and single quotes are literal, and other characters may be escaped with a
+// backslash. Characters outside quoted strings may be escaped with a
+// backslash.
+func readParamsFile(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	var arg []byte
+	quote := false
+	dquote := false
+	escape := false
+	for p := 0; p < len(data); p++ {
+		b := data[p]
+		switch {
+		case escape:
+			arg = append(arg, b)
+			escape = false
+
+		case !dquote && b == '\'':
+			quote = !quote
+
+		case !quote && b == '"':
+			dquote = !dquote
+
+		case !quote && b == '\\':
+			escape = true
+
+		case !quote && !dquote && b == '\n':
+			args = append(args, string(arg))
+			arg = arg[:0]
+
+		default:
+			arg = append(arg, b)
+		}
+	}
+	if quote || dquote {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if escape {
+		return nil, fmt.Errorf("unterminated escape")
+	}
+	if len(arg) > 0 {
+		args = append(args, string(arg))
+	}
+	return args, nil
+}
+
+// writeParamsFile formats a list of arguments in Bazel's "shell" format and writes
+// it to a file.
+func writeParamsFile(path string, args []string) error {
+	buf := new(bytes.Buffer)
+	for _, arg := range args {
+		buf.WriteString(shellQuote(arg))
+		buf.WriteByte('\n')
+	}
+	return ioutil.WriteFile(path, buf.Bytes(), 0666)
+}
+
+// shellQuote quotes an argument the same way Bazel does when writing a params
+// file in "shell" format.
+func shellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	safe := true
+	for i := 0; i < len(arg); i++ {
+		c := arg[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("@%-_+:,./", c) >= 0) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
@@ -0,0 +1,175 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/build"
+	"os/exec"
+	"strings"
+)
+
+// pkgConfigDirective is a "#cgo pkg-config:" directive from the comment
+// before import "C" in a cgo source file.
+type pkgConfigDirective struct {
+	filename string
+
+	// flags are arguments starting with "--", like "--static", which are
+	// passed to pkg-config before the package names.
+	flags []string
+
+	pkgs []string
+}
+
+// readPkgConfigDirectives returns the "#cgo pkg-config:" directives in srcs
+// whose build constraints, like "linux,amd64" in
+// "#cgo linux,amd64 pkg-config: foo", are satisfied by bctx. Other #cgo
+// directives are ignored; their flags are expected to be set in copts,
+// clinkopts, and similar attributes.
+func readPkgConfigDirectives(bctx build.Context, srcs []fileInfo) ([]pkgConfigDirective, error) {
+	var directives []pkgConfigDirective
+	for _, src := range srcs {
+		for _, imp := range src.imports {
+			if imp.path != "C" || imp.doc == nil {
+				continue
+			}
+			for _, line := range strings.Split(imp.doc.Text(), "\n") {
+				orig := line
+				line = strings.TrimSpace(line)
+				if len(line) < 5 || line[:4] != "#cgo" || (line[4] != ' ' && line[4] != '\t') {
+					continue
+				}
+				line = strings.TrimSpace(line[4:])
+				i := strings.Index(line, ":")
+				if i < 0 {
+					return nil, fmt.Errorf("%s: invalid #cgo line: %s", src.filename, orig)
+				}
+				fields := strings.Fields(line[:i])
+				if len(fields) == 0 {
+					return nil, fmt.Errorf("%s: invalid #cgo line: %s", src.filename, orig)
+				}
+				cond, verb := fields[:len(fields)-1], fields[len(fields)-1]
+				if verb != "pkg-config" || !matchCgoCondition(bctx, cond) {
+					continue
+				}
+				args, err := splitQuoted(line[i+1:])
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid #cgo line: %s", src.filename, orig)
+				}
+				d := pkgConfigDirective{filename: src.filename}
+				for _, arg := range args {
+					if strings.HasPrefix(arg, "--") {
+						d.flags = append(d.flags, arg)
+					} else if strings.HasPrefix(arg, "-") {
+						return nil, fmt.Errorf("%s: invalid pkg-config package name: %s", src.filename, arg)
+					} else {
+						d.pkgs = append(d.pkgs, arg)
+					}
+				}
+				if len(d.pkgs) > 0 {
+					directives = append(directives, d)
+				}
+			}
+		}
+	}
+	return directives, nil
+}
+
+// matchCgoCondition reports whether the build constraint terms before the
+// verb in a #cgo directive are satisfied by bctx. The directive applies if
+// any space-separated term matches. A term matches if all its
+// comma-separated tags do.
+func matchCgoCondition(bctx build.Context, cond []string) bool {
+	if len(cond) == 0 {
+		return true
+	}
+	for _, term := range cond {
+		ok := true
+		for _, tag := range strings.Split(term, ",") {
+			if !matchCgoTag(bctx, tag) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCgoTag(bctx build.Context, tag string) bool {
+	if strings.HasPrefix(tag, "!") {
+		return !matchCgoTag(bctx, tag[1:])
+	}
+	if tag == "" {
+		return false
+	}
+	if tag == bctx.GOOS || tag == bctx.GOARCH || tag == bctx.Compiler {
+		return true
+	}
+	if tag == "cgo" && bctx.CgoEnabled {
+		return true
+	}
+	for _, t := range bctx.BuildTags {
+		if t == tag {
+			return true
+		}
+	}
+	for _, t := range bctx.ReleaseTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// runPkgConfig runs pkgConfig for each directive and returns the flags it
+// prints for --cflags and --libs. Like the go command, the C flags should be
+// added to the C preprocessor flags.
+func runPkgConfig(pkgConfig string, directives []pkgConfigDirective) (cppFlags, ldFlags []string, err error) {
+	if len(directives) == 0 {
+		return nil, nil, nil
+	}
+	path, err := exec.LookPath(pkgConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: #cgo pkg-config: directive requires pkg-config, which could not be found: %v\nSet --@io_bazel_rules_go//go/config:pkg_config to the path of pkg-config.", directives[0].filename, err)
+	}
+	for _, d := range directives {
+		for _, mode := range []string{"--cflags", "--libs"} {
+			args := append([]string{mode}, d.flags...)
+			args = append(args, "--")
+			args = append(args, d.pkgs...)
+			cmd := exec.Command(path, args...)
+			stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			if err := cmd.Run(); err != nil {
+				return nil, nil, fmt.Errorf("%s: %s %s: %v\n%s", d.filename, pkgConfig, strings.Join(args, " "), err, stderr.Bytes())
+			}
+			flags, err := splitQuoted(strings.TrimSpace(stdout.String()))
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s: could not parse output of %s %s: %v", d.filename, pkgConfig, strings.Join(args, " "), err)
+			}
+			if mode == "--cflags" {
+				cppFlags = append(cppFlags, flags...)
+			} else {
+				ldFlags = append(ldFlags, flags...)
+			}
+		}
+	}
+	return cppFlags, ldFlags, nil
+}
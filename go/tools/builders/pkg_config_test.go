@@ -0,0 +1,187 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestReadPkgConfigDirectives(t *testing.T) {
+	bctx := build.Default
+	bctx.GOOS = "linux"
+	bctx.GOARCH = "amd64"
+	bctx.BuildTags = []string{"custom"}
+
+	for _, test := range []struct {
+		desc, src string
+		want      []pkgConfigDirective
+		wantErr   string
+	}{
+		{
+			desc: "none",
+			src: `package p
+
+// #cgo CFLAGS: -DFOO
+import "C"
+`,
+		}, {
+			desc: "packages",
+			src: `package p
+
+// #cgo pkg-config: foo bar
+// #cgo LDFLAGS: -lbaz
+// #cgo pkg-config: --static "baz"
+import "C"
+`,
+			want: []pkgConfigDirective{
+				{pkgs: []string{"foo", "bar"}},
+				{flags: []string{"--static"}, pkgs: []string{"baz"}},
+			},
+		}, {
+			desc: "conditions",
+			src: `package p
+
+/*
+#cgo linux,amd64 pkg-config: linux_amd64
+#cgo darwin pkg-config: darwin
+#cgo windows linux,!arm64 pkg-config: not_arm64
+#cgo custom pkg-config: custom
+#cgo !custom pkg-config: not_custom
+*/
+import "C"
+`,
+			want: []pkgConfigDirective{
+				{pkgs: []string{"linux_amd64"}},
+				{pkgs: []string{"not_arm64"}},
+				{pkgs: []string{"custom"}},
+			},
+		}, {
+			desc: "invalid_package",
+			src: `package p
+
+// #cgo pkg-config: -lfoo
+import "C"
+`,
+			wantErr: "invalid pkg-config package name: -lfoo",
+		}, {
+			desc: "invalid_line",
+			src: `package p
+
+// #cgo pkg-config foo
+import "C"
+`,
+			wantErr: "invalid #cgo line",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "TestReadPkgConfigDirectives")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "p.go")
+			if err := ioutil.WriteFile(path, []byte(test.src), 0666); err != nil {
+				t.Fatal(err)
+			}
+			src, err := readFileInfo(bctx, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readPkgConfigDirectives(bctx, []fileInfo{src})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v; want error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range test.want {
+				test.want[i].filename = path
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v; want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRunPkgConfig(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake pkg-config is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "TestRunPkgConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The fake pkg-config prints its arguments after "--" as flags, so the
+	// test can check which packages were requested.
+	pkgConfig := filepath.Join(dir, "pkg-config")
+	script := `#!/bin/sh
+mode=$1
+while [ "$1" != "--" ]; do shift; done
+shift
+for pkg in "$@"; do
+  case $mode in
+    --cflags) printf -- '-I/%s/include "-D%s=a b" ' "$pkg" "$pkg" ;;
+    --libs) printf -- '-L/%s/lib -l%s ' "$pkg" "$pkg" ;;
+  esac
+done
+echo
+`
+	if err := ioutil.WriteFile(pkgConfig, []byte(script), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	directives := []pkgConfigDirective{
+		{filename: "a.go", pkgs: []string{"foo"}},
+		{filename: "b.go", flags: []string{"--static"}, pkgs: []string{"bar"}},
+	}
+	cppFlags, ldFlags, err := runPkgConfig(pkgConfig, directives)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"-I/foo/include", "-Dfoo=a b", "-I/bar/include", "-Dbar=a b"}; !reflect.DeepEqual(cppFlags, want) {
+		t.Errorf("got C preprocessor flags %q; want %q", cppFlags, want)
+	}
+	if want := []string{"-L/foo/lib", "-lfoo", "-L/bar/lib", "-lbar"}; !reflect.DeepEqual(ldFlags, want) {
+		t.Errorf("got linker flags %q; want %q", ldFlags, want)
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		_, _, err := runPkgConfig(filepath.Join(dir, "missing"), directives)
+		if err == nil || !strings.Contains(err.Error(), "go/config:pkg_config") {
+			t.Errorf("got error %v; want an error explaining how to set pkg_config", err)
+		}
+	})
+
+	t.Run("no_directives", func(t *testing.T) {
+		// pkg-config isn't needed when nothing uses it.
+		if _, _, err := runPkgConfig(filepath.Join(dir, "missing"), nil); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -16,187 +16,1794 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 type genFileInfo struct {
-	base       string       // The basename of the path
-	path       string       // The full path to the final file
-	expected   bool         // Whether the file is expected by the rules
-	created    bool         // Whether the file was created by protoc
-	from       *genFileInfo // The actual file protoc produced if not Path
-	unique     bool         // True if this base name is unique in expected results
-	ambiguious bool         // True if there were more than one possible outputs that matched this file
+	base       string         // The basename of the path
+	path       string         // The full path to the final file
+	expected   bool           // Whether the file is expected by the rules
+	created    bool           // Whether the file was created by protoc
+	from       *genFileInfo   // The actual file protoc produced if not Path
+	unique     bool           // True if this base name is unique in expected results
+	ambiguious bool           // True if there were more than one possible outputs that matched this file
+	size       int64          // The size of the file protoc produced
+	plugin     *protocPlugin  // The plugin that produced this file, if created by protoc
+	rel        string         // The path relative to the plugin's output directory, if created by protoc
+	proto      string         // The proto source the file is generated from, if its import path was given with -import
+	importpath string         // The import path given for proto with -import, if expected
+	candidates []*genFileInfo // Generated files with the same base name, if expected
 }
 
+// protocPlugin is a protoc plugin and the options passed to it.
+type protocPlugin struct {
+	base    string   // The plugin's base name without .exe, e.g., protoc-gen-go
+	name    string   // The name used in --<name>_out, e.g., go
+	path    string   // The path to the plugin executable
+	options []string // Options passed to this plugin only
+	onPath  bool     // True if path was resolved by searching PATH
+	outPath string   // The base output path for this plugin's files, if not -out_path
+
+	sourceRelative bool // True if the plugin was given paths=source_relative
+}
+
+// setName sets the name protoc uses to refer to p. Since protoc finds the
+// plugin for --<name>_out by looking for protoc-gen-<name>, this also sets
+// the base name passed to --plugin.
+func (p *protocPlugin) setName(name string) {
+	p.name = name
+	p.base = "protoc-gen-" + name
+}
+
+// lookPath searches PATH for an executable. It is a variable so tests can
+// stub it out.
+var lookPath = exec.LookPath
+
+// resolve searches PATH for the plugin if its path is a bare name with no
+// directory, like "protoc-gen-go".
+func (p *protocPlugin) resolve() error {
+	if strings.ContainsAny(p.path, `/`+string(filepath.Separator)) {
+		return nil
+	}
+	path, err := lookPath(p.path)
+	if err != nil {
+		return fmt.Errorf("could not find plugin %q in PATH: %v", p.path, err)
+	}
+	p.path = path
+	p.onPath = true
+	return nil
+}
+
+// waitOrKill waits for cmd to exit. If ctx is done first, it kills cmd's
+// process group. Killing only protoc isn't enough: cmd.Wait doesn't return
+// until its output is copied, and a hung plugin protoc started keeps
+// protoc's stderr open.
+func waitOrKill(ctx context.Context, cmd *exec.Cmd) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+	return cmd.Wait()
+}
+
+// protocInvocation is a command line to run protoc with and a description of
+// the plugins it runs, for error messages.
+type protocInvocation struct {
+	args    []string
+	plugins string
+}
+
+// pluginList collects -plugin and -option flags. Each -option applies to the
+// most recent -plugin. Options that appear before any -plugin apply to all
+// plugins.
+type pluginList struct {
+	plugins []*protocPlugin
+	common  []string
+	stray   []string // Names of plugin attribute flags that appeared before any -plugin
+}
+
+// describe returns a description of the plugins for error messages.
+func (l *pluginList) describe() string {
+	if len(l.plugins) == 1 {
+		return fmt.Sprintf("the %q plugin", l.plugins[0].name)
+	}
+	names := make([]string, len(l.plugins))
+	for i, p := range l.plugins {
+		names[i] = strconv.Quote(p.name)
+	}
+	return "one of the plugins " + strings.Join(names, ", ")
+}
+
+// pluginFlag adds a plugin to a pluginList. Plugins may be given as a path,
+// in which case the name is derived from the base name of the path, or as
+// name=path.
+type pluginFlag struct{ l *pluginList }
+
+func (f pluginFlag) String() string {
+	if f.l == nil {
+		return ""
+	}
+	var paths []string
+	for _, p := range f.l.plugins {
+		paths = append(paths, p.path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func (f pluginFlag) Set(v string) error {
+	p := &protocPlugin{path: v}
+	if i := strings.Index(v, "="); i >= 0 {
+		p.base, p.path = v[:i], v[i+1:]
+	} else {
+		p.base = strings.TrimSuffix(filepath.Base(v), ".exe")
+	}
+	p.name = strings.TrimPrefix(p.base, "protoc-gen-")
+	f.l.plugins = append(f.l.plugins, p)
+	return nil
+}
+
+// pluginAttrFlag sets an attribute of the last plugin in a pluginList.
+type pluginAttrFlag struct {
+	l    *pluginList
+	name string
+	set  func(p *protocPlugin, v string)
+}
+
+func (f pluginAttrFlag) String() string { return "" }
+
+func (f pluginAttrFlag) Set(v string) error {
+	if len(f.l.plugins) == 0 {
+		// Reported after parsing, so it isn't treated as a usage error.
+		f.l.stray = append(f.l.stray, f.name)
+		return nil
+	}
+	f.set(f.l.plugins[len(f.l.plugins)-1], v)
+	return nil
+}
+
+// optionFlag adds an option to the last plugin in a pluginList, or to the
+// common options if there are no plugins yet.
+type optionFlag struct{ l *pluginList }
+
+func (f optionFlag) String() string { return "" }
+
+func (f optionFlag) Set(v string) error {
+	if len(f.l.plugins) == 0 {
+		f.l.common = append(f.l.common, v)
+	} else {
+		p := f.l.plugins[len(f.l.plugins)-1]
+		p.options = append(p.options, v)
+	}
+	return nil
+}
+
+// placeholderData is written for expected files that protoc did not produce.
+// It has build constraints in both the //go:build and // +build forms, as
+// gofmt writes them, so all versions of Go ignore it.
+var placeholderData = []byte("//go:build ignore\n// +build ignore\n\npackage ignore\n")
+
 func run(args []string) error {
 	// process the args
 	args, err := expandParamsFiles(args)
 	if err != nil {
 		return err
 	}
-	options := multiFlag{}
+	plugins := &pluginList{}
 	descriptors := multiFlag{}
 	expected := multiFlag{}
 	imports := multiFlag{}
 	flags := flag.NewFlagSet("protoc", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage of %s:\n", flags.Name())
+		flags.PrintDefaults()
+		fmt.Fprint(flags.Output(), exitCodesUsage)
+	}
 	protoc := flags.String("protoc", "", "The path to the real protoc.")
 	outPath := flags.String("out_path", "", "The base output path to write to.")
-	plugin := flags.String("plugin", "", "The go plugin to use.")
+	flags.Var(pluginFlag{plugins}, "plugin", "A protoc plugin to run, as a path or name=path. Paths without a directory are looked up in PATH. May be repeated.")
 	importpath := flags.String("importpath", "", "The importpath for the generated sources.")
-	flags.Var(&options, "option", "The plugin options.")
+	linkOutputs := flags.Bool("link-outputs", false, "Hard link generated files into place instead of copying them.")
+	outModeStr := flags.String("out-mode", "0644", "The octal file mode for generated files.")
+	tmpBase := flags.String("tmp-dir", "", "If set, the directory in which protoc's temporary output directory is created, instead of the system default.")
+	workdir := flags.String("workdir", "", "If set, the directory protoc is run in. Include paths are relative to it.")
+	flatten := flags.Bool("flatten", false, "Write generated files directly into -out_path by base name, ignoring the directories protoc created.")
+	warnUnexpected := flags.Bool("warn-unexpected", false, "Print a warning for each generated file that is not an expected output.")
+	minBytes := flags.Int64("min-bytes", 0, "If positive, report an error for expected files protoc produced with fewer than this many bytes.")
+	strictOutputs := flags.Bool("strict-outputs", false, "Report an error for expected files protoc did not produce instead of writing placeholders.")
+	proto3Optional := flags.Bool("proto3-optional", false, "Pass --experimental_allow_proto3_optional to protoc. Requires protoc 3.12 or newer.")
+	fatalWarnings := flags.Bool("fatal-warnings", false, "Pass --fatal_warnings to protoc, so that warnings fail the build.")
+	protoList := flags.String("proto-list", "", "A file listing proto sources to compile, one per line, after those given as arguments.")
+	maxParallel := flags.Int("max-parallel", 1, "The number of protoc invocations to run at once. If greater than 1, protoc is run separately for each plugin.")
+	timeout := flags.Duration("timeout", 0, "If positive, kill protoc if it runs longer than this.")
+	verbose := flags.Bool("v", false, "Log the protoc command line and how generated files are matched with expected files to stderr.")
+	doctor := flags.Bool("doctor", false, "Check that protoc and each plugin can be run, print a diagnosis, and exit without generating files.")
+	printCmd := flags.Bool("print-cmd", false, "Print the protoc command line to stdout and exit without running it.")
+	preserveMtime := flags.Bool("preserve-mtime", false, "Set the modification time of each output to that of the file protoc generated.")
+	outArchive := flags.String("out-archive", "", "If set, write generated files to a tar archive at this path, with paths relative to -out_path, instead of writing them under -out_path.")
+	depfile := flags.String("depfile", "", "If set, write a Makefile-style file listing the expected outputs and the protos they depend on, read from descriptor sets, to this path.")
+	reportJSON := flags.String("report-json", "", "If set, write a JSON report mapping protoc outputs to expected files to this path.")
+	flags.Var(pluginAttrFlag{plugins, "out-path", func(p *protocPlugin, v string) { p.outPath = v }}, "out-path", "The base output path for files generated by the preceding -plugin, if different from -out_path.")
+	flags.Var(pluginAttrFlag{plugins, "plugin-out-name", (*protocPlugin).setName}, "plugin-out-name", "The name used in --<name>_out for the preceding -plugin, if different from the name derived from its file name.")
+	optStyle := flags.String("opt-style", "joined", "How options are passed to plugins: joined in --<name>_out, or flags, as separate --<name>_opt flags.")
+	flags.Var(optionFlag{plugins}, "option", "An option for the preceding -plugin, or for all plugins if no -plugin precedes it.")
 	flags.Var(&descriptors, "descriptor_set", "The descriptor set to read.")
+	descriptorSetStdin := flags.Bool("descriptor-set-stdin", false, "Read a descriptor set from stdin, in addition to those given with -descriptor_set.")
+	descriptorSetList := flags.String("descriptor-set-list", "", "A file listing descriptor sets to read, one per line, after those given with -descriptor_set.")
 	flags.Var(&expected, "expected", "The expected output files.")
 	flags.Var(&imports, "import", "Map a proto file to an import path.")
+	protoPaths := multiFlag{}
+	flags.Var(&protoPaths, "proto_path", "A directory in which protoc looks for sources and imports that are not in a descriptor set. May be repeated.")
+	wellKnownTypes := flags.String("well_known_types", "", "If set, a directory containing the well-known type protos, like google/protobuf/timestamp.proto. Those not in a descriptor set may be imported, and are mapped to the Go packages in google.golang.org/protobuf/types unless -import or an M option maps them.")
+	allowedPlugins := multiFlag{}
+	flags.Var(&allowedPlugins, "allowed-plugin", "The base name of a plugin that may be run, like protoc-gen-go. May be repeated. If not given, any plugin may be run.")
+	pluginEnv := multiFlag{}
+	flags.Var(&pluginEnv, "plugin-env", "A KEY=VALUE environment variable to set when running protoc and its plugins. May be repeated.")
+	outputSuffixes := multiFlag{}
+	flags.Var(&outputSuffixes, "output-suffix", "A suffix of generated files to capture. May be repeated. Defaults to .go.")
+	importMap := flags.String("import-map", "", "A file of proto=importpath lines, treated like -import flags.")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
+	if len(outputSuffixes) == 0 {
+		outputSuffixes = multiFlag{".go"}
+	}
+	if len(plugins.plugins) == 0 {
+		return &ConfigError{errors.New("-plugin was not set")}
+	}
+	if len(plugins.stray) > 0 {
+		return &ConfigError{fmt.Errorf("-%s must follow a -plugin", plugins.stray[0])}
+	}
+	pluginNames := map[string]bool{}
+	for _, p := range plugins.plugins {
+		if pluginNames[p.name] {
+			return &ConfigError{fmt.Errorf("plugin %q was given more than once", p.name)}
+		}
+		pluginNames[p.name] = true
+	}
+	seenExpected := map[string]bool{}
+	for _, path := range expected {
+		if seenExpected[path] {
+			return &ConfigError{fmt.Errorf("expected output %s was given more than once", path)}
+		}
+		seenExpected[path] = true
+	}
+	for _, kv := range pluginEnv {
+		if strings.Index(kv, "=") <= 0 {
+			return &ConfigError{fmt.Errorf("-plugin-env: %q is not of the form KEY=VALUE", kv)}
+		}
+	}
+	for _, p := range plugins.plugins {
+		if err := p.resolve(); err != nil {
+			return &ConfigError{err}
+		}
+		// Check the executable that will run, not p.base, which may be set
+		// to any name with name=path or -plugin-out-name.
+		if exe := strings.TrimSuffix(filepath.Base(p.path), ".exe"); len(allowedPlugins) > 0 && !containsString(allowedPlugins, exe) {
+			return &ConfigError{fmt.Errorf("plugin %s (%s) is not allowed. Allowed plugins are: %s", exe, p.path, strings.Join(allowedPlugins, ", "))}
+		}
+	}
+	if *optStyle != "joined" && *optStyle != "flags" {
+		return &ConfigError{fmt.Errorf("-opt-style must be joined or flags, got %q", *optStyle)}
+	}
+	if *maxParallel < 1 {
+		return &ConfigError{fmt.Errorf("-max-parallel must be at least 1, got %d", *maxParallel)}
+	}
+	outMode, err := strconv.ParseUint(*outModeStr, 8, 32)
+	if err != nil || outMode&^uint64(os.ModePerm) != 0 {
+		return &ConfigError{fmt.Errorf("-out-mode: %q is not a valid octal file mode", *outModeStr)}
+	}
+	if *doctor {
+		env := os.Environ()
+		if len(pluginEnv) > 0 {
+			env = append(env, pluginEnv...)
+		}
+		return runDoctor(os.Stdout, *protoc, plugins.plugins, *workdir, env)
+	}
 
 	// Output to a temporary folder and then move the contents into place below.
 	// This is to work around long file paths on Windows.
-	tmpDir, err := ioutil.TempDir("", "go_proto")
+	if *tmpBase != "" {
+		if info, err := os.Stat(*tmpBase); err != nil {
+			return &ConfigError{fmt.Errorf("-tmp-dir: %v", err)}
+		} else if !info.IsDir() {
+			return &ConfigError{fmt.Errorf("-tmp-dir: %s is not a directory", *tmpBase)}
+		}
+	}
+	tmpDir, err := ioutil.TempDir(*tmpBase, "go_proto")
 	if err != nil {
+		if *tmpBase != "" {
+			return &ConfigError{fmt.Errorf("-tmp-dir: %s is not writable: %v", *tmpBase, err)}
+		}
 		return err
 	}
 	tmpDir = abs(tmpDir)        // required to work with long paths on Windows
 	absOutPath := abs(*outPath) // required to work with long paths on Windows
-	defer os.RemoveAll(tmpDir)
+	defer removeTmpDir(tmpDir)
 
-	pluginBase := filepath.Base(*plugin)
-	pluginName := strings.TrimSuffix(
-		strings.TrimPrefix(filepath.Base(*plugin), "protoc-gen-"), ".exe")
+	if *importMap != "" {
+		mappings, err := readImportMap(*importMap)
+		if err != nil {
+			return err
+		}
+		imports = append(imports, mappings...)
+	}
+	if *descriptorSetList != "" {
+		paths, err := readListFile(*descriptorSetList)
+		if err != nil {
+			return err
+		}
+		descriptors = append(descriptors, paths...)
+	}
+	if *descriptorSetStdin {
+		// protoc only reads descriptor sets from files.
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("reading descriptor set from stdin: %v", err)
+		}
+		path := filepath.Join(tmpDir, "stdin.pb")
+		if err := ioutil.WriteFile(path, data, 0666); err != nil {
+			return err
+		}
+		descriptors = append(descriptors, path)
+	}
+	if *wellKnownTypes != "" {
+		wktDir := filepath.Join(tmpDir, "wkt")
+		wktProtos, err := copyWellKnownTypes(*wellKnownTypes, wktDir, descriptors)
+		if err != nil {
+			return err
+		}
+		protoPaths = append(protoPaths, wktDir)
+		mapped := mappedProtos(imports, plugins)
+		for _, name := range wktProtos {
+			if !mapped[name] {
+				imports = append(imports, name+"="+wellKnownTypeImports[name])
+			}
+		}
+	}
+	var importOptions []string
 	for _, m := range imports {
-		options = append(options, fmt.Sprintf("M%v", m))
+		// protoc matches imports using forward slashes, but the proto file may
+		// be given in Windows form.
+		if i := strings.Index(m, "="); i >= 0 {
+			m = strings.ReplaceAll(m[:i], "\\", "/") + m[i:]
+		}
+		importOptions = append(importOptions, fmt.Sprintf("M%v", m))
 	}
-	if runtime.GOOS == "windows" {
-		// Turn the plugin path into raw form, since we're handing it off to a non-go binary.
-		// This is required to work with long paths on Windows.
-		*plugin = "\\\\?\\" + abs(*plugin)
-	}
-	protoc_args := []string{
-		fmt.Sprintf("--%v_out=%v:%v", pluginName, strings.Join(options, ","), tmpDir),
-		"--plugin", fmt.Sprintf("%v=%v", strings.TrimSuffix(pluginBase, ".exe"), *plugin),
-		"--descriptor_set_in", strings.Join(descriptors, string(os.PathListSeparator)),
-	}
-	protoc_args = append(protoc_args, flags.Args()...)
-	cmd := exec.Command(*protoc, protoc_args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("error running protoc: %v", err)
+	if *workdir != "" {
+		// Paths given to the builder are relative to the builder's working
+		// directory, not protoc's.
+		*protoc = abs(*protoc)
+		for i := range descriptors {
+			descriptors[i] = abs(descriptors[i])
+		}
+		for i := range protoPaths {
+			protoPaths[i] = abs(protoPaths[i])
+		}
+	}
+	// Plugin output directories are kept apart from the other files in
+	// tmpDir, so plugin names can't collide with them.
+	pluginsDir := filepath.Join(tmpDir, "out")
+	if err := os.Mkdir(pluginsDir, 0777); err != nil {
+		return err
+	}
+	var pluginArgs [][]string
+	for _, p := range plugins.plugins {
+		path := p.path
+		if *workdir != "" {
+			path = abs(path)
+		}
+		if runtime.GOOS == "windows" && !p.onPath {
+			// Turn the plugin path into raw form, since we're handing it off to a non-go binary.
+			// This is required to work with long paths on Windows.
+			path = "\\\\?\\" + abs(path)
+		}
+		// Each plugin writes to its own directory, so we know which plugin
+		// produced each file.
+		pluginDir := filepath.Join(pluginsDir, p.name)
+		if err := os.Mkdir(pluginDir, 0777); err != nil {
+			return err
+		}
+		// Options are passed in the order they were given: options for all
+		// plugins, then options for this plugin, then M options for -import
+		// flags. Plugins apply options in order, so a mapping from -import
+		// takes precedence over an M option for the same proto.
+		options := append(append(append([]string{}, plugins.common...), p.options...), importOptions...)
+		p.sourceRelative = hasSourceRelativePaths(options)
+		var args []string
+		if *optStyle == "flags" {
+			// Options may contain commas, which would be split if joined.
+			args = append(args, fmt.Sprintf("--%v_out=%v", p.name, pluginDir))
+			for _, opt := range options {
+				args = append(args, fmt.Sprintf("--%v_opt=%v", p.name, opt))
+			}
+		} else {
+			args = append(args, fmt.Sprintf("--%v_out=%v:%v", p.name, strings.Join(options, ","), pluginDir))
+		}
+		pluginArgs = append(pluginArgs, append(args, "--plugin", fmt.Sprintf("%v=%v", p.base, path)))
+	}
+	var common_args []string
+	common_args = append(common_args,
+		"--descriptor_set_in", strings.Join(descriptors, string(os.PathListSeparator)))
+	for _, dir := range protoPaths {
+		// protoc looks in the proto path first, and falls back to the
+		// descriptor sets for files it doesn't find there.
+		common_args = append(common_args, "--proto_path="+dir)
+	}
+	if *proto3Optional {
+		common_args = append(common_args, proto3OptionalFlag)
+	}
+	if *fatalWarnings {
+		common_args = append(common_args, fatalWarningsFlag)
+	}
+	common_args = append(common_args, flags.Args()...)
+	sources := flags.Args()
+	if *protoList != "" {
+		// Pass the sources to protoc in a response file, so they don't count
+		// toward command line length limits.
+		protos, err := readListFile(*protoList)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, protos...)
+		responseFile := filepath.Join(tmpDir, "protos.txt")
+		if err := ioutil.WriteFile(responseFile, []byte(strings.Join(protos, "\n")+"\n"), 0666); err != nil {
+			return err
+		}
+		common_args = append(common_args, "@"+responseFile)
+	}
+
+	// protoc normally runs all plugins in one invocation. With -max-parallel,
+	// each plugin gets its own invocation, so they may run concurrently.
+	var invocations []protocInvocation
+	if *maxParallel > 1 && len(plugins.plugins) > 1 {
+		for i, p := range plugins.plugins {
+			invocations = append(invocations, protocInvocation{
+				args:    append(append([]string{}, pluginArgs[i]...), common_args...),
+				plugins: p.base,
+			})
+		}
+	} else {
+		var protoc_args []string
+		for _, args := range pluginArgs {
+			protoc_args = append(protoc_args, args...)
+		}
+		invocations = append(invocations, protocInvocation{
+			args:    append(protoc_args, common_args...),
+			plugins: plugins.describe(),
+		})
+	}
+	if *printCmd {
+		for _, inv := range invocations {
+			fmt.Println(formatShellCommand(runtime.GOOS, *workdir, append([]string{*protoc}, inv.args...)))
+		}
+		return nil
+	}
+	logf := func(format string, args ...interface{}) {
+		if *verbose {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		}
+	}
+	if err := checkExecutable(*protoc); err != nil {
+		return &ConfigError{err}
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	runProtoc := func(inv protocInvocation) error {
+		logf("protoc command: %s", formatShellCommand(runtime.GOOS, *workdir, append([]string{*protoc}, inv.args...)))
+		cmd := exec.Command(*protoc, inv.args...)
+		cmd.Dir = *workdir
+		setProcessGroup(cmd)
+		if len(pluginEnv) > 0 {
+			cmd.Env = append(os.Environ(), pluginEnv...)
+		}
+		cmd.Stdout = os.Stdout
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
+		err := cmd.Start()
+		if err == nil {
+			err = waitOrKill(ctx, cmd)
+		}
+		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return &ProtocError{fmt.Errorf("error running protoc: killed after -timeout=%v. A plugin may be hung, for example, waiting for input.%s", *timeout, formatStderr(stderr.Bytes()))}
+			}
+			if *proto3Optional && rejectedFlag(stderr.Bytes(), proto3OptionalFlag) {
+				return &ProtocError{fmt.Errorf("error running protoc: protoc does not support %s, which is needed for -proto3-optional. Use protoc 3.12 or newer.", proto3OptionalFlag)}
+			}
+			if *fatalWarnings && rejectedFlag(stderr.Bytes(), fatalWarningsFlag) {
+				return &ProtocError{fmt.Errorf("error running protoc: protoc does not support %s, which is needed for -fatal-warnings. Use a newer version of protoc.", fatalWarningsFlag)}
+			}
+			if crash, ok := describeCrash(err); ok {
+				return &ProtocError{fmt.Errorf("error running protoc: protoc or %s crashed (%s). Check that the plugin is compatible with this version of protoc.%s", inv.plugins, crash, formatStderr(stderr.Bytes()))}
+			}
+			return &ProtocError{fmt.Errorf("error running protoc: %v%s", err, formatStderr(stderr.Bytes()))}
+		}
+		return nil
+	}
+	errs := make([]error, len(invocations))
+	sem := make(chan struct{}, *maxParallel)
+	var wg sync.WaitGroup
+	for i, inv := range invocations {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, inv protocInvocation) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = runProtoc(inv)
+		}(i, inv)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
 	// Build our file map, and test for existance
+	sourceImports := sourceImportPaths(sources, imports)
 	files := map[string]*genFileInfo{}
 	byBase := map[string]*genFileInfo{}
+	byPath := map[string]*genFileInfo{}
 	for _, path := range expected {
+		logf("expected output: %s", path)
 		info := &genFileInfo{
 			path:     path,
 			base:     filepath.Base(path),
 			expected: true,
 			unique:   true,
 		}
+		if src, ok := sourceImports[fileStem(info.base)]; ok {
+			info.proto = src.proto
+			info.importpath = src.importpath
+		}
 		files[info.path] = info
-		if byBase[info.base] != nil {
+		byPath[abs(info.path)] = info
+		key := baseKey(info.base)
+		if other := byBase[key]; other != nil {
 			info.unique = false
-			byBase[info.base].unique = false
+			other.unique = false
+			if other.base != info.base {
+				// These would overwrite each other on a case-insensitive file system.
+				info.ambiguious = true
+				other.ambiguious = true
+			}
 		} else {
-			byBase[info.base] = info
+			byBase[key] = info
 		}
 	}
 	// Walk the generated files
-	filepath.Walk(tmpDir, func(path string, f os.FileInfo, err error) error {
-		relPath, err := filepath.Rel(tmpDir, path)
-		if err != nil {
+	walker := &outputWalker{
+		pluginsDir: pluginsDir,
+		absOutPath: absOutPath,
+		suffixes:   outputSuffixes,
+		flatten:    *flatten,
+		mirrorDirs: !*flatten && *outArchive == "",
+		files:      files,
+		byBase:     byBase,
+		byPath:     byPath,
+		flattened:  map[string]string{},
+		sources:    sourceStems(sources),
+	}
+	for _, p := range plugins.plugins {
+		if err := walker.walk(p); err != nil {
 			return err
 		}
-		if relPath == "." {
-			return nil
+	}
+	walker.matchCandidates()
+	if *verbose {
+		logResolutions(files, *flatten)
+	}
+	if *reportJSON != "" {
+		if err := writeReport(*reportJSON, files); err != nil {
+			return err
 		}
-
-		if f.IsDir() {
-			if err := os.Mkdir(filepath.Join(absOutPath, relPath), f.Mode()); !os.IsExist(err) {
+	}
+	var archive *outputArchive
+	if *outArchive != "" {
+		archive = &outputArchive{root: absOutPath, files: map[string]archiveFile{}}
+	}
+	writeGenerated := func(src, dst string) error {
+		logf("writing %s to %s", src, dst)
+		var mtime time.Time
+		if *preserveMtime {
+			info, err := os.Stat(src)
+			if err != nil {
 				return err
 			}
-			return nil
-		}
-
-		if !strings.HasSuffix(path, ".go") {
-			return nil
+			mtime = info.ModTime()
 		}
-
-		info := &genFileInfo{
-			path:    path,
-			base:    filepath.Base(path),
-			created: true,
+		if archive != nil {
+			return archive.add(dst, archiveFile{src: src, modTime: mtime})
 		}
-
-		if foundInfo, ok := files[relPath]; ok {
-			foundInfo.created = true
-			foundInfo.from = info
-			return nil
+		if err := writeOutput(src, dst, os.FileMode(outMode), *linkOutputs); err != nil {
+			return err
 		}
-		files[relPath] = info
-		copyTo := byBase[info.base]
-		switch {
-		case copyTo == nil:
-			// Unwanted output
-		case !copyTo.unique:
-			// not unique, no copy allowed
-		case copyTo.from != nil:
-			copyTo.ambiguious = true
-			info.ambiguious = true
-		default:
-			copyTo.from = info
-			copyTo.created = true
-			info.expected = true
+		if *preserveMtime {
+			return os.Chtimes(dst, mtime, mtime)
 		}
 		return nil
-	})
+	}
 	buf := &bytes.Buffer{}
+	var unexpected, tooSmall []string
+	var ambiguous, missing []*genFileInfo
 	for _, f := range files {
 		switch {
+		case f.expected && f.ambiguious:
+			ambiguous = append(ambiguous, f)
+		case f.expected && !f.created && *strictOutputs:
+			missing = append(missing, f)
 		case f.expected && !f.created:
 			// Some plugins only create output files if the proto source files have
 			// have relevant definitions (e.g., services for grpc_gateway). Create
 			// trivial files that the compiler will ignore for missing outputs.
-			data := []byte("// +build ignore\n\npackage ignore")
-			if err := ioutil.WriteFile(abs(f.path), data, 0644); err != nil {
+			logf("writing placeholder to %s", f.path)
+			if archive != nil {
+				if err := archive.add(abs(f.path), archiveFile{data: placeholderData}); err != nil {
+					return err
+				}
+			} else if err := ioutil.WriteFile(abs(f.path), placeholderData, os.FileMode(outMode)); err != nil {
 				return err
 			}
-		case f.expected && f.ambiguious:
-			fmt.Fprintf(buf, "Ambiguious output %v.\n", f.path)
+		case f.from != nil && f.from.size < *minBytes:
+			tooSmall = append(tooSmall, fmt.Sprintf("%v (%d bytes)", f.path, f.from.size))
 		case f.from != nil:
-			data, err := ioutil.ReadFile(f.from.path)
-			if err != nil {
+			if err := writeGenerated(f.from.path, abs(f.path)); err != nil {
 				return err
 			}
-			if err := ioutil.WriteFile(abs(f.path), data, 0644); err != nil {
+		case !f.expected && *flatten && !f.ambiguious:
+			// Candidates of an ambiguous expected file aren't copied, since
+			// the ambiguity fails the action.
+			if err := writeGenerated(f.path, filepath.Join(f.plugin.outRoot(absOutPath), f.base)); err != nil {
 				return err
 			}
-		case !f.expected:
-			//fmt.Fprintf(buf, "Unexpected output %v.\n", f.path)
+		case !f.expected && !f.ambiguious:
+			unexpected = append(unexpected, fmt.Sprintf("%s (%s)", filepath.ToSlash(f.rel), f.base))
 		}
-		if buf.Len() > 0 {
-			fmt.Fprintf(buf, "Check that the go_package option is %q.", *importpath)
-			return errors.New(buf.String())
+	}
+	if *warnUnexpected && len(unexpected) > 0 {
+		sort.Strings(unexpected)
+		fmt.Fprintf(os.Stderr, "warning: protoc generated files that are not expected outputs. They will be discarded. Check the list of expected files.\n  %s\n", strings.Join(unexpected, "\n  "))
+	}
+	// Report all problems at once, so they can be fixed together. The
+	// go_package hint for -importpath is only given once.
+	needHint := false
+	report := func(problem string, files []*genFileInfo) {
+		sort.Slice(files, func(i, j int) bool { return files[i].path < files[j].path })
+		for _, f := range files {
+			fmt.Fprintf(buf, "%s %v.%s\n", problem, f.path, f.goPackageHint())
+			needHint = needHint || f.importpath == ""
+		}
+	}
+	report("Ambiguious output", ambiguous)
+	report("Missing output", missing)
+	if needHint {
+		fmt.Fprintf(buf, "Check that the go_package option is %q.", *importpath)
+	}
+	if buf.Len() > 0 {
+		return &OutputError{errors.New(strings.TrimSuffix(buf.String(), "\n"))}
+	}
+	if len(tooSmall) > 0 {
+		sort.Strings(tooSmall)
+		return &OutputError{fmt.Errorf("protoc produced outputs smaller than -min-bytes=%d. The plugin may have crashed or produced truncated output:\n  %s", *minBytes, strings.Join(tooSmall, "\n  "))}
+	}
+	if archive != nil {
+		if err := archive.write(*outArchive, os.FileMode(outMode)); err != nil {
+			return err
+		}
+	}
+	if *depfile != "" {
+		if err := writeDepfile(*depfile, expected, sources, descriptors); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// goPackageHint returns a sentence naming the go_package option f's proto
+// should have, if its import path was given with -import. Otherwise, the
+// import path given with -importpath applies, and the hint is empty.
+func (f *genFileInfo) goPackageHint() string {
+	if f.importpath == "" {
+		return ""
+	}
+	return fmt.Sprintf(" Check that the go_package option in %s is %q.", f.proto, f.importpath)
+}
+
+// protoImport is a proto source and the import path given for it with
+// -import.
+type protoImport struct {
+	proto, importpath string
+}
+
+// sourceImportPaths returns the import paths given with -import for proto
+// sources, keyed by the file stem of each source, which is also the stem of
+// the files generated from it. Sources without an -import mapping, and
+// sources whose stems clash, are omitted.
+func sourceImportPaths(sources, imports []string) map[string]protoImport {
+	byProto := map[string]string{}
+	for _, m := range imports {
+		if i := strings.Index(m, "="); i >= 0 {
+			byProto[filepath.ToSlash(m[:i])] = m[i+1:]
+		}
+	}
+	byStem := map[string]protoImport{}
+	clashes := map[string]bool{}
+	for _, src := range sources {
+		importpath, ok := byProto[filepath.ToSlash(src)]
+		if !ok {
+			continue
+		}
+		stem := fileStem(filepath.Base(src))
+		if other, ok := byStem[stem]; ok && other.importpath != importpath {
+			clashes[stem] = true
+		}
+		byStem[stem] = protoImport{proto: src, importpath: importpath}
+	}
+	for stem := range clashes {
+		delete(byStem, stem)
+	}
+	return byStem
+}
+
+// fileStem returns base up to its first '.', e.g., "foo" for "foo.pb.go".
+func fileStem(base string) string {
+	if i := strings.Index(base, "."); i >= 0 {
+		return base[:i]
+	}
+	return base
+}
+
+// writeDepfile writes a Makefile-style dependency file to path, naming
+// targets as depending on sources and the proto files described in the
+// descriptor sets, including the files they import.
+func writeDepfile(path string, targets, sources, descriptorSets []string) error {
+	seen := map[string]bool{}
+	var deps []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			deps = append(deps, name)
+		}
+	}
+	for _, src := range sources {
+		add(filepath.ToSlash(src))
+	}
+	for _, set := range descriptorSets {
+		names, err := readDescriptorSetFiles(set)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			add(name)
+		}
+	}
+	sort.Strings(deps)
+
+	escape := func(paths []string) string {
+		escaped := make([]string, len(paths))
+		for i, p := range paths {
+			p = strings.ReplaceAll(p, "$", "$$")
+			escaped[i] = strings.ReplaceAll(p, " ", `\ `)
+		}
+		return strings.Join(escaped, " \\\n  ")
+	}
+	data := fmt.Sprintf("%s: \\\n  %s\n", escape(targets), escape(deps))
+	return ioutil.WriteFile(path, []byte(data), 0666)
+}
+
+// readDescriptorSetFiles returns the names of the files in the serialized
+// FileDescriptorSet at path, along with the names of the files they import.
+// Only the fields needed for this are decoded.
+func readDescriptorSetFiles(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	// FileDescriptorSet.file is field 1.
+	err = walkProtoFields(data, func(num int, value []byte) error {
+		if num != 1 {
+			return nil
+		}
+		// FileDescriptorProto.name is field 1, and dependency is field 3.
+		return walkProtoFields(value, func(num int, value []byte) error {
+			if num == 1 || num == 3 {
+				names = append(names, string(value))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return names, nil
+}
+
+// walkProtoFields calls f for each length-delimited field in the protobuf
+// message data. Fields of other types are skipped.
+func walkProtoFields(data []byte, f func(num int, value []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("invalid protobuf message: bad field key")
+		}
+		data = data[n:]
+		num, wireType := int(key>>3), key&7
+		switch wireType {
+		case 0: // varint
+			if _, n = binary.Uvarint(data); n <= 0 {
+				return errors.New("invalid protobuf message: bad varint")
+			}
+			data = data[n:]
+		case 1: // 64-bit
+			if len(data) < 8 {
+				return errors.New("invalid protobuf message: truncated field")
+			}
+			data = data[8:]
+		case 2: // length-delimited
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errors.New("invalid protobuf message: truncated field")
+			}
+			value := data[n : n+int(size)]
+			data = data[n+int(size):]
+			if err := f(num, value); err != nil {
+				return err
+			}
+		case 5: // 32-bit
+			if len(data) < 4 {
+				return errors.New("invalid protobuf message: truncated field")
+			}
+			data = data[4:]
+		default:
+			return fmt.Errorf("invalid protobuf message: unsupported wire type %d", wireType)
+		}
+	}
+	return nil
+}
+
+// wellKnownTypeImports maps the well-known type protos bundled with protoc to
+// the Go packages generated from them. These match the go_package options
+// the protos have declared since protobuf 3.14.
+var wellKnownTypeImports = map[string]string{
+	"google/protobuf/any.proto":             "google.golang.org/protobuf/types/known/anypb",
+	"google/protobuf/api.proto":             "google.golang.org/protobuf/types/known/apipb",
+	"google/protobuf/compiler/plugin.proto": "google.golang.org/protobuf/types/pluginpb",
+	"google/protobuf/descriptor.proto":      "google.golang.org/protobuf/types/descriptorpb",
+	"google/protobuf/duration.proto":        "google.golang.org/protobuf/types/known/durationpb",
+	"google/protobuf/empty.proto":           "google.golang.org/protobuf/types/known/emptypb",
+	"google/protobuf/field_mask.proto":      "google.golang.org/protobuf/types/known/fieldmaskpb",
+	"google/protobuf/source_context.proto":  "google.golang.org/protobuf/types/known/sourcecontextpb",
+	"google/protobuf/struct.proto":          "google.golang.org/protobuf/types/known/structpb",
+	"google/protobuf/timestamp.proto":       "google.golang.org/protobuf/types/known/timestamppb",
+	"google/protobuf/type.proto":            "google.golang.org/protobuf/types/known/typepb",
+	"google/protobuf/wrappers.proto":        "google.golang.org/protobuf/types/known/wrapperspb",
+}
+
+// copyWellKnownTypes copies the well-known type protos in srcDir to dstDir,
+// keeping their import paths, and returns their sorted import paths. Protos
+// already defined in one of descriptorSets are skipped, since protoc would
+// otherwise prefer the copy in the proto path over a version the user
+// vendored. Protos missing from srcDir are skipped too, since older protobuf
+// releases don't have all of them.
+func copyWellKnownTypes(srcDir, dstDir string, descriptorSets []string) ([]string, error) {
+	defined := map[string]bool{}
+	for _, set := range descriptorSets {
+		names, err := readDescriptorSetFiles(set)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			defined[name] = true
+		}
+	}
+	var copied []string
+	for name := range wellKnownTypeImports {
+		if defined[name] {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(srcDir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		dst := filepath.Join(dstDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(dst, data, 0666); err != nil {
+			return nil, err
+		}
+		copied = append(copied, name)
+	}
+	sort.Strings(copied)
+	return copied, nil
+}
+
+// mappedProtos returns the set of proto files mapped to Go packages by
+// imports, which are proto=importpath strings, or by M options passed to any
+// plugin.
+func mappedProtos(imports []string, plugins *pluginList) map[string]bool {
+	mapped := map[string]bool{}
+	add := func(m string) {
+		if i := strings.Index(m, "="); i > 0 {
+			mapped[strings.ReplaceAll(m[:i], "\\", "/")] = true
+		}
+	}
+	for _, m := range imports {
+		add(m)
+	}
+	options := append([]string{}, plugins.common...)
+	for _, p := range plugins.plugins {
+		options = append(options, p.options...)
+	}
+	for _, opt := range options {
+		if strings.HasPrefix(opt, "M") {
+			add(opt[len("M"):])
+		}
+	}
+	return mapped
+}
+
+// readImportMap reads a file mapping proto files to Go import paths. Each
+// line has the form proto=importpath, like the value of an -import flag.
+// Blank lines and lines starting with '#' are ignored.
+func readImportMap(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var mappings []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if eq := strings.Index(line, "="); eq <= 0 || eq == len(line)-1 {
+			return nil, &ConfigError{fmt.Errorf("%s:%d: expected proto=importpath, got %q", path, i+1, line)}
+		}
+		mappings = append(mappings, line)
+	}
+	return mappings, nil
+}
+
+// readListFile reads a file containing one path per line. Blank lines are
+// ignored.
+func readListFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// formatShellCommand formats args as a command that can be pasted into a
+// shell on goos: cmd.exe on Windows, or a POSIX shell elsewhere. If dir is not
+// empty, the command changes to that directory first.
+func formatShellCommand(goos, dir string, args []string) string {
+	quote := quotePosixArg
+	if goos == "windows" {
+		quote = quoteWindowsArg
+	}
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = quote(arg)
+	}
+	cmd := strings.Join(quoted, " ")
+	if dir != "" {
+		cmd = "cd " + quote(dir) + " && " + cmd
+	}
+	return cmd
+}
+
+// quotePosixArg quotes s for a POSIX shell if it contains any characters
+// the shell would interpret.
+func quotePosixArg(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// quoteWindowsArg quotes s so that CommandLineToArgvW parses it as a single
+// argument. This follows the same rules as syscall.EscapeArg.
+func quoteWindowsArg(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"") {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\':
+			slashes++
+		case '"':
+			// Backslashes before a quote must be doubled, and the quote escaped.
+			b.WriteString(strings.Repeat(`\`, slashes+1))
+			slashes = 0
+		default:
+			slashes = 0
+		}
+		b.WriteByte(c)
+	}
+	// Backslashes before the closing quote must be doubled.
+	b.WriteString(strings.Repeat(`\`, slashes))
+	b.WriteByte('"')
+	return b.String()
+}
+
+// checkExecutable returns an error if protoc does not name an executable
+// file. A bare name is searched for in PATH, as exec.Command does.
+func checkExecutable(protoc string) error {
+	notFound := fmt.Errorf("protoc binary not found or not executable: %s", protoc)
+	if !strings.ContainsAny(protoc, `/`+string(filepath.Separator)) {
+		if _, err := lookPath(protoc); err != nil {
+			return notFound
+		}
+		return nil
+	}
+	candidates := []string{protoc}
+	if runtime.GOOS == "windows" && !strings.EqualFold(filepath.Ext(protoc), ".exe") {
+		candidates = append(candidates, protoc+".exe")
+	}
+	for _, path := range candidates {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		// Windows doesn't have executable bits.
+		if runtime.GOOS == "windows" || info.Mode()&0111 != 0 {
+			return nil
+		}
+	}
+	return notFound
+}
+
+// runDoctor checks that protoc can be run and that each plugin responds to an
+// empty code generation request, printing the result of each check to w. An
+// error is returned if any check fails.
+func runDoctor(w io.Writer, protoc string, plugins []*protocPlugin, dir string, env []string) error {
+	failed := false
+	fail := func(format string, args ...interface{}) {
+		failed = true
+		fmt.Fprintf(w, "FAIL "+format+"\n", args...)
+	}
+
+	if err := checkExecutable(protoc); err != nil {
+		fail("%v", err)
+	} else {
+		cmd := exec.Command(protoc, "--version")
+		cmd.Dir = dir
+		cmd.Env = env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			fail("protoc %s --version: %v%s", protoc, err, formatStderr(out))
+		} else {
+			fmt.Fprintf(w, "ok   protoc %s: %s\n", protoc, strings.TrimSpace(string(out)))
+		}
+	}
+
+	for _, p := range plugins {
+		// An empty message is a valid CodeGeneratorRequest with no files
+		// to generate.
+		cmd := exec.Command(p.path)
+		cmd.Dir = dir
+		cmd.Env = env
+		cmd.Stdin = bytes.NewReader(nil)
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			fail("plugin %s (%s) failed on an empty request: %v%s", p.base, p.path, err, formatStderr(stderr.Bytes()))
+			continue
+		}
+		// CodeGeneratorResponse.error is field 1.
+		var respErr string
+		if err := walkProtoFields(stdout.Bytes(), func(num int, value []byte) error {
+			if num == 1 {
+				respErr = string(value)
+			}
+			return nil
+		}); err != nil {
+			fail("plugin %s (%s) did not write a valid response. Check that it is a protoc plugin.", p.base, p.path)
+			continue
+		}
+		if respErr != "" {
+			fail("plugin %s (%s) reported an error on an empty request: %s", p.base, p.path, respErr)
+			continue
+		}
+		fmt.Fprintf(w, "ok   plugin %s (%s) responded to an empty request\n", p.base, p.path)
+	}
+
+	if failed {
+		return &ConfigError{errors.New("protoc or a plugin is not working. See the diagnosis above.")}
+	}
+	return nil
+}
+
+// proto3OptionalFlag allows optional fields in proto3 files. It was added
+// in protoc 3.12 and is not needed (but still accepted) since 3.15.
+const proto3OptionalFlag = "--experimental_allow_proto3_optional"
+
+// fatalWarningsFlag makes protoc fail when it reports warnings. Older
+// versions of protoc don't recognize it.
+const fatalWarningsFlag = "--fatal_warnings"
+
+// rejectedFlag reports whether protoc's stderr shows that it failed because
+// it did not recognize flag, which happens with older versions of protoc.
+func rejectedFlag(stderr []byte, flag string) bool {
+	return bytes.Contains(stderr, []byte("Unknown flag: "+flag))
+}
+
+// maxStderrLines is the number of lines of protoc's stderr included in
+// errors returned by the builder.
+const maxStderrLines = 10
+
+// formatStderr returns the last maxStderrLines lines of protoc's stderr,
+// formatted to be appended to an error message. If stderr is empty,
+// formatStderr returns an empty string.
+func formatStderr(stderr []byte) string {
+	lines := strings.Split(strings.TrimRight(string(stderr), "\r\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return ""
+	}
+	header := "\nprotoc stderr:\n"
+	if len(lines) > maxStderrLines {
+		header = fmt.Sprintf("\nprotoc stderr (last %d lines):\n", maxStderrLines)
+		lines = lines[len(lines)-maxStderrLines:]
+	}
+	return header + strings.Join(lines, "\n")
+}
+
+// describeCrash reports whether err, returned by running protoc, indicates
+// that protoc or a plugin crashed rather than reporting an error normally.
+// This is the case when the process was killed by a signal or exited with a
+// status above 128, which shells and wrappers use for signal deaths.
+func describeCrash(err error) (string, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return "", false
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return fmt.Sprintf("killed by signal: %v", status.Signal()), true
+	}
+	if code := exitErr.ExitCode(); code > 128 {
+		return fmt.Sprintf("exit status %d", code), true
+	}
+	return "", false
+}
+
+// caseInsensitiveFS is true on platforms whose file systems are usually
+// case-insensitive. It is a variable so tests can change it.
+var caseInsensitiveFS = runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+
+// baseKey returns the key for a base name in the map used to match generated
+// files with expected files. On case-insensitive file systems, names that
+// differ only in case refer to the same file, so they have the same key.
+func baseKey(base string) string {
+	if caseInsensitiveFS {
+		return strings.ToLower(base)
+	}
+	return base
+}
+
+// outRoot returns the absolute base output path for files produced by p.
+func (p *protocPlugin) outRoot(absOutPath string) string {
+	if p.outPath == "" {
+		return absOutPath
+	}
+	return abs(p.outPath)
+}
+
+// outputWalker matches files produced by plugins with expected files.
+type outputWalker struct {
+	pluginsDir string                  // The directory containing each plugin's output directory
+	absOutPath string                  // The absolute -out_path
+	suffixes   []string                // Suffixes of generated files to consider
+	flatten    bool                    // Whether generated files are written to output roots by base name
+	mirrorDirs bool                    // Whether directories protoc created are created in output roots
+	files      map[string]*genFileInfo // Expected and generated files
+	byBase     map[string]*genFileInfo // Expected files by baseKey
+	byPath     map[string]*genFileInfo // Expected files by absolute path
+	flattened  map[string]string       // Relative paths of generated files by base name, when flattening
+	sources    map[string]bool         // Slash-separated proto sources without extensions, for source-relative plugins
+}
+
+// walk adds the files p produced in its directory within w.pluginsDir to w.files
+// and matches them with expected files. Files with one of w.suffixes are
+// matched by base name. Other files are only matched with expected files at
+// the same path.
+//
+// Symlinks to directories are followed, since plugins may create them, and
+// filepath.Walk does not follow them. Symlinks that would lead back to a
+// directory being walked are skipped.
+func (w *outputWalker) walk(p *protocPlugin) error {
+	root := p.outRoot(w.absOutPath)
+	var walking []string
+	var walkDir func(dir, relDir string) error
+	walkDir = func(dir, relDir string) error {
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return err
+		}
+		realDir = abs(realDir)
+		walking = append(walking, realDir)
+		defer func() { walking = walking[:len(walking)-1] }()
+
+		// filepath.Walk doesn't follow dir itself if it's a symlink.
+		return filepath.Walk(realDir, func(path string, f os.FileInfo, err error) error {
+			relPath, err := outputRelPath(realDir, path)
+			if err != nil {
+				return err
+			}
+			if relPath == "." {
+				return nil
+			}
+			relPath = filepath.Join(relDir, relPath)
+
+			if f.Mode()&os.ModeSymlink != 0 {
+				target, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+				if target.IsDir() {
+					if isSymlinkLoop(path, walking) {
+						return nil
+					}
+					if w.mirrorDirs {
+						if err := os.Mkdir(filepath.Join(root, relPath), target.Mode().Perm()); err != nil && !os.IsExist(err) {
+							return err
+						}
+					}
+					return walkDir(path, relPath)
+				}
+				f = target
+			}
+
+			if f.IsDir() {
+				if !w.mirrorDirs {
+					return nil
+				}
+				if err := os.Mkdir(filepath.Join(root, relPath), f.Mode()); !os.IsExist(err) {
+					return err
+				}
+				return nil
+			}
+
+			if !hasAnySuffix(path, w.suffixes) {
+				// Other files are only copied to expected outputs at the same path.
+				if copyTo := w.byPath[filepath.Join(root, relPath)]; copyTo != nil && copyTo.from == nil {
+					info := &genFileInfo{
+						path:     path,
+						base:     filepath.Base(path),
+						expected: true,
+						created:  true,
+						size:     f.Size(),
+						plugin:   p,
+						rel:      relPath,
+					}
+					w.files[filepath.Join(p.name, relPath)] = info
+					copyTo.from = info
+					copyTo.created = true
+				}
+				return nil
+			}
+			genRel := relPath
+			if w.flatten {
+				base := filepath.Base(relPath)
+				if other, ok := w.flattened[base]; ok {
+					return &OutputError{fmt.Errorf("cannot flatten generated files %s and %s: both are named %s", other, relPath, base)}
+				}
+				w.flattened[base] = relPath
+				relPath = base
+			}
+
+			info := &genFileInfo{
+				path:    path,
+				base:    filepath.Base(path),
+				created: true,
+				size:    f.Size(),
+				plugin:  p,
+				rel:     relPath,
+			}
+
+			if foundInfo, ok := w.files[relPath]; ok {
+				foundInfo.created = true
+				foundInfo.from = info
+				return nil
+			}
+			// Plugins may produce files with the same relative path, so files
+			// produced by protoc are keyed by their path within pluginsDir.
+			w.files[filepath.Join(p.name, relPath)] = info
+			copyTo := w.byBase[baseKey(info.base)]
+			switch {
+			case copyTo == nil:
+				// Unwanted output
+			case p.outPath != "" && !isUnder(copyTo.path, root):
+				// Belongs to a plugin with a different output path
+			case p.sourceRelative && !w.sources[sourceStem(genRel)]:
+				// Not generated from one of the sources. With
+				// paths=source_relative, files are written to the directory of
+				// their proto, so only a file in a source's directory can
+				// match that source's expected file.
+			case !copyTo.unique:
+				// not unique, no copy allowed
+			default:
+				copyTo.candidates = append(copyTo.candidates, info)
+			}
+			return nil
+		})
+	}
+	return walkDir(filepath.Join(w.pluginsDir, p.name), "")
+}
+
+// hasSourceRelativePaths reports whether options, passed to a plugin, include
+// paths=source_relative. Options may be joined with commas. A later paths
+// option overrides an earlier one, as in protoc-gen-go.
+func hasSourceRelativePaths(options []string) bool {
+	sourceRelative := false
+	for _, opt := range options {
+		for _, o := range strings.Split(opt, ",") {
+			if strings.HasPrefix(o, "paths=") {
+				sourceRelative = o == "paths=source_relative"
+			}
+		}
+	}
+	return sourceRelative
+}
+
+// sourceStem returns the slash-separated path of a proto or a file generated
+// from it with the base name cut at its first '.', e.g., "a/foo" for both
+// "a/foo.proto" and "a/foo.pb.go".
+func sourceStem(path string) string {
+	path = filepath.ToSlash(path)
+	dir, base := "", path
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		dir, base = path[:i+1], path[i+1:]
+	}
+	return dir + fileStem(base)
+}
+
+// sourceStems returns the set of sourceStem values for proto sources.
+func sourceStems(sources []string) map[string]bool {
+	stems := make(map[string]bool, len(sources))
+	for _, src := range sources {
+		stems[sourceStem(src)] = true
+	}
+	return stems
+}
+
+// matchCandidates matches expected files with the generated files that were
+// found with the same base name after all plugins' outputs are walked. If an
+// expected file has several candidates, the one whose directory matches the
+// most trailing directories of the expected file is chosen. If there is no
+// single best candidate, the expected file and its candidates are ambiguous.
+func (w *outputWalker) matchCandidates() {
+	for _, f := range w.byBase {
+		if len(f.candidates) == 0 {
+			continue
+		}
+		best := bestCandidate(f)
+		if best == nil {
+			f.ambiguious = true
+			for _, c := range f.candidates {
+				c.ambiguious = true
+			}
+			continue
+		}
+		f.from = best
+		f.created = true
+		best.expected = true
+	}
+}
+
+// bestCandidate returns the generated file that f should be copied from, or
+// nil if its candidates can't be told apart.
+func bestCandidate(f *genFileInfo) *genFileInfo {
+	if f.from != nil {
+		// A generated file with the same path was also found.
+		return nil
+	}
+	if len(f.candidates) == 1 {
+		return f.candidates[0]
+	}
+	var best *genFileInfo
+	bestScore, tied := -1, false
+	for _, c := range f.candidates {
+		score := matchingDirs(f.path, c.rel)
+		switch {
+		case score > bestScore:
+			best, bestScore, tied = c, score, false
+		case score == bestScore:
+			tied = true
+		}
+	}
+	if tied {
+		return nil
+	}
+	return best
+}
+
+// matchingDirs returns the number of trailing directory names that the
+// expected path and the generated file's relative path have in common.
+func matchingDirs(expectedPath, relPath string) int {
+	dirNames := func(path string) []string {
+		dir := filepath.ToSlash(filepath.Dir(path))
+		if dir == "." {
+			return nil
+		}
+		return strings.Split(dir, "/")
+	}
+	want, got := dirNames(expectedPath), dirNames(relPath)
+	n := 0
+	for n < len(want) && n < len(got) && baseKey(want[len(want)-1-n]) == baseKey(got[len(got)-1-n]) {
+		n++
+	}
+	return n
+}
+
+// outputRelPath returns the path of the generated file path relative to the
+// directory dir protoc wrote it in. Files outside dir are rejected, since
+// their relative paths would place them outside the output root when copied.
+func outputRelPath(dir, path string) (string, error) {
+	relPath, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", err
+	}
+	if relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", &OutputError{fmt.Errorf("protoc generated %s outside of its output directory %s. Check the go_package option for path elements like \"..\".", path, dir)}
+	}
+	return relPath, nil
+}
+
+// isSymlinkLoop reports whether following the symlink link would walk a
+// directory again. walking lists the resolved directories being walked.
+func isSymlinkLoop(link string, walking []string) bool {
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return true
+	}
+	target = abs(target)
+	for _, dir := range walking {
+		if isUnder(dir, target) {
+			return true
+		}
+	}
+	// A link may point to a directory containing it, without passing through
+	// one of the directories being walked.
+	parent, err := filepath.EvalSymlinks(filepath.Dir(link))
+	return err != nil || isUnder(parent, target)
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnySuffix reports whether s ends with any of suffixes.
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnder reports whether path is within the directory root, which must be
+// absolute.
+func isUnder(path, root string) bool {
+	rel, err := filepath.Rel(root, abs(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// logResolutions logs how each file generated by protoc was matched with
+// expected files, for -v.
+func logResolutions(files map[string]*genFileInfo, flatten bool) {
+	matchedTo := map[*genFileInfo]string{}
+	var generated []*genFileInfo
+	for _, f := range files {
+		if f.from != nil {
+			matchedTo[f.from] = f.path
+		}
+		if f.plugin != nil {
+			generated = append(generated, f)
+		}
+	}
+	sort.Slice(generated, func(i, j int) bool {
+		if generated[i].plugin.name != generated[j].plugin.name {
+			return generated[i].plugin.name < generated[j].plugin.name
+		}
+		return generated[i].rel < generated[j].rel
+	})
+	for _, f := range generated {
+		var resolution string
+		switch dst, ok := matchedTo[f]; {
+		case ok:
+			resolution = "matched " + dst
+		case f.ambiguious:
+			resolution = "ambiguous"
+		case flatten:
+			resolution = "flattened"
+		default:
+			resolution = "unexpected"
+		}
+		fmt.Fprintf(os.Stderr, "generated %s by %s: %s\n", filepath.ToSlash(f.rel), f.plugin.name, resolution)
+	}
+}
+
+// genFileReport is the JSON form of a genFileInfo written by -report-json.
+// Files produced by protoc are identified by their path relative to the
+// plugin's output directory, since the directory is deleted when the builder
+// exits.
+type genFileReport struct {
+	Base      string `json:"base"`
+	Path      string `json:"path"`
+	Expected  bool   `json:"expected"`
+	Created   bool   `json:"created"`
+	Ambiguous bool   `json:"ambiguous"`
+	From      string `json:"from,omitempty"`
+	Plugin    string `json:"plugin,omitempty"`
+}
+
+// writeReport writes a JSON list describing files, sorted by path, to
+// reportPath.
+func writeReport(reportPath string, files map[string]*genFileInfo) error {
+	report := make([]genFileReport, 0, len(files))
+	for _, f := range files {
+		r := genFileReport{
+			Base:      f.base,
+			Path:      f.path,
+			Expected:  f.expected,
+			Created:   f.created,
+			Ambiguous: f.ambiguious,
+		}
+		if f.plugin != nil {
+			r.Path = filepath.ToSlash(f.rel)
+			r.Plugin = f.plugin.name
+		}
+		if f.from != nil {
+			r.From = filepath.ToSlash(f.from.rel)
+			r.Plugin = f.from.plugin.name
+		}
+		report = append(report, r)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Path < report[j].Path })
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(reportPath, data, 0666)
+}
+
+// removeAll removes a directory tree. It is a variable so tests can simulate
+// transient failures.
+var removeAll = os.RemoveAll
+
+// removeTmpDir removes the temporary output directory. On Windows, removal
+// may fail while protoc or a virus scanner still holds a handle to a file,
+// so it is retried a few times. Failure is logged but is not an error.
+func removeTmpDir(dir string) {
+	attempts := 1
+	if runtime.GOOS == "windows" {
+		attempts = 5
+	}
+	if err := removeAllWithRetry(dir, attempts, 50*time.Millisecond); err != nil {
+		log.Printf("warning: could not remove temporary directory: %v", err)
+	}
+}
+
+// removeAllWithRetry calls removeAll up to attempts times, doubling delay
+// between each attempt, and returns the last error.
+func removeAllWithRetry(dir string, attempts int, delay time.Duration) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = removeAll(dir); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// linkFile creates a hard link. It is a variable so tests can simulate
+// failures such as cross-device links.
+var linkFile = os.Link
+
+// outputArchive collects output files to be written to a tar archive for
+// -out-archive.
+type outputArchive struct {
+	root  string                 // The absolute directory archive paths are relative to
+	files map[string]archiveFile // Files to write, by slash-separated archive path
+}
+
+// archiveFile is the content of a file in an outputArchive, either read from
+// src or given as data. If modTime is zero, a fixed time is used.
+type archiveFile struct {
+	src     string
+	data    []byte
+	modTime time.Time
+}
+
+// add adds a file that would be written to dst if an archive were not used.
+func (a *outputArchive) add(dst string, f archiveFile) error {
+	rel, err := filepath.Rel(a.root, dst)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return &OutputError{fmt.Errorf("cannot add %s to -out-archive: it is not under -out_path %s", dst, a.root)}
+	}
+	a.files[filepath.ToSlash(rel)] = f
+	return nil
+}
+
+// write writes the archive to path. Files are sorted by name and have the
+// given mode and, unless given, a fixed modification time, so archives are
+// reproducible.
+func (a *outputArchive) write(path string, mode os.FileMode) error {
+	names := make([]string, 0, len(a.files))
+	for name := range a.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(out)
+	for _, name := range names {
+		f := a.files[name]
+		data := f.data
+		if f.src != "" {
+			if data, err = ioutil.ReadFile(f.src); err != nil {
+				out.Close()
+				return err
+			}
+		}
+		modTime := f.modTime
+		if modTime.IsZero() {
+			modTime = time.Unix(0, 0)
+		}
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    int64(mode),
+			Size:    int64(len(data)),
+			ModTime: modTime,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			out.Close()
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeOutput writes the generated file at src to dst with the given mode.
+// If link is true, a hard link is attempted first. If linking fails (for
+// example, because src and dst are on different devices), the file is
+// copied instead.
+func writeOutput(src, dst string, mode os.FileMode, link bool) error {
+	if link {
+		if err := linkFile(src, dst); err == nil {
+			return os.Chmod(dst, mode)
+		}
+	}
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, data, mode)
+}
+
+// ConfigError is returned by run when the builder is invoked incorrectly, for
+// example, with invalid flags or a plugin that can't be found.
+type ConfigError struct{ Err error }
+
+func (e *ConfigError) Error() string { return e.Err.Error() }
+func (e *ConfigError) Unwrap() error { return e.Err }
+
+// ProtocError is returned by run when protoc or a plugin fails.
+type ProtocError struct{ Err error }
+
+func (e *ProtocError) Error() string { return e.Err.Error() }
+func (e *ProtocError) Unwrap() error { return e.Err }
+
+// OutputError is returned by run when the files protoc generated don't match
+// the expected outputs, for example, because an output is missing or
+// ambiguous.
+type OutputError struct{ Err error }
+
+func (e *OutputError) Error() string { return e.Err.Error() }
+func (e *OutputError) Unwrap() error { return e.Err }
+
+// Exit codes for each class of error returned by run. Other errors, like I/O
+// errors, exit with code 1.
+const (
+	exitConfigError = 2 // Also used by the flag package for invalid flags
+	exitProtocError = 3
+	exitOutputError = 4
+)
+
+const exitCodesUsage = `
+Exit codes:
+  1  other errors, like I/O errors
+  2  invalid flags or configuration
+  3  protoc or a plugin failed
+  4  generated files do not match the expected outputs
+`
+
+// exitCode returns the exit code the builder should exit with for err.
+func exitCode(err error) int {
+	var configErr *ConfigError
+	var protocErr *ProtocError
+	var outputErr *OutputError
+	switch {
+	case errors.As(err, &configErr):
+		return exitConfigError
+	case errors.As(err, &protocErr):
+		return exitProtocError
+	case errors.As(err, &outputErr):
+		return exitOutputError
+	default:
+		return 1
+	}
+}
+
 func main() {
 	if err := run(os.Args[1:]); err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,2258 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/build/constraint"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProtocEnv is set in the environment of a subprocess when the test
+// binary should act as protoc instead of running tests. The value is a
+// JSON-encoded fakeProtocConfig.
+const fakeProtocEnv = "GO_PROTOC_TEST_FAKE"
+
+// fakeProtocConfig describes how the fake protoc should behave.
+type fakeProtocConfig struct {
+	// Outputs maps paths relative to the --*_out directory to the contents
+	// the fake protoc should write there.
+	Outputs map[string]string
+
+	// PluginOutputs maps plugin names (as in --<name>_out) to outputs
+	// written to that plugin's output directory, like Outputs.
+	PluginOutputs map[string]map[string]string
+
+	// ArgsFile, if set, is a path where the fake protoc writes its
+	// command line arguments as a JSON list. newProtocTest sets this.
+	ArgsFile string
+
+	// CheckSources makes the fake protoc fail unless each proto source and
+	// each file it imports can be found in an include directory given with
+	// -I or --proto_path, relative to the fake protoc's working directory.
+	CheckSources bool
+
+	// Stderr is written to the fake protoc's stderr before it does anything
+	// else.
+	Stderr string
+
+	// Sleep is how long the fake protoc waits after writing Stderr.
+	Sleep time.Duration
+
+	// ExitCode, if non-zero, makes the fake protoc exit with this code
+	// without producing outputs.
+	ExitCode int
+
+	// RejectFlags lists flags the fake protoc doesn't recognize. If one is
+	// given, it fails like an old version of protoc.
+	RejectFlags []string
+
+	// Kill makes the fake protoc kill itself instead of producing outputs,
+	// simulating a crash.
+	Kill bool
+
+	// Symlinks maps paths relative to the --*_out directory to the targets
+	// of symlinks the fake protoc should create there, after writing
+	// Outputs.
+	Symlinks map[string]string
+
+	// EnvOutputs maps paths relative to the --*_out directory to the names
+	// of environment variables whose values the fake protoc should write
+	// there, like a plugin configured by its environment.
+	EnvOutputs map[string]string
+
+	// BrokenPlugin makes the fake protoc, when run as a plugin without
+	// arguments, fail instead of writing an empty response.
+	BrokenPlugin bool
+
+	// ConcurrencyDir, if set, is a directory where the fake protoc records
+	// how many fake protoc processes were running at once. While running,
+	// each process has a file named running-<pid> there. After Sleep, it
+	// writes the number of such files to count-<pid>.
+	ConcurrencyDir string
+
+	// StartPlugin makes the fake protoc start itself as a plugin before
+	// writing Stderr, like protoc running a plugin. The plugin shares the
+	// fake protoc's stderr and isn't waited for.
+	StartPlugin bool
+
+	// PluginSleep is how long the fake protoc waits when run as a plugin,
+	// before reading its request.
+	PluginSleep time.Duration
+
+	// OutputsModTime, if not zero, is set as the modification time of files
+	// written from Outputs.
+	OutputsModTime time.Time
+}
+
+func TestMain(m *testing.M) {
+	if cfg := os.Getenv(fakeProtocEnv); cfg != "" {
+		os.Exit(fakeProtoc(cfg, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeProtoc is a minimal stand-in for protoc. It writes the configured
+// outputs into the directory named by the first --*_out flag.
+func fakeProtoc(rawCfg string, args []string) int {
+	var cfg fakeProtocConfig
+	if err := json.Unmarshal([]byte(rawCfg), &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+		return 2
+	}
+	if len(args) == 0 {
+		// Run as a plugin. An empty CodeGeneratorResponse is valid.
+		time.Sleep(cfg.PluginSleep)
+		if _, err := ioutil.ReadAll(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "fake plugin: %v\n", err)
+			return 1
+		}
+		if cfg.BrokenPlugin {
+			fmt.Fprintln(os.Stderr, "fake plugin: panic: broken")
+			return 2
+		}
+		return 0
+	}
+	if len(args) == 1 && args[0] == "--version" {
+		fmt.Println("libprotoc 3.21.12")
+		return 0
+	}
+	// Expand response files, which contain one argument per line.
+	var expandedArgs []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			expandedArgs = append(expandedArgs, arg)
+			continue
+		}
+		data, err := ioutil.ReadFile(arg[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+			return 1
+		}
+		expandedArgs = append(expandedArgs, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")...)
+	}
+	args = expandedArgs
+	if cfg.ArgsFile != "" {
+		data, _ := json.Marshal(args)
+		if err := ioutil.WriteFile(cfg.ArgsFile, data, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+			return 1
+		}
+	}
+	outDir := ""
+	pluginDirs := map[string]string{}
+	var includes, sources []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "-I"):
+			includes = append(includes, arg[len("-I"):])
+		case strings.HasPrefix(arg, "--proto_path="):
+			includes = append(includes, arg[len("--proto_path="):])
+		case arg == "--plugin" || arg == "--descriptor_set_in":
+			i++
+		case strings.HasPrefix(arg, "--") && strings.Contains(arg, "_out="):
+			eq := strings.Index(arg, "=")
+			name := strings.TrimSuffix(arg[len("--"):eq], "_out")
+			value := arg[eq+1:]
+			pluginDirs[name] = value[strings.Index(value, ":")+1:]
+			if outDir == "" {
+				outDir = pluginDirs[name]
+			}
+		case !strings.HasPrefix(arg, "-"):
+			sources = append(sources, arg)
+		}
+	}
+	if outDir == "" {
+		fmt.Fprintln(os.Stderr, "fake protoc: missing --*_out flag")
+		return 2
+	}
+	if cfg.StartPlugin {
+		self, err := os.Executable()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+			return 1
+		}
+		plugin := exec.Command(self)
+		plugin.Stderr = os.Stderr
+		if err := plugin.Start(); err != nil {
+			fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+			return 1
+		}
+	}
+	fmt.Fprint(os.Stderr, cfg.Stderr)
+	if cfg.ConcurrencyDir != "" {
+		running := filepath.Join(cfg.ConcurrencyDir, fmt.Sprintf("running-%d", os.Getpid()))
+		if err := ioutil.WriteFile(running, nil, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+			return 1
+		}
+		defer os.Remove(running)
+	}
+	time.Sleep(cfg.Sleep)
+	if cfg.ConcurrencyDir != "" {
+		matches, err := filepath.Glob(filepath.Join(cfg.ConcurrencyDir, "running-*"))
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(cfg.ConcurrencyDir, fmt.Sprintf("count-%d", os.Getpid())), []byte(strconv.Itoa(len(matches))), 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+			return 1
+		}
+	}
+	for _, arg := range args {
+		for _, flag := range cfg.RejectFlags {
+			if arg == flag {
+				fmt.Fprintf(os.Stderr, "Unknown flag: %s\n", flag)
+				return 1
+			}
+		}
+	}
+	if cfg.ExitCode != 0 {
+		return cfg.ExitCode
+	}
+	if cfg.Kill {
+		p, err := os.FindProcess(os.Getpid())
+		if err == nil {
+			err = p.Kill()
+		}
+		fmt.Fprintf(os.Stderr, "fake protoc: could not kill self: %v\n", err)
+		return 1
+	}
+	if cfg.CheckSources {
+		if err := fakeProtocCheckSources(includes, sources); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if err := fakeProtocWrite(outDir, cfg.Outputs); err != nil {
+		fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+		return 1
+	}
+	if !cfg.OutputsModTime.IsZero() {
+		for rel := range cfg.Outputs {
+			if err := os.Chtimes(filepath.Join(outDir, filepath.FromSlash(rel)), cfg.OutputsModTime, cfg.OutputsModTime); err != nil {
+				fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+				return 1
+			}
+		}
+	}
+	envOutputs := map[string]string{}
+	for rel, name := range cfg.EnvOutputs {
+		envOutputs[rel] = os.Getenv(name)
+	}
+	if err := fakeProtocWrite(outDir, envOutputs); err != nil {
+		fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+		return 1
+	}
+	for rel, target := range cfg.Symlinks {
+		path := filepath.Join(outDir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+			return 1
+		}
+		if err := os.Symlink(target, path); err != nil {
+			fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+			return 1
+		}
+	}
+	for name, outputs := range cfg.PluginOutputs {
+		dir, ok := pluginDirs[name]
+		if !ok {
+			// The plugin may be run by another invocation.
+			continue
+		}
+		if err := fakeProtocWrite(dir, outputs); err != nil {
+			fmt.Fprintf(os.Stderr, "fake protoc: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// fakeProtocWrite writes outputs, keyed by slash-separated paths relative to
+// dir.
+func fakeProtocWrite(dir string, outputs map[string]string) error {
+	for rel, content := range outputs {
+		path := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fakeProtocCheckSources checks that sources and their transitive imports can
+// be found in includes.
+func fakeProtocCheckSources(includes, sources []string) error {
+	seen := map[string]bool{}
+	for len(sources) > 0 {
+		src := sources[0]
+		sources = sources[1:]
+		if seen[src] {
+			continue
+		}
+		seen[src] = true
+		var data []byte
+		for _, inc := range includes {
+			var err error
+			if data, err = ioutil.ReadFile(filepath.Join(inc, filepath.FromSlash(src))); err == nil {
+				break
+			}
+		}
+		if data == nil {
+			return fmt.Errorf("%s: File not found.", src)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "import ") {
+				sources = append(sources, strings.Trim(line[len("import "):], `";`))
+			}
+		}
+	}
+	return nil
+}
+
+// testImportpath is the importpath passed to the builder in tests.
+const testImportpath = "example.com/foo"
+
+// protocTest holds the directories and fake tools used by a single test.
+type protocTest struct {
+	t        *testing.T
+	dir      string
+	outDir   string
+	protoc   string
+	plugin   string
+	argsFile string
+}
+
+// newProtocTest creates a temporary directory with an output directory, a
+// fake plugin, and configures the test binary to act as protoc with cfg.
+// The output directory contains the package directory for testImportpath,
+// since Bazel creates parent directories of declared outputs.
+func newProtocTest(t *testing.T, cfg fakeProtocConfig) *protocTest {
+	dir, err := ioutil.TempDir("", "protoc_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	outDir := filepath.Join(dir, "out")
+	if err := os.MkdirAll(filepath.Join(outDir, filepath.FromSlash(testImportpath)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	plugin := filepath.Join(dir, "protoc-gen-go")
+	if err := ioutil.WriteFile(plugin, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	protoc, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ArgsFile = filepath.Join(dir, "args.json")
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(fakeProtocEnv, string(data))
+	t.Cleanup(func() { os.Unsetenv(fakeProtocEnv) })
+	return &protocTest{t: t, dir: dir, outDir: outDir, protoc: protoc, plugin: plugin, argsFile: cfg.ArgsFile}
+}
+
+// out returns the path of a file below the output directory. rel is
+// slash-separated.
+func (pt *protocTest) out(rel string) string {
+	return filepath.Join(pt.outDir, filepath.FromSlash(rel))
+}
+
+// run invokes the builder with standard flags followed by args.
+func (pt *protocTest) run(args ...string) error {
+	stdArgs := []string{
+		"-protoc", pt.protoc,
+		"-out_path", pt.outDir,
+		"-plugin", pt.plugin,
+		"-importpath", testImportpath,
+	}
+	return run(append(stdArgs, args...))
+}
+
+// newPlugin creates an empty executable file to stand in for a plugin.
+func (pt *protocTest) newPlugin(name string) string {
+	path := filepath.Join(pt.dir, name)
+	if err := ioutil.WriteFile(path, nil, 0755); err != nil {
+		pt.t.Fatal(err)
+	}
+	return path
+}
+
+// readArgs returns the arguments recorded by the fake protoc.
+func (pt *protocTest) readArgs() []string {
+	data, err := ioutil.ReadFile(pt.argsFile)
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	var args []string
+	if err := json.Unmarshal(data, &args); err != nil {
+		pt.t.Fatal(err)
+	}
+	return args
+}
+
+// captureStderr calls f with os.Stderr redirected to a file and returns what
+// was written.
+func (pt *protocTest) captureStderr(f func()) string {
+	return pt.capture(&os.Stderr, f)
+}
+
+// captureStdout calls f with os.Stdout redirected to a file and returns what
+// was written.
+func (pt *protocTest) captureStdout(f func()) string {
+	return pt.capture(&os.Stdout, f)
+}
+
+// capture calls f with *file, which is os.Stdout or os.Stderr, redirected to
+// a file and returns what was written.
+func (pt *protocTest) capture(file **os.File, f func()) string {
+	tmp, err := ioutil.TempFile(pt.dir, "output")
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	defer tmp.Close()
+	orig := *file
+	*file = tmp
+	defer func() { *file = orig }()
+	f()
+	data, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	return string(data)
+}
+
+// readOut returns the contents of a file below the output directory.
+func (pt *protocTest) readOut(rel string) string {
+	data, err := ioutil.ReadFile(pt.out(rel))
+	if err != nil {
+		pt.t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestReportsAllProblems(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"x/bar.pb.go": "package x",
+			"y/bar.pb.go": "package y",
+			"baz.pb.go":   "package baz",
+		},
+	})
+	err := pt.run(
+		"-expected", pt.out("example.com/foo/foo.pb.go"),
+		"-expected", pt.out("example.com/foo/bar.pb.go"),
+		"-expected", pt.out("example.com/foo/baz.pb.go"),
+		"foo.proto", "bar.proto", "baz.proto")
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	if !strings.Contains(err.Error(), "Ambiguious output "+pt.out("example.com/foo/bar.pb.go")) {
+		t.Errorf("error does not report ambiguous output: %v", err)
+	}
+	if got := pt.readOut("example.com/foo/baz.pb.go"); got != "package baz" {
+		t.Errorf("baz.pb.go: got %q, want %q", got, "package baz")
+	}
+	if got := pt.readOut("example.com/foo/foo.pb.go"); !strings.Contains(got, "ignore") {
+		t.Errorf("foo.pb.go: got %q, want placeholder", got)
+	}
+}
+
+func TestPreferDeeperMatch(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"other.com/foo/foo.pb.go":   "package foo // other",
+			"example.com/foo/foo.pb.go": "package foo",
+			"bar/foo/foo.pb.go":         "package foo // bar",
+		},
+	})
+	if err := pt.run("-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pt.readOut("example.com/foo/foo.pb.go"), "package foo"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStillAmbiguous(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"x/foo/foo.pb.go": "package x",
+			"y/foo/foo.pb.go": "package y",
+		},
+	})
+	expected := pt.out("example.com/foo/foo.pb.go")
+	err := pt.run("-expected", expected, "foo.proto")
+	if err == nil || !strings.Contains(err.Error(), "Ambiguious output "+expected) {
+		t.Errorf("got error %v, want ambiguous output error", err)
+	}
+}
+
+func TestSourceRelative(t *testing.T) {
+	for _, test := range []struct {
+		desc, src string
+		options   []string
+	}{
+		{desc: "option", src: "a/foo.proto", options: []string{"paths=source_relative"}},
+		{desc: "joined", src: "a/foo.proto", options: []string{"plugins=grpc,paths=source_relative"}},
+		{desc: "nested", src: "other/a/foo.proto", options: []string{"paths=source_relative"}},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			// Without the option, the files would be ambiguous, since neither
+			// directory matches the expected file's directory.
+			genRel := strings.TrimSuffix(test.src, ".proto") + ".pb.go"
+			pt := newProtocTest(t, fakeProtocConfig{
+				Outputs: map[string]string{
+					genRel:            "package foo",
+					"other/foo.pb.go": "package other",
+				},
+			})
+			args := []string{"-expected", pt.out("example.com/foo/foo.pb.go")}
+			for _, opt := range test.options {
+				args = append(args, "-option", opt)
+			}
+			if err := pt.run(append(args, test.src)...); err != nil {
+				t.Fatal(err)
+			}
+			if got, want := pt.readOut("example.com/foo/foo.pb.go"), "package foo"; got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSourceRelativeOverridden(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"a/foo.pb.go":     "package foo",
+			"other/foo.pb.go": "package other",
+		},
+	})
+	expected := pt.out("example.com/foo/foo.pb.go")
+	err := pt.run("-option", "paths=source_relative", "-option", "paths=import", "-expected", expected, "a/foo.proto")
+	if err == nil || !strings.Contains(err.Error(), "Ambiguious output "+expected) {
+		t.Errorf("got error %v, want ambiguous output error", err)
+	}
+}
+
+func TestLinkOutputs(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{"foo.pb.go": "package foo"},
+	})
+	var linked []string
+	defer func(orig func(string, string) error) { linkFile = orig }(linkFile)
+	linkFile = func(src, dst string) error {
+		linked = append(linked, dst)
+		return os.Link(src, dst)
+	}
+	if err := pt.run("-link-outputs", "-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	if len(linked) != 1 || linked[0] != pt.out("example.com/foo/foo.pb.go") {
+		t.Errorf("got links %v, want one link to foo.pb.go", linked)
+	}
+	if got := pt.readOut("example.com/foo/foo.pb.go"); got != "package foo" {
+		t.Errorf("foo.pb.go: got %q, want %q", got, "package foo")
+	}
+}
+
+func TestLinkOutputsFallback(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{"foo.pb.go": "package foo"},
+	})
+	defer func(orig func(string, string) error) { linkFile = orig }(linkFile)
+	linkFile = func(src, dst string) error {
+		return &os.LinkError{Op: "link", Old: src, New: dst, Err: errors.New("invalid cross-device link")}
+	}
+	if err := pt.run("-link-outputs", "-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.pb.go"); got != "package foo" {
+		t.Errorf("foo.pb.go: got %q, want %q", got, "package foo")
+	}
+	fi, err := os.Stat(pt.out("example.com/foo/foo.pb.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := fi.Mode().Perm(); mode&^0644 != 0 && runtime.GOOS != "windows" {
+		t.Errorf("copied file has mode %v, want at most 0644", mode)
+	}
+}
+
+func TestOutMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on Windows")
+	}
+	for _, mode := range []os.FileMode{0600, 0444} {
+		t.Run(fmt.Sprintf("%04o", mode), func(t *testing.T) {
+			pt := newProtocTest(t, fakeProtocConfig{
+				Outputs: map[string]string{"foo.pb.go": "package foo"},
+			})
+			err := pt.run(
+				"-out-mode", fmt.Sprintf("%04o", mode),
+				"-expected", pt.out("example.com/foo/foo.pb.go"),
+				"-expected", pt.out("example.com/foo/missing.pb.go"),
+				"foo.proto")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"foo.pb.go", "missing.pb.go"} {
+				fi, err := os.Stat(pt.out("example.com/foo/" + name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := fi.Mode().Perm(); got != mode {
+					t.Errorf("%s: got mode %04o, want %04o", name, got, mode)
+				}
+			}
+		})
+	}
+}
+
+func TestOutModeInvalid(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	for _, mode := range []string{"0689", "rw-r--r--", "01000000"} {
+		err := pt.run("-out-mode", mode, "foo.proto")
+		if err == nil || !strings.Contains(err.Error(), "not a valid octal file mode") {
+			t.Errorf("-out-mode %s: got error %v, want invalid mode error", mode, err)
+		}
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"example.com/foo/foo.pb.go": "package foo",
+			"example.com/foo/bar.pb.go": "package foo",
+		},
+	})
+	reportPath := filepath.Join(pt.dir, "report.json")
+	err := pt.run(
+		"-report-json", reportPath,
+		"-expected", pt.out("example.com/foo/foo.pb.go"),
+		"-expected", pt.out("example.com/foo/bar.pb.go"),
+		"foo.proto", "bar.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report []genFileReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	want := []genFileReport{
+		{Base: "bar.pb.go", Path: "example.com/foo/bar.pb.go", Expected: true, Created: true, Plugin: "go"},
+		{Base: "foo.pb.go", Path: "example.com/foo/foo.pb.go", Expected: true, Created: true, Plugin: "go"},
+		{Base: "bar.pb.go", Path: pt.out("example.com/foo/bar.pb.go"), Expected: true, Created: true, From: "example.com/foo/bar.pb.go", Plugin: "go"},
+		{Base: "foo.pb.go", Path: pt.out("example.com/foo/foo.pb.go"), Expected: true, Created: true, From: "example.com/foo/foo.pb.go", Plugin: "go"},
+	}
+	sort.Slice(want, func(i, j int) bool { return want[i].Path < want[j].Path })
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("got report %#v\nwant %#v", report, want)
+	}
+}
+
+func TestWorkdir(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs:      map[string]string{"example.com/foo/foo.pb.go": "package foo"},
+		CheckSources: true,
+	})
+	workdir := filepath.Join(pt.dir, "work")
+	protos := map[string]string{
+		"a/foo/foo.proto": "syntax = \"proto3\";\nimport \"bar/bar.proto\";\n",
+		"b/bar/bar.proto": "syntax = \"proto3\";\n",
+	}
+	for rel, content := range protos {
+		path := filepath.Join(workdir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	args := []string{"-expected", pt.out("example.com/foo/foo.pb.go"), "--", "-Ia", "-Ib", "foo/foo.proto"}
+	if err := pt.run(args...); err == nil {
+		t.Fatal("unexpected success without -workdir")
+	}
+	if err := pt.run(append([]string{"-workdir", workdir}, args...)...); err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.pb.go"); got != "package foo" {
+		t.Errorf("foo.pb.go: got %q, want %q", got, "package foo")
+	}
+}
+
+func TestWellKnownTypes(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs:      map[string]string{"example.com/foo/foo.pb.go": "package foo"},
+		CheckSources: true,
+	})
+	protos := map[string]string{
+		"src/foo/foo.proto":                   "syntax = \"proto3\";\nimport \"google/protobuf/timestamp.proto\";\nimport \"google/protobuf/duration.proto\";\n",
+		"wkt/google/protobuf/timestamp.proto": "syntax = \"proto3\";\n",
+		"wkt/google/protobuf/duration.proto":  "syntax = \"proto3\";\n",
+	}
+	for rel, content := range protos {
+		path := filepath.Join(pt.dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srcDir := filepath.Join(pt.dir, "src")
+	wktDir := filepath.Join(pt.dir, "wkt")
+	expected := pt.out("example.com/foo/foo.pb.go")
+	goOut := func(args []string) string {
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "--go_out=") {
+				return arg
+			}
+		}
+		t.Fatalf("protoc args %q do not contain --go_out", args)
+		return ""
+	}
+
+	if err := pt.run("-proto_path", srcDir, "-expected", expected, "foo/foo.proto"); err == nil {
+		t.Fatal("unexpected success without -well_known_types")
+	}
+	if err := pt.run("-proto_path", srcDir, "-well_known_types", wktDir, "-import", "google/protobuf/duration.proto=example.com/duration", "-expected", expected, "foo/foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	out := goOut(pt.readArgs())
+	for _, want := range []string{
+		"Mgoogle/protobuf/timestamp.proto=google.golang.org/protobuf/types/known/timestamppb",
+		"Mgoogle/protobuf/duration.proto=example.com/duration",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("got %q, want option %q", out, want)
+		}
+	}
+	if strings.Contains(out, "durationpb") {
+		t.Errorf("got %q, want -import to override the mapping for duration.proto", out)
+	}
+
+	// A well-known type in a descriptor set, like one the user vendored,
+	// takes precedence over the bundled one, and isn't mapped.
+	field := func(num int, value []byte) []byte {
+		b := make([]byte, 2*binary.MaxVarintLen64)
+		n := binary.PutUvarint(b, uint64(num<<3|2))
+		n += binary.PutUvarint(b[n:], uint64(len(value)))
+		return append(b[:n], value...)
+	}
+	setPath := filepath.Join(pt.dir, "timestamp.pb")
+	if err := ioutil.WriteFile(setPath, field(1, field(1, []byte("google/protobuf/timestamp.proto"))), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pt = newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{"example.com/foo/foo.pb.go": "package foo"},
+	})
+	if err := pt.run("-proto_path", srcDir, "-well_known_types", wktDir, "-descriptor_set", setPath, "-expected", pt.out("example.com/foo/foo.pb.go"), "foo/foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	if out := goOut(pt.readArgs()); strings.Contains(out, "timestamp") {
+		t.Errorf("got %q, want no mapping for timestamp.proto, which is in a descriptor set", out)
+	}
+}
+
+func TestPluginCrash(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("processes can't be killed by signals on Windows")
+	}
+	pt := newProtocTest(t, fakeProtocConfig{Kill: true})
+	err := pt.run("-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto")
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	for _, want := range []string{`"go" plugin crashed`, "killed by signal", "compatible"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestProtocUsageError(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{CheckSources: true})
+	err := pt.run("-expected", pt.out("example.com/foo/foo.pb.go"), "missing.proto")
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	if strings.Contains(err.Error(), "crashed") {
+		t.Errorf("ordinary protoc failure reported as a crash: %v", err)
+	}
+}
+
+func TestMultiplePlugins(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		PluginOutputs: map[string]map[string]string{
+			"go":      {"example.com/foo/foo.pb.go": "package foo // messages"},
+			"go-grpc": {"example.com/foo/foo_grpc.pb.go": "package foo // services"},
+		},
+	})
+	grpcPlugin := pt.newPlugin("protoc-gen-go-grpc")
+	err := run([]string{
+		"-protoc", pt.protoc,
+		"-out_path", pt.outDir,
+		"-importpath", testImportpath,
+		"-option", "common=1",
+		"-plugin", "protoc-gen-go=" + pt.plugin,
+		"-option", "plugins=none",
+		"-plugin", "protoc-gen-go-grpc=" + grpcPlugin,
+		"-option", "require_unimplemented_servers=false",
+		"-import", "foo.proto=example.com/foo",
+		"-expected", pt.out("example.com/foo/foo.pb.go"),
+		"-expected", pt.out("example.com/foo/foo_grpc.pb.go"),
+		"foo.proto",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.pb.go"); got != "package foo // messages" {
+		t.Errorf("foo.pb.go: got %q", got)
+	}
+	if got := pt.readOut("example.com/foo/foo_grpc.pb.go"); got != "package foo // services" {
+		t.Errorf("foo_grpc.pb.go: got %q", got)
+	}
+	args := strings.Join(pt.readArgs(), " ")
+	for _, want := range []string{
+		"--go_out=common=1,plugins=none,Mfoo.proto=example.com/foo:",
+		"--go-grpc_out=common=1,require_unimplemented_servers=false,Mfoo.proto=example.com/foo:",
+		"--plugin protoc-gen-go=",
+		"--plugin protoc-gen-go-grpc=",
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("protoc args %q do not contain %q", args, want)
+		}
+	}
+}
+
+// TestPluginNamedLikeTmpFile checks that a plugin's output directory doesn't
+// collide with the other files the builder writes in its temporary directory.
+func TestPluginNamedLikeTmpFile(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		PluginOutputs: map[string]map[string]string{
+			"wkt": {"example.com/foo/foo.wkt.go": "package foo"},
+		},
+	})
+	wktDir := filepath.Join(pt.dir, "wkt")
+	if err := os.MkdirAll(filepath.Join(wktDir, "google", "protobuf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(wktDir, "google", "protobuf", "timestamp.proto"), []byte("syntax = \"proto3\";\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := run([]string{
+		"-protoc", pt.protoc,
+		"-out_path", pt.outDir,
+		"-importpath", testImportpath,
+		"-plugin", "protoc-gen-wkt=" + pt.newPlugin("protoc-gen-wkt"),
+		"-well_known_types", wktDir,
+		"-expected", pt.out("example.com/foo/foo.wkt.go"),
+		"foo.proto",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.wkt.go"); got != "package foo" {
+		t.Errorf("foo.wkt.go: got %q", got)
+	}
+}
+
+func TestPluginOptionOrder(t *testing.T) {
+	// Options for all plugins come first, then the plugin's own options, then
+	// the M options for -import flags. Plugins apply options in order, so
+	// -import mappings take precedence over M options given with -option.
+	for _, test := range []struct {
+		optStyle   string
+		pluginOpts func(args []string) (goOpts, grpcOpts []string)
+	}{
+		{
+			optStyle: "joined",
+			pluginOpts: func(args []string) (goOpts, grpcOpts []string) {
+				for _, arg := range args {
+					for name, opts := range map[string]*[]string{"go": &goOpts, "go-grpc": &grpcOpts} {
+						if prefix := "--" + name + "_out="; strings.HasPrefix(arg, prefix) {
+							arg = strings.TrimPrefix(arg, prefix)
+							*opts = strings.Split(arg[:strings.LastIndex(arg, ":")], ",")
+						}
+					}
+				}
+				return goOpts, grpcOpts
+			},
+		}, {
+			optStyle: "flags",
+			pluginOpts: func(args []string) (goOpts, grpcOpts []string) {
+				for _, arg := range args {
+					if strings.HasPrefix(arg, "--go_opt=") {
+						goOpts = append(goOpts, strings.TrimPrefix(arg, "--go_opt="))
+					} else if strings.HasPrefix(arg, "--go-grpc_opt=") {
+						grpcOpts = append(grpcOpts, strings.TrimPrefix(arg, "--go-grpc_opt="))
+					}
+				}
+				return goOpts, grpcOpts
+			},
+		},
+	} {
+		t.Run(test.optStyle, func(t *testing.T) {
+			pt := newProtocTest(t, fakeProtocConfig{})
+			grpcPlugin := pt.newPlugin("protoc-gen-go-grpc")
+			err := run([]string{
+				"-protoc", pt.protoc,
+				"-out_path", pt.outDir,
+				"-importpath", testImportpath,
+				"-opt-style", test.optStyle,
+				"-option", "common=1",
+				"-plugin", "protoc-gen-go=" + pt.plugin,
+				"-plugin", "protoc-gen-go-grpc=" + grpcPlugin,
+				"-option", "require_unimplemented_servers=false",
+				"-option", "Mfoo.proto=example.com/other",
+				"-import", "foo.proto=example.com/foo",
+				"foo.proto",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			goOpts, grpcOpts := test.pluginOpts(pt.readArgs())
+			if want := []string{"common=1", "Mfoo.proto=example.com/foo"}; !reflect.DeepEqual(goOpts, want) {
+				t.Errorf("got go options %q; want %q", goOpts, want)
+			}
+			if want := []string{"common=1", "require_unimplemented_servers=false", "Mfoo.proto=example.com/other", "Mfoo.proto=example.com/foo"}; !reflect.DeepEqual(grpcOpts, want) {
+				t.Errorf("got go-grpc options %q; want %q", grpcOpts, want)
+			}
+		})
+	}
+}
+
+func TestConnectPlugin(t *testing.T) {
+	// protoc-gen-connect-go writes services into a subpackage by default.
+	// The file should still be found by its base name.
+	pt := newProtocTest(t, fakeProtocConfig{
+		PluginOutputs: map[string]map[string]string{
+			"go":         {"example.com/foo/foo.pb.go": "package foo // messages"},
+			"connect-go": {"example.com/foo/fooconnect/foo.connect.go": "package foo // connect"},
+		},
+	})
+	connectPlugin := pt.newPlugin("protoc-gen-connect-go")
+	err := run([]string{
+		"-protoc", pt.protoc,
+		"-out_path", pt.outDir,
+		"-importpath", testImportpath,
+		"-plugin", pt.plugin,
+		"-plugin", connectPlugin,
+		"-option", "package_suffix=",
+		"-import", "foo.proto=example.com/foo",
+		"-expected", pt.out("example.com/foo/foo.pb.go"),
+		"-expected", pt.out("example.com/foo/foo.connect.go"),
+		"foo.proto",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.connect.go"); got != "package foo // connect" {
+		t.Errorf("foo.connect.go: got %q", got)
+	}
+	args := strings.Join(pt.readArgs(), " ")
+	for _, want := range []string{
+		"--connect-go_out=package_suffix=,Mfoo.proto=example.com/foo:",
+		"--plugin protoc-gen-connect-go=" + connectPlugin,
+	} {
+		if !strings.Contains(args, want) {
+			t.Errorf("protoc args %q do not contain %q", args, want)
+		}
+	}
+}
+
+func TestMaxParallel(t *testing.T) {
+	concurrencyDir, err := ioutil.TempDir("", "TestMaxParallel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(concurrencyDir)
+	names := []string{"a", "b", "c", "d"}
+	pluginOutputs := map[string]map[string]string{}
+	for _, name := range names {
+		pluginOutputs[name] = map[string]string{
+			fmt.Sprintf("example.com/foo/foo.%s.go", name): "package foo // " + name,
+		}
+	}
+	pt := newProtocTest(t, fakeProtocConfig{
+		PluginOutputs:  pluginOutputs,
+		ConcurrencyDir: concurrencyDir,
+		Sleep:          100 * time.Millisecond,
+	})
+	args := []string{"-protoc", pt.protoc, "-out_path", pt.outDir, "-max-parallel", "2"}
+	for _, name := range names {
+		args = append(args, "-plugin", pt.newPlugin(name), "-expected", pt.out(fmt.Sprintf("example.com/foo/foo.%s.go", name)))
+	}
+	if err := run(append(args, "foo.proto")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if got, want := pt.readOut(fmt.Sprintf("example.com/foo/foo.%s.go", name)), "package foo // "+name; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	counts, err := filepath.Glob(filepath.Join(concurrencyDir, "count-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != len(names) {
+		t.Errorf("protoc ran %d times, want once per plugin", len(counts))
+	}
+	for _, path := range counts {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := strconv.Atoi(string(data)); err != nil || n > 2 {
+			t.Errorf("got %s protoc processes running at once, want at most 2", data)
+		}
+	}
+}
+
+func TestOptStyle(t *testing.T) {
+	// With paths=source_relative, foo.pb.go is written next to foo.proto.
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{"foo.pb.go": "package foo"},
+	})
+	foo := pt.out("example.com/foo/foo.pb.go")
+	if err := pt.run("-opt-style", "flags", "-option", "paths=source_relative", "-option", "map=a:b,c:d", "-expected", foo, "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.pb.go"); got != "package foo" {
+		t.Errorf("got %q, want %q", got, "package foo")
+	}
+	var opts []string
+	for _, arg := range pt.readArgs() {
+		if strings.HasPrefix(arg, "--go_out=") && strings.Contains(arg, "paths=") {
+			t.Errorf("got %q, want options in --go_opt flags", arg)
+		}
+		if strings.HasPrefix(arg, "--go_opt=") {
+			opts = append(opts, strings.TrimPrefix(arg, "--go_opt="))
+		}
+	}
+	if want := []string{"paths=source_relative", "map=a:b,c:d"}; !reflect.DeepEqual(opts, want) {
+		t.Errorf("got --go_opt values %q, want %q", opts, want)
+	}
+
+	if err := pt.run("-opt-style", "both", "foo.proto"); err == nil || !strings.Contains(err.Error(), "-opt-style must be joined or flags") {
+		t.Errorf("got error %v, want error about -opt-style", err)
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	for _, tc := range []struct {
+		desc         string
+		brokenPlugin bool
+		want         []string
+	}{
+		{
+			desc: "ok",
+			want: []string{"ok   protoc ", ": libprotoc 3.21.12\n", "ok   plugin ", " responded to an empty request\n"},
+		}, {
+			desc:         "broken",
+			brokenPlugin: true,
+			want:         []string{"ok   protoc ", "FAIL plugin ", " failed on an empty request: exit status 2", "fake plugin: panic: broken"},
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			pt := newProtocTest(t, fakeProtocConfig{BrokenPlugin: tc.brokenPlugin})
+			var err error
+			stdout := pt.captureStdout(func() {
+				err = run([]string{"-doctor", "-protoc", pt.protoc, "-out_path", pt.outDir, "-plugin", "go=" + pt.protoc, "-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto"})
+			})
+			if tc.brokenPlugin {
+				if err == nil || exitCode(err) != exitConfigError {
+					t.Errorf("got error %v, want configuration error", err)
+				}
+			} else if err != nil {
+				t.Error(err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("diagnosis does not contain %q:\n%s", want, stdout)
+				}
+			}
+			if _, err := os.Stat(pt.out("example.com/foo/foo.pb.go")); !os.IsNotExist(err) {
+				t.Errorf("-doctor wrote an output")
+			}
+		})
+	}
+}
+
+func TestDuplicatePlugin(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	err := pt.run("-plugin", pt.plugin, "foo.proto")
+	if err == nil || !strings.Contains(err.Error(), `plugin "go" was given more than once`) {
+		t.Errorf("got error %v, want duplicate plugin error", err)
+	}
+}
+
+func TestProtocStderrInError(t *testing.T) {
+	var stderr strings.Builder
+	for i := 1; i <= 12; i++ {
+		fmt.Fprintf(&stderr, "line %d\n", i)
+	}
+	stderr.WriteString("foo.proto:3:1: Import \"bar.proto\" was not found or had errors.\n")
+	pt := newProtocTest(t, fakeProtocConfig{Stderr: stderr.String(), ExitCode: 1})
+	err := pt.run("-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto")
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	msg := err.Error()
+	if !strings.Contains(msg, `foo.proto:3:1: Import "bar.proto" was not found or had errors.`) {
+		t.Errorf("error does not contain protoc's message: %v", msg)
+	}
+	if !strings.Contains(msg, "line 12") || strings.Contains(msg, "line 3\n") {
+		t.Errorf("error does not contain exactly the last %d lines of stderr: %v", maxStderrLines, msg)
+	}
+}
+
+func TestRemoveAllWithRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protoc_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.pb.go"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(orig func(string) error) { removeAll = orig }(removeAll)
+	calls := 0
+	removeAll = func(path string) error {
+		calls++
+		if calls < 3 {
+			return &os.PathError{Op: "remove", Path: path, Err: errors.New("file in use")}
+		}
+		return os.RemoveAll(path)
+	}
+
+	if err := removeAllWithRetry(dir, 2, time.Millisecond); err == nil {
+		t.Error("unexpected success with too few attempts")
+	}
+	calls = 0
+	if err := removeAllWithRetry(dir, 5, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("got %d calls, want 3", calls)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("directory was not removed: %v", err)
+	}
+}
+
+func TestImportMap(t *testing.T) {
+	var importArgs []string
+	var importMap strings.Builder
+	importMap.WriteString("# Generated by a test.\n\n")
+	for i := 0; i < 100; i++ {
+		m := fmt.Sprintf("dep/dep%d.proto=example.com/dep%d", i, i)
+		importArgs = append(importArgs, "-import", m)
+		fmt.Fprintf(&importMap, "%s\n", m)
+	}
+
+	pt := newProtocTest(t, fakeProtocConfig{})
+	if err := pt.run(append(importArgs, "foo.proto")...); err != nil {
+		t.Fatal(err)
+	}
+	withFlags := pt.readArgs()
+
+	importMapPath := filepath.Join(pt.dir, "imports.txt")
+	if err := ioutil.WriteFile(importMapPath, []byte(importMap.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.run("-import-map", importMapPath, "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	withFile := pt.readArgs()
+
+	// The output directory is a new temporary directory for each run.
+	trimOut := func(args []string) []string {
+		for i, arg := range args {
+			if strings.HasPrefix(arg, "--go_out=") {
+				args[i] = arg[:strings.LastIndex(arg, ":")]
+			}
+		}
+		return args
+	}
+	if got, want := trimOut(withFile), trimOut(withFlags); !reflect.DeepEqual(got, want) {
+		t.Errorf("got args with -import-map:\n%q\nwant args with -import:\n%q", got, want)
+	}
+}
+
+func TestImportBackslashes(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	if err := pt.run("-import", `dep\sub\dep.proto=example.com/dep`, "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range pt.readArgs() {
+		if strings.HasPrefix(arg, "--go_out=") {
+			if want := "Mdep/sub/dep.proto=example.com/dep"; !strings.Contains(arg, want) {
+				t.Errorf("got %q, want option %q", arg, want)
+			}
+			return
+		}
+	}
+	t.Error("protoc was not given --go_out")
+}
+
+func TestImportMapInvalid(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	importMapPath := filepath.Join(pt.dir, "imports.txt")
+	if err := ioutil.WriteFile(importMapPath, []byte("foo.proto=example.com/foo\nbar.proto\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := pt.run("-import-map", importMapPath, "foo.proto")
+	if err == nil || !strings.Contains(err.Error(), "imports.txt:2: expected proto=importpath") {
+		t.Errorf("got error %v, want error for line 2", err)
+	}
+}
+
+func TestDescriptorSetStdin(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{"example.com/foo/foo.pb.go": "package foo"},
+	})
+	stdinPath := filepath.Join(pt.dir, "stdin.pb")
+	if err := ioutil.WriteFile(stdinPath, []byte("descriptors"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := os.Open(stdinPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	defer func(orig *os.File) { os.Stdin = orig }(os.Stdin)
+	os.Stdin = stdin
+
+	if err := pt.run("-descriptor-set-stdin", "-descriptor_set", "dep.pb", "-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.pb.go"); got != "package foo" {
+		t.Errorf("got %q, want %q", got, "package foo")
+	}
+	args := pt.readArgs()
+	for i, arg := range args {
+		if arg != "--descriptor_set_in" || i+1 == len(args) {
+			continue
+		}
+		sets := filepath.SplitList(args[i+1])
+		if len(sets) != 2 || sets[0] != "dep.pb" || filepath.Base(sets[1]) != "stdin.pb" {
+			t.Errorf("got descriptor sets %q, want dep.pb and a file read from stdin", sets)
+		}
+		return
+	}
+	t.Errorf("protoc args %q do not contain --descriptor_set_in", args)
+}
+
+func TestStrictOutputs(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	expected := []string{
+		pt.out("example.com/foo/bar.pb.go"),
+		pt.out("example.com/foo/foo.pb.go"),
+	}
+	err := pt.run("-strict-outputs", "-expected", expected[1], "-expected", expected[0], "foo.proto", "bar.proto")
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	want := fmt.Sprintf("Missing output %s.\nMissing output %s.\nCheck that the go_package option is %q.", expected[0], expected[1], testImportpath)
+	if err.Error() != want {
+		t.Errorf("got error:\n%v\nwant:\n%v", err, want)
+	}
+	for _, path := range expected {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s: placeholder was written", path)
+		}
+	}
+}
+
+func TestAllAmbiguousReported(t *testing.T) {
+	names := []string{"c", "a", "b"}
+	outputs := map[string]string{}
+	for _, name := range names {
+		outputs[fmt.Sprintf("x/%s.pb.go", name)] = "package x"
+		outputs[fmt.Sprintf("y/%s.pb.go", name)] = "package y"
+	}
+	pt := newProtocTest(t, fakeProtocConfig{Outputs: outputs})
+	var args []string
+	for _, name := range names {
+		args = append(args, "-expected", pt.out(fmt.Sprintf("example.com/foo/%s.pb.go", name)))
+	}
+	err := pt.run(append(args, "a.proto", "b.proto", "c.proto")...)
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	want := fmt.Sprintf("Ambiguious output %s.\nAmbiguious output %s.\nAmbiguious output %s.\nCheck that the go_package option is %q.",
+		pt.out("example.com/foo/a.pb.go"), pt.out("example.com/foo/b.pb.go"), pt.out("example.com/foo/c.pb.go"), testImportpath)
+	if err.Error() != want {
+		t.Errorf("got error:\n%v\nwant:\n%v", err, want)
+	}
+}
+
+func TestImportPathHints(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"x/b.pb.go": "package x",
+			"y/b.pb.go": "package y",
+		},
+	})
+	expectedA := pt.out("example.com/a/a.pb.go")
+	expectedB := pt.out("example.com/b/b.pb.go")
+	err := pt.run(
+		"-strict-outputs",
+		"-import", "a/a.proto=example.com/a",
+		"-import", "b/b.proto=example.com/b",
+		"-expected", expectedA,
+		"-expected", expectedB,
+		"a/a.proto", "b/b.proto")
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	want := fmt.Sprintf("Ambiguious output %s. Check that the go_package option in b/b.proto is %q.\nMissing output %s. Check that the go_package option in a/a.proto is %q.", expectedB, "example.com/b", expectedA, "example.com/a")
+	if err.Error() != want {
+		t.Errorf("got error:\n%v\nwant:\n%v", err, want)
+	}
+}
+
+func TestDepfile(t *testing.T) {
+	// Encode a FileDescriptorSet for foo.proto, which imports dep.proto.
+	field := func(num int, value []byte) []byte {
+		b := make([]byte, 2*binary.MaxVarintLen64)
+		n := binary.PutUvarint(b, uint64(num<<3|2))
+		n += binary.PutUvarint(b[n:], uint64(len(value)))
+		return append(b[:n], value...)
+	}
+	var fooFile []byte
+	fooFile = append(fooFile, field(1, []byte("foo.proto"))...)
+	fooFile = append(fooFile, field(2, []byte("foo"))...)
+	fooFile = append(fooFile, field(3, []byte("dep/dep.proto"))...)
+	set := append(field(1, field(1, []byte("dep/dep.proto"))), field(1, fooFile)...)
+
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{"example.com/foo/foo.pb.go": "package foo"},
+	})
+	setPath := filepath.Join(pt.dir, "foo.pb")
+	if err := ioutil.WriteFile(setPath, set, 0644); err != nil {
+		t.Fatal(err)
+	}
+	depfilePath := filepath.Join(pt.dir, "foo.d")
+	expected := pt.out("example.com/foo/foo.pb.go")
+	if err := pt.run("-depfile", depfilePath, "-descriptor_set", setPath, "-expected", expected, "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(depfilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%s: \\\n  dep/dep.proto \\\n  foo.proto\n", expected)
+	if got := string(data); got != want {
+		t.Errorf("got depfile:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestDuplicateExpected(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	foo := pt.out("example.com/foo/foo.pb.go")
+	err := pt.run("-expected", foo, "-expected", pt.out("example.com/foo/bar.pb.go"), "-expected", foo, "foo.proto")
+	if want := fmt.Sprintf("expected output %s was given more than once", foo); err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestPlaceholderIsIgnored(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	if err := pt.run("-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	data := pt.readOut("example.com/foo/foo.pb.go")
+	if formatted, err := format.Source([]byte(data)); err != nil {
+		t.Fatal(err)
+	} else if string(formatted) != data {
+		t.Errorf("placeholder is not gofmt-formatted:\n%s", data)
+	}
+
+	var goBuild, plusBuild constraint.Expr
+	for _, line := range strings.Split(data, "\n") {
+		switch {
+		case constraint.IsGoBuild(line):
+			expr, err := constraint.Parse(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			goBuild = expr
+		case constraint.IsPlusBuild(line):
+			expr, err := constraint.Parse(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			plusBuild = expr
+		}
+	}
+	if goBuild == nil || plusBuild == nil {
+		t.Fatalf("placeholder does not have both //go:build and // +build lines:\n%s", data)
+	}
+	for _, expr := range []constraint.Expr{goBuild, plusBuild} {
+		if expr.String() != "ignore" {
+			t.Errorf("got constraint %q, want %q", expr, "ignore")
+		}
+		if expr.Eval(func(tag string) bool { return tag != "ignore" }) {
+			t.Errorf("constraint %q is satisfied without the ignore tag", expr)
+		}
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"example.com/foo/a/b/foo.pb.go": "package foo",
+			"example.com/foo/c/bar.pb.go":   "package foo // bar",
+			"example.com/foo/c/extra.pb.go": "package foo // extra",
+		},
+	})
+	err := pt.run(
+		"-flatten",
+		"-expected", pt.out("foo.pb.go"),
+		"-expected", pt.out("bar.pb.go"),
+		"foo.proto", "bar.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"foo.pb.go":   "package foo",
+		"bar.pb.go":   "package foo // bar",
+		"extra.pb.go": "package foo // extra",
+	} {
+		if got := pt.readOut(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	for _, dir := range []string{"example.com/foo/a", "example.com/foo/c"} {
+		if _, err := os.Stat(pt.out(dir)); !os.IsNotExist(err) {
+			t.Errorf("%s: directory was created", dir)
+		}
+	}
+}
+
+func TestFlattenCollision(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"a/foo.pb.go": "package a",
+			"b/foo.pb.go": "package b",
+		},
+	})
+	err := pt.run("-flatten", "-expected", pt.out("foo.pb.go"), "foo.proto")
+	if err == nil || !strings.Contains(err.Error(), "cannot flatten generated files") || !strings.Contains(err.Error(), "both are named foo.pb.go") {
+		t.Errorf("got error %v, want flatten collision error", err)
+	}
+}
+
+func TestFlattenAmbiguous(t *testing.T) {
+	defer func(orig bool) { caseInsensitiveFS = orig }(caseInsensitiveFS)
+	caseInsensitiveFS = true
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"a/Foo.pb.go": "package a",
+			"b/foo.pb.go": "package b",
+		},
+	})
+	expected := pt.out("Foo.pb.go")
+	err := pt.run("-flatten", "-expected", expected, "foo.proto")
+	if err == nil || !strings.Contains(err.Error(), "Ambiguious output "+expected) {
+		t.Fatalf("got error %v, want ambiguous output error", err)
+	}
+	for _, name := range []string{"Foo.pb.go", "foo.pb.go"} {
+		if _, err := os.Stat(pt.out(name)); !os.IsNotExist(err) {
+			t.Errorf("%s: ambiguous candidate was written", name)
+		}
+	}
+}
+
+func TestDescriptorSetList(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	listPath := filepath.Join(pt.dir, "descriptors.txt")
+	if err := ioutil.WriteFile(listPath, []byte("c.descriptor\r\n\nd.descriptor\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := pt.run(
+		"-descriptor_set", "a.descriptor",
+		"-descriptor-set-list", listPath,
+		"-descriptor_set", "b.descriptor",
+		"foo.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := pt.readArgs()
+	got := ""
+	for i, arg := range args {
+		if arg == "--descriptor_set_in" && i+1 < len(args) {
+			got = args[i+1]
+		}
+	}
+	want := strings.Join([]string{"a.descriptor", "b.descriptor", "c.descriptor", "d.descriptor"}, string(os.PathListSeparator))
+	if got != want {
+		t.Errorf("got --descriptor_set_in %q, want %q", got, want)
+	}
+}
+
+func TestPrintCmd(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{"example.com/foo/foo.pb.go": "package foo"},
+	})
+	stdoutFile, err := ioutil.TempFile(pt.dir, "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(orig *os.File) { os.Stdout = orig }(os.Stdout)
+	os.Stdout = stdoutFile
+	err = pt.run("-print-cmd", "-option", "paths=import", "-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto")
+	os.Stdout.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(stdoutFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	for _, want := range []string{"--go_out=paths=import:", "--plugin protoc-gen-go=", "foo.proto"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("printed command %q does not contain %q", got, want)
+		}
+	}
+	if _, err := os.Stat(pt.argsFile); !os.IsNotExist(err) {
+		t.Error("protoc was run")
+	}
+	if _, err := os.Stat(pt.out("example.com/foo/foo.pb.go")); !os.IsNotExist(err) {
+		t.Error("output was written")
+	}
+}
+
+func TestFormatShellCommand(t *testing.T) {
+	args := []string{"protoc", "--go_out=M a.proto=x:/tmp/out", "it's", `C:\Program Files\`, `say "hi"`, ""}
+	for _, tc := range []struct {
+		goos, dir, want string
+	}{
+		{
+			goos: "linux",
+			want: `protoc '--go_out=M a.proto=x:/tmp/out' 'it'\''s' 'C:\Program Files\' 'say "hi"' ''`,
+		}, {
+			goos: "darwin",
+			dir:  "/work dir",
+			want: `cd '/work dir' && protoc '--go_out=M a.proto=x:/tmp/out' 'it'\''s' 'C:\Program Files\' 'say "hi"' ''`,
+		}, {
+			goos: "windows",
+			want: `protoc "--go_out=M a.proto=x:/tmp/out" it's "C:\Program Files\\" "say \"hi\"" ""`,
+		},
+	} {
+		if got := formatShellCommand(tc.goos, tc.dir, args); got != tc.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.goos, got, tc.want)
+		}
+	}
+}
+
+func TestProto3Optional(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	if err := pt.run("-proto3-optional", "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	args := pt.readArgs()
+	found := false
+	for _, arg := range args {
+		found = found || arg == "--experimental_allow_proto3_optional"
+	}
+	if !found {
+		t.Errorf("protoc args %q do not contain --experimental_allow_proto3_optional", args)
+	}
+}
+
+func TestProto3OptionalUnsupported(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{RejectFlags: []string{"--experimental_allow_proto3_optional"}})
+	err := pt.run("-proto3-optional", "foo.proto")
+	if err == nil || !strings.Contains(err.Error(), "protoc does not support --experimental_allow_proto3_optional") || !strings.Contains(err.Error(), "3.12 or newer") {
+		t.Errorf("got error %v, want error about old protoc", err)
+	}
+}
+
+func TestFatalWarnings(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	if err := pt.run("-fatal-warnings", "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	args := pt.readArgs()
+	found := false
+	for _, arg := range args {
+		found = found || arg == "--fatal_warnings"
+	}
+	if !found {
+		t.Errorf("protoc args %q do not contain --fatal_warnings", args)
+	}
+}
+
+func TestFatalWarningsUnsupported(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{RejectFlags: []string{"--fatal_warnings"}})
+	err := pt.run("-fatal-warnings", "foo.proto")
+	if err == nil || !strings.Contains(err.Error(), "protoc does not support --fatal_warnings, which is needed for -fatal-warnings") {
+		t.Errorf("got error %v, want error about old protoc", err)
+	}
+}
+
+func TestProtocNotExecutable(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	bogus := filepath.Join(pt.dir, "no-such-protoc")
+	err := run([]string{"-protoc", bogus, "-out_path", pt.outDir, "-plugin", pt.plugin, "foo.proto"})
+	if want := "protoc binary not found or not executable: " + bogus; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	notExec := filepath.Join(pt.dir, "protoc")
+	if err := ioutil.WriteFile(notExec, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = run([]string{"-protoc", notExec, "-out_path", pt.outDir, "-plugin", pt.plugin, "foo.proto"})
+	if want := "protoc binary not found or not executable: " + notExec; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestPluginEnv(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		EnvOutputs: map[string]string{"example.com/foo/foo.pb.go": "PROTOC_GEN_TEST_TEMPLATE"},
+	})
+	if err := pt.run("-plugin-env", "PROTOC_GEN_TEST_TEMPLATE=a=b c", "-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pt.readOut("example.com/foo/foo.pb.go"), "a=b c"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, bad := range []string{"NOVALUE", "=value"} {
+		err := pt.run("-plugin-env", bad, "foo.proto")
+		if want := fmt.Sprintf("-plugin-env: %q is not of the form KEY=VALUE", bad); err == nil || err.Error() != want {
+			t.Errorf("got error %v, want %q", err, want)
+		}
+	}
+}
+
+func TestAllowedPlugin(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	if err := pt.run("-allowed-plugin", "protoc-gen-grpc", "-allowed-plugin", "protoc-gen-go", "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	err := pt.run("-allowed-plugin", "protoc-gen-grpc", "foo.proto")
+	if err == nil || !strings.Contains(err.Error(), "plugin protoc-gen-go ("+pt.plugin+") is not allowed") {
+		t.Errorf("got error %v, want error about protoc-gen-go", err)
+	}
+
+	// The allowlist applies to the executable, whatever name the plugin is
+	// given.
+	evil := pt.newPlugin("evil")
+	for _, test := range []struct {
+		desc string
+		args []string
+	}{
+		{
+			desc: "name_path",
+			args: []string{"-plugin", "protoc-gen-grpc=" + evil},
+		}, {
+			desc: "out_name",
+			args: []string{"-plugin", evil, "-plugin-out-name", "grpc"},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			args := append([]string{"-allowed-plugin", "protoc-gen-grpc", "-allowed-plugin", "protoc-gen-go"}, test.args...)
+			err := pt.run(append(args, "foo.proto")...)
+			if err == nil || !strings.Contains(err.Error(), "plugin evil ("+evil+") is not allowed") {
+				t.Errorf("got error %v, want error about evil", err)
+			}
+		})
+	}
+}
+
+func TestPluginOnPath(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	defer func(orig func(string) (string, error)) { lookPath = orig }(lookPath)
+	lookPath = func(file string) (string, error) {
+		if file == "protoc-gen-go" {
+			return pt.plugin, nil
+		}
+		return "", &exec.Error{Name: file, Err: exec.ErrNotFound}
+	}
+	err := run([]string{"-protoc", pt.protoc, "-out_path", pt.outDir, "-plugin", "protoc-gen-go", "foo.proto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(pt.readArgs(), " ")
+	if want := "--plugin protoc-gen-go=" + pt.plugin; !strings.Contains(args, want) {
+		t.Errorf("protoc args %q do not contain %q", args, want)
+	}
+
+	err = run([]string{"-protoc", pt.protoc, "-out_path", pt.outDir, "-plugin", "protoc-gen-missing", "foo.proto"})
+	if err == nil || !strings.Contains(err.Error(), `could not find plugin "protoc-gen-missing" in PATH`) {
+		t.Errorf("got error %v, want lookup error", err)
+	}
+}
+
+func TestWarnUnexpected(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"example.com/foo/foo.pb.go":   "package foo",
+			"example.com/foo/extra.pb.go": "package foo",
+			"example.com/foo/extra.txt":   "not go",
+		},
+	})
+	args := []string{"-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto"}
+	var err error
+	stderr := pt.captureStderr(func() { err = pt.run(args...) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stderr, "warning") {
+		t.Errorf("got warning without -warn-unexpected:\n%s", stderr)
+	}
+
+	stderr = pt.captureStderr(func() { err = pt.run(append([]string{"-warn-unexpected"}, args...)...) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "warning: protoc generated files that are not expected outputs. They will be discarded. Check the list of expected files.\n  example.com/foo/extra.pb.go (extra.pb.go)\n"
+	if stderr != want {
+		t.Errorf("got stderr:\n%s\nwant:\n%s", stderr, want)
+	}
+}
+
+func TestOutputSuffix(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"example.com/foo/foo.pb.validate.go": "package foo",
+			"gen/foo.json":                       "{}",
+		},
+	})
+	args := []string{"-expected", pt.out("example.com/foo/foo.pb.validate.go"), "-expected", pt.out("example.com/foo/foo.json"), "foo.proto"}
+	if err := pt.run(args...); err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.json"); got == "{}" {
+		t.Errorf("foo.json was captured without -output-suffix .json")
+	}
+
+	if err := pt.run(append([]string{"-output-suffix", ".go", "-output-suffix", ".json"}, args...)...); err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.pb.validate.go"); got != "package foo" {
+		t.Errorf("got foo.pb.validate.go %q, want %q", got, "package foo")
+	}
+	if got := pt.readOut("example.com/foo/foo.json"); got != "{}" {
+		t.Errorf("got foo.json %q, want %q", got, "{}")
+	}
+}
+
+func TestExpectedSidecar(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"example.com/foo/foo.pb.go":        "package foo",
+			"example.com/foo/foo.swagger.json": "{}",
+			"gen/bar.swagger.json":             "{}",
+		},
+	})
+	err := pt.run(
+		"-expected", pt.out("example.com/foo/foo.pb.go"),
+		"-expected", pt.out("example.com/foo/foo.swagger.json"),
+		"-expected", pt.out("example.com/foo/bar.swagger.json"),
+		"foo.proto", "bar.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.swagger.json"); got != "{}" {
+		t.Errorf("got foo.swagger.json %q, want %q", got, "{}")
+	}
+	// Only files with -output-suffix are matched by base name.
+	if got := pt.readOut("example.com/foo/bar.swagger.json"); got != string(placeholderData) {
+		t.Errorf("got bar.swagger.json %q, want placeholder", got)
+	}
+}
+
+func TestPreserveMtime(t *testing.T) {
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs:        map[string]string{"example.com/foo/foo.pb.go": "package foo"},
+		OutputsModTime: mtime,
+	})
+	foo := pt.out("example.com/foo/foo.pb.go")
+	if err := pt.run("-expected", foo, "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(foo); err != nil {
+		t.Fatal(err)
+	} else if info.ModTime().Equal(mtime) {
+		t.Errorf("mtime was preserved without -preserve-mtime")
+	}
+
+	if err := pt.run("-preserve-mtime", "-expected", foo, "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(foo); err != nil {
+		t.Fatal(err)
+	} else if !info.ModTime().Equal(mtime) {
+		t.Errorf("got mtime %v, want %v", info.ModTime(), mtime)
+	}
+}
+
+func TestTmpDir(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	tmpBase := filepath.Join(pt.dir, "tmp")
+	if err := os.Mkdir(tmpBase, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.run("-tmp-dir", tmpBase, "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, arg := range pt.readArgs() {
+		if strings.HasPrefix(arg, "--go_out=") {
+			found = true
+			if !strings.Contains(arg, abs(tmpBase)+string(filepath.Separator)) {
+				t.Errorf("got %s, want output directory under %s", arg, tmpBase)
+			}
+		}
+	}
+	if !found {
+		t.Error("protoc was not given --go_out")
+	}
+}
+
+func TestTmpDirInvalid(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	missing := filepath.Join(pt.dir, "missing")
+	if err := pt.run("-tmp-dir", missing, "foo.proto"); err == nil || !strings.Contains(err.Error(), "-tmp-dir") {
+		t.Errorf("got error %v, want error about -tmp-dir", err)
+	}
+	notDir := filepath.Join(pt.dir, "file")
+	if err := ioutil.WriteFile(notDir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.run("-tmp-dir", notDir, "foo.proto"); err == nil || !strings.Contains(err.Error(), "is not a directory") {
+		t.Errorf("got error %v, want error about a file", err)
+	}
+}
+
+func TestSymlinkedOutputDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSymlinkedOutputDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink(dir, filepath.Join(dir, "loop")); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.pb.go"), []byte("package foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pt := newProtocTest(t, fakeProtocConfig{
+		Symlinks: map[string]string{"example.com/foo": dir},
+	})
+	if err := pt.run("-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto"); err != nil {
+		t.Fatal(err)
+	}
+	if got := pt.readOut("example.com/foo/foo.pb.go"); got != "package foo" {
+		t.Errorf("got %q, want %q", got, "package foo")
+	}
+}
+
+func TestOutputRelPath(t *testing.T) {
+	dir := filepath.Join(string(filepath.Separator)+"tmp", "go_proto", "go")
+	if rel, err := outputRelPath(dir, filepath.Join(dir, "example.com", "foo", "foo.pb.go")); err != nil {
+		t.Error(err)
+	} else if want := filepath.Join("example.com", "foo", "foo.pb.go"); rel != want {
+		t.Errorf("got %s, want %s", rel, want)
+	}
+	escaping := filepath.Join(dir, "..", "..", "evil.pb.go")
+	if _, err := outputRelPath(dir, escaping); err == nil || !strings.Contains(err.Error(), escaping) {
+		t.Errorf("got error %v, want error naming %s", err, escaping)
+	}
+}
+
+func TestOutArchive(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"example.com/foo/foo.pb.go":   "package foo",
+			"example.com/foo/extra.pb.go": "package foo",
+			"other/bar.pb.go":             "package foo // bar",
+		},
+	})
+	archivePath := filepath.Join(pt.dir, "out.tar")
+	err := pt.run(
+		"-out-archive", archivePath,
+		"-expected", pt.out("example.com/foo/foo.pb.go"),
+		"-expected", pt.out("example.com/foo/bar.pb.go"),
+		"-expected", pt.out("example.com/foo/baz.pb.go"),
+		"foo.proto", "bar.proto", "baz.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got := map[string]string{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[hdr.Name] = string(data)
+	}
+	want := map[string]string{
+		"example.com/foo/foo.pb.go": "package foo",
+		"example.com/foo/bar.pb.go": "package foo // bar",
+		"example.com/foo/baz.pb.go": string(placeholderData),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got archive contents %q, want %q", got, want)
+	}
+	if _, err := os.Stat(pt.out("example.com/foo/foo.pb.go")); !os.IsNotExist(err) {
+		t.Errorf("foo.pb.go was written under -out_path")
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"example.com/foo/foo.pb.go":   "package foo",
+			"example.com/foo/extra.pb.go": "package foo",
+		},
+	})
+	foo := pt.out("example.com/foo/foo.pb.go")
+	bar := pt.out("example.com/foo/bar.pb.go")
+	args := []string{"-expected", foo, "-expected", bar, "foo.proto", "bar.proto"}
+	var err error
+	stderr := pt.captureStderr(func() { err = pt.run(args...) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stderr != "" {
+		t.Errorf("got output without -v:\n%s", stderr)
+	}
+
+	stderr = pt.captureStderr(func() { err = pt.run(append([]string{"-v"}, args...)...) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"protoc command: " + pt.protoc,
+		"expected output: " + foo + "\n",
+		"expected output: " + bar + "\n",
+		"generated example.com/foo/extra.pb.go by go: unexpected\n",
+		"generated example.com/foo/foo.pb.go by go: matched " + foo + "\n",
+		"writing placeholder to " + bar + "\n",
+		" to " + foo + "\n",
+	} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("verbose output does not contain %q:\n%s", want, stderr)
+		}
+	}
+}
+
+func TestMinBytes(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{
+			"example.com/foo/foo.pb.go":   "",
+			"example.com/foo/other.pb.go": "package foo",
+		},
+	})
+	args := []string{
+		"-expected", pt.out("example.com/foo/foo.pb.go"),
+		"-expected", pt.out("example.com/foo/other.pb.go"),
+		"-expected", pt.out("example.com/foo/missing.pb.go"),
+		"foo.proto",
+	}
+	if err := pt.run(args...); err != nil {
+		t.Fatalf("unexpected error without -min-bytes: %v", err)
+	}
+	err := pt.run(append([]string{"-min-bytes", "1"}, args...)...)
+	if err == nil {
+		t.Fatal("unexpected success with -min-bytes")
+	}
+	want := fmt.Sprintf("protoc produced outputs smaller than -min-bytes=1. The plugin may have crashed or produced truncated output:\n  %s (0 bytes)", pt.out("example.com/foo/foo.pb.go"))
+	if err.Error() != want {
+		t.Errorf("got error:\n%v\nwant:\n%v", err, want)
+	}
+}
+
+func TestPluginOutPaths(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		PluginOutputs: map[string]map[string]string{
+			"go": {
+				"example.com/foo/foo.pb.go": "package foo // messages",
+			},
+			"go-grpc": {
+				"example.com/foo/foo_grpc.pb.go": "package foo // services",
+				// Not expected in grpcOut, so this must not be matched with
+				// foo.pb.go in the default output path.
+				"example.com/foo/other/foo.pb.go": "package foo // wrong",
+			},
+		},
+	})
+	grpcPlugin := pt.newPlugin("protoc-gen-go-grpc")
+	grpcOut := filepath.Join(pt.dir, "grpc_out")
+	if err := os.MkdirAll(filepath.Join(grpcOut, filepath.FromSlash(testImportpath)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err := run([]string{
+		"-protoc", pt.protoc,
+		"-out_path", pt.outDir,
+		"-importpath", testImportpath,
+		"-plugin", pt.plugin,
+		"-plugin", grpcPlugin,
+		"-out-path", grpcOut,
+		"-expected", pt.out("example.com/foo/foo.pb.go"),
+		"-expected", filepath.Join(grpcOut, "example.com/foo/foo_grpc.pb.go"),
+		"foo.proto",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		pt.out("example.com/foo/foo.pb.go"):                      "package foo // messages",
+		filepath.Join(grpcOut, "example.com/foo/foo_grpc.pb.go"): "package foo // services",
+	} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Error(err)
+		} else if string(data) != want {
+			t.Errorf("%s: got %q, want %q", path, data, want)
+		}
+	}
+}
+
+func TestOutPathWithoutPlugin(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	err := run([]string{"-protoc", pt.protoc, "-out_path", pt.outDir, "-out-path", pt.dir, "-plugin", pt.plugin, "foo.proto"})
+	if err == nil || !strings.Contains(err.Error(), "-out-path must follow a -plugin") {
+		t.Errorf("got error %v, want -out-path error", err)
+	}
+}
+
+func TestCaseInsensitiveCollision(t *testing.T) {
+	for _, insensitive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("insensitive=%v", insensitive), func(t *testing.T) {
+			if !insensitive && caseInsensitiveFS {
+				t.Skip("outputs would collide on this file system")
+			}
+			defer func(orig bool) { caseInsensitiveFS = orig }(caseInsensitiveFS)
+			caseInsensitiveFS = insensitive
+			pt := newProtocTest(t, fakeProtocConfig{
+				Outputs: map[string]string{
+					"a/Foo.pb.go": "package a",
+					"b/foo.pb.go": "package b",
+				},
+			})
+			upper := pt.out("example.com/foo/Foo.pb.go")
+			lower := pt.out("example.com/foo/foo.pb.go")
+			err := pt.run("-expected", upper, "-expected", lower, "foo.proto")
+			if !insensitive {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := pt.readOut("example.com/foo/Foo.pb.go"); got != "package a" {
+					t.Errorf("Foo.pb.go: got %q, want %q", got, "package a")
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("unexpected success")
+			}
+			for _, path := range []string{upper, lower} {
+				if !strings.Contains(err.Error(), "Ambiguious output "+path) {
+					t.Errorf("error does not report %s as ambiguous: %v", path, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Stderr: "waiting for plugin\n",
+		Sleep:  time.Minute,
+	})
+	start := time.Now()
+	err := pt.run("-timeout", "100ms", "-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto")
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("protoc was not killed promptly: took %v", elapsed)
+	}
+	for _, want := range []string{"killed after -timeout=100ms", "waiting for plugin"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
+
+func TestTimeoutHungPlugin(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("plugins started by protoc are not killed on Windows")
+	}
+	pt := newProtocTest(t, fakeProtocConfig{
+		StartPlugin: true,
+		PluginSleep: time.Minute,
+		Sleep:       time.Minute,
+	})
+	start := time.Now()
+	err := pt.run("-timeout", "100ms", "-expected", pt.out("example.com/foo/foo.pb.go"), "foo.proto")
+	if err == nil {
+		t.Fatal("unexpected success")
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("hung plugin was not killed promptly: took %v", elapsed)
+	}
+	if want := "killed after -timeout=100ms"; !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not contain %q", err, want)
+	}
+}
+
+func TestPluginOutName(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{
+		Outputs: map[string]string{"example.com/foo/foo.pb.go": "package foo"},
+	})
+	mygen := pt.newPlugin("mygen")
+	err := run([]string{
+		"-protoc", pt.protoc,
+		"-out_path", pt.outDir,
+		"-plugin", mygen,
+		"-plugin-out-name", "go",
+		"-expected", pt.out("example.com/foo/foo.pb.go"),
+		"foo.proto",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Join(pt.readArgs(), " ")
+	for _, want := range []string{"--go_out=", "--plugin protoc-gen-go=" + mygen} {
+		if !strings.Contains(args, want) {
+			t.Errorf("protoc args %q do not contain %q", args, want)
+		}
+	}
+	if strings.Contains(args, "--mygen_out") {
+		t.Errorf("protoc args %q contain the derived --mygen_out", args)
+	}
+	if got := pt.readOut("example.com/foo/foo.pb.go"); got != "package foo" {
+		t.Errorf("foo.pb.go: got %q, want %q", got, "package foo")
+	}
+}
+
+func TestProtoList(t *testing.T) {
+	pt := newProtocTest(t, fakeProtocConfig{})
+	var protos []string
+	for i := 0; i < 1000; i++ {
+		protos = append(protos, fmt.Sprintf("pkg/sub%d/file%d.proto", i, i))
+	}
+	listPath := filepath.Join(pt.dir, "protos.txt")
+	if err := ioutil.WriteFile(listPath, []byte(strings.Join(protos, "\n")+"\n\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pt.run("-proto-list", listPath, "first.proto"); err != nil {
+		t.Fatal(err)
+	}
+	args := pt.readArgs()
+	want := append([]string{"first.proto"}, protos...)
+	if len(args) < len(want) || !reflect.DeepEqual(args[len(args)-len(want):], want) {
+		t.Errorf("protoc did not receive all sources in order; got args %q", args)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	for _, tc := range []struct {
+		desc string
+		cfg  fakeProtocConfig
+		args []string
+		want int
+	}{
+		{
+			desc: "config",
+			args: []string{"-out-mode", "999", "foo.proto"},
+			want: exitConfigError,
+		}, {
+			desc: "protoc",
+			cfg:  fakeProtocConfig{ExitCode: 1, Stderr: "foo.proto: syntax error"},
+			args: []string{"foo.proto"},
+			want: exitProtocError,
+		}, {
+			desc: "output",
+			args: []string{"-strict-outputs", "-expected", "foo.pb.go", "foo.proto"},
+			want: exitOutputError,
+		}, {
+			desc: "other",
+			args: []string{"-report-json", filepath.Join(os.DevNull, "report.json"), "foo.proto"},
+			want: 1,
+		},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			pt := newProtocTest(t, tc.cfg)
+			err := pt.run(tc.args...)
+			if err == nil {
+				t.Fatal("unexpected success")
+			}
+			if got := exitCode(err); got != tc.want {
+				t.Errorf("got exit code %d for error %v; want %d", got, err, tc.want)
+			}
+		})
+	}
+}
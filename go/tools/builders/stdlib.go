@@ -33,6 +33,8 @@ func stdlib(args []string) error {
 	race := flags.Bool("race", false, "Build in race mode")
 	shared := flags.Bool("shared", false, "Build in shared mode")
 	dynlink := flags.Bool("dynlink", false, "Build in dynlink mode")
+	var extraGcflags multiFlag
+	flags.Var(&extraGcflags, "gcflags", "Additional flag to pass to the compiler for all packages. May be repeated.")
 	if err := flags.Parse(args); err != nil {
 		return err
 	}
@@ -92,6 +94,14 @@ You may need to use the flags --cpu=x64_windows --compiler=mingw-gcc.`)
 	os.Setenv("CGO_CFLAGS", os.Getenv("CGO_CFLAGS")+" "+strings.Join(defaultCFlags(output), " "))
 	os.Setenv("CGO_LDFLAGS", os.Getenv("CGO_LDFLAGS")+" "+strings.Join(defaultLdFlags(), " "))
 
+	// Point the C toolchain at the Apple SDK when cross-compiling for darwin.
+	if sysroot := appleSysrootFlags(strings.Fields(os.Getenv("CGO_CFLAGS"))); sysroot != nil {
+		os.Setenv("CGO_CFLAGS", os.Getenv("CGO_CFLAGS")+" "+strings.Join(sysroot, " "))
+	}
+	if sysroot := appleSysrootFlags(strings.Fields(os.Getenv("CGO_LDFLAGS"))); sysroot != nil {
+		os.Setenv("CGO_LDFLAGS", os.Getenv("CGO_LDFLAGS")+" "+strings.Join(sysroot, " "))
+	}
+
 	// Allow flags in CGO_LDFLAGS that wouldn't pass the security check.
 	// Workaround for golang.org/issue/42565.
 	var b strings.Builder
@@ -136,6 +146,7 @@ You may need to use the flags --cpu=x64_windows --compiler=mingw-gcc.`)
 		ldflags = append(ldflags, "-dynlink")
 		asmflags = append(asmflags, "-dynlink")
 	}
+	gcflags = append(gcflags, extraGcflags...)
 
 	// Since Go 1.10, an all= prefix indicates the flags should apply to the package
 	// and its dependencies, rather than just the package itself. This was the
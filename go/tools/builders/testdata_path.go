@@ -0,0 +1,163 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// testDataPathNames are the package-level names declared by the file
+// writeTestDataPathFile generates.
+var testDataPathNames = []string{"TestDataPath", "rulesGoTestDataRunDir"}
+
+// testDataPathImports are the packages imported by the generated file.
+var testDataPathImports = []string{"bufio", "os", "path/filepath", "strings"}
+
+// testDataPathSrc is the source of the generated file. Imports are renamed,
+// since file-scoped names may not conflict with names declared elsewhere in
+// the package.
+const testDataPathSrc = `// Code generated by rules_go. DO NOT EDIT.
+
+//line testdata_path.go:1
+package PACKAGE
+
+import (
+	rulesgo_bufio "bufio"
+	rulesgo_os "os"
+	rulesgo_filepath "path/filepath"
+	rulesgo_strings "strings"
+)
+
+// rulesGoTestDataRunDir is the directory tests run in, relative to the
+// root of the runfiles tree, or an absolute path.
+const rulesGoTestDataRunDir = RUN_DIR
+
+// TestDataPath returns the path to rel, a data file or directory given
+// relative to the test's package directory, like "testdata/input.txt". The
+// path is found in the test's runfiles, so it's correct whether the test is
+// run by bazel test, locally or remotely, or directly. If rel can't be found,
+// it's returned unchanged.
+func TestDataPath(rel string) string {
+	rel = rulesgo_filepath.FromSlash(rel)
+	if rulesgo_filepath.IsAbs(rel) {
+		return rel
+	}
+	if rulesgo_filepath.IsAbs(rulesGoTestDataRunDir) {
+		return rulesgo_filepath.Join(rulesGoTestDataRunDir, rel)
+	}
+	runfilesPath := rulesgo_filepath.Join(rulesGoTestDataRunDir, rel)
+
+	var dirs, manifests []string
+	if dir := rulesgo_os.Getenv("TEST_SRCDIR"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	if dir := rulesgo_os.Getenv("RUNFILES_DIR"); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	if manifest := rulesgo_os.Getenv("RUNFILES_MANIFEST_FILE"); manifest != "" {
+		manifests = append(manifests, manifest)
+	}
+	if exe, err := rulesgo_os.Executable(); err == nil {
+		// When the test is run directly, the runfiles are next to it.
+		dirs = append(dirs, exe+".runfiles")
+		manifests = append(manifests, exe+".runfiles_manifest", rulesgo_filepath.Join(exe+".runfiles", "MANIFEST"))
+	}
+	for _, dir := range dirs {
+		path := rulesgo_filepath.Join(dir, runfilesPath)
+		if _, err := rulesgo_os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	// Without a runfiles tree, as on Windows, look the file up in a manifest.
+	// Each line has a path in the runfiles and a path on disk.
+	key := rulesgo_filepath.ToSlash(runfilesPath)
+	for _, manifest := range manifests {
+		f, err := rulesgo_os.Open(manifest)
+		if err != nil {
+			continue
+		}
+		scanner := rulesgo_bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if rulesgo_strings.HasPrefix(line, key+" ") {
+				f.Close()
+				return line[len(key)+1:]
+			}
+		}
+		f.Close()
+	}
+	return rel
+}
+`
+
+// declaresTestDataPathNames reports whether any of files declares one of
+// testDataPathNames at package level.
+func declaresTestDataPathNames(files []fileInfo) (bool, error) {
+	names := make(map[string]bool)
+	for _, name := range testDataPathNames {
+		names[name] = true
+	}
+	fset := token.NewFileSet()
+	for _, f := range files {
+		parsed, err := parser.ParseFile(fset, f.filename, nil, 0)
+		if err != nil {
+			return false, err
+		}
+		for _, decl := range parsed.Decls {
+			switch decl := decl.(type) {
+			case *ast.FuncDecl:
+				if decl.Recv == nil && names[decl.Name.Name] {
+					return true, nil
+				}
+			case *ast.GenDecl:
+				for _, spec := range decl.Specs {
+					switch spec := spec.(type) {
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							if names[name.Name] {
+								return true, nil
+							}
+						}
+					case *ast.TypeSpec:
+						if names[spec.Name.Name] {
+							return true, nil
+						}
+					}
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// writeTestDataPathFile writes a file declaring TestDataPath in the package
+// packageName to dir and returns its path. runDir is the directory data files
+// are found relative to.
+func writeTestDataPathFile(dir, packageName, runDir string) (string, error) {
+	path := filepath.Join(dir, "testdata_path.go")
+	src := strings.Replace(testDataPathSrc, "PACKAGE", packageName, 1)
+	src = strings.Replace(src, "RUN_DIR", strconv.Quote(runDir), 1)
+	if err := ioutil.WriteFile(path, []byte(src), 0666); err != nil {
+		return "", err
+	}
+	return path, nil
+}
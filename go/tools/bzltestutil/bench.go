@@ -0,0 +1,115 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// benchmarkOutputName is the name of the file written to
+// TEST_UNDECLARED_OUTPUTS_DIR when benchmarks are run.
+const benchmarkOutputName = "benchmark.txt"
+
+// shouldRunBenchmarks indicates if the test wrapper should run benchmarks
+// instead of tests. This is enabled by setting GO_TEST_BENCH=1.
+func shouldRunBenchmarks() bool {
+	if benchEnv, ok := os.LookupEnv("GO_TEST_BENCH"); ok {
+		bench, err := strconv.ParseBool(benchEnv)
+		if err != nil {
+			log.Fatalf("invalid value for GO_TEST_BENCH: %q", benchEnv)
+		}
+		return bench
+	}
+	return false
+}
+
+// benchmarkArgs returns the flags passed to the test binary to run all
+// benchmarks and no tests. GO_TEST_BENCH_COUNT and GO_TEST_BENCH_TIME set
+// -test.count and -test.benchtime.
+func benchmarkArgs() []string {
+	args := []string{"-test.run=^$", "-test.bench=."}
+	if count, ok := os.LookupEnv("GO_TEST_BENCH_COUNT"); ok {
+		if _, err := strconv.Atoi(count); err != nil {
+			log.Fatalf("invalid value for GO_TEST_BENCH_COUNT: %q", count)
+		}
+		args = append(args, "-test.count="+count)
+	}
+	if benchTime, ok := os.LookupEnv("GO_TEST_BENCH_TIME"); ok {
+		args = append(args, "-test.benchtime="+benchTime)
+	}
+	return args
+}
+
+// writeBenchmarkOutput writes the benchmark results from a test binary's
+// output to benchmark.txt in TEST_UNDECLARED_OUTPUTS_DIR. Nothing is written
+// if that variable isn't set, for example, with bazel run.
+func writeBenchmarkOutput(output []byte) error {
+	dir, ok := os.LookupEnv("TEST_UNDECLARED_OUTPUTS_DIR")
+	if !ok {
+		return nil
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, benchmarkOutputName), benchmarkResults(output), 0664); err != nil {
+		return fmt.Errorf("error writing benchmark output: %v", err)
+	}
+	return nil
+}
+
+// benchmarkResults extracts the lines benchstat reads from a test binary's
+// output: configuration lines like "goos: linux" and benchmark result lines.
+// Other output, like logs and the final PASS line, is dropped. The result
+// is empty (but still valid) if the package has no benchmarks.
+func benchmarkResults(output []byte) []byte {
+	var results bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if isBenchmarkConfigLine(line) || isBenchmarkResultLine(line) {
+			results.WriteString(line)
+			results.WriteByte('\n')
+		}
+	}
+	return results.Bytes()
+}
+
+// isBenchmarkConfigLine reports whether line is a configuration line in the
+// Go benchmark format: a key that starts with a lower case letter and
+// contains no spaces, followed by a colon and a value.
+func isBenchmarkConfigLine(line string) bool {
+	i := strings.Index(line, ":")
+	if i <= 0 || (i+1 < len(line) && line[i+1] != ' ') {
+		return false
+	}
+	key := line[:i]
+	return 'a' <= key[0] && key[0] <= 'z' && !strings.ContainsAny(key, " \t")
+}
+
+// isBenchmarkResultLine reports whether line is a benchmark result, like
+// "BenchmarkFoo-8   1000   1234 ns/op".
+func isBenchmarkResultLine(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+		return false
+	}
+	_, err := strconv.Atoi(fields[1])
+	return err == nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBenchmarkResults(t *testing.T) {
+	var tests = []struct {
+		desc, output, want string
+	}{
+		{
+			desc:   "no benchmarks",
+			output: "PASS\n",
+			want:   "",
+		}, {
+			desc: "benchmarks",
+			output: `goos: linux
+goarch: amd64
+pkg: example.com/bench
+cpu: Intel(R) Xeon(R) CPU @ 2.20GHz
+BenchmarkFoo
+    bench_test.go:10: log message
+BenchmarkFoo-8   	 1000000	      1052 ns/op
+BenchmarkBar/sub-8   	   50000	     23456 ns/op	     128 B/op	       2 allocs/op
+PASS
+`,
+			want: `goos: linux
+goarch: amd64
+pkg: example.com/bench
+cpu: Intel(R) Xeon(R) CPU @ 2.20GHz
+BenchmarkFoo-8   	 1000000	      1052 ns/op
+BenchmarkBar/sub-8   	   50000	     23456 ns/op	     128 B/op	       2 allocs/op
+`,
+		}, {
+			desc: "verbose",
+			output: `=== RUN   BenchmarkFoo
+BenchmarkFoo
+BenchmarkFoo-8   	 1000000	      1052 ns/op
+--- FAIL: BenchmarkBar
+    bench_test.go:20: failed
+FAIL
+`,
+			want: "BenchmarkFoo-8   \t 1000000\t      1052 ns/op\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got := string(benchmarkResults([]byte(tt.output))); got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBenchmarkArgs(t *testing.T) {
+	var tests = []struct {
+		count, benchTime string
+		want             []string
+	}{
+		{
+			want: []string{"-test.run=^$", "-test.bench=."},
+		}, {
+			count:     "5",
+			benchTime: "100x",
+			want:      []string{"-test.run=^$", "-test.bench=.", "-test.count=5", "-test.benchtime=100x"},
+		},
+	}
+	for _, tt := range tests {
+		for k, v := range map[string]string{"GO_TEST_BENCH_COUNT": tt.count, "GO_TEST_BENCH_TIME": tt.benchTime} {
+			if v == "" {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, v)
+			}
+		}
+		if got := benchmarkArgs(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("got %q; want %q", got, tt.want)
+		}
+	}
+	os.Unsetenv("GO_TEST_BENCH_COUNT")
+	os.Unsetenv("GO_TEST_BENCH_TIME")
+}
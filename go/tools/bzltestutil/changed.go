@@ -0,0 +1,129 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Unaffected reports whether none of the files listed in the changed files
+// manifest affect the test, so running it can be skipped. It also returns a
+// message explaining why the test is or isn't skipped.
+//
+// changedFilesPath and testInputsPath are the paths of the manifest and of a
+// list of files the test was built from, relative to the workspace directory
+// in the runfiles tree. Both files list paths relative to the repository
+// root, one per line.
+//
+// Unaffected never skips a test when it isn't sure the test is unaffected:
+// when the test isn't run by "bazel test", when a file can't be read, when
+// the manifest is empty, or when a changed file may change how anything is
+// built, like a BUILD or .bzl file.
+func Unaffected(changedFilesPath, testInputsPath string) (string, bool) {
+	srcDir, hasSrcDir := os.LookupEnv("TEST_SRCDIR")
+	workspace, hasWorkspace := os.LookupEnv("TEST_WORKSPACE")
+	if !hasSrcDir || !hasWorkspace {
+		return "not run by bazel test", false
+	}
+	changed, err := readPathList(filepath.Join(srcDir, workspace, changedFilesPath))
+	if err != nil {
+		return fmt.Sprintf("could not read changed files: %v", err), false
+	}
+	if len(changed) == 0 {
+		return "changed files manifest is empty", false
+	}
+	inputs, err := readPathList(filepath.Join(srcDir, workspace, testInputsPath))
+	if err != nil {
+		return fmt.Sprintf("could not read test inputs: %v", err), false
+	}
+	inputSet := make(map[string]bool, len(inputs))
+	for _, input := range inputs {
+		inputSet[input] = true
+	}
+	for _, c := range changed {
+		if inputSet[c] {
+			return fmt.Sprintf("changed file %s affects this test", c), false
+		}
+		if affectsBuild(c) {
+			return fmt.Sprintf("changed file %s may affect how this test is built", c), false
+		}
+	}
+	return fmt.Sprintf("none of the %d changed files affect this test", len(changed)), true
+}
+
+// affectsBuild reports whether a change to the file at p may change how
+// targets are built, even though it isn't an input of them.
+func affectsBuild(p string) bool {
+	switch path.Base(p) {
+	case "BUILD", "BUILD.bazel", "WORKSPACE", "WORKSPACE.bazel", ".bazelrc", "go.mod", "go.sum":
+		return true
+	}
+	return path.Ext(p) == ".bzl"
+}
+
+// readPathList reads a file listing one path per line. Blank lines are
+// ignored, and paths are cleaned and converted to use forward slashes.
+func readPathList(name string) ([]string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		paths = append(paths, path.Clean(filepath.ToSlash(line)))
+	}
+	return paths, nil
+}
+
+// ReportSkipped writes a test report marking tests as skipped with reason,
+// if Bazel asked for one with XML_OUTPUT_FILE.
+func ReportSkipped(pkg string, tests []string, reason string) error {
+	out, ok := os.LookupEnv("XML_OUTPUT_FILE")
+	if !ok {
+		return nil
+	}
+	suite := xmlTestSuite{
+		Name:    pkg,
+		Tests:   len(tests),
+		Skipped: len(tests),
+		Time:    "0.000",
+	}
+	for _, test := range tests {
+		suite.TestCases = append(suite.TestCases, xmlTestCase{
+			Classname: path.Base(pkg),
+			Name:      test,
+			Time:      "0.000",
+			Skipped:   &xmlMessage{Message: reason, Contents: reason},
+		})
+	}
+	data, err := xml.MarshalIndent(&xmlTestSuites{Suites: []xmlTestSuite{suite}}, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(out, data, 0664); err != nil {
+		return fmt.Errorf("error writing test xml: %s", err)
+	}
+	return nil
+}
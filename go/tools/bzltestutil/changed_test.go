@@ -0,0 +1,86 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnaffected(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "changed_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	if err := os.Mkdir(filepath.Join(srcDir, "ws"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	inputs := "pkg/lib.go\npkg/lib_test.go\nother/dep.go\n"
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "ws", "inputs.txt"), []byte(inputs), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"TEST_SRCDIR": srcDir, "TEST_WORKSPACE": "ws"} {
+		if old, ok := os.LookupEnv(k); ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+		os.Setenv(k, v)
+	}
+
+	for _, test := range []struct {
+		desc, changed string
+		want          bool
+	}{
+		{
+			desc:    "unrelated",
+			changed: "docs/README.md\nunrelated/lib.go\n",
+			want:    true,
+		}, {
+			desc:    "source",
+			changed: "unrelated/lib.go\npkg/lib.go\n",
+		}, {
+			desc:    "dependency",
+			changed: "./other/dep.go\n",
+		}, {
+			desc:    "build_file",
+			changed: "unrelated/BUILD.bazel\n",
+		}, {
+			desc:    "bzl_file",
+			changed: "tools/defs.bzl\n",
+		}, {
+			desc:    "empty",
+			changed: "\n",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			if err := ioutil.WriteFile(filepath.Join(srcDir, "ws", "changed.txt"), []byte(test.changed), 0666); err != nil {
+				t.Fatal(err)
+			}
+			if reason, got := Unaffected("changed.txt", "inputs.txt"); got != test.want {
+				t.Errorf("got %v (%s); want %v", got, reason, test.want)
+			}
+		})
+	}
+
+	t.Run("missing_manifest", func(t *testing.T) {
+		if reason, got := Unaffected("missing.txt", "inputs.txt"); got {
+			t.Errorf("got true (%s); want false", reason)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// stmtCoverage is the number of statements in some code, and the number of
+// those that were covered.
+type stmtCoverage struct {
+	covered, total int64
+}
+
+// percent returns the percentage of statements covered. Code without
+// statements has nothing left to cover, so it's reported as fully covered,
+// as in the per-function coverage report.
+func (c stmtCoverage) percent() float64 {
+	if c.total == 0 {
+		return 100
+	}
+	return 100 * float64(c.covered) / float64(c.total)
+}
+
+// CheckCoverage returns an error if the percentage of statements covered in
+// cover is below a threshold. total is the minimum percentage for all
+// instrumented packages together, and packages maps import paths to minimum
+// percentages for individual packages. A threshold for a package without
+// instrumented files is an error, since it can't be checked.
+//
+// CheckCoverage is called by the generated test main function after tests
+// pass, when the test is run with "bazel coverage" and the go_test sets
+// coverage_threshold or coverage_package_thresholds.
+func CheckCoverage(cover testing.Cover, total float64, packages map[string]float64) error {
+	var all stmtCoverage
+	byPackage := make(map[string]stmtCoverage)
+	for file, blocks := range cover.Blocks {
+		var f stmtCoverage
+		counters := cover.Counters[file]
+		for i, b := range blocks {
+			f.total += int64(b.Stmts)
+			if atomic.LoadUint32(&counters[i]) > 0 {
+				f.covered += int64(b.Stmts)
+			}
+		}
+		// Instrumented files are named by the package's import path and the
+		// file's base name.
+		pkg := path.Dir(file)
+		c := byPackage[pkg]
+		c.covered += f.covered
+		c.total += f.total
+		byPackage[pkg] = c
+		all.covered += f.covered
+		all.total += f.total
+	}
+
+	var errs []string
+	if p := all.percent(); p < total {
+		errs = append(errs, fmt.Sprintf("coverage: %.1f%% of statements, below the threshold of %.1f%%", p, total))
+	}
+	pkgs := make([]string, 0, len(packages))
+	for pkg := range packages {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		threshold := packages[pkg]
+		c, ok := byPackage[pkg]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("coverage: %s is not instrumented, so its threshold of %.1f%% can't be checked", pkg, threshold))
+			continue
+		}
+		if p := c.percent(); p < threshold {
+			errs = append(errs, fmt.Sprintf("coverage: %.1f%% of statements in %s, below its threshold of %.1f%%", p, pkg, threshold))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
+	return nil
+}
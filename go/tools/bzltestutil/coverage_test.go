@@ -0,0 +1,112 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bzltestutil
+
+import (
+	"strings"
+	"testing"
+)
+
+// testCover returns coverage data for two packages. example.com/a has 4
+// statements with 3 covered, across two files. example.com/b has 4 statements
+// with 1 covered. Together, 50% of statements are covered.
+func testCover() testing.Cover {
+	return testing.Cover{
+		Mode: "set",
+		Counters: map[string][]uint32{
+			"example.com/a/a1.go": {1, 0},
+			"example.com/a/a2.go": {5},
+			"example.com/b/b.go":  {0, 1},
+		},
+		Blocks: map[string][]testing.CoverBlock{
+			"example.com/a/a1.go": {{Stmts: 2}, {Stmts: 1}},
+			"example.com/a/a2.go": {{Stmts: 1}},
+			"example.com/b/b.go":  {{Stmts: 3}, {Stmts: 1}},
+		},
+	}
+}
+
+func TestCheckCoverage(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		cover    testing.Cover
+		total    float64
+		packages map[string]float64
+		wantErrs []string
+	}{
+		{
+			desc:  "total_at_threshold",
+			cover: testCover(),
+			total: 50,
+		}, {
+			desc:     "total_below_threshold",
+			cover:    testCover(),
+			total:    50.5,
+			wantErrs: []string{"coverage: 50.0% of statements, below the threshold of 50.5%"},
+		}, {
+			desc:     "packages_at_threshold",
+			cover:    testCover(),
+			packages: map[string]float64{"example.com/a": 75, "example.com/b": 25},
+		}, {
+			desc:     "packages_below_threshold",
+			cover:    testCover(),
+			total:    40,
+			packages: map[string]float64{"example.com/a": 80, "example.com/b": 30},
+			wantErrs: []string{
+				"coverage: 75.0% of statements in example.com/a, below its threshold of 80.0%",
+				"coverage: 25.0% of statements in example.com/b, below its threshold of 30.0%",
+			},
+		}, {
+			desc:     "package_not_instrumented",
+			cover:    testCover(),
+			packages: map[string]float64{"example.com/c": 10},
+			wantErrs: []string{"coverage: example.com/c is not instrumented, so its threshold of 10.0% can't be checked"},
+		}, {
+			desc:  "empty_profile",
+			cover: testing.Cover{Mode: "set"},
+			total: 100,
+		}, {
+			desc:     "empty_profile_package",
+			cover:    testing.Cover{Mode: "set"},
+			packages: map[string]float64{"example.com/a": 1},
+			wantErrs: []string{"coverage: example.com/a is not instrumented, so its threshold of 1.0% can't be checked"},
+		}, {
+			desc: "package_without_statements",
+			cover: testing.Cover{
+				Mode:     "set",
+				Counters: map[string][]uint32{"example.com/a/a.go": {}},
+				Blocks:   map[string][]testing.CoverBlock{"example.com/a/a.go": {}},
+			},
+			total:    100,
+			packages: map[string]float64{"example.com/a": 100},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := CheckCoverage(test.cover, test.total, test.packages)
+			if len(test.wantErrs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("unexpected success")
+			}
+			if got, want := err.Error(), strings.Join(test.wantErrs, "\n"); got != want {
+				t.Errorf("got error:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
@@ -30,6 +30,14 @@ var (
 	testExecDir string
 )
 
+// outputEnvVars are the environment variables Bazel sets to paths the test
+// writes its outputs to.
+var outputEnvVars = []string{
+	"TEST_UNDECLARED_OUTPUTS_DIR",
+	"TEST_UNDECLARED_OUTPUTS_ANNOTATIONS_DIR",
+	"XML_OUTPUT_FILE",
+}
+
 // This initializer runs before any user packages.
 func init() {
 	var err error
@@ -38,6 +46,22 @@ func init() {
 		panic(err)
 	}
 
+	// Files the test writes under TEST_UNDECLARED_OUTPUTS_DIR are zipped by
+	// Bazel after the test exits, whether or not it passed. Make that path
+	// and the other output paths absolute first, so they still work after
+	// changing directories below, and create the directory so tests can
+	// write to it directly.
+	for _, key := range outputEnvVars {
+		if p, ok := os.LookupEnv(key); ok && p != "" && !filepath.IsAbs(p) {
+			os.Setenv(key, filepath.Join(testExecDir, p))
+		}
+	}
+	if dir, ok := os.LookupEnv("TEST_UNDECLARED_OUTPUTS_DIR"); ok && dir != "" {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			panic(fmt.Sprintf("could not create undeclared outputs directory: %v", err))
+		}
+	}
+
 	// Check if we're being run by Bazel and change directories if so.
 	// TEST_SRCDIR and TEST_WORKSPACE are set by the Bazel test runner, so that makes a decent proxy.
 	testSrcDir, hasSrcDir := os.LookupEnv("TEST_SRCDIR")
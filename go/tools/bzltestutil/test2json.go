@@ -317,6 +317,10 @@ func (c *Converter) flushReport(depth int) {
 func (c *Converter) Close() error {
 	c.input.flush()
 	c.output.flush()
+	// Report tests that printed their results before the test binary exited,
+	// for example a test that panicked. The final event is then for the
+	// whole package, not the last test that printed output.
+	c.flushReport(0)
 	if c.result != "" {
 		e := &event{Action: c.result}
 		if c.mode&Timestamp != 0 {
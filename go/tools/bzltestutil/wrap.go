@@ -25,6 +25,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 // TestWrapperAbnormalExit is used by Wrap to indicate the child
@@ -66,15 +67,28 @@ func Wrap(pkg string) error {
 	if shouldAddTestV() {
 		args = append([]string{"-test.v"}, args...)
 	}
+	runBenchmarks := shouldRunBenchmarks()
+	var benchBuffer bytes.Buffer
+	if runBenchmarks {
+		args = append(benchmarkArgs(), args...)
+	}
 	exePath := os.Args[0]
 	if !filepath.IsAbs(exePath) && strings.ContainsRune(exePath, filepath.Separator) && testExecDir != "" {
 		exePath = filepath.Join(testExecDir, exePath)
 	}
 	cmd := exec.Command(exePath, args...)
 	cmd.Env = append(os.Environ(), "GO_TEST_WRAP=0")
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = io.MultiWriter(os.Stdout, jsonConverter)
+	// Panics and other runtime errors are printed to stderr, so it's
+	// converted along with stdout, as "go test -json" does. The lock keeps
+	// the two from writing to the converter at the same time.
+	converterWriter := &lockedWriter{w: jsonConverter}
+	cmd.Stderr = io.MultiWriter(os.Stderr, converterWriter)
+	cmd.Stdout = io.MultiWriter(os.Stdout, converterWriter)
+	if runBenchmarks {
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, &benchBuffer)
+	}
 	err := cmd.Run()
+	jsonConverter.Exited(err)
 	jsonConverter.Close()
 	if out, ok := os.LookupEnv("XML_OUTPUT_FILE"); ok {
 		werr := writeReport(jsonBuffer, pkg, out)
@@ -90,9 +104,26 @@ func Wrap(pkg string) error {
 			return fmt.Errorf("error writing test json: %s", err)
 		}
 	}
+	if runBenchmarks {
+		if werr := writeBenchmarkOutput(benchBuffer.Bytes()); werr != nil {
+			return werr
+		}
+	}
 	return err
 }
 
+// lockedWriter serializes writes to w.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
 func writeReport(jsonBuffer bytes.Buffer, pkg string, path string) error {
 	xml, cerr := json2xml(&jsonBuffer, pkg)
 	if cerr != nil {
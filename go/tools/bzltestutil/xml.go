@@ -77,6 +77,8 @@ type testCase struct {
 // http://windyroad.com.au/dl/Open%20Source/JUnit.xsd
 func json2xml(r io.Reader, pkgName string) ([]byte, error) {
 	var pkgDuration *float64
+	var pkgFailed bool
+	var pkgOutput strings.Builder
 	testcases := make(map[string]*testCase)
 	testCaseByName := func(name string) *testCase {
 		if name == "" {
@@ -104,6 +106,8 @@ func json2xml(r io.Reader, pkgName string) ([]byte, error) {
 		case "output":
 			if c := testCaseByName(e.Test); c != nil {
 				c.output.WriteString(e.Output)
+			} else {
+				pkgOutput.WriteString(e.Output)
 			}
 		case "skip":
 			if c := testCaseByName(e.Test); c != nil {
@@ -117,6 +121,7 @@ func json2xml(r io.Reader, pkgName string) ([]byte, error) {
 				c.duration = e.Elapsed
 			} else {
 				pkgDuration = e.Elapsed
+				pkgFailed = true
 			}
 		case "pass":
 			if c := testCaseByName(e.Test); c != nil {
@@ -128,10 +133,10 @@ func json2xml(r io.Reader, pkgName string) ([]byte, error) {
 		}
 	}
 
-	return xml.MarshalIndent(toXML(pkgName, pkgDuration, testcases), "", "\t")
+	return xml.MarshalIndent(toXML(pkgName, pkgDuration, pkgFailed, pkgOutput.String(), testcases), "", "\t")
 }
 
-func toXML(pkgName string, pkgDuration *float64, testcases map[string]*testCase) *xmlTestSuites {
+func toXML(pkgName string, pkgDuration *float64, pkgFailed bool, pkgOutput string, testcases map[string]*testCase) *xmlTestSuites {
 	cases := make([]string, 0, len(testcases))
 	for k := range testcases {
 		cases = append(cases, k)
@@ -157,7 +162,7 @@ func toXML(pkgName string, pkgDuration *float64, testcases map[string]*testCase)
 		case "skip":
 			suite.Skipped++
 			newCase.Skipped = &xmlMessage{
-				Message:  "Skipped",
+				Message:  skipReason(c.output.String()),
 				Contents: c.output.String(),
 			}
 		case "fail":
@@ -177,5 +182,38 @@ func toXML(pkgName string, pkgDuration *float64, testcases map[string]*testCase)
 		}
 		suite.TestCases = append(suite.TestCases, newCase)
 	}
+	if pkgFailed && suite.Failures == 0 && suite.Errors == 0 {
+		// The test binary failed without reporting a failed test, for example
+		// because it panicked during initialization or TestMain exited early.
+		// Report the failure as an error, so the suite isn't mistaken for
+		// passing.
+		suite.Tests++
+		suite.Errors++
+		suite.TestCases = append(suite.TestCases, xmlTestCase{
+			Name:      pkgName,
+			Classname: path.Base(pkgName),
+			Time:      suite.Time,
+			Error: &xmlMessage{
+				Message:  "Test binary failed without a failing test",
+				Contents: pkgOutput,
+			},
+		})
+	}
 	return &xmlTestSuites{Suites: []xmlTestSuite{suite}}
 }
+
+// skipReason returns the message a skipped test logged with its skip, which
+// is the last line it printed after its "--- SKIP" line.
+func skipReason(output string) string {
+	reason := "Skipped"
+	skipped := false
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "--- SKIP: ") {
+			skipped = true
+		} else if skipped && line != "" {
+			reason = line
+		}
+	}
+	return reason
+}
@@ -36,6 +36,9 @@ def _file_path(f):
     return paths.join(prefix, f.path)
 
 def _go_archive_to_pkg(archive):
+    # For cgo packages, the driver replaces files that import "C" in
+    # CompiledGoFiles with the files cgo generated into CgoGoFilesDir.
+    cgo_go_srcs = archive.data._cgo_go_srcs
     return struct(
         ID = str(archive.data.label),
         PkgPath = archive.data.importpath,
@@ -48,6 +51,7 @@ def _go_archive_to_pkg(archive):
             _file_path(src)
             for src in archive.data.srcs
         ],
+        CgoGoFilesDir = _file_path(cgo_go_srcs) if cgo_go_srcs else "",
     )
 
 def _make_pkg_json(ctx, archive, pkg_info):
@@ -62,6 +66,7 @@ def _go_pkg_info_aspect_impl(target, ctx):
     deps_transitive_json_file = []
     deps_transitive_export_file = []
     deps_transitive_compiled_go_files = []
+    deps_transitive_cgo_go_srcs = []
 
     for attr in ["deps", "embed"]:
         for dep in getattr(ctx.rule.attr, attr, []):
@@ -71,12 +76,14 @@ def _go_pkg_info_aspect_impl(target, ctx):
                     deps_transitive_json_file.append(pkg_info.transitive_json_file)
                     deps_transitive_export_file.append(pkg_info.transitive_export_file)
                     deps_transitive_compiled_go_files.append(pkg_info.transitive_compiled_go_files)
+                    deps_transitive_cgo_go_srcs.append(pkg_info.transitive_cgo_go_srcs)
                 elif attr == "embed":
                     # If deps are embedded, do not gather their json or export_file since they
                     # are included in the current target, but do gather their deps'.
                     deps_transitive_json_file.append(pkg_info.deps_transitive_json_file)
                     deps_transitive_export_file.append(pkg_info.deps_transitive_export_file)
                     deps_transitive_compiled_go_files.append(pkg_info.deps_transitive_compiled_go_files)
+                    deps_transitive_cgo_go_srcs.append(pkg_info.deps_transitive_cgo_go_srcs)
 
                 # Fetch the stdlib json from the first dependency
                 if not stdlib_json_file:
@@ -84,11 +91,14 @@ def _go_pkg_info_aspect_impl(target, ctx):
 
     pkg_json_files = []
     compiled_go_files = []
+    cgo_go_srcs = []
     export_files = []
 
     if GoArchive in target:
         archive = target[GoArchive]
         compiled_go_files.extend(archive.source.srcs)
+        if archive.data._cgo_go_srcs:
+            cgo_go_srcs.append(archive.data._cgo_go_srcs)
         export_files.append(archive.data.export_file)
         pkg = _go_archive_to_pkg(archive)
         pkg_json_files.append(_make_pkg_json(ctx, archive, pkg))
@@ -109,6 +119,8 @@ def _go_pkg_info_aspect_impl(target, ctx):
                     pkg = _go_archive_to_pkg(archive)
                     pkg_json_files.append(_make_pkg_json(ctx, archive, pkg))
                     compiled_go_files.extend(archive.source.srcs)
+                    if archive.data._cgo_go_srcs:
+                        cgo_go_srcs.append(archive.data._cgo_go_srcs)
                     export_files.append(archive.data.export_file)
 
     # If there was no stdlib json in any dependencies, fetch it from the
@@ -132,6 +144,13 @@ def _go_pkg_info_aspect_impl(target, ctx):
         deps_transitive_compiled_go_files = depset(
             transitive = deps_transitive_compiled_go_files,
         ),
+        transitive_cgo_go_srcs = depset(
+            direct = cgo_go_srcs,
+            transitive = deps_transitive_cgo_go_srcs,
+        ),
+        deps_transitive_cgo_go_srcs = depset(
+            transitive = deps_transitive_cgo_go_srcs,
+        ),
         transitive_export_file = depset(
             direct = export_files,
             transitive = deps_transitive_export_file,
@@ -146,6 +165,7 @@ def _go_pkg_info_aspect_impl(target, ctx):
         OutputGroupInfo(
             go_pkg_driver_json_file = pkg_info.transitive_json_file,
             go_pkg_driver_srcs = pkg_info.transitive_compiled_go_files,
+            go_pkg_driver_cgo_go_srcs = pkg_info.transitive_cgo_go_srcs,
             go_pkg_driver_export_file = pkg_info.transitive_export_file,
             go_pkg_driver_stdlib_json_file = depset([pkg_info.stdlib_json_file] if pkg_info.stdlib_json_file else []),
         ),
@@ -85,6 +85,10 @@ func (b *BazelJSONBuilder) outputGroupsForMode(mode LoadMode) string {
 	if mode&NeedExportsFile != 0 {
 		og += ",go_pkg_driver_export_file"
 	}
+	if mode&NeedCompiledGoFiles != 0 {
+		// Building these compiles cgo packages, so only do it when needed.
+		og += ",go_pkg_driver_cgo_go_srcs"
+	}
 	return og
 }
 
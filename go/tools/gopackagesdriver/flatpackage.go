@@ -17,9 +17,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"go/ast"
 	"go/parser"
 	"go/token"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -63,6 +66,11 @@ type FlatPackage struct {
 	ExportFile      string              `json:",omitempty"`
 	Imports         map[string]string   `json:",omitempty"`
 	Standard        bool                `json:",omitempty"`
+
+	// CgoGoFilesDir is the directory containing Go files generated by cgo.
+	// It's set by the aspect for cgo packages and cleared by
+	// ExpandCgoFiles, so it's not reported to clients.
+	CgoGoFilesDir string `json:",omitempty"`
 }
 
 type (
@@ -99,9 +107,56 @@ func (fp *FlatPackage) ResolvePaths(prf PathResolverFunc) error {
 	resolvePathsInPlace(prf, fp.GoFiles)
 	resolvePathsInPlace(prf, fp.OtherFiles)
 	fp.ExportFile = prf(fp.ExportFile)
+	if fp.CgoGoFilesDir != "" {
+		fp.CgoGoFilesDir = prf(fp.CgoGoFilesDir)
+	}
 	return nil
 }
 
+// ExpandCgoFiles replaces files that import "C" in CompiledGoFiles with the
+// Go files cgo generated from them, as "go list -compiled" does. Nothing
+// is changed for packages without cgo, or if the generated files haven't
+// been built.
+func (fp *FlatPackage) ExpandCgoFiles() {
+	dir := fp.CgoGoFilesDir
+	fp.CgoGoFilesDir = ""
+	if dir == "" || !buildContext.CgoEnabled {
+		return
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var genFiles []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".go") {
+			genFiles = append(genFiles, filepath.Join(dir, e.Name()))
+		}
+	}
+	if len(genFiles) == 0 {
+		return
+	}
+
+	fset := token.NewFileSet()
+	compiledGoFiles := make([]string, 0, len(fp.CompiledGoFiles)+len(genFiles))
+	for _, file := range fp.CompiledGoFiles {
+		if f, err := parser.ParseFile(fset, file, nil, parser.ImportsOnly); err == nil && importsC(f) {
+			continue
+		}
+		compiledGoFiles = append(compiledGoFiles, file)
+	}
+	fp.CompiledGoFiles = append(compiledGoFiles, genFiles...)
+}
+
+func importsC(f *ast.File) bool {
+	for _, imp := range f.Imports {
+		if imp.Path.Value == `"C"` {
+			return true
+		}
+	}
+	return false
+}
+
 // FilterFilesForBuildTags filters the source files given the current build
 // tags.
 func (fp *FlatPackage) FilterFilesForBuildTags() {
@@ -113,7 +168,9 @@ func (fp *FlatPackage) IsStdlib() bool {
 	return fp.Standard
 }
 
-func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc) {
+// ResolveImports sets the package's imports from the import declarations in
+// its compiled files, reading overlaid files from o.
+func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc, o Overlay) {
 	// Stdlib packages are already complete import wise
 	if fp.IsStdlib() {
 		return
@@ -122,7 +179,7 @@ func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc) {
 	fset := token.NewFileSet()
 
 	for _, file := range fp.CompiledGoFiles {
-		f, err := parser.ParseFile(fset, file, nil, parser.ImportsOnly)
+		f, err := parser.ParseFile(fset, file, o.Source(file), parser.ImportsOnly)
 		if err != nil {
 			continue
 		}
@@ -152,6 +209,33 @@ func (fp *FlatPackage) ResolveImports(resolve ResolvePkgFunc) {
 	}
 }
 
+// hasGoFileInDir reports whether any of the package's Go files are in dir.
+func (fp *FlatPackage) hasGoFileInDir(dir string) bool {
+	for _, file := range fp.GoFiles {
+		if filepath.Dir(file) == dir && filepath.Ext(file) == ".go" {
+			return true
+		}
+	}
+	return false
+}
+
+// packageName returns the package's name, reading it from the package clause
+// of its first Go file if it's not known yet.
+func (fp *FlatPackage) packageName(fset *token.FileSet, o Overlay) string {
+	if fp.Name != "" {
+		return fp.Name
+	}
+	for _, file := range fp.GoFiles {
+		if filepath.Ext(file) != ".go" {
+			continue
+		}
+		if f, err := parser.ParseFile(fset, file, o.Source(file), parser.PackageClauseOnly); err == nil {
+			return f.Name.Name
+		}
+	}
+	return ""
+}
+
 func (fp *FlatPackage) IsRoot() bool {
 	return strings.HasPrefix(fp.ID, "//")
 }
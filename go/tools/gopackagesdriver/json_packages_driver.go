@@ -23,7 +23,7 @@ type JSONPackagesDriver struct {
 	registry *PackageRegistry
 }
 
-func NewJSONPackagesDriver(jsonFiles []string, prf PathResolverFunc) (*JSONPackagesDriver, error) {
+func NewJSONPackagesDriver(jsonFiles []string, prf PathResolverFunc, overlay Overlay) (*JSONPackagesDriver, error) {
 	jpd := &JSONPackagesDriver{
 		registry: NewPackageRegistry(),
 	}
@@ -40,7 +40,9 @@ func NewJSONPackagesDriver(jsonFiles []string, prf PathResolverFunc) (*JSONPacka
 		return nil, fmt.Errorf("unable to resolve paths: %w", err)
 	}
 
-	if err := jpd.registry.ResolveImports(); err != nil {
+	jpd.registry.ApplyOverlay(overlay)
+
+	if err := jpd.registry.ResolveImports(overlay); err != nil {
 		return nil, fmt.Errorf("unable to resolve paths: %w", err)
 	}
 
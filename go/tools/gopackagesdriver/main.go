@@ -77,6 +77,10 @@ func run() (*driverResponse, error) {
 		return emptyResponse, fmt.Errorf("unable to read request: %w", err)
 	}
 
+	// Read build constraints from files with unsaved changes.
+	overlay := NewOverlay(request.Overlay)
+	buildContext.OpenFile = overlay.OpenFile
+
 	bazel, err := NewBazel(ctx, bazelBin, workspaceRoot)
 	if err != nil {
 		return emptyResponse, fmt.Errorf("unable to create bazel instance: %w", err)
@@ -92,7 +96,7 @@ func run() (*driverResponse, error) {
 		return emptyResponse, fmt.Errorf("unable to build JSON files: %w", err)
 	}
 
-	driver, err := NewJSONPackagesDriver(jsonFiles, bazelJsonBuilder.PathResolver())
+	driver, err := NewJSONPackagesDriver(jsonFiles, bazelJsonBuilder.PathResolver(), overlay)
 	if err != nil {
 		return emptyResponse, fmt.Errorf("unable to load JSON files: %w", err)
 	}
@@ -0,0 +1,60 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Overlay maps absolute file paths to the contents of files with unsaved
+// changes, like editor buffers, sent with a driver request. go/packages
+// parses and type-checks overlaid files itself. The driver reads them
+// instead of the files on disk to find build constraints, package names and
+// imports.
+type Overlay map[string][]byte
+
+// NewOverlay returns an overlay for the files in a driver request. Relative
+// paths are resolved against the workspace root, like file= queries.
+func NewOverlay(files map[string][]byte) Overlay {
+	o := make(Overlay, len(files))
+	for path, contents := range files {
+		o[filepath.Clean(ensureAbsolutePathFromWorkspace(path))] = contents
+	}
+	return o
+}
+
+// Source returns the overlaid contents of path, for parser.ParseFile. It
+// returns an untyped nil if path isn't overlaid, so the parser reads the file
+// from disk.
+func (o Overlay) Source(path string) interface{} {
+	if contents, ok := o[path]; ok {
+		return contents
+	}
+	return nil
+}
+
+// OpenFile opens path for reading, with its overlaid contents if it has any.
+// It's used as build.Context.OpenFile, so build constraints are read from
+// overlaid files.
+func (o Overlay) OpenFile(path string) (io.ReadCloser, error) {
+	if contents, ok := o[path]; ok {
+		return ioutil.NopCloser(bytes.NewReader(contents)), nil
+	}
+	return os.Open(path)
+}
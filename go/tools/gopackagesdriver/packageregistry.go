@@ -15,6 +15,10 @@
 package main
 
 import (
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -57,7 +61,8 @@ func (pr *PackageRegistry) ResolvePaths(prf PathResolverFunc) error {
 	for _, pkg := range pr.packagesByImportPath {
 		pkg.ResolvePaths(prf)
 		pkg.FilterFilesForBuildTags()
-		for _, f := range pkg.CompiledGoFiles {
+		pkg.ExpandCgoFiles()
+		for _, f := range pkg.GoFiles {
 			pr.packagesByFile[f] = pkg
 		}
 		for _, f := range pkg.CompiledGoFiles {
@@ -67,11 +72,53 @@ func (pr *PackageRegistry) ResolvePaths(prf PathResolverFunc) error {
 	return nil
 }
 
-func (pr *PackageRegistry) ResolveImports() error {
+// ApplyOverlay updates packages with overlaid files. Their export data was
+// compiled from the files on disk, so it isn't reported, and go/packages
+// type-checks them from source with the overlay instead. Export data for
+// other packages is still reported. Overlaid files that aren't in any
+// package, like new files, are added to the packages in the same directory
+// with the same package name, if their build constraints are satisfied.
+func (pr *PackageRegistry) ApplyOverlay(o Overlay) {
+	files := make([]string, 0, len(o))
+	for file := range o {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if pkg, ok := pr.packagesByFile[file]; ok {
+			pkg.ExportFile = ""
+			continue
+		}
+		dir, base := filepath.Split(file)
+		if filepath.Ext(base) != ".go" {
+			continue
+		}
+		if match, _ := buildContext.MatchFile(dir, base); !match {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, o.Source(file), parser.PackageClauseOnly)
+		if err != nil {
+			continue
+		}
+		for _, pkg := range pr.packagesByImportPath {
+			if pkg.IsStdlib() || !pkg.hasGoFileInDir(filepath.Clean(dir)) || pkg.packageName(fset, o) != f.Name.Name {
+				continue
+			}
+			pkg.GoFiles = append(pkg.GoFiles, file)
+			pkg.CompiledGoFiles = append(pkg.CompiledGoFiles, file)
+			pkg.ExportFile = ""
+			pr.packagesByFile[file] = pkg
+		}
+	}
+}
+
+func (pr *PackageRegistry) ResolveImports(o Overlay) error {
 	for _, pkg := range pr.packagesByImportPath {
 		pkg.ResolveImports(func(importPath string) *FlatPackage {
 			return pr.FromPkgPath(importPath)
-		})
+		}, o)
 	}
 	return nil
 }
@@ -68,11 +68,13 @@ def go_proto_compile(go, compiler, protos, imports, importpath):
     go_srcs = []
     outpath = None
     proto_paths = {}
+    proto_roots = {}
     desc_sets = []
     for proto in protos:
         desc_sets.append(proto.transitive_descriptor_sets)
         for src in proto.check_deps_sources.to_list():
             path = proto_path(src, proto)
+            proto_roots[_proto_root(src, path)] = True
             if path in proto_paths:
                 if proto_paths[path] != src:
                     fail("proto files {} and {} have the same import path, {}".format(
@@ -93,8 +95,31 @@ def go_proto_compile(go, compiler, protos, imports, importpath):
                 outpath = out.dirname[:-len(importpath)]
 
     transitive_descriptor_sets = depset(direct = [], transitive = desc_sets)
+    inputs = [
+        compiler.internal.go_protoc,
+        compiler.internal.protoc,
+        compiler.internal.plugin,
+    ]
+    well_known_types_dir = None
+    if compiler.internal.well_known_protos:
+        # Compile the protos from source, so they may import the well-known
+        # types without depending on them. Their own descriptor sets can't
+        # be built in that case, since proto_library requires imports to be
+        # declared. Descriptor sets of dependencies are still used.
+        direct_sets = {proto.direct_descriptor_set: True for proto in protos}
+        transitive_descriptor_sets = depset([
+            s
+            for s in transitive_descriptor_sets.to_list()
+            if s not in direct_sets
+        ])
+        for proto in protos:
+            inputs.extend(proto.check_deps_sources.to_list())
+        inputs.extend(compiler.internal.well_known_protos)
+        well_known_types_dir = _well_known_types_dir(compiler.internal.well_known_protos)
 
     args = go.actions.args()
+    args.use_param_file("-param=%s")
+    args.set_param_file_format("shell")
     args.add("-protoc", compiler.internal.protoc)
     args.add("-importpath", importpath)
     args.add("-out_path", outpath)
@@ -107,14 +132,13 @@ def go_proto_compile(go, compiler, protos, imports, importpath):
     args.add_all(transitive_descriptor_sets, before_each = "-descriptor_set")
     args.add_all(go_srcs, before_each = "-expected")
     args.add_all(imports, before_each = "-import")
+    if well_known_types_dir:
+        args.add_all(proto_roots.keys(), before_each = "-proto_path")
+        args.add("-well_known_types", well_known_types_dir)
     args.add_all(proto_paths.keys())
     go.actions.run(
         inputs = depset(
-            direct = [
-                compiler.internal.go_protoc,
-                compiler.internal.protoc,
-                compiler.internal.plugin,
-            ],
+            direct = inputs,
             transitive = [transitive_descriptor_sets],
         ),
         outputs = go_srcs,
@@ -172,6 +196,24 @@ def proto_path(src, proto):
         return src.path
     return src.path[len(prefix):]
 
+def _proto_root(src, path):
+    """Returns the directory protoc must search to find src by its import
+    path, as returned by proto_path."""
+    if src.path == path:
+        return "."
+    return src.path[:-len(path) - 1]
+
+def _well_known_types_dir(files):
+    """Returns the directory containing google/protobuf/*.proto, given the
+    well-known type protos in it."""
+    for f in files:
+        i = f.path.rfind("google/protobuf/")
+        if i == 0:
+            return "."
+        if i > 0:
+            return f.path[:i - 1]
+    fail("well_known_protos does not contain any google/protobuf/*.proto files")
+
 def _go_proto_compiler_impl(ctx):
     go = go_context(ctx)
     library = go.new_library(go)
@@ -188,6 +230,7 @@ def _go_proto_compiler_impl(ctx):
                 go_protoc = ctx.executable._go_protoc,
                 plugin = ctx.executable.plugin,
                 import_path_option = ctx.attr.import_path_option,
+                well_known_protos = ctx.files.well_known_protos,
             ),
         ),
         library,
@@ -207,6 +250,9 @@ _go_proto_compiler = rule(
             cfg = "exec",
             mandatory = True,
         ),
+        "well_known_protos": attr.label(
+            allow_files = [".proto"],
+        ),
         "_go_protoc": attr.label(
             executable = True,
             cfg = "exec",
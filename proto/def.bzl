@@ -125,6 +125,8 @@ def _go_proto_library_impl(ctx):
     if valid_archive:
         archive = go.archive(go, source)
         output_groups["compilation_outputs"] = [archive.data.file]
+        if archive.data._nogo_validation:
+            output_groups["_validation"] = [archive.data._nogo_validation]
         providers.extend([
             archive,
             DefaultInfo(
@@ -0,0 +1,52 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package c_linkmodes
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCSharedWindowsOutputs(t *testing.T) {
+	files := make(map[string]string)
+	for _, path := range flag.Args() {
+		for _, ext := range []string{".dll.a", ".dll", ".def", ".h"} {
+			if strings.HasSuffix(path, ext) {
+				files[ext] = path
+				break
+			}
+		}
+	}
+	for _, ext := range []string{".dll", ".h", ".def", ".dll.a"} {
+		path, ok := files[ext]
+		if !ok {
+			t.Errorf("no %s file in outputs %v", ext, flag.Args())
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(data) == 0 {
+			t.Errorf("%s is empty", path)
+		}
+		if ext == ".def" && !strings.Contains(string(data), "GoAdd") {
+			t.Errorf("%s does not export GoAdd:\n%s", path, data)
+		}
+	}
+}
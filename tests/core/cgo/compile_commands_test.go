@@ -0,0 +1,134 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compile_commands_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_compile_commands", "go_library")
+
+go_library(
+    name = "foo",
+    srcs = [
+        "foo.c",
+        "foo.go",
+    ],
+    cgo = True,
+    copts = ["-DFOO_VALUE=42"],
+    importpath = "example.com/foo",
+)
+
+go_library(
+    name = "pure",
+    srcs = ["pure.go"],
+    importpath = "example.com/pure",
+)
+
+go_binary(
+    name = "bin",
+    srcs = ["main.go"],
+    deps = [
+        ":foo",
+        ":pure",
+    ],
+)
+
+go_compile_commands(
+    name = "compile_commands",
+    deps = [":bin"],
+)
+
+-- foo.c --
+int foo() { return FOO_VALUE; }
+
+-- foo.go --
+package foo
+
+// int foo();
+import "C"
+
+func Foo() int { return int(C.foo()) }
+
+-- pure.go --
+package pure
+
+-- main.go --
+package main
+
+import (
+	"fmt"
+
+	"example.com/foo"
+	_ "example.com/pure"
+)
+
+func main() {
+	fmt.Println(foo.Foo())
+}
+`,
+	})
+}
+
+type compileCommand struct {
+	Directory string   `json:"directory"`
+	File      string   `json:"file"`
+	Arguments []string `json:"arguments"`
+}
+
+func TestCompileCommands(t *testing.T) {
+	if err := bazel_testing.RunBazel("build", "//:compile_commands"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.FromSlash("bazel-bin/compile_commands.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmds []compileCommand
+	if err := json.Unmarshal(data, &cmds); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only foo.c is a C source. Files generated by cgo are not included.
+	if len(cmds) != 1 {
+		t.Fatalf("got %d compile commands; want 1:\n%s", len(cmds), data)
+	}
+	cmd := cmds[0]
+	if cmd.Directory != "__EXEC_ROOT__" {
+		t.Errorf("got directory %q; want %q", cmd.Directory, "__EXEC_ROOT__")
+	}
+	if cmd.File != "__EXEC_ROOT__/foo.c" {
+		t.Errorf("got file %q; want %q", cmd.File, "__EXEC_ROOT__/foo.c")
+	}
+	args := strings.Join(cmd.Arguments, " ")
+	for _, want := range []string{"-DFOO_VALUE=42", "-c __EXEC_ROOT__/foo.c"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("arguments do not contain %q: %s", want, args)
+		}
+	}
+	if strings.Contains(args, "rules_go_work") {
+		t.Errorf("arguments refer to the temporary work directory: %s", args)
+	}
+}
@@ -0,0 +1,5 @@
+// +build gc
+
+package custom_tag
+
+const compiler = "gc"
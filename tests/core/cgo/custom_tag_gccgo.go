@@ -0,0 +1,5 @@
+// +build gccgo
+
+package custom_tag
+
+var Does Not = Compile
@@ -0,0 +1,5 @@
+// +build !custom
+
+package custom_tag
+
+const goCustomEnabled = false
@@ -0,0 +1,3 @@
+// +build custom
+
+int custom_enabled = 1;
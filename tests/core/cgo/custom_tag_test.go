@@ -0,0 +1,41 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package custom_tag
+
+// extern int custom_enabled;
+import "C"
+import "testing"
+
+// wantCustom is set with x_defs to "true" when the test is built with the
+// custom tag.
+var wantCustom string
+
+func TestGo(t *testing.T) {
+	if want := wantCustom == "true"; goCustomEnabled != want {
+		t.Errorf("goCustomEnabled is %v; want %v", goCustomEnabled, want)
+	}
+}
+
+func TestC(t *testing.T) {
+	if want := wantCustom == "true"; (C.custom_enabled != 0) != want {
+		t.Errorf("C.custom_enabled is %v; want %v", C.custom_enabled, want)
+	}
+}
+
+func TestCompiler(t *testing.T) {
+	if compiler != "gc" {
+		t.Errorf("compiler is %q; want %q", compiler, "gc")
+	}
+}
@@ -0,0 +1,17 @@
+package objc
+
+/*
+#include <stdlib.h>
+
+#include "length_darwin.h"
+*/
+import "C"
+import "unsafe"
+
+// UTF16Length returns the length of s in UTF-16 code units, as reported by
+// NSString.
+func UTF16Length(s string) int {
+	cs := C.CString(s)
+	defer C.free(unsafe.Pointer(cs))
+	return int(C.utf16_length(cs))
+}
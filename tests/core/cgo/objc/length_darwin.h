@@ -0,0 +1 @@
+int utf16_length(const char *s);
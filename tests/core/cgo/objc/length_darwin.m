@@ -0,0 +1,10 @@
+#import <Foundation/Foundation.h>
+
+#include "length_darwin.h"
+
+int utf16_length(const char *s) {
+    @autoreleasepool {
+        NSString *str = [NSString stringWithUTF8String:s];
+        return (int)[str length];
+    }
+}
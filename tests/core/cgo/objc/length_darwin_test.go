@@ -0,0 +1,16 @@
+package objc
+
+import "testing"
+
+func TestFramework(t *testing.T) {
+	for s, want := range map[string]int{
+		"":       0,
+		"gopher": 6,
+		"héllo":  5,
+		"😀":      2,
+	} {
+		if got := UTF16Length(s); got != want {
+			t.Errorf("UTF16Length(%q) = %d; want %d", s, got, want)
+		}
+	}
+}
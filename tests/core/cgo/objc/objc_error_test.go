@@ -0,0 +1,80 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objc_error_test
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "lib",
+    srcs = [
+        "lib.go",
+        "lib.m",
+    ],
+    cgo = True,
+    importpath = "example.com/lib",
+)
+
+-- lib.go --
+package lib
+
+/*
+int answer(void);
+*/
+import "C"
+
+func Answer() int {
+	return int(C.answer())
+}
+
+-- lib.m --
+int answer(void) {
+    return 42;
+}
+`,
+	})
+}
+
+func TestObjcError(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skip("Objective-C files can be compiled for the host")
+	}
+	cmd := bazel_testing.BazelCmd("build", "//:lib")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatal("unexpected success")
+	}
+	for _, want := range []string{
+		"Objective-C and Objective-C++ files can only be compiled for darwin or ios, not " + runtime.GOOS,
+		"lib.m",
+	} {
+		if !strings.Contains(stderr.String(), want) {
+			t.Errorf("got output:\n%s\nwhich does not contain %q", stderr.String(), want)
+		}
+	}
+}
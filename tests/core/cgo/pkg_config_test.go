@@ -0,0 +1,104 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg_config_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_binary(
+    name = "main",
+    srcs = ["main.go"],
+    cgo = True,
+)
+
+-- main.go --
+package main
+
+/*
+#cgo pkg-config: fake
+#cgo windows pkg-config: fake_windows_only
+int fake_value() { return FAKE_VALUE; }
+*/
+import "C"
+import "fmt"
+
+func main() {
+	fmt.Println(C.fake_value())
+}
+
+-- fake_pkg_config.sh --
+#!/bin/sh
+# Prints flags for the "fake" package, which isn't installed.
+case "$*" in
+  "--cflags -- fake") echo "-DFAKE_VALUE=42" ;;
+  "--libs -- fake") echo "-lm" ;;
+  *) echo "unexpected arguments: $*" >&2; exit 1 ;;
+esac
+`,
+	})
+}
+
+func fakePkgConfig(t *testing.T) string {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake pkg-config is a shell script")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(wd, "fake_pkg_config.sh")
+	if err := os.Chmod(path, 0777); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPkgConfig(t *testing.T) {
+	pkgConfig := fakePkgConfig(t)
+	out, err := bazel_testing.BazelOutput("run", "--@io_bazel_rules_go//go/config:pkg_config="+pkgConfig, "//:main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "42" {
+		t.Errorf("got %q; want %q", got, "42")
+	}
+}
+
+func TestPkgConfigMissing(t *testing.T) {
+	pkgConfig := filepath.Join(filepath.Dir(fakePkgConfig(t)), "missing_pkg_config")
+	cmd := bazel_testing.BazelCmd("build", "--@io_bazel_rules_go//go/config:pkg_config="+pkgConfig, "//:main")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatal("unexpected success")
+	}
+	if want := "directive requires pkg-config, which could not be found"; !strings.Contains(stderr.String(), want) {
+		t.Errorf("got output:\n%s\nwhich does not contain %q", stderr.String(), want)
+	}
+}
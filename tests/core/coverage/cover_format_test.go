@@ -0,0 +1,145 @@
+// Copyright 2019 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cover_format_test
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_test(
+    name = "a_test",
+    srcs = ["a_test.go"],
+    embed = [":a"],
+)
+
+go_library(
+    name = "a",
+    srcs = ["a.go"],
+    importpath = "example.com/coverage/a",
+)
+-- a_test.go --
+package a
+
+import "testing"
+
+func TestA(t *testing.T) {
+	ALive()
+}
+
+-- a.go --
+package a
+
+func ALive() int {
+	return 12
+}
+
+func ADead() int {
+	return 34
+}
+`,
+	})
+}
+
+func TestBinaryFormat(t *testing.T) {
+	if !goVersionAtLeast("go1.20") {
+		t.Skip("the binary coverage format requires Go 1.20 or later")
+	}
+	if err := bazel_testing.RunBazel("coverage", "--@io_bazel_rules_go//go/config:cover_format=binary", "--nozip_undeclared_test_outputs", ":a_test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test writes covmeta and covcounters files instead of a profile.
+	coverDir := filepath.FromSlash("bazel-testlogs/a_test/test.outputs/gocoverdir")
+	for _, pattern := range []string{"covmeta.*", "covcounters.*"} {
+		if matches, err := filepath.Glob(filepath.Join(coverDir, pattern)); err != nil {
+			t.Fatal(err)
+		} else if len(matches) == 0 {
+			t.Errorf("%s: no files match %s", coverDir, pattern)
+		}
+	}
+
+	// The directory can be merged and converted to a profile with the SDK's
+	// covdata tool.
+	out, err := bazel_testing.BazelOutput("info", "output_base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goPath := filepath.Join(strings.TrimSpace(string(out)), "external", "go_sdk", "bin", "go")
+	tmpDir, err := ioutil.TempDir("", "cover_format_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	mergedDir := filepath.Join(tmpDir, "merged")
+	if err := os.Mkdir(mergedDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	profilePath := filepath.Join(tmpDir, "profile.txt")
+	for _, args := range [][]string{
+		{"tool", "covdata", "merge", "-i=" + coverDir, "-o=" + mergedDir},
+		{"tool", "covdata", "textfmt", "-i=" + mergedDir, "-o=" + profilePath},
+	} {
+		if out, err := exec.Command(goPath, args...).CombinedOutput(); err != nil {
+			t.Fatalf("go %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+	}
+	profile, err := ioutil.ReadFile(profilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "example.com/coverage/a/a.go:"; !strings.Contains(string(profile), want) {
+		t.Errorf("merged profile does not contain %q:\n%s", want, profile)
+	}
+}
+
+func TestTextFormatDefault(t *testing.T) {
+	if err := bazel_testing.RunBazel("coverage", "--nozip_undeclared_test_outputs", ":a_test"); err != nil {
+		t.Fatal(err)
+	}
+	coverageData, err := ioutil.ReadFile(filepath.FromSlash("bazel-testlogs/a_test/coverage.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "example.com/coverage/a/a.go:"; !strings.Contains(string(coverageData), want) {
+		t.Errorf("coverage.dat does not contain %q", want)
+	}
+	coverDir := filepath.FromSlash("bazel-testlogs/a_test/test.outputs/gocoverdir")
+	if _, err := os.Stat(coverDir); err == nil {
+		t.Errorf("%s was written with the default coverage format", coverDir)
+	}
+}
+
+func goVersionAtLeast(v string) bool {
+	for _, t := range build.Default.ReleaseTags {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
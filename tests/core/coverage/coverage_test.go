@@ -75,6 +75,21 @@ go_test(
 	name = "d_test",
 	embed = [":d"],
 )
+
+go_test(
+    name = "e_test",
+    srcs = ["e_test.go"],
+    embed = [":e"],
+)
+
+go_library(
+    name = "e",
+    srcs = [
+        "e.go",
+        "e.pb.go",
+    ],
+    importpath = "example.com/coverage/e",
+)
 -- a_test.go --
 package a
 
@@ -128,6 +143,31 @@ package lzma
 
 // ntz32Const is used by the functions NTZ and NLZ.
 const ntz32Const = 0x04d7651f
+
+-- e_test.go --
+package e
+
+import "testing"
+
+func TestE(t *testing.T) {
+	ELive()
+}
+
+-- e.go --
+package e
+
+func ELive() int {
+	return EGenerated()
+}
+
+-- e.pb.go --
+// Code generated by protoc-gen-go. DO NOT EDIT.
+
+package e
+
+func EGenerated() int {
+	return 56
+}
 `,
 	})
 }
@@ -170,3 +210,46 @@ func TestCoverageWithComments(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCoverageExcludesGenerated(t *testing.T) {
+	for _, test := range []struct {
+		desc             string
+		args             []string
+		include, exclude []string
+	}{
+		{
+			desc:    "default",
+			include: []string{"example.com/coverage/e/e.go:"},
+			exclude: []string{"example.com/coverage/e/e.pb.go:"},
+		}, {
+			desc: "override",
+			args: []string{"--@io_bazel_rules_go//go/config:cover_exclude=*_gen.go"},
+			include: []string{
+				"example.com/coverage/e/e.go:",
+				"example.com/coverage/e/e.pb.go:",
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			args := append(append([]string{"coverage"}, test.args...), ":e_test")
+			if err := bazel_testing.RunBazel(args...); err != nil {
+				t.Fatal(err)
+			}
+			coveragePath := filepath.FromSlash("bazel-testlogs/e_test/coverage.dat")
+			coverageData, err := ioutil.ReadFile(coveragePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, include := range test.include {
+				if !bytes.Contains(coverageData, []byte(include)) {
+					t.Errorf("%s: does not contain %q\n", coveragePath, include)
+				}
+			}
+			for _, exclude := range test.exclude {
+				if bytes.Contains(coverageData, []byte(exclude)) {
+					t.Errorf("%s: contains %q\n", coveragePath, exclude)
+				}
+			}
+		})
+	}
+}
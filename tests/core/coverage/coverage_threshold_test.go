@@ -0,0 +1,165 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package coverage_threshold_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "half",
+    srcs = ["half.go"],
+    importpath = "example.com/half",
+)
+
+go_library(
+    name = "empty",
+    srcs = ["empty.go"],
+    importpath = "example.com/empty",
+)
+
+go_test(
+    name = "at_threshold_test",
+    srcs = ["half_test.go"],
+    coverage_threshold = "50",
+    embed = [":half"],
+)
+
+go_test(
+    name = "below_threshold_test",
+    srcs = ["half_test.go"],
+    coverage_threshold = "50.5",
+    embed = [":half"],
+)
+
+go_test(
+    name = "package_at_threshold_test",
+    srcs = ["half_test.go"],
+    coverage_package_thresholds = {"example.com/half": "50"},
+    embed = [":half"],
+)
+
+go_test(
+    name = "package_below_threshold_test",
+    srcs = ["half_test.go"],
+    coverage_package_thresholds = {"example.com/half": "75"},
+    embed = [":half"],
+)
+
+go_test(
+    name = "package_not_instrumented_test",
+    srcs = ["half_test.go"],
+    coverage_package_thresholds = {"example.com/missing": "10"},
+    embed = [":half"],
+)
+
+go_test(
+    name = "empty_test",
+    coverage_threshold = "100",
+    embed = [":empty"],
+)
+
+-- half.go --
+package half
+
+func Live() int {
+	return 1
+}
+
+func Dead() int {
+	return 2
+}
+
+-- half_test.go --
+package half
+
+import "testing"
+
+func TestLive(t *testing.T) {
+	Live()
+}
+
+-- empty.go --
+package empty
+
+const Answer = 42
+`,
+	})
+}
+
+func TestCoverageThreshold(t *testing.T) {
+	for _, test := range []struct {
+		target, wantErr string
+	}{
+		{
+			target: "at_threshold_test",
+		}, {
+			target:  "below_threshold_test",
+			wantErr: "coverage: 50.0% of statements, below the threshold of 50.5%",
+		}, {
+			target: "package_at_threshold_test",
+		}, {
+			target:  "package_below_threshold_test",
+			wantErr: "coverage: 50.0% of statements in example.com/half, below its threshold of 75.0%",
+		}, {
+			target:  "package_not_instrumented_test",
+			wantErr: "coverage: example.com/missing is not instrumented, so its threshold of 10.0% can't be checked",
+		}, {
+			target: "empty_test",
+		},
+	} {
+		t.Run(test.target, func(t *testing.T) {
+			err := bazel_testing.RunBazel("coverage", "//:"+test.target)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("unexpected success")
+			}
+			if xerr, ok := err.(*bazel_testing.StderrExitError); !ok || xerr.Err.ExitCode() != 3 {
+				t.Fatalf("expected bazel coverage to fail with exit code 3 (TESTS_FAILED), got: %v", err)
+			}
+			logPath := filepath.FromSlash("bazel-testlogs/" + test.target + "/test.log")
+			log, err := ioutil.ReadFile(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(log), test.wantErr) {
+				t.Errorf("%s does not contain %q:\n%s", logPath, test.wantErr, log)
+			}
+		})
+	}
+}
+
+func TestCoverageThresholdWithoutCoverage(t *testing.T) {
+	// Thresholds are only checked when coverage is collected.
+	if err := bazel_testing.RunBazel("test", "//:below_threshold_test"); err != nil {
+		t.Fatal(err)
+	}
+}
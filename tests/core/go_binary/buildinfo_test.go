@@ -0,0 +1,138 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buildinfo_test
+
+import (
+	"go/build"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+
+go_binary(
+    name = "cmd",
+    srcs = ["main.go"],
+    importpath = "example.com/cmd",
+    deps = [":lib"],
+)
+
+go_library(
+    name = "lib",
+    srcs = ["lib.go"],
+    importpath = "example.com/lib",
+    deps = [":dep"],
+)
+
+go_library(
+    name = "dep",
+    srcs = ["dep.go"],
+    importpath = "example.com/dep",
+)
+
+-- main.go --
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+
+	"example.com/lib"
+)
+
+func main() {
+	lib.Lib()
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Fprintln(os.Stderr, "no build info")
+		os.Exit(1)
+	}
+	fmt.Println("path", bi.Path)
+	fmt.Println("mod", bi.Main.Path, bi.Main.Version)
+	for _, dep := range bi.Deps {
+		fmt.Println("dep", dep.Path, dep.Version)
+	}
+}
+
+-- lib.go --
+package lib
+
+import "example.com/dep"
+
+func Lib() { dep.Dep() }
+
+-- dep.go --
+package dep
+
+func Dep() {}
+`,
+	})
+}
+
+func TestBuildInfo(t *testing.T) {
+	hasGo118 := false
+	for _, tag := range build.Default.ReleaseTags {
+		if tag == "go1.18" {
+			hasGo118 = true
+		}
+	}
+	if !hasGo118 {
+		t.Skip("build info requires Go 1.18 or later")
+	}
+
+	for _, test := range []struct {
+		desc    string
+		args    []string
+		version string
+	}{
+		{
+			desc:    "nostamp",
+			args:    []string{"--nostamp", "--embed_label=v1.2.3"},
+			version: "(devel)",
+		}, {
+			desc:    "stamp_no_label",
+			args:    []string{"--stamp"},
+			version: "(devel)",
+		}, {
+			desc:    "stamp_label",
+			args:    []string{"--stamp", "--embed_label=v1.2.3"},
+			version: "v1.2.3",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			args := append([]string{"run"}, test.args...)
+			args = append(args, "//:cmd")
+			out, err := bazel_testing.BazelOutput(args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := strings.TrimSpace(string(out))
+			want := strings.Join([]string{
+				"path example.com/cmd",
+				"mod example.com/cmd " + test.version,
+			}, "\n")
+			if got != want {
+				t.Errorf("got build info:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
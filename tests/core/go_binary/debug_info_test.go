@@ -0,0 +1,87 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package debug_info_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"runtime"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel"
+)
+
+func openELF(t *testing.T, path string) *elf.File {
+	t.Helper()
+	p, err := bazel.Runfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := elf.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestSplitDebugInfo(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("split_debug_info is only tested on Linux")
+	}
+	bin := openELF(t, "tests/core/go_binary/debug_info_bin_/debug_info_bin")
+	debug := openELF(t, "tests/core/go_binary/debug_info_bin_/debug_info_bin.debug")
+
+	if s := bin.Section(".symtab"); s != nil {
+		t.Error("stripped binary has a symbol table")
+	}
+	if _, err := bin.DWARF(); err == nil {
+		t.Error("stripped binary has DWARF information")
+	}
+	if s := bin.Section(".gnu_debuglink"); s == nil {
+		t.Error("stripped binary does not have a .gnu_debuglink section")
+	} else if data, err := s.Data(); err != nil {
+		t.Error(err)
+	} else if name := bytes.SplitN(data, []byte{0}, 2)[0]; string(name) != "debug_info_bin.debug" {
+		t.Errorf(".gnu_debuglink names %q; want %q", name, "debug_info_bin.debug")
+	}
+
+	if s := debug.Section(".symtab"); s == nil {
+		t.Error("debug file does not have a symbol table")
+	}
+	if _, err := debug.DWARF(); err != nil {
+		t.Errorf("debug file does not have DWARF information: %v", err)
+	}
+
+	// Sections that are loaded must be the same in both files, so addresses
+	// in the stripped binary can be looked up in the debug file.
+	debugSections := make(map[string]*elf.Section)
+	for _, s := range debug.Sections {
+		if s.Flags&elf.SHF_ALLOC != 0 {
+			debugSections[s.Name] = s
+		}
+	}
+	for _, s := range bin.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 {
+			continue
+		}
+		ds, ok := debugSections[s.Name]
+		if !ok {
+			t.Errorf("section %s is not in the debug file", s.Name)
+		} else if s.Addr != ds.Addr || s.Size != ds.Size {
+			t.Errorf("section %s: got address %#x and size %d in the binary, %#x and %d in the debug file", s.Name, s.Addr, s.Size, ds.Addr, ds.Size)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package link_order_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library")
+load(":shuffled_link.bzl", "shuffled_link")
+
+go_binary(
+    name = "main",
+    srcs = ["main.go"],
+    deps = [
+        ":a",
+        ":b",
+    ],
+)
+
+go_library(
+    name = "a",
+    srcs = ["a.go"],
+    importpath = "example.com/a",
+    deps = [":c"],
+)
+
+go_library(
+    name = "b",
+    srcs = ["b.go"],
+    importpath = "example.com/b",
+    deps = [
+        ":c",
+        ":d",
+    ],
+)
+
+go_library(
+    name = "c",
+    srcs = ["c.go"],
+    importpath = "example.com/c",
+    deps = [":d"],
+)
+
+go_library(
+    name = "d",
+    srcs = ["d.go"],
+    importpath = "example.com/d",
+)
+
+shuffled_link(
+    name = "shuffled",
+    binary = ":main",
+)
+
+-- shuffled_link.bzl --
+load("@io_bazel_rules_go//go:def.bzl", "GoArchive", "go_context")
+
+def _format_archive(d):
+    return "{}={}={}".format(d.label, d.importmap, d.file.path)
+
+def _shuffled_link_impl(ctx):
+    # Link the binary's main archive the way the link action does, but with
+    # the dependencies given in dependency order in one action and in
+    # reverse order in another.
+    go = go_context(ctx)
+    archive = ctx.attr.binary[GoArchive]
+    deps = depset(transitive = [d.transitive for d in archive.direct]).to_list()
+    inputs = depset(
+        direct = [go.package_list] + go.sdk.tools,
+        transitive = [archive.libs, depset(go.stdlib.libs)],
+    )
+    outs = []
+    for name, order in [("forward", deps), ("reverse", reversed(deps))]:
+        out = go.actions.declare_file("{}_{}{}".format(ctx.label.name, name, go.exe_extension))
+        builder_args = go.builder_args(go, "link")
+        builder_args.add_all(order, before_each = "-arc", map_each = _format_archive)
+        builder_args.add("-package_list", go.package_list)
+        builder_args.add("-o", out)
+        builder_args.add("-main", archive.data.file)
+        builder_args.add("-p", archive.data.importmap)
+        tool_args = go.tool_args(go)
+        tool_args.add("-buildid=redacted")
+        tool_args.add("-linkmode", "internal")
+        go.actions.run(
+            inputs = inputs,
+            outputs = [out],
+            mnemonic = "GoLink",
+            executable = go.toolchain._builder,
+            arguments = [builder_args, "--", tool_args],
+            env = go.env,
+        )
+        outs.append(out)
+    return [DefaultInfo(files = depset(outs))]
+
+shuffled_link = rule(
+    implementation = _shuffled_link_impl,
+    attrs = {
+        "binary": attr.label(
+            mandatory = True,
+            providers = [GoArchive],
+        ),
+        "_go_context_data": attr.label(
+            default = "@io_bazel_rules_go//:go_context_data",
+        ),
+    },
+    toolchains = ["@io_bazel_rules_go//go:toolchain"],
+)
+
+-- main.go --
+package main
+
+import (
+	"fmt"
+
+	"example.com/a"
+	"example.com/b"
+)
+
+func main() {
+	fmt.Println(a.A(), b.B())
+}
+
+-- a.go --
+package a
+
+import "example.com/c"
+
+func A() string { return "a" + c.C() }
+
+-- b.go --
+package b
+
+import (
+	"example.com/c"
+	"example.com/d"
+)
+
+func B() string { return "b" + c.C() + d.D() }
+
+-- c.go --
+package c
+
+import "example.com/d"
+
+func C() string { return "c" + d.D() }
+
+-- d.go --
+package d
+
+func D() string { return "d" }
+`,
+	})
+}
+
+func TestLinkOrder(t *testing.T) {
+	if err := bazel_testing.RunBazel("build", "//:shuffled"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := bazel_testing.BazelOutput("info", "bazel-bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := strings.TrimSpace(string(out))
+	matches, err := filepath.Glob(filepath.Join(bin, "shuffled_*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 2 {
+		t.Fatalf("got binaries %q; want shuffled_forward and shuffled_reverse", matches)
+	}
+	forward, err := ioutil.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverse, err := ioutil.ReadFile(matches[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(forward, reverse) {
+		t.Errorf("%s and %s differ; binaries linked from archives in different orders should be identical", matches[0], matches[1])
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linkopts_stamp_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_binary(
+    name = "stamped_bin",
+    srcs = ["main.go"],
+    gc_linkopts = [
+        "-X",
+        "main.revision={BUILD_SCM_REVISION}",
+        "-X=main.commit={STABLE_GIT_COMMIT}",
+    ],
+)
+
+-- main.go --
+package main
+
+import "fmt"
+
+var (
+	revision = "unknown"
+	commit   = "unknown"
+)
+
+func main() {
+	fmt.Println(revision, commit)
+}
+`,
+	})
+}
+
+// writeStatus writes a workspace status script that reports the given values
+// and returns the flag that makes Bazel use it.
+func writeStatus(t *testing.T, revision, commit string) string {
+	script := "#!/usr/bin/env bash\n" +
+		"echo BUILD_SCM_REVISION " + revision + "\n" +
+		"echo STABLE_GIT_COMMIT " + commit + "\n"
+	path, err := filepath.Abs("status.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return "--workspace_status_command=" + path
+}
+
+func runBin(t *testing.T, args ...string) string {
+	args = append(append([]string{"run"}, args...), "//:stamped_bin")
+	out, err := bazel_testing.BazelOutput(args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestLinkoptsStamp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("workspace status script is a bash script")
+	}
+
+	// Without --stamp, -X flags that refer to stamp keys are dropped.
+	if got, want := runBin(t), "unknown unknown"; got != want {
+		t.Errorf("without stamping: got %q; want %q", got, want)
+	}
+
+	status := writeStatus(t, "rev1", "commit1")
+	if got, want := runBin(t, "--stamp", status), "rev1 commit1"; got != want {
+		t.Errorf("with stamping: got %q; want %q", got, want)
+	}
+
+	// Changing a stable value relinks the binary but doesn't recompile anything.
+	status = writeStatus(t, "rev1", "commit2")
+	cmd := bazel_testing.BazelCmd("build", "--stamp", status, "--subcommands", "//:stamped_bin")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.Bytes())
+	}
+	if !bytes.Contains(stderr.Bytes(), []byte("GoLink")) {
+		t.Errorf("binary was not relinked after a stamp value changed:\n%s", stderr.Bytes())
+	}
+	if bytes.Contains(stderr.Bytes(), []byte("GoCompilePkg")) {
+		t.Errorf("package was recompiled after a stamp value changed:\n%s", stderr.Bytes())
+	}
+	if got, want := runBin(t, "--stamp", status), "rev1 commit2"; got != want {
+		t.Errorf("after changing a stable value: got %q; want %q", got, want)
+	}
+}
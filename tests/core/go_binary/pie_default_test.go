@@ -0,0 +1,183 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pie_default_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: strings.ReplaceAll(`
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_toolchain")
+
+constraint_setting(name = "hardening")
+
+constraint_value(
+    name = "hardened",
+    constraint_setting = ":hardening",
+)
+
+platform(
+    name = "hardened_platform",
+    constraint_values = [":hardened"],
+    parents = ["@io_bazel_rules_go//go/toolchain:linux_GOARCH_cgo"],
+)
+
+go_toolchain(
+    name = "hardened_toolchain_impl",
+    builder = "@go_sdk//:builder",
+    goarch = "GOARCH",
+    goos = "linux",
+    pie_by_default = True,
+    sdk = "@go_sdk//:go_sdk",
+)
+
+toolchain(
+    name = "hardened_toolchain",
+    target_compatible_with = [":hardened"],
+    toolchain = ":hardened_toolchain_impl",
+    toolchain_type = "@io_bazel_rules_go//go:toolchain",
+)
+
+go_binary(
+    name = "auto_bin",
+    srcs = ["main.go"],
+    cgo = True,
+)
+
+go_binary(
+    name = "normal_bin",
+    srcs = ["main.go"],
+    cgo = True,
+    linkmode = "normal",
+)
+
+go_binary(
+    name = "c_archive_bin",
+    srcs = ["main.go"],
+    cgo = True,
+    linkmode = "c-archive",
+)
+
+-- main.go --
+package main
+
+import "C"
+
+func main() {}
+`, "GOARCH", runtime.GOARCH),
+	})
+}
+
+var hardenedArgs = []string{
+	"--platforms=//:hardened_platform",
+	"--extra_toolchains=//:hardened_toolchain",
+}
+
+func TestPIEByDefault(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only checks ELF binaries")
+	}
+	for _, test := range []struct {
+		desc, target string
+		hardened     bool
+		want         elf.Type
+	}{
+		{
+			desc:     "hardened_auto",
+			target:   "auto_bin",
+			hardened: true,
+			want:     elf.ET_DYN,
+		}, {
+			desc:     "hardened_explicit_normal",
+			target:   "normal_bin",
+			hardened: true,
+			want:     elf.ET_EXEC,
+		}, {
+			desc:   "default_auto",
+			target: "auto_bin",
+			want:   elf.ET_EXEC,
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var args []string
+			if test.hardened {
+				args = hardenedArgs
+			}
+			e, err := buildELF(test.target, args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close()
+			if e.Type != test.want {
+				t.Errorf("got ELF type %v; want %v", e.Type, test.want)
+			}
+		})
+	}
+}
+
+func TestCArchiveNotPIE(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only checks ELF binaries")
+	}
+	path, err := buildOutput("c_archive_bin", hardenedArgs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// If the link mode had been replaced with pie, there would be an
+	// executable instead of an archive.
+	if filepath.Ext(path) != ".a" {
+		t.Errorf("got output %s; want an archive", path)
+	}
+}
+
+func buildELF(target string, args ...string) (*elf.File, error) {
+	path, err := buildOutput(target, args...)
+	if err != nil {
+		return nil, err
+	}
+	return elf.Open(path)
+}
+
+// buildOutput builds a target and returns the path to its output file, as
+// printed by Bazel. Targets with a linkmode attribute are built in a
+// different configuration, so their outputs aren't under bazel-bin.
+func buildOutput(target string, args ...string) (string, error) {
+	buildArgs := append([]string{"build"}, args...)
+	buildArgs = append(buildArgs, "//:"+target)
+	cmd := bazel_testing.BazelCmd(buildArgs...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("building %s: %v\n%s", target, err, stderr.Bytes())
+	}
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "bazel-") {
+			return filepath.FromSlash(line), nil
+		}
+	}
+	return "", fmt.Errorf("could not find output of %s in:\n%s", target, stderr.Bytes())
+}
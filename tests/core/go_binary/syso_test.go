@@ -0,0 +1,58 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syso_test
+
+import (
+	"bytes"
+	"debug/pe"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel"
+)
+
+// sysoMarker is a string in the resource section of rsrc_windows_amd64.syso.
+// The section has an empty resource directory followed by the string.
+const sysoMarker = "rules_go syso resource"
+
+func TestSyso(t *testing.T) {
+	path, err := bazel.Runfile("tests/core/go_binary/syso_bin_/syso_bin.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := pe.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	s := f.Section(".rsrc")
+	if s == nil {
+		t.Fatal("binary does not have a .rsrc section")
+	}
+	data, err := s.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(sysoMarker)) {
+		t.Errorf(".rsrc section does not contain %q from the .syso file", sysoMarker)
+	}
+	oh, ok := f.OptionalHeader.(*pe.OptionalHeader64)
+	if !ok {
+		t.Fatalf("got optional header %T; want *pe.OptionalHeader64", f.OptionalHeader)
+	}
+	if dir := oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_RESOURCE]; dir.VirtualAddress != s.VirtualAddress {
+		t.Errorf("resource directory is at %#x; want the start of the .rsrc section at %#x", dir.VirtualAddress, s.VirtualAddress)
+	}
+}
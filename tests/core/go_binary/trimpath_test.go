@@ -0,0 +1,106 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package trimpath_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_binary(
+    name = "panic",
+    srcs = ["main.go"],
+    deps = ["//lib"],
+)
+
+-- main.go --
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"example.com/repo/lib"
+)
+
+func main() {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("%s", debug.Stack())
+		}
+	}()
+	lib.Panic()
+}
+
+-- lib/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "lib",
+    srcs = ["lib.go"],
+    importpath = "example.com/repo/lib",
+    visibility = ["//visibility:public"],
+)
+
+-- lib/lib.go --
+package lib
+
+func Panic() {
+	panic("oops")
+}
+`,
+	})
+}
+
+func Test(t *testing.T) {
+	for _, test := range []struct {
+		desc, want string
+		args       []string
+	}{
+		{
+			desc: "default",
+			want: "example.com/repo/lib/lib.go:",
+		}, {
+			desc: "prefix",
+			want: "myrepo/lib/lib.go:",
+			args: []string{"--@io_bazel_rules_go//go/config:trimpath_prefix=myrepo"},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			args := append(append([]string{"run"}, test.args...), "//:panic")
+			out, err := bazel_testing.BazelOutput(args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stack := string(out)
+			if !strings.Contains(stack, test.want) {
+				t.Errorf("stack trace does not contain %q:\n%s", test.want, stack)
+			}
+			for _, bad := range []string{"execroot", "sandbox", "rules_go_work"} {
+				if strings.Contains(stack, bad) {
+					t.Errorf("stack trace contains %q:\n%s", bad, stack)
+				}
+			}
+		})
+	}
+}
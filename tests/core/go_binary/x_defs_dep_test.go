@@ -0,0 +1,175 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package x_defs_dep_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library", "go_test")
+
+go_library(
+    name = "buildinfo",
+    srcs = ["buildinfo.go"],
+    importmap = "example.com/vendor/example.com/buildinfo",
+    importpath = "example.com/buildinfo",
+)
+
+go_binary(
+    name = "x_defs_bin",
+    srcs = ["main.go"],
+    x_defs = {"example.com/buildinfo.version": "1.2.3"},
+    deps = [":buildinfo"],
+)
+
+go_binary(
+    name = "linkopts_bin",
+    srcs = ["main.go"],
+    gc_linkopts = ["-X=example.com/buildinfo.version=4.5.6"],
+    deps = [":buildinfo"],
+)
+
+go_binary(
+    name = "importmap_bin",
+    srcs = ["main.go"],
+    x_defs = {"example.com/vendor/example.com/buildinfo.version": "7.8.9"},
+    deps = [":buildinfo"],
+)
+
+go_binary(
+    name = "missing_var_bin",
+    srcs = ["main.go"],
+    x_defs = {"example.com/buildinfo.Missing": "1.2.3"},
+    deps = [":buildinfo"],
+)
+
+go_binary(
+    name = "missing_pkg_bin",
+    srcs = ["main.go"],
+    x_defs = {"example.com/other.version": "1.2.3"},
+    deps = [":buildinfo"],
+)
+
+go_test(
+    name = "buildinfo_test",
+    srcs = ["buildinfo_test.go"],
+    embed = [":buildinfo"],
+    x_defs = {"version": "1.2.3"},
+)
+
+-- buildinfo.go --
+package buildinfo
+
+var version = "unknown"
+
+func Version() string {
+	return version
+}
+
+-- buildinfo_test.go --
+package buildinfo
+
+import "testing"
+
+func TestVersion(t *testing.T) {
+	if got, want := Version(), "1.2.3"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+-- main.go --
+package main
+
+import (
+	"fmt"
+
+	"example.com/buildinfo"
+)
+
+func main() {
+	fmt.Println(buildinfo.Version())
+}
+`,
+	})
+}
+
+func TestDependencyVar(t *testing.T) {
+	for _, test := range []struct {
+		target, want string
+	}{
+		{target: "//:x_defs_bin", want: "1.2.3"},
+		{target: "//:linkopts_bin", want: "4.5.6"},
+		{target: "//:importmap_bin", want: "7.8.9"},
+	} {
+		t.Run(strings.TrimPrefix(test.target, "//:"), func(t *testing.T) {
+			out, err := bazel_testing.BazelOutput("run", test.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(out)); got != test.want {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMissingVar(t *testing.T) {
+	for _, test := range []struct {
+		target, wantWarning string
+	}{
+		{
+			target:      "//:missing_var_bin",
+			wantWarning: "package example.com/buildinfo does not define variable Missing",
+		}, {
+			target:      "//:missing_pkg_bin",
+			wantWarning: "package example.com/other is not linked into this binary",
+		},
+	} {
+		t.Run(strings.TrimPrefix(test.target, "//:"), func(t *testing.T) {
+			cmd := bazel_testing.BazelCmd("build", test.target)
+			stderr := &bytes.Buffer{}
+			cmd.Stderr = stderr
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("%v\n%s", err, stderr.Bytes())
+			}
+			if !bytes.Contains(stderr.Bytes(), []byte(test.wantWarning)) {
+				t.Errorf("got output:\n%s\nwant warning containing %q", stderr.Bytes(), test.wantWarning)
+			}
+		})
+	}
+}
+
+// TestUnqualifiedTestVar checks that go_test x_defs without a package name
+// set the variable in the package under test, without a warning about the
+// external test package, which doesn't define it.
+func TestUnqualifiedTestVar(t *testing.T) {
+	cmd := bazel_testing.BazelCmd("test", "//:buildinfo_test")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v\n%s", err, stderr.Bytes())
+	}
+	if bytes.Contains(stderr.Bytes(), []byte("warning: -X")) {
+		t.Errorf("unexpected warning:\n%s", stderr.Bytes())
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mirror_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+`,
+	})
+}
+
+const archiveName = "go0.0.fake.tar.gz"
+
+// fakeSDK returns a small archive that looks enough like a Go SDK for
+// go_download_sdk to extract it.
+func fakeSDK(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	content := []byte("go0.0\n")
+	if err := tw.WriteHeader(&tar.Header{Name: "go/VERSION", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// mirrorServer serves the fake SDK archive from several mirrors. The first
+// path element names the mirror: "good" always serves the archive, "corrupt"
+// serves different content, "flaky" fails the first request and then serves
+// the archive, and "broken" always fails.
+type mirrorServer struct {
+	archive []byte
+
+	mu          sync.Mutex
+	flakyFailed bool
+	requests    map[string]int
+}
+
+func (s *mirrorServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.URL.Path]++
+	if !strings.HasSuffix(r.URL.Path, "/"+archiveName) {
+		http.NotFound(w, r)
+		return
+	}
+	switch strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0] {
+	case "good":
+		w.Write(s.archive)
+	case "corrupt":
+		w.Write([]byte("not an archive"))
+	case "flaky":
+		if !s.flakyFailed {
+			s.flakyFailed = true
+			http.Error(w, "try again later", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(s.archive)
+	default:
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}
+}
+
+func (s *mirrorServer) requestCount(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func Test(t *testing.T) {
+	archive := fakeSDK(t)
+	sum := sha256.Sum256(archive)
+	srv := &mirrorServer{archive: archive, requests: make(map[string]int)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, srv)
+	defer ln.Close()
+	base := "http://" + ln.Addr().String()
+
+	for _, test := range []struct {
+		desc    string
+		mirrors []string
+		wantErr []string
+		check   func(t *testing.T)
+	}{
+		{
+			desc:    "fallback_after_checksum_mismatch",
+			mirrors: []string{"corrupt", "good"},
+			check: func(t *testing.T) {
+				if n := srv.requestCount("/corrupt/" + archiveName); n > 2 {
+					t.Errorf("corrupt mirror was requested %d times; want at most 2 (no retries)", n)
+				}
+			},
+		}, {
+			desc:    "retry_success",
+			mirrors: []string{"flaky"},
+			check: func(t *testing.T) {
+				if n := srv.requestCount("/flaky/" + archiveName); n < 2 {
+					t.Errorf("flaky mirror was requested %d times; want at least 2", n)
+				}
+			},
+		}, {
+			desc:    "all_mirrors_fail",
+			mirrors: []string{"corrupt", "broken"},
+			wantErr: []string{
+				base + "/corrupt/" + archiveName + ": checksum mismatch",
+				base + "/broken/" + archiveName + ": download failed after 2 attempt(s)",
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var urls []string
+			for _, m := range test.mirrors {
+				urls = append(urls, fmt.Sprintf("%q", base+"/"+m+"/{}"))
+			}
+			rule := fmt.Sprintf(`
+load("@io_bazel_rules_go//go:deps.bzl", "go_download_sdk")
+
+go_download_sdk(
+    name = "mirror_sdk",
+    goos = %q,
+    goarch = %q,
+    sdks = {%q: (%q, %q)},
+    urls = [%s],
+    retries = 1,
+)
+`, runtime.GOOS, runtime.GOARCH, runtime.GOOS+"_"+runtime.GOARCH, archiveName, hex.EncodeToString(sum[:]), strings.Join(urls, ", "))
+			restore := appendToWorkspace(t, rule)
+			defer restore()
+
+			// Disable the repository cache, so each case downloads the archive.
+			_, err := bazel_testing.BazelOutput("query", "--repository_cache=", "@mirror_sdk//:ROOT")
+			if len(test.wantErr) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				if err == nil {
+					t.Fatal("unexpected success")
+				}
+				for _, want := range test.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error does not contain %q:\n%v", want, err)
+					}
+				}
+			}
+			if test.check != nil {
+				test.check(t)
+			}
+		})
+	}
+}
+
+// appendToWorkspace adds rule to the WORKSPACE file and returns a function
+// that restores the original file.
+func appendToWorkspace(t *testing.T, rule string) func() {
+	orig, err := ioutil.ReadFile("WORKSPACE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile("WORKSPACE", append(append([]byte{}, orig...), rule...), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if err := ioutil.WriteFile("WORKSPACE", orig, 0666); err != nil {
+			t.Errorf("error restoring WORKSPACE: %v", err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package multiple_sdks_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library", "go_test")
+
+go_library(
+    name = "version",
+    srcs = ["version.go"],
+    importpath = "example.com/version",
+)
+
+go_binary(
+    name = "default",
+    srcs = ["main.go"],
+    deps = [":version"],
+)
+
+go_binary(
+    name = "old",
+    srcs = ["main.go"],
+    sdk_version = "1.16",
+    deps = [":version"],
+)
+
+go_binary(
+    name = "new",
+    srcs = ["main.go"],
+    sdk_version = "1.17",
+    deps = [":version"],
+)
+
+go_test(
+    name = "version_test",
+    srcs = ["version_test.go"],
+    sdk_version = "1.17",
+    deps = [":version"],
+)
+
+-- version.go --
+package version
+
+import "runtime"
+
+func Version() string {
+	return runtime.Version()
+}
+
+-- main.go --
+package main
+
+import (
+	"fmt"
+
+	"example.com/version"
+)
+
+func main() {
+	fmt.Println(version.Version())
+}
+
+-- version_test.go --
+package version_test
+
+import (
+	"testing"
+
+	"example.com/version"
+)
+
+func Test(t *testing.T) {
+	if v := version.Version(); v != "go1.17" {
+		t.Errorf("got version %q; want %q", v, "go1.17")
+	}
+}
+`,
+	})
+}
+
+func TestMultipleSDKs(t *testing.T) {
+	origWorkspaceData, err := ioutil.ReadFile("WORKSPACE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := bytes.Index(origWorkspaceData, []byte("go_rules_dependencies()"))
+	if i < 0 {
+		t.Fatal("could not find call to go_rules_dependencies()")
+	}
+
+	// The 1.16 SDK is declared first, so its toolchains are registered first
+	// and used when no version is selected.
+	buf := &bytes.Buffer{}
+	buf.Write(origWorkspaceData[:i])
+	buf.WriteString(`
+load("@io_bazel_rules_go//go:deps.bzl", "go_download_sdk")
+
+go_download_sdk(
+    name = "go_sdk",
+    version = "1.16",
+)
+
+go_download_sdk(
+    name = "go_sdk_1_17",
+    version = "1.17",
+)
+
+go_rules_dependencies()
+
+go_register_toolchains()
+`)
+	if err := ioutil.WriteFile("WORKSPACE", buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := ioutil.WriteFile("WORKSPACE", origWorkspaceData, 0666); err != nil {
+			t.Errorf("error restoring WORKSPACE: %v", err)
+		}
+	}()
+
+	// Build all the targets together, so both SDKs and their standard
+	// libraries are used in the same build.
+	if err := bazel_testing.RunBazel("build", "//:all"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		target string
+		args   []string
+		want   string
+	}{
+		{target: "//:default", want: "go1.16"},
+		{target: "//:old", want: "go1.16"},
+		{target: "//:new", want: "go1.17"},
+		{
+			target: "//:default",
+			args:   []string{"--@io_bazel_rules_go//go/config:sdk_version=1.17"},
+			want:   "go1.17",
+		},
+	} {
+		args := append([]string{"run"}, test.args...)
+		args = append(args, test.target)
+		out, err := bazel_testing.BazelOutput(args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(out)); got != test.want {
+			t.Errorf("%s %s: got version %q; want %q", test.target, strings.Join(test.args, " "), got, test.want)
+		}
+	}
+
+	if err := bazel_testing.RunBazel("test", "//:version_test"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package asm_arch
+
+// archValue is implemented in asm_arch_x86.s and asm_arch_aarch64.s.
+func archValue() int
+
+// archIsAMD64 is implemented in asm_arch_shared.s.
+func archIsAMD64() bool
@@ -0,0 +1,8 @@
+//go:build arm64
+
+#include "textflag.h"
+
+TEXT ·archValue(SB),NOSPLIT,$0-8
+	MOVD $2, R0
+	MOVD R0, ret+0(FP)
+	RET
@@ -0,0 +1,5 @@
+package main
+
+import _ "asm_arch"
+
+func main() {}
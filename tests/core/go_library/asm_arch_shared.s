@@ -0,0 +1,12 @@
+//go:build amd64 || arm64
+
+#include "textflag.h"
+
+TEXT ·archIsAMD64(SB),NOSPLIT,$0-1
+#ifdef GOARCH_amd64
+	MOVB $1, ret+0(FP)
+#else
+	MOVD $0, R0
+	MOVB R0, ret+0(FP)
+#endif
+	RET
@@ -0,0 +1,19 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package asm_arch
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestArch(t *testing.T) {
+	want := map[string]int{"amd64": 1, "arm64": 2}[runtime.GOARCH]
+	if got := archValue(); got != want {
+		t.Errorf("archValue() = %d; want %d", got, want)
+	}
+	if got, want := archIsAMD64(), runtime.GOARCH == "amd64"; got != want {
+		t.Errorf("archIsAMD64() = %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package asm_complete
+
+// Add is declared without a body. It's implemented in asm_complete_amd64.s
+// and asm_complete_arm64.s, so the package must not be compiled with
+// -complete, even though its gc_goopts ask for it.
+func Add(a, b int64) int64
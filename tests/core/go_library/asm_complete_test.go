@@ -0,0 +1,12 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package asm_complete
+
+import "testing"
+
+func TestAdd(t *testing.T) {
+	if got := Add(2, 3); got != 5 {
+		t.Errorf("Add(2, 3) = %d; want 5", got)
+	}
+}
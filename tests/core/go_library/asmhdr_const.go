@@ -0,0 +1,18 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package asmhdr_const
+
+// answer and pair are referenced from assembly through go_asm.h, which
+// defines const_answer, pair_a, pair_b, and pair__size.
+const answer = 42
+
+type pair struct {
+	a int32
+	b int64
+}
+
+// Implemented in asmhdr_const_amd64.s and asmhdr_const_arm64.s.
+func constAnswer() int64
+func pairBOffset() int64
+func pairSize() int64
@@ -0,0 +1,16 @@
+//go:build amd64
+
+#include "go_asm.h"
+#include "textflag.h"
+
+TEXT ·constAnswer(SB),NOSPLIT,$0-8
+	MOVQ $const_answer, ret+0(FP)
+	RET
+
+TEXT ·pairBOffset(SB),NOSPLIT,$0-8
+	MOVQ $pair_b, ret+0(FP)
+	RET
+
+TEXT ·pairSize(SB),NOSPLIT,$0-8
+	MOVQ $pair__size, ret+0(FP)
+	RET
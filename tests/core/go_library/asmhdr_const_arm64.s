@@ -0,0 +1,19 @@
+//go:build arm64
+
+#include "go_asm.h"
+#include "textflag.h"
+
+TEXT ·constAnswer(SB),NOSPLIT,$0-8
+	MOVD $const_answer, R0
+	MOVD R0, ret+0(FP)
+	RET
+
+TEXT ·pairBOffset(SB),NOSPLIT,$0-8
+	MOVD $pair_b, R0
+	MOVD R0, ret+0(FP)
+	RET
+
+TEXT ·pairSize(SB),NOSPLIT,$0-8
+	MOVD $pair__size, R0
+	MOVD R0, ret+0(FP)
+	RET
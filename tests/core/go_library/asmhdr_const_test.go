@@ -0,0 +1,21 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package asmhdr_const
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestAsmHdrConst(t *testing.T) {
+	if got := constAnswer(); got != answer {
+		t.Errorf("constAnswer() = %d; want %d", got, answer)
+	}
+	if got, want := pairBOffset(), int64(unsafe.Offsetof(pair{}.b)); got != want {
+		t.Errorf("pairBOffset() = %d; want %d", got, want)
+	}
+	if got, want := pairSize(), int64(unsafe.Sizeof(pair{})); got != want {
+		t.Errorf("pairSize() = %d; want %d", got, want)
+	}
+}
@@ -20,3 +20,27 @@ embedsrcs_files = rule(
         ),
     },
 )
+
+def _opt_transition_impl(settings, attr):
+    return {"//command_line_option:compilation_mode": "opt"}
+
+_opt_transition = transition(
+    implementation = _opt_transition_impl,
+    inputs = [],
+    outputs = ["//command_line_option:compilation_mode"],
+)
+
+def _opt_files_impl(ctx):
+    return [DefaultInfo(files = depset(ctx.files.srcs))]
+
+# opt_files builds srcs in the opt configuration, so generated files are under
+# a different output root than targets that depend on them.
+opt_files = rule(
+    implementation = _opt_files_impl,
+    attrs = {
+        "srcs": attr.label_list(cfg = _opt_transition),
+        "_whitelist_function_transition": attr.label(
+            default = "@bazel_tools//tools/whitelists/function_transition_whitelist",
+        ),
+    },
+)
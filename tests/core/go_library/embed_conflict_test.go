@@ -0,0 +1,109 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embed_conflict_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "embedder",
+    srcs = ["embedder.go"],
+    embed = [":embeddee"],
+    importpath = "example.com/conflict",
+)
+
+go_library(
+    name = "embeddee",
+    srcs = ["embeddee.go"],
+    importpath = "example.com/conflict",
+)
+
+go_test(
+    name = "embedder_test",
+    srcs = ["embedder_test.go"],
+    embed = [":embeddee"],
+)
+-- embedder.go --
+package conflict
+
+func Foo() {}
+-- embeddee.go --
+package conflict
+
+func Foo() {}
+
+var Bar = 1
+-- embedder_test.go --
+package conflict
+
+import "testing"
+
+var Bar = 2
+
+func TestBar(t *testing.T) {}
+`,
+	})
+}
+
+func Test(t *testing.T) {
+	for _, test := range []struct {
+		desc, target string
+		want         []string
+	}{
+		{
+			desc:   "library",
+			target: "//:embedder",
+			want: []string{
+				"Foo redeclared in this block",
+				"Foo is declared in:",
+				"embedder.go (from //:embedder)",
+				"embeddee.go (from //:embeddee)",
+			},
+		},
+		{
+			desc:   "test",
+			target: "//:embedder_test",
+			want: []string{
+				"Bar redeclared in this block",
+				"Bar is declared in:",
+				"embedder_test.go (from //:embedder_test)",
+				"embeddee.go (from //:embeddee)",
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			err := bazel_testing.RunBazel("build", test.target)
+			if err == nil {
+				t.Fatal("expected build to fail")
+			}
+			errMsg := err.Error()
+			for _, want := range test.want {
+				if !strings.Contains(errMsg, want) {
+					t.Errorf("expected error containing %q; got %v", want, errMsg)
+				}
+			}
+		})
+	}
+}
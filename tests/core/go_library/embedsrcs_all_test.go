@@ -0,0 +1,83 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedsrcs_all
+
+import (
+	"embed"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+//go:embed embedsrcs_nested/assets
+var assets embed.FS
+
+//go:embed all:embedsrcs_nested/assets
+var allAssets embed.FS
+
+func TestAllPrefix(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		fsys fs.FS
+		want []string
+	}{
+		{
+			desc: "default",
+			fsys: assets,
+			want: []string{
+				".",
+				"embedsrcs_nested",
+				"embedsrcs_nested/assets",
+				"embedsrcs_nested/assets/f",
+				"embedsrcs_nested/assets/sub",
+				"embedsrcs_nested/assets/sub/f",
+			},
+		},
+		{
+			desc: "all",
+			fsys: allAssets,
+			want: []string{
+				".",
+				"embedsrcs_nested",
+				"embedsrcs_nested/assets",
+				"embedsrcs_nested/assets/.hidden",
+				"embedsrcs_nested/assets/_hidden",
+				"embedsrcs_nested/assets/f",
+				"embedsrcs_nested/assets/sub",
+				"embedsrcs_nested/assets/sub/.hidden",
+				"embedsrcs_nested/assets/sub/f",
+			},
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			var got []string
+			err := fs.WalkDir(test.fsys, ".", func(path string, _ fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				got = append(got, path)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotStr := strings.Join(got, "\n")
+			wantStr := strings.Join(test.want, "\n")
+			if gotStr != wantStr {
+				t.Errorf("got:\n%s\nwant:\n%s", gotStr, wantStr)
+			}
+		})
+	}
+}
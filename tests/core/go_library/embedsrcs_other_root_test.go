@@ -0,0 +1,51 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package embedsrcs_other_root
+
+import (
+	"embed"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+//go:embed all:embedsrcs_opt/assets
+var assets embed.FS
+
+func TestOtherRoot(t *testing.T) {
+	var got []string
+	err := fs.WalkDir(assets, ".", func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		got = append(got, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		".",
+		"embedsrcs_opt",
+		"embedsrcs_opt/assets",
+		"embedsrcs_opt/assets/.hidden",
+		"embedsrcs_opt/assets/f",
+	}
+	gotStr := strings.Join(got, "\n")
+	wantStr := strings.Join(want, "\n")
+	if gotStr != wantStr {
+		t.Errorf("got:\n%s\nwant:\n%s", gotStr, wantStr)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package src_order_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "sorted",
+    srcs = [
+        "a.go",
+        "b.go",
+        "c.go",
+        "x.s",
+        "y.s",
+    ],
+    importpath = "example.com/lib",
+)
+
+go_library(
+    name = "shuffled",
+    srcs = [
+        "y.s",
+        "c.go",
+        "a.go",
+        "x.s",
+        "b.go",
+    ],
+    importpath = "example.com/lib",
+)
+
+-- a.go --
+package lib
+
+var A = initA()
+
+func initA() int { return B + 1 }
+
+func x()
+
+-- b.go --
+package lib
+
+var B = initB()
+
+func initB() int { return 2 }
+
+type T struct{ N int }
+
+func (t T) Get() int { return t.N + A }
+
+-- c.go --
+package lib
+
+func init() { x(); y() }
+
+func y()
+
+-- x.s --
+#include "textflag.h"
+
+TEXT ·x(SB),NOSPLIT,$0-0
+	RET
+
+-- y.s --
+#include "textflag.h"
+
+TEXT ·y(SB),NOSPLIT,$0-0
+	RET
+`,
+	})
+}
+
+func TestSrcOrder(t *testing.T) {
+	if err := bazel_testing.RunBazel("build", "//:sorted", "//:shuffled"); err != nil {
+		t.Fatal(err)
+	}
+	sorted, err := ioutil.ReadFile(filepath.FromSlash("bazel-bin/sorted.a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shuffled, err := ioutil.ReadFile(filepath.FromSlash("bazel-bin/shuffled.a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The archives include the build ID and export data of the compiled
+	// package, and objects for the assembly files, so identical archives
+	// have identical build IDs.
+	if !bytes.Equal(sorted, shuffled) {
+		t.Error("archives compiled from the same sources in a different order are not identical")
+	}
+}
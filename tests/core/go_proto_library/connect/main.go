@@ -0,0 +1,52 @@
+/* Copyright 2022 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// protoc-gen-connect-go is a stand-in for the connect-go plugin. Like the
+// real plugin, it writes a <name>.connect.go file for each proto file that
+// declares services and accepts a package_suffix option. Only an empty
+// suffix is supported, which is how //proto:go_connect invokes the plugin.
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"google.golang.org/protobuf/compiler/protogen"
+)
+
+func main() {
+	var flags flag.FlagSet
+	packageSuffix := flags.String("package_suffix", "connect", "")
+	protogen.Options{ParamFunc: flags.Set}.Run(func(gen *protogen.Plugin) error {
+		if *packageSuffix != "" {
+			return fmt.Errorf("package_suffix=%q is not supported", *packageSuffix)
+		}
+		for _, f := range gen.Files {
+			if !f.Generate || len(f.Services) == 0 {
+				continue
+			}
+			g := gen.NewGeneratedFile(f.GeneratedFilenamePrefix+".connect.go", f.GoImportPath)
+			g.P("// Code generated by protoc-gen-connect-go. DO NOT EDIT.")
+			g.P()
+			g.P("package ", f.GoPackageName)
+			for _, s := range f.Services {
+				g.P()
+				g.P("// ", s.GoName, "Name is the fully-qualified name of the ", s.GoName, " service.")
+				g.P("const ", s.GoName, "Name = ", fmt.Sprintf("%q", s.Desc.FullName()))
+			}
+		}
+		return nil
+	})
+}
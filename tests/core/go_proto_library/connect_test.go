@@ -0,0 +1,32 @@
+/* Copyright 2022 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package connect_test
+
+import (
+	"testing"
+
+	"github.com/bazelbuild/rules_go/tests/core/go_proto_library/grpc"
+)
+
+func TestConnect(t *testing.T) {
+	// The service name comes from the .connect.go file, the messages from
+	// go_proto. Both must be in the same package.
+	if got, want := grpc.RPCName, "tests.core.go_proto_library.grpc.RPC"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	_ = &grpc.HelloRequest{}
+	_ = &grpc.HelloReply{}
+}
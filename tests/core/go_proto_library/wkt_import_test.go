@@ -0,0 +1,32 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wkt_import_test
+
+import (
+	"testing"
+
+	"github.com/bazelbuild/rules_go/tests/core/go_proto_library/wkt_import"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestWellKnownTypeImport(t *testing.T) {
+	// The field must have the type from the canonical timestamppb package,
+	// not a copy generated for this library.
+	ts := &timestamppb.Timestamp{Seconds: 42}
+	e := &wkt_import.Event{Time: ts}
+	if got := e.GetTime().GetSeconds(); got != 42 {
+		t.Errorf("got %d seconds; want 42", got)
+	}
+}
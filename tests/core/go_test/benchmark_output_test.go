@@ -0,0 +1,150 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package benchmark_output_test
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "bench_test",
+    srcs = ["bench_test.go"],
+)
+
+go_test(
+    name = "nobench_test",
+    srcs = ["nobench_test.go"],
+)
+-- bench_test.go --
+package bench
+
+import "testing"
+
+func TestFails(t *testing.T) {
+	t.Fatal("tests should not run in benchmark mode")
+}
+
+func BenchmarkSum(b *testing.B) {
+	b.Log("this message should not be in the output")
+	sum := 0
+	for i := 0; i < b.N; i++ {
+		sum += i
+	}
+}
+-- nobench_test.go --
+package nobench
+
+import "testing"
+
+func TestFails(t *testing.T) {
+	t.Fatal("tests should not run in benchmark mode")
+}
+`,
+	})
+}
+
+func Test(t *testing.T) {
+	if err := bazel_testing.RunBazel(
+		"test",
+		"--test_env=GO_TEST_BENCH=1",
+		"--test_env=GO_TEST_BENCH_COUNT=3",
+		"--test_env=GO_TEST_BENCH_TIME=10x",
+		"//:bench_test",
+		"//:nobench_test",
+	); err != nil {
+		t.Fatal(err)
+	}
+	out, err := bazel_testing.BazelOutput("info", "bazel-testlogs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testlogs := strings.TrimSpace(string(out))
+
+	t.Run("bench_test", func(t *testing.T) {
+		got := readBenchmarkOutput(t, filepath.Join(testlogs, "bench_test"))
+		resultRe := regexp.MustCompile(`^BenchmarkSum(-\d+)?\s+10\s+\d+(\.\d+)? ns/op$`)
+		configRe := regexp.MustCompile(`^[a-z]\S*: `)
+		var results int
+		for _, line := range strings.Split(strings.TrimSuffix(got, "\n"), "\n") {
+			switch {
+			case resultRe.MatchString(line):
+				results++
+			case configRe.MatchString(line):
+			default:
+				t.Errorf("unexpected line in benchmark output: %q", line)
+			}
+		}
+		if results != 3 {
+			t.Errorf("got %d benchmark results; want 3. Output:\n%s", results, got)
+		}
+		if !regexp.MustCompile(`(?m)^pkg: `).MatchString(got) {
+			t.Errorf("benchmark output does not have a pkg line:\n%s", got)
+		}
+	})
+
+	t.Run("nobench_test", func(t *testing.T) {
+		if got := readBenchmarkOutput(t, filepath.Join(testlogs, "nobench_test")); got != "" {
+			t.Errorf("got benchmark output for package without benchmarks:\n%s", got)
+		}
+	})
+}
+
+// readBenchmarkOutput returns the content of benchmark.txt from a test's
+// undeclared outputs. Bazel zips these by default.
+func readBenchmarkOutput(t *testing.T, testlog string) string {
+	t.Helper()
+	outputsDir := filepath.Join(testlog, "test.outputs")
+	if data, err := ioutil.ReadFile(filepath.Join(outputsDir, "benchmark.txt")); err == nil {
+		return string(data)
+	} else if !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	r, err := zip.OpenReader(filepath.Join(outputsDir, "outputs.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if f.Name != "benchmark.txt" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	t.Fatalf("benchmark.txt not found in %s", outputsDir)
+	return ""
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package changed_files_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+exports_files(["changed_files.txt"])
+
+-- changed_files.txt --
+changed/lib.go
+-- changed/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "lib",
+    srcs = ["lib.go"],
+    importpath = "example.com/changed",
+)
+
+go_test(
+    name = "lib_test",
+    srcs = ["lib_test.go"],
+    embed = [":lib"],
+)
+
+-- changed/lib.go --
+package changed
+
+func Answer() int { return 42 }
+
+-- changed/lib_test.go --
+package changed
+
+import "testing"
+
+func TestAnswer(t *testing.T) {
+	if Answer() != 42 {
+		t.Fatal("wrong answer")
+	}
+}
+
+-- unchanged/BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "lib",
+    srcs = ["lib.go"],
+    importpath = "example.com/unchanged",
+)
+
+go_test(
+    name = "lib_test",
+    srcs = ["lib_test.go"],
+    embed = [":lib"],
+)
+
+-- unchanged/lib.go --
+package unchanged
+
+func Answer() int { return 42 }
+
+-- unchanged/lib_test.go --
+package unchanged
+
+import "testing"
+
+func TestSkipped(t *testing.T) {
+	t.Fatal("test should have been skipped, since none of its files changed")
+}
+`,
+	})
+}
+
+const changedFilesFlag = "--@io_bazel_rules_go//go/config:changed_files=//:changed_files.txt"
+
+func TestChangedFiles(t *testing.T) {
+	if err := bazel_testing.RunBazel("test", changedFilesFlag, "//changed:lib_test", "//unchanged:lib_test"); err != nil {
+		t.Fatal(err)
+	}
+
+	changedLog := readTestLog(t, "changed/lib_test/test.log")
+	if !strings.Contains(changedLog, "PASS") || strings.Contains(changedLog, "Skipping") {
+		t.Errorf("//changed:lib_test should have run. test.log:\n%s", changedLog)
+	}
+
+	unchangedLog := readTestLog(t, "unchanged/lib_test/test.log")
+	if want := "none of the 1 changed files affect this test"; !strings.Contains(unchangedLog, want) {
+		t.Errorf("//unchanged:lib_test should have been skipped. test.log:\n%s", unchangedLog)
+	}
+	unchangedXML := readTestLog(t, "unchanged/lib_test/test.xml")
+	if want := `<testcase classname="unchanged" name="TestSkipped" time="0.000">`; !strings.Contains(unchangedXML, want) || !strings.Contains(unchangedXML, "<skipped") {
+		t.Errorf("test.xml of //unchanged:lib_test does not report TestSkipped as skipped:\n%s", unchangedXML)
+	}
+}
+
+func TestChangedBuildFile(t *testing.T) {
+	// A changed BUILD file may change how any test is built, so no tests are
+	// skipped.
+	if err := ioutil.WriteFile("changed_files.txt", []byte("changed/lib.go\nunchanged/BUILD.bazel\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	defer ioutil.WriteFile("changed_files.txt", []byte("changed/lib.go\n"), 0666)
+
+	err := bazel_testing.RunBazel("test", changedFilesFlag, "//unchanged:lib_test")
+	if err == nil {
+		t.Fatal("//unchanged:lib_test passed, but should have run and failed")
+	}
+	if log := readTestLog(t, "unchanged/lib_test/test.log"); !strings.Contains(log, "test should have been skipped") {
+		t.Errorf("//unchanged:lib_test should have run. test.log:\n%s", log)
+	}
+}
+
+func readTestLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("bazel-testlogs", filepath.FromSlash(path)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
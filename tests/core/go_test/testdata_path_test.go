@@ -0,0 +1,157 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testdata_path_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "go_test")
+
+go_library(
+    name = "data",
+    srcs = ["data.go"],
+    importpath = "example.com/data",
+)
+
+go_test(
+    name = "data_test",
+    srcs = [
+        "external_test.go",
+        "internal_test.go",
+    ],
+    data = ["testdata/hello.txt"],
+    embed = [":data"],
+    testdata_path = True,
+)
+
+go_test(
+    name = "internal_only_test",
+    srcs = ["internal_test.go"],
+    data = ["testdata/hello.txt"],
+    embed = [":data"],
+    testdata_path = True,
+)
+
+go_test(
+    name = "own_test",
+    srcs = ["own_test.go"],
+    embed = [":data"],
+)
+-- data.go --
+package data
+-- internal_test.go --
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestInternal(t *testing.T) {
+	path := TestDataPath("testdata/hello.txt")
+	// The path doesn't depend on the working directory.
+	if err := os.Chdir(os.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != "hello\n" {
+		t.Errorf("got %q; want %q", got, "hello\n")
+	}
+}
+-- external_test.go --
+package data_test
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestExternal(t *testing.T) {
+	data, err := ioutil.ReadFile(TestDataPath("testdata/hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(data); got != "hello\n" {
+		t.Errorf("got %q; want %q", got, "hello\n")
+	}
+}
+-- own_test.go --
+package data
+
+import "testing"
+
+// TestDataPath doesn't conflict with a generated function, since the test
+// doesn't set testdata_path.
+func TestDataPath(t *testing.T) {}
+-- testdata/hello.txt --
+hello
+`,
+	})
+}
+
+func TestBazelTest(t *testing.T) {
+	if err := bazel_testing.RunBazel("test", "//:data_test", "//:internal_only_test", "//:own_test"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirectInvocation(t *testing.T) {
+	if err := bazel_testing.RunBazel("build", "//:data_test"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := bazel_testing.BazelOutput("info", "bazel-bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(strings.TrimSpace(string(out)), "data_test_", "data_test")
+	if runtime.GOOS == "windows" {
+		exe += ".exe"
+	}
+
+	// Run the test from another directory, without the environment Bazel
+	// sets for tests and runfiles.
+	dir, err := ioutil.TempDir("", "testdata_path_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cmd := exec.Command(exe, "-test.v")
+	cmd.Dir = dir
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "TEST_") && !strings.HasPrefix(kv, "RUNFILES_") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v\n%s", exe, err, out)
+	}
+}
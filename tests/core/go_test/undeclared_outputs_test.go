@@ -0,0 +1,143 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package undeclared_outputs_test
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_test")
+
+go_test(
+    name = "pass_test",
+    srcs = ["outputs_test.go"],
+)
+
+go_test(
+    name = "fail_test",
+    srcs = ["outputs_test.go"],
+    args = ["-fail"],
+)
+
+go_test(
+    name = "rundir_test",
+    srcs = ["outputs_test.go"],
+    data = ["sub/data.txt"],
+    rundir = "sub",
+)
+-- sub/data.txt --
+-- outputs_test.go --
+package outputs_test
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var fail = flag.Bool("fail", false, "fail after writing outputs")
+
+func Test(t *testing.T) {
+	dir := os.Getenv("TEST_UNDECLARED_OUTPUTS_DIR")
+	if !filepath.IsAbs(dir) {
+		t.Fatalf("TEST_UNDECLARED_OUTPUTS_DIR is not absolute: %q", dir)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "out.txt"), []byte("top"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "sub", "nested.txt"), []byte("nested"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if *fail {
+		t.Fatal("failing after writing outputs")
+	}
+}
+`,
+	})
+}
+
+func Test(t *testing.T) {
+	if err := bazel_testing.RunBazel("test", "//:pass_test", "//:rundir_test"); err != nil {
+		t.Fatal(err)
+	}
+	err := bazel_testing.RunBazel("test", "//:fail_test")
+	if xerr, ok := err.(*bazel_testing.StderrExitError); !ok || xerr.Err.ExitCode() != 3 {
+		t.Fatalf("expected fail_test to fail with exit code 3; got %v", err)
+	}
+
+	out, err := bazel_testing.BazelOutput("info", "bazel-testlogs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testlogs := strings.TrimSpace(string(out))
+
+	for _, name := range []string{"pass_test", "fail_test", "rundir_test"} {
+		t.Run(name, func(t *testing.T) {
+			got := readOutputsZip(t, filepath.Join(testlogs, name, "test.outputs", "outputs.zip"))
+			want := map[string]string{
+				"out.txt":        "top",
+				"sub/nested.txt": "nested",
+			}
+			for name, content := range want {
+				if got[name] != content {
+					t.Errorf("%s: got %q; want %q", name, got[name], content)
+				}
+			}
+		})
+	}
+}
+
+// readOutputsZip returns the contents of the regular files in the zip of a
+// test's undeclared outputs, keyed by name.
+func readOutputsZip(t *testing.T, path string) map[string]string {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	files := make(map[string]string)
+	for _, f := range r.File {
+		if strings.HasSuffix(f.Name, "/") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+	}
+	return files
+}
@@ -0,0 +1,211 @@
+// Copyright 2021 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gopackagesdriver_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library")
+
+go_library(
+    name = "cgolib",
+    srcs = [
+        "cgo.go",
+        "pure.go",
+    ],
+    cgo = True,
+    importpath = "example.com/cgolib",
+)
+
+go_library(
+    name = "purelib",
+    srcs = ["purelib.go"],
+    importpath = "example.com/purelib",
+)
+-- cgo.go --
+package cgolib
+
+// static int answer() { return 42; }
+import "C"
+
+func Answer() int { return int(C.answer()) }
+-- pure.go --
+package cgolib
+
+func Pure() int { return Answer() }
+-- purelib.go --
+package purelib
+
+func Pure() int { return 42 }
+`,
+	})
+}
+
+// flatPackage contains the fields of the driver's response checked here.
+type flatPackage struct {
+	ID              string
+	GoFiles         []string
+	CompiledGoFiles []string
+	ExportFile      string
+	Imports         map[string]string
+}
+
+// driverRequest is the request sent to the driver on stdin.
+type driverRequest struct {
+	Mode    int               `json:"mode"`
+	Overlay map[string][]byte `json:"overlay,omitempty"`
+}
+
+// NeedName | NeedFiles | NeedCompiledGoFiles | NeedImports
+const filesMode = 15
+
+func Test(t *testing.T) {
+	// The driver runs bazel itself. Make sure it uses the same output root
+	// as the test, so it talks to the same server.
+	out, err := bazel_testing.BazelOutput("info", "output_base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputUserRoot := filepath.Dir(strings.TrimSpace(string(out)))
+	tmpDir, err := ioutil.TempDir("", "gopackagesdriver_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	bazelWrapper := filepath.Join(tmpDir, "bazel.sh")
+	wrapperScript := fmt.Sprintf("#!/bin/sh\nexec bazel --output_user_root=%s \"$@\"\n", outputUserRoot)
+	if err := ioutil.WriteFile(bazelWrapper, []byte(wrapperScript), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("cgo", func(t *testing.T) {
+		pkg := runDriver(t, bazelWrapper, driverRequest{Mode: filesMode}, "file=cgo.go", ":cgolib")
+		if got, want := baseNames(pkg.GoFiles), []string{"cgo.go", "pure.go"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got GoFiles %v; want %v", got, want)
+		}
+		compiled := make(map[string]bool)
+		for _, f := range pkg.CompiledGoFiles {
+			if _, err := os.Stat(f); err != nil {
+				t.Errorf("compiled file does not exist: %v", err)
+			}
+			compiled[filepath.Base(f)] = true
+		}
+		for _, want := range []string{"pure.go", "cgo.cgo1.go", "_cgo_gotypes.go"} {
+			if !compiled[want] {
+				t.Errorf("CompiledGoFiles %v does not contain %s", pkg.CompiledGoFiles, want)
+			}
+		}
+		if compiled["cgo.go"] {
+			t.Errorf("CompiledGoFiles %v contains cgo.go, which should be replaced by cgo's output", pkg.CompiledGoFiles)
+		}
+	})
+
+	t.Run("pure", func(t *testing.T) {
+		pkg := runDriver(t, bazelWrapper, driverRequest{Mode: filesMode}, "file=purelib.go", ":purelib")
+		if !reflect.DeepEqual(pkg.CompiledGoFiles, pkg.GoFiles) {
+			t.Errorf("got CompiledGoFiles %v; want GoFiles %v", pkg.CompiledGoFiles, pkg.GoFiles)
+		}
+	})
+
+	t.Run("overlay", func(t *testing.T) {
+		// The overlay changes the signature of Pure, which now needs an
+		// import, and adds a file that isn't on disk.
+		request := driverRequest{
+			// filesMode | NeedExportsFile
+			Mode: filesMode | 32,
+			Overlay: map[string][]byte{
+				"purelib.go": []byte(`package purelib
+
+import "strings"
+
+func Pure(s string) string { return strings.ToUpper(s) }
+`),
+				"extra.go": []byte(`package purelib
+
+func Extra() string { return Pure("extra") }
+`),
+			},
+		}
+		pkg := runDriver(t, bazelWrapper, request, "file=purelib.go", ":purelib")
+		if got, want := baseNames(pkg.GoFiles), []string{"purelib.go", "extra.go"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got GoFiles %v; want %v", got, want)
+		}
+		if _, ok := pkg.Imports["strings"]; !ok {
+			t.Errorf("got Imports %v; want the overlaid file's import of strings", pkg.Imports)
+		}
+		if pkg.ExportFile != "" {
+			t.Errorf("got ExportFile %s, compiled without the overlay; want none, so the package is type-checked from source", pkg.ExportFile)
+		}
+
+		// Export data for packages without overlaid files is still used.
+		pkg = runDriver(t, bazelWrapper, request, "file=pure.go", ":cgolib")
+		if pkg.ExportFile == "" {
+			t.Error("package without overlaid files has no ExportFile")
+		}
+	})
+}
+
+// runDriver runs gopackagesdriver with the given request and query, and
+// returns the package whose ID ends with idSuffix.
+func runDriver(t *testing.T, bazelWrapper string, request driverRequest, query, idSuffix string) flatPackage {
+	t.Helper()
+	requestData, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := bazel_testing.BazelCmd("run", "@io_bazel_rules_go//go/tools/gopackagesdriver", "--", query)
+	cmd.Env = append(cmd.Env, "GOPACKAGESDRIVER_BAZEL="+bazelWrapper)
+	cmd.Stdin = bytes.NewReader(requestData)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Packages []flatPackage
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		t.Fatalf("could not parse driver response: %v\n%s", err, out)
+	}
+	for _, pkg := range resp.Packages {
+		if strings.HasSuffix(pkg.ID, idSuffix) {
+			return pkg
+		}
+	}
+	t.Fatalf("package %s not found in driver response:\n%s", idSuffix, out)
+	return flatPackage{}
+}
+
+func baseNames(paths []string) []string {
+	names := make([]string, len(paths))
+	for i, p := range paths {
+		names[i] = filepath.Base(p)
+	}
+	return names
+}
@@ -0,0 +1,186 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package baseline_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Nogo: "@//:nogo",
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "nogo")
+
+nogo(
+    name = "nogo",
+    baseline = "baseline.txt",
+    deps = [":funcs"],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "funcs",
+    srcs = ["funcs.go"],
+    importpath = "funcs",
+    deps = ["@org_golang_x_tools//go/analysis"],
+)
+
+go_library(
+    name = "lib",
+    srcs = ["lib.go"],
+    importpath = "example.com/lib",
+)
+
+-- baseline.txt --
+# Findings that don't fail the build.
+
+-- funcs.go --
+package funcs
+
+import (
+	"go/ast"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+var Analyzer = &analysis.Analyzer{
+	Name: "funcs",
+	Doc:  "reports exported function declarations",
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		for _, f := range pass.Files {
+			for _, decl := range f.Decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.IsExported() {
+					pass.Reportf(fn.Pos(), "exported function %s", fn.Name.Name)
+				}
+			}
+		}
+		return nil, nil
+	},
+}
+
+-- lib.go --
+package lib
+
+func Hello() string { return "hello" }
+`,
+	})
+}
+
+func TestBaseline(t *testing.T) {
+	// With an empty baseline, the finding fails the build.
+	if stderr, err := build(); err == nil {
+		t.Fatal("unexpected success")
+	} else if !strings.Contains(stderr, "exported function Hello") {
+		t.Fatalf("finding wasn't printed:\n%s", stderr)
+	}
+
+	// Generating a baseline doesn't fail the build, and records the finding in
+	// the library's validation output.
+	if stderr, err := build("--@io_bazel_rules_go//go/config:nogo_generate_baseline"); err != nil {
+		t.Fatalf("generating a baseline failed: %v\n%s", err, stderr)
+	}
+	generated := readValidationOutputs(t)
+	if want := "lib.go:3: exported function Hello (funcs)\n"; generated != want {
+		t.Fatalf("got generated baseline %q; want %q", generated, want)
+	}
+	if err := ioutil.WriteFile("baseline.txt", []byte(generated), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// The recorded finding doesn't fail the build, even after it moves.
+	if stderr, err := build(); err != nil {
+		t.Fatalf("finding in baseline failed the build: %v\n%s", err, stderr)
+	}
+	if err := ioutil.WriteFile("lib.go", []byte(`package lib
+
+// Hello says hello.
+func Hello() string { return "hello" }
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if stderr, err := build(); err != nil {
+		t.Fatalf("shifted finding in baseline failed the build: %v\n%s", err, stderr)
+	}
+
+	// A new finding fails the build, and only it is printed.
+	if err := ioutil.WriteFile("lib.go", []byte(`package lib
+
+// Hello says hello.
+func Hello() string { return "hello" }
+
+func Goodbye() string { return "goodbye" }
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := build()
+	if err == nil {
+		t.Fatal("new finding didn't fail the build")
+	}
+	if !strings.Contains(stderr, "exported function Goodbye") {
+		t.Errorf("new finding wasn't printed:\n%s", stderr)
+	}
+	if strings.Contains(stderr, "exported function Hello") {
+		t.Errorf("finding in baseline was printed:\n%s", stderr)
+	}
+}
+
+// build builds the library with extra flags and returns the build's stderr.
+func build(args ...string) (string, error) {
+	args = append([]string{"build"}, args...)
+	args = append(args, "//:lib")
+	cmd := bazel_testing.BazelCmd(args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	return stderr.String(), err
+}
+
+// readValidationOutputs returns the concatenated contents of the .nogo
+// validation outputs in bazel-bin.
+func readValidationOutputs(t *testing.T) string {
+	t.Helper()
+	out, err := bazel_testing.BazelOutput("info", "bazel-bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := strings.TrimSpace(string(out))
+	buf := &bytes.Buffer{}
+	err = filepath.Walk(bin, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && strings.HasSuffix(path, ".nogo") {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			buf.Write(data)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
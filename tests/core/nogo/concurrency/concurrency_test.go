@@ -0,0 +1,265 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package concurrency_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+const origConcurrency = `# concurrency = 0,`
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Nogo: "@//:nogo",
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "nogo")
+
+nogo(
+    name = "nogo",
+    deps = [
+        ":a",
+        ":b",
+        ":c",
+        ":report",
+    ],
+    # concurrency = 0,
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "rendezvous",
+    srcs = ["rendezvous.go"],
+    importpath = "rendezvous",
+    deps = ["@org_golang_x_tools//go/analysis"],
+)
+
+[go_library(
+    name = name,
+    srcs = [name + ".go"],
+    importpath = name,
+    deps = [":rendezvous"],
+) for name in ("a", "b", "c")]
+
+go_library(
+    name = "report",
+    srcs = ["report.go"],
+    importpath = "report",
+    deps = [
+        ":a",
+        ":b",
+        ":c",
+        ":rendezvous",
+    ],
+)
+
+go_library(
+    name = "lib",
+    srcs = ["lib.go"],
+    importpath = "lib",
+)
+
+-- rendezvous.go --
+// Package rendezvous builds analyzers that wait for each other, so a test can
+// tell how many of them ran at the same time.
+package rendezvous
+
+import (
+	"go/ast"
+	"sync"
+	"time"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+// parties is the number of analyzers made by NewAnalyzer.
+const parties = 3
+
+var (
+	mu                  sync.Mutex
+	running, maxRunning int
+)
+
+// enter waits until all parties are running at the same time, or until a
+// timeout passes if they don't run concurrently.
+func enter() {
+	mu.Lock()
+	running++
+	if running > maxRunning {
+		maxRunning = running
+	}
+	mu.Unlock()
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		done := maxRunning >= parties
+		mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+func exit() {
+	mu.Lock()
+	running--
+	mu.Unlock()
+}
+
+// NewAnalyzer returns an analyzer that reports each function declaration.
+func NewAnalyzer(name string) *analysis.Analyzer {
+	return &analysis.Analyzer{
+		Name: name,
+		Doc:  "reports function declarations after meeting the other analyzers",
+		Run: func(pass *analysis.Pass) (interface{}, error) {
+			enter()
+			defer exit()
+			for _, f := range pass.Files {
+				for _, decl := range f.Decls {
+					if fn, ok := decl.(*ast.FuncDecl); ok {
+						pass.Reportf(fn.Pos(), "%s saw function %s", name, fn.Name.Name)
+					}
+				}
+			}
+			return nil, nil
+		},
+	}
+}
+
+// NewReporter returns an analyzer that runs after the given analyzers and
+// reports how many analyzers ran at the same time.
+func NewReporter(requires ...*analysis.Analyzer) *analysis.Analyzer {
+	return &analysis.Analyzer{
+		Name:     "report",
+		Doc:      "reports how many analyzers ran at the same time",
+		Requires: requires,
+		Run: func(pass *analysis.Pass) (interface{}, error) {
+			mu.Lock()
+			n := maxRunning
+			mu.Unlock()
+			pass.Reportf(pass.Files[0].Package, "at most %d analyzers ran at once", n)
+			return nil, nil
+		},
+	}
+}
+
+-- a.go --
+package a
+
+import "rendezvous"
+
+var Analyzer = rendezvous.NewAnalyzer("a")
+
+-- b.go --
+package b
+
+import "rendezvous"
+
+var Analyzer = rendezvous.NewAnalyzer("b")
+
+-- c.go --
+package c
+
+import "rendezvous"
+
+var Analyzer = rendezvous.NewAnalyzer("c")
+
+-- report.go --
+package report
+
+import (
+	"a"
+	"b"
+	"c"
+	"rendezvous"
+)
+
+var Analyzer = rendezvous.NewReporter(a.Analyzer, b.Analyzer, c.Analyzer)
+
+-- lib.go --
+package lib
+
+func F() {}
+
+func G() {}
+`,
+	})
+}
+
+var (
+	sawFunctionRe = regexp.MustCompile(`lib\.go:\d+:\d+: \w saw function \w+ \(\w\)`)
+	atMostRe      = regexp.MustCompile(`at most (\d+) analyzers ran at once`)
+)
+
+func TestConcurrency(t *testing.T) {
+	var sequential []string
+	for _, test := range []struct {
+		concurrency int
+		wantMax     string
+	}{
+		{concurrency: 1, wantMax: "1"},
+		{concurrency: 3, wantMax: "3"},
+	} {
+		t.Run(fmt.Sprintf("concurrency_%d", test.concurrency), func(t *testing.T) {
+			concurrency := fmt.Sprintf("concurrency = %d,", test.concurrency)
+			if err := replaceInFile("BUILD.bazel", origConcurrency, concurrency); err != nil {
+				t.Fatal(err)
+			}
+			defer replaceInFile("BUILD.bazel", concurrency, origConcurrency)
+
+			cmd := bazel_testing.BazelCmd("build", "//:lib")
+			stderr := &bytes.Buffer{}
+			cmd.Stderr = stderr
+			if err := cmd.Run(); err == nil {
+				t.Fatal("unexpected success")
+			}
+
+			m := atMostRe.FindSubmatch(stderr.Bytes())
+			if m == nil {
+				t.Fatalf("got output:\n%s\nwhich does not report how many analyzers ran at once", stderr)
+			}
+			if got := string(m[1]); got != test.wantMax {
+				t.Errorf("got at most %s analyzers at once; want %s", got, test.wantMax)
+			}
+
+			// Diagnostics are reported in the same order, however analyzers are
+			// scheduled.
+			got := sawFunctionRe.FindAllString(stderr.String(), -1)
+			if len(got) != 6 {
+				t.Fatalf("got diagnostics %q; want one from each analyzer for each function", got)
+			}
+			if sequential == nil {
+				sequential = got
+			} else if !reflect.DeepEqual(got, sequential) {
+				t.Errorf("got diagnostics %q; want %q, as when run sequentially", got, sequential)
+			}
+		})
+	}
+}
+
+func replaceInFile(path, old, new string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	data = bytes.ReplaceAll(data, []byte(old), []byte(new))
+	return ioutil.WriteFile(path, data, 0666)
+}
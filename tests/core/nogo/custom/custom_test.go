@@ -102,6 +102,12 @@ go_library(
     deps = [":dep"],
 )
 
+go_library(
+    name = "has_foo",
+    srcs = ["has_foo.go"],
+    importpath = "hasfoo",
+)
+
 go_library(
     name = "dep",
     srcs = ["dep.go"],
@@ -297,6 +303,64 @@ func run(pass *analysis.Pass) (interface{}, error) {
   }
 }
 
+-- severity_error.json --
+{
+  "foofuncname": {
+    "severity": "error"
+  }
+}
+
+-- severity_warning.json --
+{
+  "foofuncname": {
+    "severity": "warning"
+  }
+}
+
+-- severity_off.json --
+{
+  "foofuncname": {
+    "severity": "off"
+  }
+}
+
+-- exclude_messages.json --
+{
+  "foofuncname": {
+    "exclude_messages": {
+      "must not be named Foo$": "Foo is allowed"
+    }
+  }
+}
+
+-- exclude_messages_nomatch.json --
+{
+  "foofuncname": {
+    "exclude_messages": {
+      "must not be named Bar$": ""
+    }
+  }
+}
+
+-- exclude_files_and_messages.json --
+{
+  "foofuncname": {
+    "exclude_files": {
+      "has_foo\\.go": ""
+    },
+    "exclude_messages": {
+      "must not be named Foo$": "Foo is allowed in has_foo.go"
+    }
+  }
+}
+
+-- has_foo.go --
+package hasfoo
+
+func Foo() bool { // This should fail foofuncname
+	return true
+}
+
 -- has_errors.go --
 package haserrors
 
@@ -427,6 +491,67 @@ func Test(t *testing.T) {
 				// note the cross platform regex :)
 				`.*[\\/]cgo[\\/]examplepkg[\\/]pure_src_with_err_calling_native.go:.*function must not be named Foo \(foofuncname\)`,
 			},
+		}, {
+			desc:        "severity_error",
+			config:      "severity_error.json",
+			target:      "//:has_foo",
+			wantSuccess: false,
+			includes: []string{
+				`errors found by nogo`,
+				`has_foo.go:.*function must not be named Foo \(foofuncname\)`,
+			},
+		}, {
+			desc:        "severity_warning",
+			config:      "severity_warning.json",
+			target:      "//:has_foo",
+			wantSuccess: true,
+			includes: []string{
+				`warnings found by nogo`,
+				`has_foo.go:.*function must not be named Foo \(foofuncname\)`,
+			},
+			excludes: []string{
+				`errors found by nogo`,
+			},
+		}, {
+			desc:        "severity_off",
+			config:      "severity_off.json",
+			target:      "//:has_foo",
+			wantSuccess: true,
+			excludes: []string{
+				`foofuncname`,
+			},
+		}, {
+			desc:        "exclude_messages",
+			config:      "exclude_messages.json",
+			target:      "//:has_foo",
+			wantSuccess: true,
+			excludes: []string{
+				`foofuncname`,
+			},
+		}, {
+			desc:        "exclude_messages_nomatch",
+			config:      "exclude_messages_nomatch.json",
+			target:      "//:has_foo",
+			wantSuccess: false,
+			includes: []string{
+				`has_foo.go:.*function must not be named Foo \(foofuncname\)`,
+			},
+		}, {
+			desc:        "exclude_files_and_messages",
+			config:      "exclude_files_and_messages.json",
+			target:      "//:has_foo",
+			wantSuccess: true,
+			excludes: []string{
+				`foofuncname`,
+			},
+		}, {
+			desc:        "exclude_files_and_messages_other_file",
+			config:      "exclude_files_and_messages.json",
+			target:      "//:has_errors",
+			wantSuccess: false,
+			includes: []string{
+				`has_errors.go:.*function must not be named Foo \(foofuncname\)`,
+			},
 		}, {
 			desc:        "no_errors",
 			target:      "//:no_errors",
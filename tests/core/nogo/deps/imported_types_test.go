@@ -0,0 +1,228 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package imported_types_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Nogo: "@//:nogo",
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_library", "nogo")
+
+nogo(
+    name = "nogo",
+    deps = [
+        ":errfunc",
+        ":sig",
+    ],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "sig",
+    srcs = ["sig.go"],
+    importpath = "sig",
+    deps = ["@org_golang_x_tools//go/analysis"],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "errfunc",
+    srcs = ["errfunc.go"],
+    importpath = "errfunc",
+    deps = ["@org_golang_x_tools//go/analysis"],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "a",
+    srcs = ["a.go"],
+    importpath = "a",
+    deps = [":b"],
+)
+
+go_library(
+    name = "b",
+    srcs = ["b.go"],
+    importpath = "b",
+    deps = [":c"],
+)
+
+go_library(
+    name = "c",
+    srcs = ["c.go"],
+    importpath = "c",
+)
+
+-- sig.go --
+package sig
+
+import (
+	"go/ast"
+	"go/types"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+var Analyzer = &analysis.Analyzer{
+	Name: "sig",
+	Doc:  "reports the signatures of imported functions that are called",
+	Run:  run,
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	for _, f := range pass.Files {
+		ast.Inspect(f, func(n ast.Node) bool {
+			if fn := importedCallee(pass, n); fn != nil {
+				pass.Reportf(n.Pos(), "%s: %s", fn.FullName(), fn.Type())
+			}
+			return true
+		})
+	}
+	return nil, nil
+}
+
+func importedCallee(pass *analysis.Pass, n ast.Node) *types.Func {
+	call, ok := n.(*ast.CallExpr)
+	if !ok {
+		return nil
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return nil
+	}
+	fn, ok := pass.TypesInfo.Uses[sel.Sel].(*types.Func)
+	if !ok || fn.Pkg() == pass.Pkg {
+		return nil
+	}
+	return fn
+}
+
+-- errfunc.go --
+package errfunc
+
+import (
+	"go/ast"
+	"go/types"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+var Analyzer = &analysis.Analyzer{
+	Name:      "errfunc",
+	Doc:       "reports calls to imported functions that return an error",
+	Run:       run,
+	FactTypes: []analysis.Fact{new(returnsError)},
+}
+
+type returnsError struct{}
+
+func (*returnsError) AFact() {}
+
+func (*returnsError) String() string { return "returnsError" }
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	errorType := types.Universe.Lookup("error").Type()
+	for _, f := range pass.Files {
+		for _, decl := range f.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Recv != nil {
+				continue
+			}
+			fn := pass.TypesInfo.Defs[fd.Name].(*types.Func)
+			res := fn.Type().(*types.Signature).Results()
+			if res.Len() > 0 && types.Identical(res.At(res.Len()-1).Type(), errorType) {
+				pass.ExportObjectFact(fn, new(returnsError))
+			}
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			fn, ok := pass.TypesInfo.Uses[sel.Sel].(*types.Func)
+			if ok && fn.Pkg() != pass.Pkg && pass.ImportObjectFact(fn, new(returnsError)) {
+				pass.Reportf(call.Pos(), "%s returns an error", fn.FullName())
+			}
+			return true
+		})
+	}
+	return nil, nil
+}
+
+-- a.go --
+package a
+
+import "b"
+
+func Hello() {
+	b.Join(",", "x", "y")
+}
+
+-- b.go --
+package b
+
+import "c"
+
+func Join(sep string, parts ...c.Part) (string, error) {
+	s := ""
+	for i, p := range parts {
+		if i > 0 {
+			s += sep
+		}
+		s += string(p)
+	}
+	return s, nil
+}
+
+-- c.go --
+package c
+
+type Part string
+`,
+	})
+}
+
+func Test(t *testing.T) {
+	if err := bazel_testing.RunBazel("build", "//:b"); err != nil {
+		t.Fatalf("building a package that calls no imported functions: %v", err)
+	}
+
+	cmd := bazel_testing.BazelCmd("build", "//:a")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err == nil {
+		t.Fatal("unexpected success")
+	}
+	for _, want := range []string{
+		"b.Join: func(sep string, parts ...c.Part) (string, error)",
+		"b.Join returns an error",
+	} {
+		if !bytes.Contains(stderr.Bytes(), []byte(want)) {
+			t.Errorf("output does not contain %q:\n%s", want, stderr.Bytes())
+		}
+	}
+}
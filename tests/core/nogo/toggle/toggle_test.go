@@ -0,0 +1,203 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package toggle_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Nogo: "@//:nogo",
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary", "go_library", "nogo")
+
+nogo(
+    name = "nogo",
+    config = "config.json",
+    deps = [":funcs"],
+    visibility = ["//visibility:public"],
+)
+
+go_library(
+    name = "funcs",
+    srcs = ["funcs.go"],
+    importpath = "funcs",
+    deps = ["@org_golang_x_tools//go/analysis"],
+)
+
+go_library(
+    name = "lib",
+    srcs = ["lib.go"],
+    importpath = "example.com/lib",
+)
+
+go_binary(
+    name = "bin",
+    srcs = ["bin.go"],
+    deps = [":lib"],
+)
+
+-- config.json --
+{
+  "funcs": {
+    "severity": "off"
+  }
+}
+
+-- funcs.go --
+package funcs
+
+import (
+	"go/ast"
+
+	"golang.org/x/tools/go/analysis"
+)
+
+var Analyzer = &analysis.Analyzer{
+	Name: "funcs",
+	Doc:  "reports exported function declarations",
+	Run: func(pass *analysis.Pass) (interface{}, error) {
+		for _, f := range pass.Files {
+			for _, decl := range f.Decls {
+				if fn, ok := decl.(*ast.FuncDecl); ok && fn.Name.IsExported() {
+					pass.Reportf(fn.Pos(), "exported function %s", fn.Name.Name)
+				}
+			}
+		}
+		return nil, nil
+	},
+}
+
+-- lib.go --
+package lib
+
+func Hello() string { return "hello" }
+
+-- bin.go --
+package main
+
+import (
+	"fmt"
+
+	"example.com/lib"
+)
+
+func main() {
+	fmt.Println(lib.Hello())
+}
+`,
+	})
+}
+
+const diagnostic = "exported function Hello"
+
+func TestToggle(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "toggle_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+
+	// With the analyzer off, everything is built, and nothing is reported.
+	stderr, mnemonics, err := build(t, filepath.Join(logDir, "off.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stderr, diagnostic) {
+		t.Fatalf("analyzer is off, but its diagnostic was printed:\n%s", stderr)
+	}
+	for _, m := range []string{"GoCompilePkg", "GoLink", "RunNogo"} {
+		if mnemonics[m] == 0 {
+			t.Fatalf("first build ran no %s actions; ran %v", m, mnemonics)
+		}
+	}
+
+	for _, test := range []struct {
+		severity string
+		wantErr  bool
+	}{
+		{severity: "warning"},
+		{severity: "error", wantErr: true},
+	} {
+		t.Run(test.severity, func(t *testing.T) {
+			if err := writeConfig(test.severity); err != nil {
+				t.Fatal(err)
+			}
+			stderr, mnemonics, err := build(t, filepath.Join(logDir, test.severity+".json"))
+			if test.wantErr && err == nil {
+				t.Fatal("unexpected success")
+			} else if !test.wantErr && err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(stderr, diagnostic) {
+				t.Errorf("analyzer is on, but its diagnostic wasn't printed:\n%s", stderr)
+			}
+			if mnemonics["RunNogo"] == 0 {
+				t.Errorf("changing the configuration ran no RunNogo actions; ran %v", mnemonics)
+			}
+			for _, m := range []string{"GoCompilePkg", "GoLink"} {
+				if n := mnemonics[m]; n > 0 {
+					t.Errorf("changing the configuration ran %d %s actions; want 0", n, m)
+				}
+			}
+		})
+	}
+}
+
+// build builds the binary and returns the build's stderr, and the number of
+// actions it ran with each mnemonic, read from its execution log.
+func build(t *testing.T, logPath string) (string, map[string]int, error) {
+	cmd := bazel_testing.BazelCmd("build", "--execution_log_json_file="+logPath, "//:bin")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	buildErr := cmd.Run()
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mnemonics := make(map[string]int)
+	dec := json.NewDecoder(f)
+	for {
+		var spawn struct {
+			Mnemonic string `json:"mnemonic"`
+		}
+		if err := dec.Decode(&spawn); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("reading execution log %s: %v", logPath, err)
+		}
+		mnemonics[spawn.Mnemonic]++
+	}
+	return stderr.String(), mnemonics, buildErr
+}
+
+func writeConfig(severity string) error {
+	config := fmt.Sprintf("{\n  \"funcs\": {\n    \"severity\": %q\n  }\n}\n", severity)
+	return ioutil.WriteFile("config.json", []byte(config), 0666)
+}
@@ -299,3 +299,53 @@ func Test(t *testing.T) {
 		})
 	}
 }
+
+// TestUnsupportedPlatform checks that requesting race instrumentation for a
+// platform without a race detector fails with a clear message, or builds
+// without race instrumentation and warns when race_fallback is set.
+func TestUnsupportedPlatform(t *testing.T) {
+	for _, test := range []struct {
+		desc          string
+		fallback      bool
+		wantBuildFail bool
+		wantStderr    string
+	}{
+		{
+			desc:          "error",
+			wantBuildFail: true,
+			wantStderr:    "race instrumentation is not supported on linux/386",
+		}, {
+			desc:       "fallback",
+			fallback:   true,
+			wantStderr: "WARNING: race instrumentation is not supported on linux/386; building //:racy_cmd without it.",
+		},
+	} {
+		t.Run(test.desc, func(t *testing.T) {
+			args := []string{
+				"build",
+				"--platforms=@io_bazel_rules_go//go/toolchain:linux_386",
+				"--@io_bazel_rules_go//go/config:race",
+			}
+			if test.fallback {
+				args = append(args, "--@io_bazel_rules_go//go/config:race_fallback")
+			}
+			args = append(args, "//:racy_cmd")
+			cmd := bazel_testing.BazelCmd(args...)
+			stderr := &bytes.Buffer{}
+			cmd.Stderr = stderr
+			t.Logf("running: bazel %s", strings.Join(args, " "))
+			err := cmd.Run()
+			if test.wantBuildFail {
+				var xerr *exec.ExitError
+				if !errors.As(err, &xerr) || xerr.ExitCode() != bazel_testing.BUILD_FAILURE {
+					t.Fatalf("got error %v; want build failure\nstderr:\n%s", err, stderr.Bytes())
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v\nstderr:\n%s", err, stderr.Bytes())
+			}
+			if !bytes.Contains(stderr.Bytes(), []byte(test.wantStderr)) {
+				t.Errorf("stderr does not contain %q:\n%s", test.wantStderr, stderr.Bytes())
+			}
+		})
+	}
+}
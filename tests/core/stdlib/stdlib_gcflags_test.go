@@ -0,0 +1,101 @@
+// Copyright 2022 The Bazel Authors. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package stdlib_gcflags_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/bazelbuild/rules_go/go/tools/bazel_testing"
+)
+
+func TestMain(m *testing.M) {
+	bazel_testing.TestMain(m, bazel_testing.Args{
+		Main: `
+-- BUILD.bazel --
+load("@io_bazel_rules_go//go:def.bzl", "go_binary")
+
+go_binary(
+    name = "default_bin",
+    srcs = ["main.go"],
+)
+
+go_binary(
+    name = "debug_bin",
+    srcs = ["main.go"],
+    gc_goopts = [
+        "-N",
+        "-l",
+    ],
+)
+
+go_binary(
+    name = "unrelated_opts_bin",
+    srcs = ["main.go"],
+    gc_goopts = ["-e"],
+)
+
+-- main.go --
+package main
+
+import "fmt"
+
+func main() {
+	fmt.Println("hello")
+}
+`,
+	})
+}
+
+// stdlibActions returns the text description of GoStdlib actions needed
+// to build target.
+func stdlibActions(t *testing.T, target string) string {
+	out, err := bazel_testing.BazelOutput("aquery", "--output=text", `mnemonic("GoStdlib", deps(`+target+`))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestStdlibGcflags(t *testing.T) {
+	if actions := stdlibActions(t, "//:debug_bin"); !strings.Contains(actions, "-gcflags") || !strings.Contains(actions, "-N") || !strings.Contains(actions, "-l") {
+		t.Errorf("standard library for //:debug_bin was not built with -N -l:\n%s", actions)
+	}
+	for _, target := range []string{"//:default_bin", "//:unrelated_opts_bin"} {
+		if actions := stdlibActions(t, target); strings.Contains(actions, "-gcflags") {
+			t.Errorf("standard library for %s was built with extra flags:\n%s", target, actions)
+		}
+	}
+}
+
+func TestStdlibGcflagsCached(t *testing.T) {
+	// Build both binaries, so each standard library is built and cached. After
+	// that, neither build should invalidate the other.
+	if err := bazel_testing.RunBazel("build", "//:default_bin", "//:debug_bin"); err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"//:default_bin", "//:debug_bin", "//:default_bin"} {
+		cmd := bazel_testing.BazelCmd("build", "--subcommands", target)
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("building %s: %v\n%s", target, err, stderr.Bytes())
+		}
+		if bytes.Contains(stderr.Bytes(), []byte("SUBCOMMAND")) {
+			t.Errorf("building %s ran actions; want everything cached:\n%s", target, stderr.Bytes())
+		}
+	}
+}